@@ -10,27 +10,69 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-var client AppSocket.SocketClientInterface
+var (
+	client   AppSocket.SocketClientInterface
+	messages = AppSocket.NewMessageRouter(&socketHandler{})
+	schema   = AppSocket.NewSchemaInspector("skeleton websocket", messages)
+)
+
+type echoPayload struct {
+	Text string `json:"text"`
+}
 
 func init() {
-	client, _ = AppSocket.NewSocket(AppSocket.WithHandler(&socketHandler{}))
+	AppSocket.Handle(messages, "echo", func(key string, payload echoPayload) error {
+		return client.SendTo(key, websocket.TextMessage, []byte(payload.Text))
+	})
+	client, _ = AppSocket.NewSocket(
+		AppSocket.WithHandler(messages),
+		AppSocket.WithLabelExtractor(socketLabels),
+		AppSocket.WithMetricLabels("platform"),
+	)
+}
+
+// socketLabels 客户端在升级请求头中携带版本号和平台
+func socketLabels(ctx *gin.Context) map[string]string {
+	labels := map[string]string{}
+	if version := ctx.GetHeader("X-App-Version"); version != "" {
+		labels["version"] = version
+	}
+	if platform := ctx.GetHeader("X-Platform"); platform != "" {
+		labels["platform"] = platform
+	}
+	return labels
 }
 
 type Socket struct{}
 
 func (s *Socket) Connect(ctx *gin.Context) {
 	subkey := uuid.New().String()
-	client.Connect(ctx, subkey)
+	if err := client.Connect(ctx, subkey); err != nil {
+		return
+	}
+	if info, err := client.Info(subkey); err == nil {
+		fmt.Printf("socket connected. client:%s, ip:%s, labels:%v\n", info.ID, info.ClientIP, info.Labels)
+	}
 	client.WriteMessage(AppSocket.Message{
 		MessageType: websocket.TextMessage,
 		Data:        []byte(fmt.Sprintf("uuid: %s", subkey)),
 	})
 }
 
+// Schema 返回websocket消息的结构文档
+func (s *Socket) Schema(ctx *gin.Context) {
+	schema.Handler()(ctx)
+}
+
+// Ready websocket层的就绪探针，不就绪时返回503
+func (s *Socket) Ready(ctx *gin.Context) {
+	client.ReadyHandler()(ctx)
+}
+
 type socketHandler struct{}
 
 func (s *socketHandler) OnMessage(message AppSocket.Message) {
-	fmt.Println(fmt.Sprintf("mt: %v，data: %s, uuid: %v", message.MessageType, message.Data, message.Subkeys))
+	fmt.Println(fmt.Sprintf("mt: %v，data: %s, uuid: %v", AppSocket.MessageTypes.Name(message.MessageType), message.Data, message.Subkeys))
 	fmt.Println(client.GetAllKeys())
 	client.WriteMessage(AppSocket.Message{
 		MessageType: websocket.TextMessage,
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultMaxPendingAcks 每个连接同时等待确认的消息数上限
+const defaultMaxPendingAcks = 64
+
+// WithMaxPendingAcks 每个连接同时等待确认的SendWithAck数量上限，超出时返回ErrTooManyPendingAcks，默认64
+func WithMaxPendingAcks(n int) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.maxPendingAcks = n
+	}
+}
+
+// ackFrame 客户端确认消息的格式{"ack":id}，由读循环处理，不会交给OnMessage
+type ackFrame struct {
+	Ack *int64 `json:"ack"`
+}
+
+// SendWithAck 在JSON对象文本消息开头加上"_ack":id后经由发送队列发送，等待客户端回复{"ack":id}。
+// 返回nil表示客户端应用已处理该消息；ctx结束返回ctx的错误，连接关闭返回ErrConnectionClosed。
+// 只支持JSON对象文本消息，其他消息返回ErrInvalidPayload。只在open阶段可用
+func (s *SocketClient) SendWithAck(ctx context.Context, messageType int, data []byte) error {
+	if err := s.requireOpen("send", ErrConnectionClosed); err != nil {
+		return err
+	}
+	if messageType != websocket.TextMessage {
+		return newError(s.key, "send", fmt.Errorf("%w: ack requires a text message", ErrInvalidPayload))
+	}
+	acked := make(chan struct{}, 1)
+	s.ackMu.Lock()
+	if s.acksClosed {
+		s.ackMu.Unlock()
+		return newError(s.key, "send", ErrConnectionClosed)
+	}
+	if len(s.ackWaiters) >= s.socket.opts.maxPendingAcks {
+		s.ackMu.Unlock()
+		return newError(s.key, "send", ErrTooManyPendingAcks)
+	}
+	if s.ackWaiters == nil {
+		s.ackWaiters = make(map[int64]chan struct{})
+	}
+	s.ackSeq++
+	id := s.ackSeq
+	s.ackWaiters[id] = acked
+	s.ackMu.Unlock()
+	defer func() {
+		s.ackMu.Lock()
+		delete(s.ackWaiters, id)
+		s.ackMu.Unlock()
+	}()
+
+	stamped := prependJSONField(data, "_ack", id)
+	if len(stamped) == len(data) {
+		return newError(s.key, "send", fmt.Errorf("%w: ack requires a JSON object", ErrInvalidPayload))
+	}
+	if err := s.enqueue(messageType, stamped); err != nil {
+		return err
+	}
+	select {
+	case _, ok := <-acked:
+		if !ok {
+			return newError(s.key, "send", ErrConnectionClosed)
+		}
+		return nil
+	case <-ctx.Done():
+		return newError(s.key, "send", ctx.Err())
+	}
+}
+
+// handleAck 读循环中识别确认消息，返回true时该消息不再分发
+func (s *SocketClient) handleAck(messageType int, data []byte) bool {
+	if messageType != websocket.TextMessage || len(data) > 64 || !bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte(`{"ack"`)) {
+		return false
+	}
+	var frame ackFrame
+	if err := json.Unmarshal(data, &frame); err != nil || frame.Ack == nil {
+		return false
+	}
+	s.ackMu.Lock()
+	defer s.ackMu.Unlock()
+	if acked, ok := s.ackWaiters[*frame.Ack]; ok {
+		acked <- struct{}{}
+		delete(s.ackWaiters, *frame.Ack)
+	}
+	return true
+}
+
+// cancelAcks 读循环退出后不会再收到确认，唤醒所有等待中的SendWithAck
+func (s *SocketClient) cancelAcks() {
+	s.ackMu.Lock()
+	defer s.ackMu.Unlock()
+	for _, acked := range s.ackWaiters {
+		close(acked)
+	}
+	s.ackWaiters = nil
+	s.acksClosed = true
+}
+
+// SendToUserWithAck 向SessionLabel为userID的所有在线连接并发调用SendWithAck，返回每个连接的结果，
+// nil表示已确认；没有在线连接时返回ErrSessionNotFound。属于WithNamespaces租户的连接不在范围内，使用Namespace.SendToUserWithAck
+func (s *Socket) SendToUserWithAck(ctx context.Context, userID string, messageType int, data []byte) (map[string]error, error) {
+	return s.sendToUserWithAck(ctx, nil, userID, messageType, data)
+}
+
+func (s *Socket) sendToUserWithAck(ctx context.Context, ns *Namespace, userID string, messageType int, data []byte) (map[string]error, error) {
+	s.mu.RLock()
+	var clients []*SocketClient
+	for _, client := range s.clients {
+		if client.State() == OnlineState && client.labels[SessionLabel] == userID && client.namespace == ns {
+			clients = append(clients, client)
+		}
+	}
+	s.mu.RUnlock()
+	if len(clients) == 0 {
+		return nil, newError("", "send", fmt.Errorf("%w: user %q", ErrSessionNotFound, userID))
+	}
+	results := make(map[string]error, len(clients))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *SocketClient) {
+			defer wg.Done()
+			err := client.SendWithAck(ctx, messageType, data)
+			mu.Lock()
+			results[client.key] = err
+			mu.Unlock()
+		}(client)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// ReadMessageAck 供Go客户端使用：读取一条消息，消息带有"_ack"时先回复{"ack":id}再返回，
+// 返回的数据中保留"_ack"字段
+func ReadMessageAck(conn *websocket.Conn) (int, []byte, error) {
+	messageType, data, err := conn.ReadMessage()
+	if err != nil || messageType != websocket.TextMessage || !bytes.Contains(data, []byte(`"_ack"`)) {
+		return messageType, data, err
+	}
+	var stamped struct {
+		Ack *int64 `json:"_ack"`
+	}
+	if json.Unmarshal(data, &stamped) == nil && stamped.Ack != nil {
+		reply, _ := json.Marshal(ackFrame{Ack: stamped.Ack})
+		if err = conn.WriteMessage(websocket.TextMessage, reply); err != nil {
+			return messageType, data, err
+		}
+	}
+	return messageType, data, nil
+}
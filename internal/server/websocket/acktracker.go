@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultAckTrackerTimeout = 5 * time.Second
+	defaultAckTrackerRetries = 3
+)
+
+// AckTrackerOptions Timeout为每次发送等待确认的时间，默认5s；MaxRetries为超时后的重发次数，默认3，小于0表示不重发。
+// 重发用尽仍未确认时回调OnTimeout
+type AckTrackerOptions struct {
+	Timeout    time.Duration
+	MaxRetries int
+	OnTimeout  func(AckTimeout)
+}
+
+// AckTimeout 重发用尽仍未确认的消息，Attempts包含第一次发送
+type AckTimeout struct {
+	Key      string
+	Seq      int64
+	Attempts int
+	Data     []byte
+}
+
+type trackedMessage struct {
+	ctx         context.Context
+	messageType int
+	data        []byte
+	attempts    int
+	deadline    time.Time
+}
+
+// AckTracker 在hub之上为一个连接提供至少一次(QoS 1)投递：Send在JSON对象开头加上"_qos":seq，
+// 客户端处理后回复任意携带seq的消息，应用在OnMessage中解析后调用Ack。超时未确认的消息原样重发，
+// 客户端应按seq去重。与SendWithAck不同，确认由应用转交，不占用读循环，也不阻塞发送方。
+// 重发goroutine不随连接断开或hub关闭退出，不再使用时必须调用Close
+type AckTracker struct {
+	socket  SocketClientInterface
+	key     string
+	opts    AckTrackerOptions
+	mu      sync.Mutex
+	seq     int64
+	pending map[int64]*trackedMessage
+	closed  bool
+	done    chan struct{}
+}
+
+func NewAckTracker(socket SocketClientInterface, key string, opts AckTrackerOptions) (*AckTracker, error) {
+	if opts.Timeout < 0 {
+		return nil, fmt.Errorf("%w: ack timeout must be positive, got %s", ErrInvalidOption, opts.Timeout)
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultAckTrackerTimeout
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = defaultAckTrackerRetries
+	} else if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	}
+	t := &AckTracker{
+		socket:  socket,
+		key:     key,
+		opts:    opts,
+		pending: make(map[int64]*trackedMessage),
+		done:    make(chan struct{}),
+	}
+	go t.retryLoop()
+	return t, nil
+}
+
+// Send 发送并登记等待确认，返回分配的seq。第一次发送失败时不登记；ctx结束后该消息不再重发，也不回调OnTimeout。
+// 只支持JSON对象文本消息，其他消息返回ErrInvalidPayload
+func (t *AckTracker) Send(ctx context.Context, messageType int, data []byte) (int64, error) {
+	if messageType != websocket.TextMessage {
+		return 0, newError(t.key, "send", fmt.Errorf("%w: ack tracking requires a text message", ErrInvalidPayload))
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, newError(t.key, "send", err)
+	}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return 0, newError(t.key, "send", ErrAlreadyClosed)
+	}
+	t.seq++
+	seq := t.seq
+	t.mu.Unlock()
+
+	stamped := prependJSONField(data, "_qos", seq)
+	if len(stamped) == len(data) {
+		return 0, newError(t.key, "send", fmt.Errorf("%w: ack tracking requires a JSON object", ErrInvalidPayload))
+	}
+	// 先登记再发送，避免确认先于登记到达
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return 0, newError(t.key, "send", ErrAlreadyClosed)
+	}
+	t.pending[seq] = &trackedMessage{
+		ctx:         ctx,
+		messageType: messageType,
+		data:        stamped,
+		attempts:    1,
+		deadline:    time.Now().Add(t.opts.Timeout),
+	}
+	t.mu.Unlock()
+	if err := t.socket.SendTo(t.key, messageType, stamped); err != nil {
+		t.Ack(seq)
+		return 0, err
+	}
+	return seq, nil
+}
+
+// Ack 标记seq已确认，返回false表示seq未在等待中(已确认、已超时或不存在)
+func (t *AckTracker) Ack(seq int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.pending[seq]; !ok {
+		return false
+	}
+	delete(t.pending, seq)
+	return true
+}
+
+// PendingAcks 等待确认的消息数
+func (t *AckTracker) PendingAcks() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending)
+}
+
+// Close 停止重发并丢弃等待中的消息，返回被丢弃的数量，不回调OnTimeout
+func (t *AckTracker) Close() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return 0
+	}
+	t.closed = true
+	close(t.done)
+	dropped := len(t.pending)
+	t.pending = nil
+	return dropped
+}
+
+// retryLoop 以超时时间的四分之一为间隔检查，重发和回调都在锁外进行
+func (t *AckTracker) retryLoop() {
+	interval := t.opts.Timeout / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case now := <-ticker.C:
+			t.retry(now)
+		}
+	}
+}
+
+func (t *AckTracker) retry(now time.Time) {
+	var resend []*trackedMessage
+	var expired []AckTimeout
+	t.mu.Lock()
+	for seq, msg := range t.pending {
+		switch {
+		case msg.ctx.Err() != nil:
+			delete(t.pending, seq)
+		case now.Before(msg.deadline):
+		case msg.attempts > t.opts.MaxRetries:
+			delete(t.pending, seq)
+			expired = append(expired, AckTimeout{Key: t.key, Seq: seq, Attempts: msg.attempts, Data: msg.data})
+		default:
+			msg.attempts++
+			msg.deadline = now.Add(t.opts.Timeout)
+			resend = append(resend, msg)
+		}
+	}
+	t.mu.Unlock()
+	// 连接暂时不可用时同样计为一次发送，由之后的重发或超时处理
+	for _, msg := range resend {
+		_ = t.socket.SendTo(t.key, msg.messageType, msg.data)
+	}
+	if t.opts.OnTimeout != nil {
+		for _, event := range expired {
+			t.onTimeout(event)
+		}
+	}
+}
+
+// onTimeout 恢复OnTimeout中的panic：socket是*Socket时交给WithPanicHandler，否则记录到标准日志
+func (t *AckTracker) onTimeout(event AckTimeout) {
+	defer func() {
+		if r := recover(); r != nil {
+			if s, ok := t.socket.(*Socket); ok {
+				s.notifyPanic(r, t.key)
+				return
+			}
+			log.Printf("websocket panic: %v, client: %s\n%s", r, t.key, debug.Stack())
+		}
+	}()
+	t.opts.OnTimeout(event)
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultAdmissionRetryAfter 拒绝升级时默认的Retry-After
+const defaultAdmissionRetryAfter = 5 * time.Second
+
+// AdmissionAction 准入控制对一次升级的决定
+type AdmissionAction int
+
+const (
+	AdmissionAccept AdmissionAction = iota
+	// AdmissionReject 以503和Retry-After拒绝升级，Connect返回ErrOverloaded
+	AdmissionReject
+	// AdmissionDegrade 接受升级，但对新连接应用Options中更严格的配置
+	AdmissionDegrade
+)
+
+func (a AdmissionAction) String() string {
+	switch a {
+	case AdmissionAccept:
+		return "accept"
+	case AdmissionReject:
+		return "reject"
+	case AdmissionDegrade:
+		return "degrade"
+	default:
+		return "unknown"
+	}
+}
+
+// AdmissionDecision RetryAfter只用于AdmissionReject，为0时使用5秒；
+// Options只用于AdmissionDegrade，只支持UpdateOption可调整的配置(读写截止时间、心跳等)
+type AdmissionDecision struct {
+	Action     AdmissionAction
+	RetryAfter time.Duration
+	Options    []SocketOptionFunc
+	Reason     string
+}
+
+// AdmissionStats 准入控制的决定次数，用于调整阈值
+type AdmissionStats struct {
+	Accepted int64 `json:"accepted"`
+	Rejected int64 `json:"rejected"`
+	Degraded int64 `json:"degraded"`
+}
+
+// AdmissionThresholds 内置准入控制的阈值，零值表示不检查该项；任一Max项达到时拒绝，否则任一Degrade项达到时降级
+type AdmissionThresholds struct {
+	MaxConnections     int
+	DegradeConnections int
+	// MaxQueuedBytes、DegradeQueuedBytes 所有连接发送队列中尚未写出的字节数
+	MaxQueuedBytes     int64
+	DegradeQueuedBytes int64
+	// Load 调用方提供的负载信号，例如CPU使用率或内存占用比例，为nil时不检查MaxLoad、DegradeLoad
+	Load        func() float64
+	MaxLoad     float64
+	DegradeLoad float64
+	// RetryAfter 拒绝时的Retry-After，默认5秒
+	RetryAfter time.Duration
+	// DegradedOptions 降级时应用于新连接的配置，例如更长的心跳周期
+	DegradedOptions []SocketOptionFunc
+}
+
+// WithAdmissionController 每次升级前调用fn，进程内存或CPU紧张时拒绝新连接或降级接受，避免拖垮已有连接。
+// fn在握手的goroutine中执行，应当只读取缓存的指标
+func WithAdmissionController(fn func() AdmissionDecision) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.admissionController = fn
+	}
+}
+
+// WithAdmissionThresholds 使用内置的准入控制，按在线连接数、发送队列积压字节数和调用方的负载信号决定，
+// 不能与WithAdmissionController同时使用
+func WithAdmissionThresholds(thresholds AdmissionThresholds) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.admissionThresholds = &thresholds
+	}
+}
+
+type admissionCounters struct {
+	accepted atomic.Int64
+	rejected atomic.Int64
+	degraded atomic.Int64
+}
+
+// AdmissionStats 未配置准入控制时全部为0
+func (s *Socket) AdmissionStats() AdmissionStats {
+	return AdmissionStats{
+		Accepted: s.admission.accepted.Load(),
+		Rejected: s.admission.rejected.Load(),
+		Degraded: s.admission.degraded.Load(),
+	}
+}
+
+// QueuedBytes 所有在线连接发送队列中尚未写出的字节数
+func (s *Socket) QueuedBytes() int64 {
+	var total int64
+	s.mu.RLock()
+	for _, client := range s.clients {
+		total += client.queuedBytes.Load()
+	}
+	s.mu.RUnlock()
+	return total
+}
+
+// admit 拒绝时以503和Retry-After结束握手
+func (s *Socket) admit(ctx *gin.Context, key string) (AdmissionDecision, error) {
+	decide := s.opts.admissionController
+	if decide == nil {
+		return AdmissionDecision{}, nil
+	}
+	decision := decide()
+	switch decision.Action {
+	case AdmissionReject:
+		s.admission.rejected.Add(1)
+		retryAfter := decision.RetryAfter
+		if retryAfter <= 0 {
+			retryAfter = defaultAdmissionRetryAfter
+		}
+		ctx.Header("Retry-After", strconv.Itoa(max(int(retryAfter.Seconds()), 1)))
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+		err := ErrOverloaded
+		if decision.Reason != "" {
+			err = fmt.Errorf("%w: %s", ErrOverloaded, decision.Reason)
+		}
+		return decision, newError(key, "upgrade", err)
+	case AdmissionDegrade:
+		s.admission.degraded.Add(1)
+	default:
+		s.admission.accepted.Add(1)
+	}
+	return decision, nil
+}
+
+// thresholdAdmission 由WithAdmissionThresholds创建的准入控制
+func (s *Socket) thresholdAdmission(t AdmissionThresholds) func() AdmissionDecision {
+	return func() AdmissionDecision {
+		connections := s.onlineCount()
+		var queued int64
+		if t.MaxQueuedBytes > 0 || t.DegradeQueuedBytes > 0 {
+			queued = s.QueuedBytes()
+		}
+		var load float64
+		if t.Load != nil {
+			load = t.Load()
+		}
+		reject := func(reason string) AdmissionDecision {
+			return AdmissionDecision{Action: AdmissionReject, RetryAfter: t.RetryAfter, Reason: reason}
+		}
+		switch {
+		case t.MaxConnections > 0 && connections >= t.MaxConnections:
+			return reject(fmt.Sprintf("connections %d reached %d", connections, t.MaxConnections))
+		case t.MaxQueuedBytes > 0 && queued >= t.MaxQueuedBytes:
+			return reject(fmt.Sprintf("queued bytes %d reached %d", queued, t.MaxQueuedBytes))
+		case t.Load != nil && t.MaxLoad > 0 && load >= t.MaxLoad:
+			return reject(fmt.Sprintf("load %.2f reached %.2f", load, t.MaxLoad))
+		}
+		if (t.DegradeConnections > 0 && connections >= t.DegradeConnections) ||
+			(t.DegradeQueuedBytes > 0 && queued >= t.DegradeQueuedBytes) ||
+			(t.Load != nil && t.DegradeLoad > 0 && load >= t.DegradeLoad) {
+			return AdmissionDecision{Action: AdmissionDegrade, Options: t.DegradedOptions}
+		}
+		return AdmissionDecision{Action: AdmissionAccept}
+	}
+}
+
+func (s *Socket) onlineCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, client := range s.clients {
+		if client.State() == OnlineState {
+			n++
+		}
+	}
+	return n
+}
+
+// Degraded 连接是否由准入控制降级接受
+func (s *SocketClient) Degraded() bool {
+	return s.degraded
+}
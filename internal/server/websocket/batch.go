@@ -0,0 +1,44 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// textBatch WithFlushInterval的文本消息缓冲，只在写循环中使用，不需要加锁
+type textBatch struct {
+	items    [][]byte
+	size     int
+	compress *bool
+}
+
+// accepts 缓冲为空或压缩选项相同时可以合并
+func (b *textBatch) accepts(compress *bool) bool {
+	if len(b.items) == 0 || b.compress == compress {
+		return true
+	}
+	return b.compress != nil && compress != nil && *b.compress == *compress
+}
+
+func (b *textBatch) add(data []byte, compress *bool) {
+	b.compress = compress
+	if !json.Valid(data) {
+		data, _ = json.Marshal(string(data))
+	}
+	b.items = append(b.items, data)
+	b.size += len(data) + 1
+}
+
+// take 将缓冲的消息合并为JSON数组并清空缓冲，没有消息时返回nil
+func (b *textBatch) take() []byte {
+	if len(b.items) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.Grow(b.size + 1)
+	buf.WriteByte('[')
+	buf.Write(bytes.Join(b.items, []byte{','}))
+	buf.WriteByte(']')
+	b.items, b.size, b.compress = b.items[:0], 0, nil
+	return buf.Bytes()
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// BinaryDispatcher 按二进制消息的第一个字节(魔数)分发到不同的处理器，不需要解析完整的消息外层结构，
+// 适合同一连接上二进制帧与JSON并存的场景，例如AI控制帧(0x01)和数据帧(0x02)。作为MessageHandler传给WithHandler，
+// 也可以作为MessageRouter的fallback
+type BinaryDispatcher struct {
+	fallback MessageHandler
+	mu       sync.RWMutex
+	handlers map[byte]MessageHandler
+}
+
+// NewBinaryDispatcher fallback处理文本消息、空消息和未注册魔数的消息，以及OnError、OnOpen回调，可以为nil
+func NewBinaryDispatcher(fallback MessageHandler) *BinaryDispatcher {
+	return &BinaryDispatcher{
+		fallback: fallback,
+		handlers: make(map[byte]MessageHandler),
+	}
+}
+
+// Register 第一个字节为magic的二进制消息交给handler，Data保留魔数字节；同一魔数重复注册会覆盖
+func (d *BinaryDispatcher) Register(magic byte, handler MessageHandler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.handlers[magic] = handler
+}
+
+func (d *BinaryDispatcher) OnMessage(message Message) {
+	if message.MessageType == websocket.BinaryMessage && len(message.Data) > 0 {
+		d.mu.RLock()
+		handler, ok := d.handlers[message.Data[0]]
+		d.mu.RUnlock()
+		if ok {
+			handler.OnMessage(message)
+			return
+		}
+	}
+	if d.fallback != nil {
+		d.fallback.OnMessage(message)
+	} else {
+		d.OnError(message.Subkeys[0], newError(message.Subkeys[0], "dispatch", ErrUnknownMessageType))
+	}
+}
+
+func (d *BinaryDispatcher) OnError(key string, err error) {
+	if d.fallback != nil {
+		d.fallback.OnError(key, err)
+	}
+}
+
+func (d *BinaryDispatcher) OnOpen(client *SocketClient) {
+	if h, ok := d.fallback.(OpenHandler); ok {
+		h.OnOpen(client)
+	}
+}
+
+// OnClose 通知fallback和所有已注册的处理器，便于它们清理连接相关的状态
+func (d *BinaryDispatcher) OnClose(key string) {
+	for _, handler := range d.distinct() {
+		handler.OnClose(key)
+	}
+}
+
+// bind 传递给fallback和已注册的处理器，使其中的MessageRouter等能访问管理器
+func (d *BinaryDispatcher) bind(socket *Socket) {
+	for _, handler := range d.distinct() {
+		if h, ok := handler.(interface{ bind(*Socket) }); ok {
+			h.bind(socket)
+		}
+	}
+}
+
+func (d *BinaryDispatcher) distinct() []MessageHandler {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	handlers := make([]MessageHandler, 0, len(d.handlers)+1)
+	seen := make(map[MessageHandler]bool, len(d.handlers)+1)
+	if d.fallback != nil {
+		handlers = append(handlers, d.fallback)
+		if reflect.TypeOf(d.fallback).Comparable() {
+			seen[d.fallback] = true
+		}
+	}
+	for _, handler := range d.handlers {
+		// 不可比较的处理器(值类型中含有map、slice等)无法判重，直接加入
+		if !reflect.TypeOf(handler).Comparable() {
+			handlers = append(handlers, handler)
+		} else if !seen[handler] {
+			seen[handler] = true
+			handlers = append(handlers, handler)
+		}
+	}
+	return handlers
+}
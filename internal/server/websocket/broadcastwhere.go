@@ -0,0 +1,68 @@
+package server
+
+// ConnView BroadcastWhere中谓词看到的只读连接视图，读取标签不复制，Stats在调用时才计算
+type ConnView struct {
+	client *SocketClient
+}
+
+func (v ConnView) ID() string {
+	return v.client.key
+}
+
+// User 连接的SessionLabel标签，没有时为空
+func (v ConnView) User() string {
+	return v.client.labels[SessionLabel]
+}
+
+func (v ConnView) Label(name string) string {
+	return v.client.labels[name]
+}
+
+// Metadata 读取连接Store中的值
+func (v ConnView) Metadata(key string) (any, bool) {
+	return v.client.store.Get(key)
+}
+
+func (v ConnView) Handshake() HandshakeInfo {
+	return v.client.Handshake()
+}
+
+func (v ConnView) Stats() SocketStats {
+	return v.client.Stats()
+}
+
+// BroadcastResult Matched为谓词返回true的连接数，Failed为其中入队失败的连接及原因
+type BroadcastResult struct {
+	Matched int
+	Sent    int
+	Failed  map[string]error
+}
+
+// BroadcastWhere 向谓词返回true的在线连接发送消息。谓词在连接列表的快照上逐个执行，不持有管理器的锁，
+// 较慢的谓词不会阻塞连接的建立和关闭；快照之后建立的连接不参与本次发送。
+// 每次调用都遍历全部连接，复杂度O(连接数)，适合偶尔的运维操作，固定的分组请使用房间
+func (s *Socket) BroadcastWhere(pred func(ConnView) bool, messageType int, data []byte) BroadcastResult {
+	clients, _ := s.targets(nil)
+	var result BroadcastResult
+	for _, client := range clients {
+		if client.State() != OnlineState || !s.matches(client, pred) {
+			continue
+		}
+		result.Matched++
+		if err := client.enqueue(messageType, data); err != nil {
+			if result.Failed == nil {
+				result.Failed = make(map[string]error)
+			}
+			result.Failed[client.key] = err
+			continue
+		}
+		result.Sent++
+	}
+	return result
+}
+
+// matches 谓词panic时视为不匹配
+func (s *Socket) matches(client *SocketClient, pred func(ConnView) bool) (ok bool) {
+	defer s.recoverPanic(client.key)
+	return pred(ConnView{client: client})
+}
@@ -0,0 +1,41 @@
+package server
+
+import "strconv"
+
+// MessageBusPublisher 把入站消息转发到NATS、Kafka等消息队列，natssink.BusPublisher为NATS实现
+type MessageBusPublisher interface {
+	Publish(topic string, key []byte, value []byte) error
+}
+
+// WithMessageBusPublisher 每条入站消息在OnMessage返回后发布到pub：topic为会话标识(SessionLabel，没有时为连接标识)，
+// key为十进制的消息类型值(TextMessage为"1"，BinaryMessage为"2")，不随MessageTypes中注册的名称变化，
+// value为收到的原始数据，不受OnMessage修改的影响。
+// 发布在读循环中同步执行，消息队列变慢会减缓该连接的读取；OnMessage panic的消息不发布。
+// 失败计入SocketStats.BusPublishErrors并记录日志，不回调OnError
+func WithMessageBusPublisher(pub MessageBusPublisher) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.busPublisher = pub
+	}
+}
+
+// busCopy 在OnMessage之前复制数据，未配置WithMessageBusPublisher时返回nil
+func (s *SocketClient) busCopy(message Message) []byte {
+	if s.socket.opts.busPublisher == nil {
+		return nil
+	}
+	return append([]byte{}, message.Data...)
+}
+
+func (s *SocketClient) publishToBus(messageType int, value []byte) {
+	if value == nil {
+		return
+	}
+	topic := s.labels[SessionLabel]
+	if topic == "" {
+		topic = s.key
+	}
+	if err := s.socket.opts.busPublisher.Publish(topic, []byte(strconv.Itoa(messageType)), value); err != nil {
+		s.busErrors.Add(1)
+		s.socket.logWarning(s.key, "bus publish", err)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import "time"
+
+// QueuedMessage 发送队列中尚未开始写出的消息，Data为入队时的原始数据，不能修改
+type QueuedMessage struct {
+	// Key 入队时SendOpts.Key指定的消息标识，没有时为空
+	Key         string
+	MessageType int
+	Data        []byte
+	EnqueuedAt  time.Time
+}
+
+// queuedEntry 发送队列中每条消息在索引链表中的节点，由sendMu保护。
+// 通道不支持删除元素，取消只标记节点并从链表中摘除，写循环出队时跳过已取消的消息，入队和出队都是O(1)
+type queuedEntry struct {
+	QueuedMessage
+	prev, next *queuedEntry
+	cancelled  bool
+}
+
+// linkQueued 调用方持有sendMu，在消息成功写入通道后调用
+func (s *SocketClient) linkQueued(entry *queuedEntry) {
+	entry.prev = s.queueTail
+	if s.queueTail != nil {
+		s.queueTail.next = entry
+	} else {
+		s.queueHead = entry
+	}
+	s.queueTail = entry
+}
+
+// unlinkQueued 调用方持有sendMu
+func (s *SocketClient) unlinkQueued(entry *queuedEntry) {
+	if entry.prev != nil {
+		entry.prev.next = entry.next
+	} else {
+		s.queueHead = entry.next
+	}
+	if entry.next != nil {
+		entry.next.prev = entry.prev
+	} else {
+		s.queueTail = entry.prev
+	}
+	entry.prev, entry.next = nil, nil
+}
+
+// takeQueued 写循环出队时调用，返回false表示该消息已被取消；返回true之后消息不能再取消
+func (s *SocketClient) takeQueued(entry *queuedEntry) bool {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if entry.cancelled {
+		return false
+	}
+	s.unlinkQueued(entry)
+	return true
+}
+
+// CancelQueued 取消发送队列中标识为key的全部消息，返回取消的数量。key不能为空
+func (s *SocketClient) CancelQueued(key string) int {
+	if key == "" {
+		return 0
+	}
+	return s.CancelQueuedWhere(func(message QueuedMessage) bool {
+		return message.Key == key
+	})
+}
+
+// CancelQueuedWhere 取消发送队列中match返回true的消息，返回取消的数量，例如用户切换房间后丢弃旧房间积压的消息。
+// 已交给写循环的消息(正在写出或在WithFlushInterval的缓冲中)不能取消。取消计入SocketStats.QueueCancelled，
+// 不计入QueueWaitDrops；被取消的消息在写循环取出之前仍占用队列长度。match在持有发送队列锁时调用，不能再向该连接发送消息
+func (s *SocketClient) CancelQueuedWhere(match func(QueuedMessage) bool) int {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	var cancelled int
+	for entry := s.queueHead; entry != nil; {
+		next := entry.next
+		if match(entry.QueuedMessage) {
+			entry.cancelled = true
+			s.unlinkQueued(entry)
+			s.countDequeued(len(entry.Data))
+			cancelled++
+		}
+		entry = next
+	}
+	s.queueCancelled.Add(int64(cancelled))
+	return cancelled
+}
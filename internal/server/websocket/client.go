@@ -1,15 +1,27 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"runtime/debug"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
 )
 
+// maxControlPayload RFC 6455规定控制帧负载不能超过125字节
+const maxControlPayload = 125
+
 type ClientState int
 
 const (
@@ -18,131 +30,809 @@ const (
 	OffLineState
 )
 
+// outbound 发送队列中的一条待写消息
+type outbound struct {
+	messageType int
+	data        []byte
+	compress    *bool
+	// deadline 排队等待的截止时间，零值表示不限制
+	deadline time.Time
+	// key SendOpts.Key，用于CancelQueued
+	key   string
+	entry *queuedEntry
+}
+
+// SocketClient 单个连接，依次经历created(升级完成之前)、open、draining(已发出关闭帧)、closed四个阶段。
+// SendBytesOpt、SendJSON、SendWait、SendWithAck、SendReader、WriterFor、Ping、SendClose只在open阶段可用，
+// Close、CloseWithReason、UpdateOption、Subscribe、Run在open和draining阶段可用，阶段不符时立即返回ErrNotOpen或ErrClosed；
+// Key、Stats、Labels、Done等只读取状态的方法以及Tag、CancelQueued在任意阶段可用，非open阶段Tag不生效
 type SocketClient struct {
-	key                string
-	conn               *websocket.Conn
-	send               chan []byte
-	heartbeatFailTimes int
-	socket             *Socket
-	state              ClientState
+	key               string
+	conn              *websocket.Conn
+	writeMu           sync.Mutex
+	sendMu            sync.Mutex
+	send              chan outbound
+	sendClosed        bool
+	heartbeatFailures atomic.Int32
+	lastPongAt        atomic.Int64
+	socket            *Socket
+	state             atomic.Int32
+	e2eLatency        latencyWindow
+	handshake         HandshakeInfo
+	readersMu         sync.Mutex
+	readers           map[*readSubscriber]struct{}
+	readDone          bool
+	readErr           error
+	settingsMu        sync.Mutex
+	settings          atomic.Pointer[clientSettings]
+	settingsChanged   chan struct{}
+	store             Store
+	bytesSent         atomic.Int64
+	bytesReceived     atomic.Int64
+	sendRate          rateWindow
+	writesCanceled    atomic.Bool
+	labels            map[string]string
+	codec             atomic.Pointer[codecRef]
+	pingMu            sync.Mutex
+	pingSeq           uint64
+	pingWaiters       map[string]chan time.Time
+	pingsClosed       bool
+	pingRTT           atomic.Int64
+	outSeq            atomic.Uint64
+	outOfOrder        atomic.Int64
+	schemaVersion     int
+	downgrades        []downgradeEncoder
+	codecName         string
+	codecSubprotocol  string
+	slowStartBucket   *tokenBucket
+	statsDue          time.Time
+	lastClose         atomic.Pointer[closeRecord]
+	ackMu             sync.Mutex
+	ackSeq            int64
+	ackWaiters        map[int64]chan struct{}
+	acksClosed        bool
+	idGenerated       bool
+	pingInFlight      atomic.Bool
+	recentPanics      []time.Time
+	queuedBytes       atomic.Int64
+	degraded          bool
+	sessionSampled    bool
+	namespace         *Namespace
+	topicMu           sync.Mutex
+	topicsClosed      bool
+	disallowedCount   atomic.Int64
+	resumeToken       string
+	resumeStatus      string
+	sessionFinal      atomic.Pointer[SessionState]
+	sessionDirty      atomic.Bool
+	sendDone          chan struct{}
+	queueFreed        chan struct{}
+	queueWaiters      atomic.Int32
+	queueWaitDrops    atomic.Int64
+	metricsMu         sync.Mutex
+	metricsAt         time.Time
+	latestMetrics     *ClientMetrics
+	metricsRejected   atomic.Int64
+	busErrors         atomic.Int64
+	queuedMessages    atomic.Int64
+	queuePeakMsgs     atomic.Int64
+	queuePeakBytes    atomic.Int64
+	queueHead         *queuedEntry
+	queueTail         *queuedEntry
+	queueCancelled    atomic.Int64
+	recvAcks          receiveAcks
+	recvDuplicates    atomic.Int64
+	lastReadAt        atomic.Int64
+	reaping           atomic.Bool
+	tags              map[string]struct{}
+	done              chan struct{}
 }
 
-func NewSocketClient(ctx *gin.Context, key string, socket *Socket) *SocketClient {
+func NewSocketClient(ctx *gin.Context, key string, socket *Socket) (*SocketClient, error) {
+	return newSocketClient(ctx, key, socket, nil, nil)
+}
+
+// newSocketClient migrated不为nil时以迁移令牌中的标签为基础提取标签，resumed不为nil时在升级响应中下发恢复令牌
+func newSocketClient(ctx *gin.Context, key string, socket *Socket, migrated *MigrationState, resumed *resumedSession) (*SocketClient, error) {
 	client := &SocketClient{
 		key:    key,
 		socket: socket,
-		state:  OnlineState,
+		done:   make(chan struct{}),
+	}
+	client.settings.Store(newClientSettings(socket.opts))
+	client.settingsChanged = make(chan struct{}, 1)
+	extractor := socket.opts.labelExtractor
+	if migrated != nil {
+		extractor = migratedLabels(migrated, extractor)
+	}
+	client.labels = extractLabels(ctx, extractor)
+	if err := socket.admitNamespace(ctx, client); err != nil {
+		return nil, err
+	}
+	if err := socket.rejectDuplicate(ctx, client); err != nil {
+		return nil, err
+	}
+	if err := client.negotiate(ctx); err != nil {
+		return nil, err
+	}
+	client.negotiateSchema(ctx)
+	if resumed != nil {
+		client.resumeToken, client.resumeStatus = resumed.token, resumed.status
+	}
+	if err := client.upGrader(ctx, socket.opts); err != nil {
+		return nil, err
+	}
+	client.advance(phaseCreated, phaseOpen)
+	if socket.slowStart != nil {
+		client.slowStartBucket = newSlowStartBucket(socket.opts.slowStartBudget, socket.opts.slowStartWindow)
+	}
+	return client, nil
+}
+
+// State open和draining阶段为OnlineState，升级完成之前和关闭之后为OffLineState
+func (s *SocketClient) State() ClientState {
+	if p := s.phase(); p == phaseOpen || p == phaseDraining {
+		return OnlineState
+	}
+	return OffLineState
+}
+
+// Handshake 返回升级时的握手信息快照
+func (s *SocketClient) Handshake() HandshakeInfo {
+	return s.handshake.clone()
+}
+
+// Info ClientIP由gin的ClientIP解析，会按照gin配置的可信代理读取X-Forwarded-For等请求头
+func (s *SocketClient) Info() ConnInfo {
+	return ConnInfo{
+		ID:          s.key,
+		ClientIP:    s.handshake.ClientIP,
+		ConnectedAt: s.handshake.ConnectedAt,
+		Subprotocol: s.handshake.Subprotocol,
+		Labels:      s.Labels(),
+	}
+}
+
+// Store 连接级别的键值存储，OnClose中仍可读取，之后被清空
+func (s *SocketClient) Store() *Store {
+	return &s.store
+}
+
+// HeartbeatFailures 当前连续发送ping失败的次数，任意一次发送成功即归零，
+// 连续失败达到WithHeartbeatFailMaxTimes设置的次数时连接被关闭
+func (s *SocketClient) HeartbeatFailures() int {
+	return int(s.heartbeatFailures.Load())
+}
+
+// LastPongAt 最近一次收到pong的时间，尚未收到时返回零值
+func (s *SocketClient) LastPongAt() time.Time {
+	if nanos := s.lastPongAt.Load(); nanos != 0 {
+		return time.Unix(0, nanos)
 	}
-	client.upGrader(ctx, socket.opts)
-	return client
+	return time.Time{}
+}
+
+func (s *SocketClient) Key() string {
+	return s.key
+}
+
+// RemoteAddr 以下访问方法在连接的任意阶段调用都是安全的，升级完成前返回零值
+func (s *SocketClient) RemoteAddr() net.Addr {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.RemoteAddr()
+}
+
+func (s *SocketClient) LocalAddr() net.Addr {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.LocalAddr()
+}
+
+// Subprotocol 握手时协商的子协议。目前只有WithCodecs注册的编码名会作为子协议协商，
+// 未配置WithCodecs或客户端没有请求同名子协议时返回""
+func (s *SocketClient) Subprotocol() string {
+	if s.conn == nil {
+		return ""
+	}
+	return s.conn.Subprotocol()
+}
+
+// UnderlyingConn 返回底层网络连接，仅用于设置socket参数等低层操作，直接读写会破坏websocket帧
+func (s *SocketClient) UnderlyingConn() net.Conn {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.UnderlyingConn()
 }
 
 func (s *SocketClient) readPump() {
+	var readErr error
 	defer func() {
 		if err := recover(); err != nil {
-			s.socket.opts.handler.OnError(s.key, fmt.Errorf("%v", err))
+			s.socket.notifyPanic(err, s.key)
+			readErr = newError(s.key, "read", panicError(err))
+			s.reportError(readErr)
 		}
 		s.close()
+		s.stopReading(readErr)
 	}()
-	_ = s.conn.SetReadDeadline(time.Now().Add(s.socket.opts.readDeadline))
+	if s.socket.opts.maxMessageSize > 0 {
+		s.conn.SetReadLimit(s.socket.opts.maxMessageSize)
+	}
+	if !s.options().noReadDeadline {
+		_ = s.conn.SetReadDeadline(time.Now().Add(s.options().readDeadline))
+	}
 	s.conn.SetPongHandler(func(receivedPong string) error {
-		if s.socket.opts.readDeadline > time.Nanosecond {
-			_ = s.conn.SetReadDeadline(time.Now().Add(s.socket.opts.readDeadline))
+		now := time.Now()
+		s.lastPongAt.Store(now.UnixNano())
+		if strings.HasPrefix(receivedPong, pingPayloadPrefix) {
+			s.matchPong(receivedPong, now)
+		}
+		if settings := s.options(); settings.noReadDeadline {
+			// 未设置读取截止时间，无需刷新
+		} else if settings.readDeadline > time.Nanosecond {
+			_ = s.conn.SetReadDeadline(time.Now().Add(settings.readDeadline))
 		} else {
 			_ = s.conn.SetReadDeadline(time.Time{})
 		}
+		if h, ok := s.socket.opts.handler.(PongHandler); ok {
+			s.controlCall("pong", func() { h.OnPong(s.key, receivedPong) })
+		}
 		return nil
 	})
+	s.conn.SetPingHandler(func(appData string) error {
+		s.lastReadAt.Store(time.Now().UnixNano())
+		err := s.conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(s.options().writeDeadline))
+		if err == websocket.ErrCloseSent {
+			err = nil
+		} else if e, ok := err.(net.Error); ok && e.Timeout() {
+			err = nil
+		}
+		if h, ok := s.socket.opts.handler.(PingHandler); ok {
+			s.controlCall("ping", func() { h.OnPing(s.key, appData) })
+		}
+		return err
+	})
 	for {
 		if mt, data, err := s.conn.ReadMessage(); err != nil {
-			if websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				s.socket.opts.handler.OnClose(s.key)
-			} else {
-				s.socket.opts.handler.OnError(s.key, err)
+			s.recordReadClose(err)
+			if !isExpectedClose(err) && !(s.phase() >= phaseDraining && isCloseError(err)) {
+				readErr = newError(s.key, "read", classifyReadError(err))
+				s.reportError(readErr)
 			}
 			break
 		} else {
+			s.lastReadAt.Store(time.Now().UnixNano())
+			s.bytesReceived.Add(int64(len(data)))
+			if ok, closed := s.admitMessageType(mt); closed {
+				break
+			} else if !ok {
+				continue
+			}
+			if logger := s.socket.opts.logger; logger != nil {
+				logger.Debug("websocket message received", s.logFields(
+					zap.String("message_type", MessageTypes.Name(mt)),
+					zap.Int("size", len(data)),
+				)...)
+			}
+			if s.socket.opts.e2eLatencyProbe != nil {
+				s.probeE2ELatency(data)
+			}
+			if s.handleAck(mt, data) || s.handleTopicFrame(mt, data) || s.handleClientMetrics(mt, data) || !s.admitSlowStart() {
+				continue
+			}
+			seq, skip := s.receiveSeq(mt, data)
+			if skip {
+				continue
+			}
+			s.sample(DirectionInbound, mt, data)
 			message := Message{
 				MessageType: mt,
 				Data:        data,
 				Subkeys:     []string{s.key},
 			}
-			s.socket.opts.handler.OnMessage(message)
+			if err = s.handleMessage(message); err != nil && s.socket.opts.isolatePanics && isPanic(err) {
+				if !s.isolatePanic(err) {
+					readErr = err
+					break
+				}
+			} else if err != nil {
+				s.reportError(err)
+				if continueOnError := s.socket.opts.continueOnError; continueOnError == nil || !continueOnError(err) {
+					readErr = err
+					break
+				}
+			} else {
+				s.markReceived(seq)
+			}
+			s.dispatchReaders(IncomingMessage{Type: mt, Data: data})
 		}
 	}
 }
 
+// handleMessage 将OnMessage中的panic转换为错误
+func (s *SocketClient) handleMessage(message Message) (err error) {
+	shadow := s.shadowCopy(message)
+	published := s.busCopy(message)
+	if s.socket.opts.protobufEncoding && message.MessageType == websocket.BinaryMessage {
+		if message.Envelope, err = decodeEnvelope(message.Data); err != nil {
+			return newError(s.key, "dispatch", err)
+		}
+	}
+	if len(s.socket.opts.contentTypes) > 0 || len(s.socket.opts.namedCodecs) > 0 || s.socket.opts.serializer != nil {
+		if err = s.decodePayload(&message); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			s.socket.notifyPanic(r, s.key)
+			err = newError(s.key, "dispatch", &PanicError{Value: r, Stack: debug.Stack()})
+		}
+	}()
+	s.socket.opts.handler.OnMessage(message)
+	s.shadowMessage(shadow)
+	s.publishToBus(message.MessageType, published)
+	return nil
+}
+
 func (s *SocketClient) writePump() {
-	ticker := time.NewTicker(s.socket.opts.pingPeriod)
+	var (
+		ticker    *time.Ticker
+		heartbeat <-chan time.Time
+	)
+	resetHeartbeat := func() {
+		if ticker != nil {
+			ticker.Stop()
+			ticker, heartbeat = nil, nil
+		}
+		if period := s.options().pingPeriod; period > 0 {
+			ticker = time.NewTicker(period)
+			heartbeat = ticker.C
+		}
+	}
+	resetHeartbeat()
+	var idle idleTracker
+	idleCheck := idle.reset(s)
+	defer idle.stop()
+	flusher := newConnFlusher(s)
+	var (
+		flush <-chan time.Time
+		batch textBatch
+	)
+	if interval := s.socket.opts.flushInterval; interval > 0 {
+		flushTicker := time.NewTicker(interval)
+		defer flushTicker.Stop()
+		flush = flushTicker.C
+	}
+	flushBatch := func() error {
+		compress := batch.compress
+		if payload := batch.take(); payload != nil {
+			return s.writeWith(websocket.TextMessage, payload, compress)
+		}
+		return nil
+	}
 	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
 		if err := recover(); err != nil {
-			s.socket.opts.handler.OnError(s.key, fmt.Errorf("%v", err))
+			s.socket.notifyPanic(err, s.key)
+			s.reportError(newError(s.key, "write", panicError(err)))
 		}
 		s.close()
 	}()
 	for {
 		select {
 		case message, ok := <-s.send:
-			s.conn.SetWriteDeadline(time.Now().Add(s.socket.opts.readDeadline))
 			if !ok {
-				s.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				_ = flushBatch()
+				_ = s.SendClose(websocket.CloseNormalClosure, "")
+				_ = flusher.after(s, true)
 				return
 			}
-
-			w, err := s.conn.NextWriter(websocket.TextMessage)
+			// 已取消的消息在取消时已从队列深度中扣除
+			cancelled := !s.takeQueued(message.entry)
+			if !cancelled {
+				s.countDequeued(len(message.data))
+			}
+			s.notifyQueueFreed()
+			if cancelled || s.expired(message, time.Now()) {
+				continue
+			}
+			data, err := s.transform(message.messageType, message.data)
 			if err != nil {
+				s.logError(fmt.Sprintf("websocket message dropped by write transformer: %s, client: %s", err, s.key))
+				continue
+			}
+			if flush != nil && message.messageType == websocket.TextMessage {
+				// 压缩选项不同的消息不能合并到同一帧
+				if !batch.accepts(message.compress) {
+					if err = flushBatch(); err != nil {
+						s.reportWriteError(err)
+						return
+					}
+				}
+				batch.add(data, message.compress)
+				continue
+			}
+			// 二进制消息写出前先发送已缓冲的文本，保证发送顺序
+			if err = flushBatch(); err == nil {
+				err = s.writeWith(message.messageType, data, message.compress)
+			}
+			if err == nil {
+				err = flusher.after(s, false)
+			}
+			if err != nil {
+				s.reportWriteError(err)
 				return
 			}
-			w.Write(message)
-			if err := w.Close(); err != nil {
+		case <-flush:
+			err := flushBatch()
+			if err == nil {
+				err = flusher.after(s, false)
+			}
+			if err != nil {
+				s.reportWriteError(err)
 				return
 			}
-		case <-ticker.C:
-			if err := s.conn.SetWriteDeadline(time.Now().Add(s.socket.opts.writeDeadline)); err != nil {
+		case <-s.settingsChanged:
+			resetHeartbeat()
+			idleCheck = idle.reset(s)
+		case now := <-idleCheck:
+			if !idle.check(s, now) {
 				return
 			}
-			if err := s.conn.WriteMessage(websocket.PingMessage, []byte(s.socket.opts.pingMsg)); err != nil {
-				s.heartbeatFailTimes++
-				if s.heartbeatFailTimes > s.socket.opts.heartbeatFailMaxTimes {
-					return
-				}
-			} else {
-				if s.heartbeatFailTimes > 0 {
-					s.heartbeatFailTimes--
-				}
+			if err := flusher.after(s, false); err != nil {
+				s.reportWriteError(err)
+				return
+			}
+		case <-heartbeat:
+			if !s.heartbeat() {
+				return
+			}
+			if err := flusher.after(s, true); err != nil {
+				s.reportWriteError(err)
+				return
 			}
 		}
 	}
 }
 
-func (s *SocketClient) close() {
-	if s.state == OnlineState {
-		s.state = OffLineState
-		s.socket.unregister <- s.key
-		s.conn.Close()
+// transform 依次执行写入转换器，前一个的输出作为后一个的输入
+func (s *SocketClient) transform(messageType int, data []byte) ([]byte, error) {
+	var err error
+	for _, fn := range s.socket.opts.writeTransformers {
+		if data, err = fn(messageType, data); err != nil {
+			return nil, err
+		}
+	}
+	if len(s.downgrades) > 0 {
+		if data, err = s.downgrade(data); err != nil {
+			return nil, err
+		}
+	}
+	if s.socket.opts.injectTimestamp {
+		data = injectTimestamp(messageType, data, time.Now().UnixNano())
+	}
+	return data, nil
+}
+
+// write 数据帧的写入都需要持有writeMu，保证队列消息与SendReader等直接写入不会交错；
+// 控制帧通过WriteControl写入，gorilla允许其与数据帧并发
+func (s *SocketClient) write(messageType int, message []byte) error {
+	return s.writeWith(messageType, message, nil)
+}
+
+// writeWith compress不为nil时只对这一帧覆盖连接的写压缩设置
+func (s *SocketClient) writeWith(messageType int, message []byte, compress *bool) error {
+	writeDeadline := s.options().writeDeadline
+	elapsed, err := s.writeFrame(messageType, message, writeDeadline, compress)
+	if err != nil {
+		return err
+	}
+	s.checkWriteLatency(elapsed, writeDeadline)
+	return nil
+}
+
+// writeFrame 返回的耗时从获得writeMu开始计算，不包含等待其他写入的时间
+func (s *SocketClient) writeFrame(messageType int, message []byte, writeDeadline time.Duration, compress *bool) (time.Duration, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.writeFrameLocked(messageType, message, writeDeadline, compress)
+}
+
+// writeFrameLocked 调用方持有writeMu
+func (s *SocketClient) writeFrameLocked(messageType int, message []byte, writeDeadline time.Duration, compress *bool) (time.Duration, error) {
+	if s.writesCanceled.Load() {
+		return 0, websocket.ErrCloseSent
+	}
+	if compress != nil {
+		s.conn.EnableWriteCompression(*compress)
+		defer s.conn.EnableWriteCompression(true)
+	}
+	message = s.stampSequence(messageType, message)
+	start := time.Now()
+	if err := s.conn.SetWriteDeadline(start.Add(writeDeadline)); err != nil {
+		return 0, err
+	}
+	w, err := s.conn.NextWriter(messageType)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(message); err != nil {
+		return 0, err
+	}
+	if err = w.Close(); err != nil {
+		return 0, err
+	}
+	s.countSent(len(message))
+	s.sample(DirectionOutbound, messageType, message)
+	return time.Since(start), nil
+}
+
+// checkWriteLatency 写出成功但耗时接近写入截止时间时触发WithWriteLatencyWarning
+func (s *SocketClient) checkWriteLatency(elapsed, writeDeadline time.Duration) {
+	opts := s.socket.opts
+	if opts.writeLatencyWarning == nil || float64(elapsed) <= opts.writeLatencyThreshold*float64(writeDeadline) {
+		return
+	}
+	s.safeCall(func() {
+		opts.writeLatencyWarning(elapsed)
+	})
+}
+
+// enqueue 非阻塞地写入发送队列，队列已满或连接已关闭时返回对应错误
+func (s *SocketClient) enqueue(messageType int, data []byte) error {
+	return s.enqueueOutbound(outbound{messageType: messageType, data: data, deadline: s.queueDeadline(0)})
+}
+
+func (s *SocketClient) enqueueOutbound(message outbound) error {
+	if err := s.requireOpen("send", ErrConnectionClosed); err != nil {
+		return err
+	}
+	if message.messageType == 0 {
+		message.messageType = websocket.TextMessage
+	}
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.sendClosed {
+		return newError(s.key, "send", ErrConnectionClosed)
+	}
+	message.entry = &queuedEntry{QueuedMessage: QueuedMessage{
+		Key: message.key, MessageType: message.messageType, Data: message.data, EnqueuedAt: time.Now(),
+	}}
+	select {
+	case s.send <- message:
+		s.linkQueued(message.entry)
+		s.countEnqueued(len(message.data))
+		return nil
+	default:
+		return newError(s.key, "send", ErrQueueFull)
+	}
+}
+
+func (s *SocketClient) closeSend() {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if !s.sendClosed {
+		s.sendClosed = true
+		close(s.send)
+		close(s.sendDone)
+	}
+}
+
+// Close 主动关闭连接，先发送关闭帧再断开底层连接，open和draining阶段可用，重复调用返回ErrClosed(同时匹配ErrAlreadyClosed)。
+// 正在写出的数据帧(例如对端不读取时阻塞的SendReader)会被立即中断，不等待写入截止时间
+func (s *SocketClient) Close() error {
+	if err := s.requireLive("close", ErrAlreadyClosed); err != nil {
+		return err
+	}
+	return s.closeWith(websocket.CloseNormalClosure, "")
+}
+
+// closingNotice CloseWithReason在关闭帧之前发送的最后一条应用消息
+type closingNotice struct {
+	Type   string         `json:"type"`
+	Code   int            `json:"code"`
+	Reason string         `json:"reason"`
+	Detail map[string]any `json:"detail,omitempty"`
+}
+
+// CloseWithReason 先直接写出{"type":"closing","code":n,"reason":"...","detail":{...}}，再发送携带code和reason的关闭帧，
+// 便于客户端区分超时、配额、管理员踢出等关闭原因。队列中尚未发送的消息会被丢弃，
+// reason超过关闭帧的容量时在关闭帧中被截断，应用消息中保留完整内容。open和draining阶段可用，
+// draining阶段已发出关闭帧，不再写出应用消息，直接断开
+func (s *SocketClient) CloseWithReason(code int, reason string, detail map[string]any) error {
+	if err := s.requireLive("close", ErrAlreadyClosed); err != nil {
+		return err
+	}
+	if s.phase() == phaseDraining {
+		return s.closeWith(code, reason)
+	}
+	messageType, notice, err := s.encodeNotice(closingNotice{Type: "closing", Code: code, Reason: reason, Detail: detail})
+	if err != nil {
+		return newError(s.key, "close", err)
+	}
+	s.noteDirectWrite()
+	if err = s.write(messageType, notice); err != nil {
+		s.reportError(newError(s.key, "close", classifyWriteError(err)))
+	}
+	return s.closeWith(code, reason)
+}
+
+func (s *SocketClient) closeWith(code int, reason string) error {
+	s.interruptWrite()
+	_ = s.SendClose(code, reason)
+	if !s.close() {
+		return newError(s.key, "close", wrapError(ErrClosed, ErrAlreadyClosed))
+	}
+	return nil
+}
+
+// close 所有终止路径(读写错误、handler panic、心跳失败、主动关闭)都汇总到这里，进入closed阶段保证OnClose只回调一次
+func (s *SocketClient) close() bool {
+	if !s.markClosed() {
+		return false
+	}
+	s.persistFinalSession()
+	s.socket.unregister <- s
+	s.conn.Close()
+	s.recordClose(websocket.CloseAbnormalClosure, "")
+	if logger := s.socket.opts.logger; logger != nil {
+		code, reason := s.LastClose()
+		logger.Info("websocket closed", s.logFields(
+			zap.Int("close_code", code),
+			zap.String("close_description", CloseCodeDescription(code)),
+			zap.String("close_reason", reason),
+		)...)
+	}
+	s.safeCall(func() {
 		s.socket.opts.handler.OnClose(s.key)
+	})
+	s.socket.emitDisconnect(s)
+	s.store.clear()
+	return true
+}
+
+// interruptWrite 主动关闭时不再等待正在写出的数据帧：此时有写入持有writeMu则将底层连接的写截止时间设为当前时间，
+// 使其立即超时返回，之后的写入直接失败。不能先获取writeMu，那样会等待的正是需要取消的写入。
+// 被中断的连接不再允许写入数据帧，关闭帧可能无法发出，由随后断开底层连接兜底
+func (s *SocketClient) interruptWrite() {
+	s.writesCanceled.Store(true)
+	if s.writeMu.TryLock() {
+		s.writeMu.Unlock()
+		return
+	}
+	_ = s.conn.UnderlyingConn().SetWriteDeadline(time.Now())
+}
+
+// reportWriteError 被interruptWrite中断的写入是关闭流程的一部分，不回调OnError
+func (s *SocketClient) reportWriteError(err error) {
+	if s.writesCanceled.Load() {
+		return
+	}
+	s.reportError(newError(s.key, "write", classifyWriteError(err)))
+}
+
+// reportError 连接关闭之后产生的读写错误是关闭本身导致的，不再回调OnError
+func (s *SocketClient) reportError(err error) {
+	if s.State() != OnlineState {
+		return
+	}
+	s.safeCall(func() {
+		s.socket.opts.handler.OnError(s.key, err)
+	})
+}
+
+// safeCall 回调中的panic只通知panic handler，避免影响连接的关闭流程
+func (s *SocketClient) safeCall(fn func()) {
+	defer s.socket.recoverPanic(s.key)
+	fn()
+}
+
+func (s *SocketClient) logError(msg string) {
+	if s.socket.opts.logger != nil {
+		s.socket.opts.logger.Error(msg, s.logFields()...)
+	} else {
+		log.Println(msg)
+	}
+}
+
+// controlCall 控制帧回调运行在读循环中，panic被恢复后交给OnError，不会中断读取和截止时间的维护
+func (s *SocketClient) controlCall(op string, fn func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			s.socket.notifyPanic(err, s.key)
+			s.reportError(newError(s.key, op, panicError(err)))
+		}
+	}()
+	fn()
+}
+
+// run 读写循环带有pprof标签ws_conn，goroutine分析中可按连接标识区分；
+// 写循环同时发送心跳，设置WithHeartbeatGoroutineLabel时另带ws_heartbeat标签
+func (s *SocketClient) run() {
+	labels := pprof.Labels("ws_conn", s.key)
+	go pprof.Do(context.Background(), labels, func(context.Context) { s.readPump() })
+	if label := s.socket.opts.heartbeatLabel; label != "" {
+		labels = pprof.Labels("ws_conn", s.key, "ws_heartbeat", label)
 	}
+	go pprof.Do(context.Background(), labels, func(context.Context) { s.writePump() })
 }
 
-func (s *SocketClient) upGrader(context *gin.Context, opts *SocketOption) {
+func (s *SocketClient) upGrader(context *gin.Context, opts *SocketOption) error {
 	upGrader := websocket.Upgrader{
-		ReadBufferSize:  opts.writeReadBufferSize,
-		WriteBufferSize: opts.writeReadBufferSize,
+		ReadBufferSize:    opts.writeReadBufferSize,
+		WriteBufferSize:   opts.writeReadBufferSize,
+		EnableCompression: opts.enableCompression,
+		HandshakeTimeout:  opts.upgradeTimeout,
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
 	}
-	wsConn, err := upGrader.Upgrade(context.Writer, context.Request, nil)
+	if s.codecSubprotocol != "" {
+		upGrader.Subprotocols = []string{s.codecSubprotocol}
+	}
+	header := http.Header{ConnectionIDHeader: {s.key}}
+	if s.resumeToken != "" {
+		header.Set(SessionResumeHeader, s.resumeToken)
+	}
+	var wsConn *websocket.Conn
+	err := drainUpgradeBody(context, opts.upgradeBodyLimit)
+	if err == nil {
+		wsConn, err = upGrader.Upgrade(context.Writer, context.Request, header)
+	}
 	if err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			err = wrapError(ErrUpgradeTimeout, err)
+		}
+		err = newError(s.key, "upgrade", wrapError(ErrUpgradeFailed, err))
 		if opts.logger != nil {
-			opts.logger.Error(err.Error())
-		} else {
-			log.Panicln(err)
+			opts.logger.Error(err.Error(), s.logFields()...)
 		}
-		return
+		return err
 	}
 	s.conn = wsConn
-	s.send = make(chan []byte, opts.writeReadBufferSize)
-	go s.readPump()
-	go s.writePump()
+	s.handshake = newHandshakeInfo(context.Request, context.ClientIP(), wsConn.Subprotocol(),
+		opts.enableCompression && offersCompression(context.Request))
+	s.send = make(chan outbound, opts.sendQueueLength)
+	s.sendDone = make(chan struct{})
+	s.queueFreed = make(chan struct{}, 1)
+	if opts.tcpKeepAlive > 0 {
+		s.setKeepAlive(opts.tcpKeepAlive)
+	}
+	return nil
+}
+
+// drainUpgradeBody 声明的请求体超过limit时以413拒绝升级；否则在升级前读完请求体，
+// 残留在连接缓冲区中的请求体会被gorilla当作握手完成前发送的数据而拒绝升级。未声明长度时最多读取limit字节
+func drainUpgradeBody(context *gin.Context, limit int64) error {
+	body := context.Request.Body
+	if limit <= 0 || body == nil || body == http.NoBody {
+		return nil
+	}
+	if context.Request.ContentLength > limit {
+		context.AbortWithStatus(http.StatusRequestEntityTooLarge)
+		return fmt.Errorf("%w: request body of %d bytes exceeds %d", ErrMessageTooLarge, context.Request.ContentLength, limit)
+	}
+	_, err := io.Copy(io.Discard, io.LimitReader(body, limit))
+	return err
+}
+
+func (s *SocketClient) setKeepAlive(interval time.Duration) {
+	tcpConn, ok := s.conn.UnderlyingConn().(*net.TCPConn)
+	if !ok {
+		return
+	}
+	err := tcpConn.SetKeepAlive(true)
+	if err == nil {
+		err = tcpConn.SetKeepAlivePeriod(interval)
+	}
+	if err != nil && s.socket.opts.logger != nil {
+		s.socket.opts.logger.Warn(newError(s.key, "keepalive", err).Error(), s.logFields()...)
+	}
 }
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// ClientMetricsType 客户端上报指标的帧类型
+	ClientMetricsType = "client.metrics"
+	// maxClientMetricsSize 指标帧的大小上限，超长的帧按前256字节识别类型
+	maxClientMetricsSize = 2048
+	maxClientMetricsKeys = 16
+	// defaultClientMetricsInterval 同一连接两次上报的最小间隔
+	defaultClientMetricsInterval = 10 * time.Second
+)
+
+// ClientMetrics 客户端上报的指标，帧格式为
+// {"type":"client.metrics","render_latency_ms":12.5,"processing_lag_ms":3,"extra":{"fps":58}}，
+// 时间不能为负数，Extra最多16项
+type ClientMetrics struct {
+	RenderLatency time.Duration      `json:"render_latency"`
+	ProcessingLag time.Duration      `json:"processing_lag"`
+	Extra         map[string]float64 `json:"extra,omitempty"`
+	ReceivedAt    time.Time          `json:"received_at"`
+}
+
+type clientMetricsFrame struct {
+	Type          string             `json:"type"`
+	RenderLatency *float64           `json:"render_latency_ms"`
+	ProcessingLag *float64           `json:"processing_lag_ms"`
+	Extra         map[string]float64 `json:"extra"`
+}
+
+// WithClientMetricsHandler 开启client.metrics帧：读循环校验后交给fn，不会交给OnMessage，最近一次的指标出现在
+// SocketStats.ClientMetrics以及诊断接口的/connections中。超过大小上限、间隔小于WithClientMetricsInterval
+// 或格式不正确的帧被丢弃，计入SocketStats.MetricsViolations。fn在读循环中同步执行，应尽快返回
+func WithClientMetricsHandler(fn func(connID string, m ClientMetrics)) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.clientMetrics = fn
+	}
+}
+
+// WithClientMetricsInterval 同一连接两次上报的最小间隔，默认10s
+func WithClientMetricsInterval(d time.Duration) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.clientMetricsInterval = d
+	}
+}
+
+// handleClientMetrics 返回true表示是指标帧，已处理或已计为违规
+func (s *SocketClient) handleClientMetrics(messageType int, data []byte) bool {
+	if s.socket.opts.clientMetrics == nil || messageType != websocket.TextMessage {
+		return false
+	}
+	head := data
+	if len(head) > maxClientMetricsSize {
+		head = head[:256]
+	}
+	if !bytes.Contains(head, []byte(`"`+ClientMetricsType+`"`)) {
+		return false
+	}
+	if len(data) > maxClientMetricsSize {
+		s.metricsViolation(fmt.Errorf("%w: %d bytes exceeds %d", ErrMessageTooLarge, len(data), maxClientMetricsSize))
+		return true
+	}
+	var frame clientMetricsFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		var probe struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(data, &probe) != nil || probe.Type != ClientMetricsType {
+			return false
+		}
+		s.metricsViolation(fmt.Errorf("%w: %v", ErrInvalidPayload, err))
+		return true
+	}
+	if frame.Type != ClientMetricsType {
+		// 只是在其他字段中提到了该类型
+		return false
+	}
+	metrics, err := frame.metrics()
+	if err != nil {
+		s.metricsViolation(err)
+		return true
+	}
+	now := time.Now()
+	s.metricsMu.Lock()
+	if !s.metricsAt.IsZero() && now.Sub(s.metricsAt) < s.socket.opts.clientMetricsInterval {
+		s.metricsMu.Unlock()
+		s.metricsViolation(ErrRateLimited)
+		return true
+	}
+	s.metricsAt = now
+	metrics.ReceivedAt = now
+	s.latestMetrics = &metrics
+	s.metricsMu.Unlock()
+	s.safeCall(func() {
+		s.socket.opts.clientMetrics(s.key, metrics)
+	})
+	return true
+}
+
+func (f *clientMetricsFrame) metrics() (ClientMetrics, error) {
+	var m ClientMetrics
+	if len(f.Extra) > maxClientMetricsKeys {
+		return m, fmt.Errorf("%w: %d extra metrics exceeds %d", ErrInvalidPayload, len(f.Extra), maxClientMetricsKeys)
+	}
+	for name, ms := range map[string]*float64{"render_latency_ms": f.RenderLatency, "processing_lag_ms": f.ProcessingLag} {
+		if ms != nil && *ms < 0 {
+			return m, fmt.Errorf("%w: %s must be a non-negative number, got %v", ErrInvalidPayload, name, *ms)
+		}
+	}
+	if f.RenderLatency != nil {
+		m.RenderLatency = time.Duration(*f.RenderLatency * float64(time.Millisecond))
+	}
+	if f.ProcessingLag != nil {
+		m.ProcessingLag = time.Duration(*f.ProcessingLag * float64(time.Millisecond))
+	}
+	m.Extra = f.Extra
+	return m, nil
+}
+
+// metricsViolation 违规的帧只计数并记录日志，不回调OnError，避免客户端借此放大服务端的处理开销
+func (s *SocketClient) metricsViolation(err error) {
+	s.metricsRejected.Add(1)
+	s.socket.logWarning(s.key, "client metrics", err)
+}
+
+// ClientMetrics 最近一次有效的客户端指标，没有时为nil
+func (s *SocketClient) ClientMetrics() *ClientMetrics {
+	s.metricsMu.Lock()
+	defer s.metricsMu.Unlock()
+	return s.latestMetrics
+}
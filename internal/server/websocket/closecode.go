@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// 应用自定义的关闭码，RFC 6455将4000-4999留给应用使用
+const (
+	// CloseAuthExpired 登录凭证过期，客户端应重新认证后再连接
+	CloseAuthExpired = 4000
+	// CloseLoggedInElsewhere 同一账号在其他地方建立了连接
+	CloseLoggedInElsewhere = 4001
+	// CloseSlowConsumer 客户端消费过慢，发送队列持续积压
+	CloseSlowConsumer = 4002
+	// CloseServerDraining 服务端下线前排空连接，客户端应重连到其他节点
+	CloseServerDraining = 4003
+	// CloseStaleConnection 长时间没有任何入站活动，被WithStaleConnectionReaper回收
+	CloseStaleConnection = 4004
+	// CloseIdleTimeout 超过WithIdleTimeout双方都没有数据帧
+	CloseIdleTimeout = 4408
+)
+
+var closeDescriptions = map[int]string{
+	websocket.CloseNormalClosure:           "normal closure",
+	websocket.CloseGoingAway:               "going away: server shutting down or page navigated away",
+	websocket.CloseProtocolError:           "protocol error",
+	websocket.CloseUnsupportedData:         "unsupported data type",
+	websocket.CloseNoStatusReceived:        "no status code received",
+	websocket.CloseAbnormalClosure:         "abnormal closure: connection dropped without a close frame",
+	websocket.CloseInvalidFramePayloadData: "invalid frame payload data",
+	websocket.ClosePolicyViolation:         "policy violation",
+	websocket.CloseMessageTooBig:           "message too big",
+	websocket.CloseMandatoryExtension:      "mandatory extension not negotiated",
+	websocket.CloseInternalServerErr:       "internal server error",
+	websocket.CloseServiceRestart:          "service restart",
+	websocket.CloseTryAgainLater:           "try again later",
+	websocket.CloseTLSHandshake:            "TLS handshake failure",
+	CloseAuthExpired:                       "authentication expired",
+	CloseLoggedInElsewhere:                 "logged in elsewhere",
+	CloseSlowConsumer:                      "slow consumer",
+	CloseServerDraining:                    "server draining, reconnect to another node",
+	CloseStaleConnection:                   "stale connection reaped",
+	CloseIdleTimeout:                       "idle timeout: no application messages",
+}
+
+// CloseCodeDescription 关闭码的可读描述，覆盖RFC 6455第7.4.1节的标准关闭码和上面的应用关闭码，
+// 用于日志和监控面板，避免直接展示数字
+func CloseCodeDescription(code int) string {
+	if description, ok := closeDescriptions[code]; ok {
+		return description
+	}
+	switch {
+	case code >= 3000 && code <= 3999:
+		return fmt.Sprintf("registered close code %d", code)
+	case code >= 4000 && code <= 4999:
+		return fmt.Sprintf("application close code %d", code)
+	}
+	return fmt.Sprintf("unknown close code %d", code)
+}
+
+// closeRecord 连接第一次发送或收到的关闭码，之后的关闭帧不覆盖
+type closeRecord struct {
+	code   int
+	reason string
+}
+
+func (s *SocketClient) recordClose(code int, reason string) {
+	s.lastClose.CompareAndSwap(nil, &closeRecord{code: code, reason: reason})
+}
+
+// recordReadClose 读循环退出时记录对端的关闭码，没有收到关闭帧时为1006
+func (s *SocketClient) recordReadClose(err error) {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		s.recordClose(closeErr.Code, closeErr.Text)
+	} else {
+		s.recordClose(websocket.CloseAbnormalClosure, "")
+	}
+}
+
+// LastClose 连接的关闭码和对端或服务端给出的原因，尚未关闭时返回0
+func (s *SocketClient) LastClose() (code int, reason string) {
+	if record := s.lastClose.Load(); record != nil {
+		return record.code, record.reason
+	}
+	return 0, ""
+}
+
+// closeFrameTimeout 写关闭帧只等待很短的时间，对端无响应时不拖慢关闭流程
+const closeFrameTimeout = time.Second
+
+// SendClose 写出携带code和reason的关闭帧，不断开底层连接，读循环仍可收到对端回应的关闭帧，
+// 之后按正常关闭处理。reason超过关闭帧容量时按UTF-8字符边界截断。只在open阶段可用，发出后连接进入draining阶段，
+// 不再接受新的发送；重复发送返回ErrClosed(同时匹配ErrAlreadyClosed)
+func (s *SocketClient) SendClose(code int, reason string) error {
+	if err := s.requireOpen("close", ErrAlreadyClosed); err != nil {
+		return err
+	}
+	if !s.advance(phaseOpen, phaseDraining) {
+		return s.phaseError("close", ErrAlreadyClosed)
+	}
+	s.recordClose(code, reason)
+	err := s.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, truncateCloseReason(reason)), time.Now().Add(closeFrameTimeout))
+	if errors.Is(err, websocket.ErrCloseSent) {
+		return newError(s.key, "close", ErrAlreadyClosed)
+	}
+	if err != nil {
+		return newError(s.key, "close", classifyWriteError(err))
+	}
+	return nil
+}
+
+// truncateCloseReason 关闭帧负载最多125字节，扣除2字节状态码后按UTF-8字符边界截断
+func truncateCloseReason(reason string) string {
+	limit := maxControlPayload - 2
+	if len(reason) <= limit {
+		return reason
+	}
+	for limit > 0 && !utf8.RuneStart(reason[limit]) {
+		limit--
+	}
+	return reason[:limit]
+}
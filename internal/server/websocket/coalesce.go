@@ -0,0 +1,140 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// coalescedBroadcast 窗口内同一合并键暂存的最新广播
+type coalescedBroadcast struct {
+	key         string
+	messageType int
+	data        []byte
+	timer       *time.Timer
+}
+
+// roomCoalescer 一个房间暂存的合并广播，按合并键首次出现的顺序投递。
+// emit在投递期间持有，保证暂存的广播先于之后的普通广播投递
+type roomCoalescer struct {
+	emit    sync.Mutex
+	mu      sync.Mutex
+	entries []*coalescedBroadcast
+}
+
+// BroadcastCoalesced 适合在线状态、光标位置等只关心最新值的高频广播：同一房间内key相同的广播在window内只投递最新的一条，
+// 窗口从该key第一次广播开始计时。普通的Broadcast、SendFrom会先投递房间内暂存的合并广播，保持两者的先后顺序；
+// 房间最后一个成员离开、StartDrain以及调用FlushCoalesced时立即投递。window不大于0时等同于Broadcast。
+// 被替换掉的广播数见RoomStats.BroadcastsSuppressed
+func (m *RoomManager) BroadcastCoalesced(name, key string, messageType int, data []byte, window time.Duration) error {
+	if window <= 0 {
+		return m.Broadcast(name, messageType, data)
+	}
+	room, ok := m.Room(name)
+	if !ok && m.socket.opts.pubSub == nil {
+		return newError("", "broadcast", ErrRoomNotFound)
+	}
+	// 持有coalesceMu时锁住c，避免c在追加之前因为清空被删除
+	m.coalesceMu.Lock()
+	c, exists := m.coalescers[name]
+	if !exists {
+		c = &roomCoalescer{}
+		m.coalescers[name] = c
+	}
+	c.mu.Lock()
+	m.coalesceMu.Unlock()
+	for _, entry := range c.entries {
+		if entry.key == key {
+			entry.messageType, entry.data = messageType, data
+			c.mu.Unlock()
+			m.suppressedCount.Add(1)
+			if room != nil {
+				room.suppressedCount.Add(1)
+			}
+			return nil
+		}
+	}
+	entry := &coalescedBroadcast{key: key, messageType: messageType, data: data}
+	entry.timer = time.AfterFunc(window, func() { m.flushCoalescedEntry(name, c, entry) })
+	c.entries = append(c.entries, entry)
+	c.mu.Unlock()
+	return nil
+}
+
+// FlushCoalesced 立即投递所有房间暂存的合并广播，停止服务前调用
+func (m *RoomManager) FlushCoalesced() {
+	m.coalesceMu.Lock()
+	names := make([]string, 0, len(m.coalescers))
+	for name := range m.coalescers {
+		names = append(names, name)
+	}
+	m.coalesceMu.Unlock()
+	for _, name := range names {
+		m.flushCoalesced(name)
+	}
+}
+
+// ordered 房间有暂存的合并广播时先投递，再执行fn
+func (m *RoomManager) ordered(name string, fn func() error) error {
+	m.coalesceMu.Lock()
+	c, ok := m.coalescers[name]
+	m.coalesceMu.Unlock()
+	if !ok {
+		return fn()
+	}
+	c.emit.Lock()
+	defer c.emit.Unlock()
+	m.emitCoalesced(name, c.take(nil))
+	m.release(name, c)
+	return fn()
+}
+
+func (m *RoomManager) flushCoalesced(name string) {
+	_ = m.ordered(name, func() error { return nil })
+}
+
+// flushCoalescedEntry 窗口结束时投递，已被提前投递的不再重复
+func (m *RoomManager) flushCoalescedEntry(name string, c *roomCoalescer, entry *coalescedBroadcast) {
+	defer m.socket.recoverPanic("")
+	c.emit.Lock()
+	defer c.emit.Unlock()
+	m.emitCoalesced(name, c.take(entry))
+	m.release(name, c)
+}
+
+// release 没有暂存的广播时删除房间的合并状态
+func (m *RoomManager) release(name string, c *roomCoalescer) {
+	m.coalesceMu.Lock()
+	defer m.coalesceMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) == 0 && m.coalescers[name] == c {
+		delete(m.coalescers, name)
+	}
+}
+
+// take 取出entry，entry为nil时取出全部并停止各自的定时器
+func (c *roomCoalescer) take(entry *coalescedBroadcast) []*coalescedBroadcast {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry == nil {
+		taken := c.entries
+		c.entries = nil
+		for _, e := range taken {
+			e.timer.Stop()
+		}
+		return taken
+	}
+	for i, e := range c.entries {
+		if e == entry {
+			c.entries = append(c.entries[:i], c.entries[i+1:]...)
+			return []*coalescedBroadcast{e}
+		}
+	}
+	return nil
+}
+
+func (m *RoomManager) emitCoalesced(name string, entries []*coalescedBroadcast) {
+	for _, entry := range entries {
+		_ = m.broadcast(name, entry.messageType, entry.data)
+	}
+}
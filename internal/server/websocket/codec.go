@@ -0,0 +1,256 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
+)
+
+// 内置的消息编码
+const (
+	ContentTypeJSON    = "application/json"
+	ContentTypeMsgPack = "application/msgpack"
+	ContentTypeCBOR    = "application/cbor"
+)
+
+// Serializer 消息的序列化方式，通过WithSerializer替换默认的JSON
+type Serializer interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// Codec 连接协商得到的消息编码，SendJSON按它编码，入站消息按它解码到Message.Payload
+type Codec interface {
+	Serializer
+	ContentType() string
+	// MessageType 编码后的消息使用的帧类型
+	MessageType() int
+}
+
+// JSONSerializer 以文本帧发送，同时实现Codec
+type JSONSerializer struct{}
+
+func (JSONSerializer) ContentType() string                { return ContentTypeJSON }
+func (JSONSerializer) MessageType() int                   { return websocket.TextMessage }
+func (JSONSerializer) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (JSONSerializer) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// msgpackHandle 结构体沿用json标签，map解码为map[string]any，与JSON解码的结果一致
+var msgpackHandle = func() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{}
+	h.MapType = reflect.TypeOf(map[string]any(nil))
+	h.RawToString = true
+	h.WriteExt = true
+	return h
+}()
+
+// MsgPackSerializer 以二进制帧发送，同时实现Codec
+type MsgPackSerializer struct{}
+
+func (MsgPackSerializer) ContentType() string { return ContentTypeMsgPack }
+func (MsgPackSerializer) MessageType() int    { return websocket.BinaryMessage }
+
+func (MsgPackSerializer) Marshal(v any) ([]byte, error) {
+	var data []byte
+	err := codec.NewEncoderBytes(&data, msgpackHandle).Encode(v)
+	return data, err
+}
+
+func (MsgPackSerializer) Unmarshal(data []byte, v any) error {
+	return codec.NewDecoderBytes(data, msgpackHandle).Decode(v)
+}
+
+var cborHandle = func() *codec.CborHandle {
+	h := &codec.CborHandle{}
+	h.MapType = reflect.TypeOf(map[string]any(nil))
+	return h
+}()
+
+// CborSerializer 以二进制帧发送，同时实现Codec
+type CborSerializer struct{}
+
+func (CborSerializer) ContentType() string { return ContentTypeCBOR }
+func (CborSerializer) MessageType() int    { return websocket.BinaryMessage }
+
+func (CborSerializer) Marshal(v any) ([]byte, error) {
+	var data []byte
+	err := codec.NewEncoderBytes(&data, cborHandle).Encode(v)
+	return data, err
+}
+
+func (CborSerializer) Unmarshal(data []byte, v any) error {
+	return codec.NewDecoderBytes(data, cborHandle).Decode(v)
+}
+
+// 内置编码的实例，可用于WithCodecs
+var (
+	JSONCodec    Codec = JSONSerializer{}
+	MsgPackCodec Codec = MsgPackSerializer{}
+	CborCodec    Codec = CborSerializer{}
+)
+
+var codecs = map[string]Codec{
+	ContentTypeJSON:    JSONSerializer{},
+	ContentTypeMsgPack: MsgPackSerializer{},
+	ContentTypeCBOR:    CborSerializer{},
+}
+
+// serializerCodec 未实现Codec的Serializer，以二进制帧发送
+type serializerCodec struct {
+	Serializer
+}
+
+func (serializerCodec) ContentType() string { return "application/octet-stream" }
+func (serializerCodec) MessageType() int    { return websocket.BinaryMessage }
+
+// WithSerializer 替换默认的JSON，SendJSON、closing和rate_limited等通知以及入站消息的解码都使用s，
+// MessageRouter按解码后的type和data分发。s实现Codec时按其MessageType发送，否则为二进制帧
+func WithSerializer(s Serializer) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.serializer = s
+	}
+}
+
+// WithContentTypeNegotiation 按客户端声明的编码选择每个连接的Codec，supported按服务端偏好排序。
+// 客户端在握手请求的Content-Type请求头或content_type查询参数中声明编码，声明了不支持的编码时握手返回415；
+// 未声明时由第一条入站消息决定：文本帧为JSON，二进制帧为MsgPack。确定之前SendJSON使用supported[0]
+func WithContentTypeNegotiation(supported []string) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.contentTypes = append([]string(nil), supported...)
+	}
+}
+
+// codecRef atomic.Pointer需要具体类型
+type codecRef struct {
+	Codec
+}
+
+// negotiateCodec 返回nil表示客户端未声明编码
+func negotiateCodec(r *http.Request, supported []string) (Codec, error) {
+	declared := r.URL.Query().Get("content_type")
+	if declared == "" {
+		declared = r.Header.Get("Content-Type")
+	}
+	if declared == "" {
+		return nil, nil
+	}
+	if mediaType, _, err := mime.ParseMediaType(declared); err == nil {
+		declared = mediaType
+	}
+	for _, contentType := range supported {
+		if contentType == declared {
+			return codecs[contentType], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedContentType, declared)
+}
+
+// negotiate 升级之前按握手请求选择编码，声明了不支持的编码时以415结束握手
+func (s *SocketClient) negotiate(ctx *gin.Context) error {
+	if len(s.socket.opts.namedCodecs) > 0 {
+		return s.selectCodec(ctx)
+	}
+	supported := s.socket.opts.contentTypes
+	if len(supported) == 0 {
+		return nil
+	}
+	c, err := negotiateCodec(ctx.Request, supported)
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusUnsupportedMediaType)
+		return newError(s.key, "upgrade", err)
+	}
+	if c != nil {
+		s.codec.Store(&codecRef{c})
+	}
+	return nil
+}
+
+// Codec 连接使用的编码，未启用WithContentTypeNegotiation、WithCodecs和WithSerializer时为JSON
+func (s *SocketClient) Codec() Codec {
+	if ref := s.codec.Load(); ref != nil {
+		return ref.Codec
+	}
+	return s.socket.defaultCodec()
+}
+
+// defaultCodec 尚未确定编码的连接以及离线发送使用的编码
+func (s *Socket) defaultCodec() Codec {
+	if named := s.opts.namedCodecs; len(named) > 0 {
+		return named[s.opts.defaultCodecName()]
+	}
+	if supported := s.opts.contentTypes; len(supported) > 0 {
+		return codecs[supported[0]]
+	}
+	if c, ok := s.opts.serializer.(Codec); ok {
+		return c
+	}
+	if s.opts.serializer != nil {
+		return serializerCodec{s.opts.serializer}
+	}
+	return JSONSerializer{}
+}
+
+// codecFor 第一条入站消息确定尚未协商的编码，之后保持不变
+func (s *SocketClient) codecFor(messageType int) Codec {
+	if ref := s.codec.Load(); ref != nil {
+		return ref.Codec
+	}
+	preferred := ContentTypeJSON
+	if messageType == websocket.BinaryMessage {
+		preferred = ContentTypeMsgPack
+	}
+	selected := s.Codec()
+	for _, contentType := range s.socket.opts.contentTypes {
+		if contentType == preferred {
+			selected = codecs[contentType]
+		}
+	}
+	s.codec.CompareAndSwap(nil, &codecRef{selected})
+	return s.codec.Load().Codec
+}
+
+// decodePayload 按连接的编码解码入站消息，失败按OnMessage出错处理
+func (s *SocketClient) decodePayload(message *Message) error {
+	c := s.codecFor(message.MessageType)
+	message.ContentType = c.ContentType()
+	if err := c.Unmarshal(message.Data, &message.Payload); err != nil {
+		return newError(s.key, "dispatch", wrapError(ErrInvalidPayload, err))
+	}
+	return nil
+}
+
+// SendJSON 按连接协商的编码序列化v并发送，MsgPack以二进制帧发送。只在open阶段可用
+func (s *SocketClient) SendJSON(v any) error {
+	if err := s.requireOpen("send", ErrConnectionClosed); err != nil {
+		return err
+	}
+	c := s.Codec()
+	data, err := c.Marshal(v)
+	if err != nil {
+		return newError(s.key, "send", err)
+	}
+	return s.enqueue(c.MessageType(), data)
+}
+
+// SendJSON 连接在线时按其协商的编码发送，否则按supported[0]或WithDefaultCodec编码后交给SendTo，
+// 配置了WithPendingStore时写入离线存储
+func (s *Socket) SendJSON(key string, v any) error {
+	s.mu.RLock()
+	client, ok := s.clients[key]
+	s.mu.RUnlock()
+	if ok {
+		return client.SendJSON(v)
+	}
+	c := s.defaultCodec()
+	data, err := c.Marshal(v)
+	if err != nil {
+		return newError(key, "send", err)
+	}
+	return s.SendTo(key, c.MessageType(), data)
+}
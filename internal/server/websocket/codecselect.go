@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// CodecParam 客户端在握手的查询参数或X-WS-Codec请求头中选择WithCodecs注册的编码
+const CodecParam = "codec"
+
+// WithCodecs 按名称注册可选的编码，客户端依次通过?codec=、X-WS-Codec请求头或与编码同名的子协议选择，
+// 都未指定时使用WithDefaultCodec，请求了未注册的编码时握手返回400。选定的编码用于SendJSON、
+// 入站消息的解码以及closing、rate_limited等通知，连接建立后首先收到按该编码发送的{"type":"welcome","data":{"codec":name,"id":连接标识}}
+func WithCodecs(named map[string]Codec) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.namedCodecs = make(map[string]Codec, len(named))
+		for name, c := range named {
+			opt.namedCodecs[name] = c
+		}
+	}
+}
+
+// WithDefaultCodec 客户端未选择编码时使用的WithCodecs名称，不设置时为"json"
+func WithDefaultCodec(name string) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.defaultCodec = name
+	}
+}
+
+func (opts *SocketOption) defaultCodecName() string {
+	if opts.defaultCodec != "" {
+		return opts.defaultCodec
+	}
+	return "json"
+}
+
+// welcomeFrame 连接建立后发送，客户端据此确认服务端选定的编码
+type welcomeFrame struct {
+	Type string `json:"type"`
+	Data struct {
+		Codec       string `json:"codec,omitempty"`
+		ID          string `json:"id"`
+		ResumeToken string `json:"resume_token,omitempty"`
+		Session     string `json:"session,omitempty"`
+	} `json:"data"`
+}
+
+// selectCodec 升级之前按查询参数、请求头、子协议的顺序选择编码，请求了未注册的编码时以400结束握手
+func (s *SocketClient) selectCodec(ctx *gin.Context) error {
+	named := s.socket.opts.namedCodecs
+	name := ctx.Query(CodecParam)
+	if name == "" {
+		name = ctx.GetHeader("X-WS-Codec")
+	}
+	if name == "" {
+		for _, protocol := range websocket.Subprotocols(ctx.Request) {
+			if _, ok := named[protocol]; ok {
+				name, s.codecSubprotocol = protocol, protocol
+				break
+			}
+		}
+	}
+	if name == "" {
+		name = s.socket.opts.defaultCodecName()
+	}
+	c, ok := named[name]
+	if !ok {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return newError(s.key, "upgrade", fmt.Errorf("%w: %q", ErrUnknownCodec, name))
+	}
+	s.codecName = name
+	s.codec.Store(&codecRef{c})
+	return nil
+}
+
+// CodecName 通过WithCodecs选定的编码名称，未配置WithCodecs时为空
+func (s *SocketClient) CodecName() string {
+	return s.codecName
+}
+
+// sendWelcome 配置了WithCodecs、WithSessionPersistence或连接标识由服务端生成时发送，在OnOpen之前入队，保证是连接收到的第一条消息
+func (s *SocketClient) sendWelcome() {
+	if s.codecName == "" && !s.idGenerated && s.resumeToken == "" {
+		return
+	}
+	var frame welcomeFrame
+	frame.Type = "welcome"
+	frame.Data.Codec = s.codecName
+	frame.Data.ID = s.key
+	frame.Data.ResumeToken = s.resumeToken
+	frame.Data.Session = s.resumeStatus
+	if err := s.SendJSON(frame); err != nil {
+		s.reportError(err)
+	}
+}
+
+// encodeNotice 配置了WithCodecs或WithSerializer时通知按连接的编码发送，否则为JSON文本
+func (s *SocketClient) encodeNotice(v any) (int, []byte, error) {
+	c := Codec(JSONSerializer{})
+	if s.codecName != "" || s.socket.opts.serializer != nil {
+		c = s.Codec()
+	}
+	data, err := c.Marshal(v)
+	return c.MessageType(), data, err
+}
+
+// sendNotice 连接不在线时按默认编码交给SendTo
+func (s *Socket) sendNotice(key string, v any) {
+	s.mu.RLock()
+	client, ok := s.clients[key]
+	s.mu.RUnlock()
+	if !ok {
+		client = &SocketClient{key: key, socket: s}
+		if len(s.opts.namedCodecs) > 0 {
+			client.codecName = s.opts.defaultCodecName()
+		}
+	}
+	if messageType, data, err := client.encodeNotice(v); err == nil {
+		_ = s.SendTo(key, messageType, data)
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import "time"
+
+// SendOpts 单条消息的发送选项
+type SendOpts struct {
+	// Compress 不为nil时覆盖该条消息是否压缩，例如压缩大的JSON快照、跳过已压缩的图片。
+	// 只在连接协商了permessage-deflate时生效，写出后恢复连接的默认设置
+	Compress *bool
+	// QueueWait 覆盖WithQueueWaitTimeout，该条消息在发送队列中等待超过该时间仍未写出时丢弃，小于0表示不限制
+	QueueWait time.Duration
+	// Key 消息标识，可以多条消息共用，例如房间名；尚未开始写出时可通过CancelQueued(Key)取消
+	Key string
+}
+
+// SendBytesOpt 与WriteMessage相同经由发送队列写出，opts只作用于这一条消息；
+// 开启WithFlushInterval时压缩选项不同的文本消息不会合并到同一帧。只在open阶段可用
+func (s *SocketClient) SendBytesOpt(messageType int, data []byte, opts SendOpts) error {
+	if err := s.requireOpen("send", ErrConnectionClosed); err != nil {
+		return err
+	}
+	return s.enqueueOutbound(outbound{messageType: messageType, data: data, compress: opts.Compress, deadline: s.queueDeadline(opts.QueueWait), key: opts.Key})
+}
+
+// SendToOpt 按连接标识发送带选项的消息；连接不在线且配置了WithPendingStore时按SendTo写入离线存储，不保留opts
+func (s *Socket) SendToOpt(key string, messageType int, data []byte, opts SendOpts) error {
+	s.mu.RLock()
+	client, ok := s.clients[key]
+	s.mu.RUnlock()
+	if !ok {
+		return s.SendTo(key, messageType, data)
+	}
+	return client.SendBytesOpt(messageType, data, opts)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Duration 支持"30s"这类字符串，数字按秒处理以兼容config.yaml中已有的写法
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	return d.set(value)
+}
+
+func (d Duration) MarshalYAML() (any, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(any) error) error {
+	var value any
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	return d.set(value)
+}
+
+func (d *Duration) set(value any) error {
+	switch v := value.(type) {
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	case int:
+		*d = Duration(time.Duration(v) * time.Second)
+	case nil:
+		*d = 0
+	default:
+		return fmt.Errorf("invalid duration %v", value)
+	}
+	return nil
+}
+
+// SocketConfig 与各个WithXxx配置项一一对应，零值字段使用与NewSocket相同的默认值
+type SocketConfig struct {
+	WriteReadBufferSize   int      `json:"writeReadBufferSize" yaml:"WriteReadBufferSize"`
+	SendQueueLength       int      `json:"sendQueueLength" yaml:"SendQueueLength"`
+	HeartbeatFailMaxTimes int      `json:"heartbeatFailMaxTimes" yaml:"HeartbeatFailMaxTimes"`
+	WriteDeadline         Duration `json:"writeDeadline" yaml:"WriteDeadline"`
+	ReadDeadline          Duration `json:"readDeadline" yaml:"ReadDeadline"`
+	PingPeriod            Duration `json:"pingPeriod" yaml:"PingPeriod"`
+	PingMsg               string   `json:"pingMsg" yaml:"PingMsg"`
+	RoomHistorySize       int      `json:"roomHistorySize" yaml:"RoomHistorySize"`
+	RoomRateLimit         int      `json:"roomRateLimit" yaml:"RoomRateLimit"`
+	RoomInboundLimit      int      `json:"roomInboundLimit" yaml:"RoomInboundLimit"`
+	RoomBroadcastLimit    int      `json:"roomBroadcastLimit" yaml:"RoomBroadcastLimit"`
+	MaxMessageSize        int64    `json:"maxMessageSize" yaml:"MaxMessageSize"`
+	TCPKeepAlive          Duration `json:"tcpKeepAlive" yaml:"TCPKeepAlive"`
+	UpgradeBodyLimit      int64    `json:"upgradeBodyLimit" yaml:"UpgradeBodyLimit"`
+	UpgradeTimeout        Duration `json:"upgradeTimeout" yaml:"UpgradeTimeout"`
+	EnableCompression     bool     `json:"enableCompression" yaml:"EnableCompression"`
+	InjectTimestamp       bool     `json:"injectTimestamp" yaml:"InjectTimestamp"`
+	StrictOrdering        bool     `json:"strictOrdering" yaml:"StrictOrdering"`
+	FlushInterval         Duration `json:"flushInterval" yaml:"FlushInterval"`
+	FlushAfterBytes       int      `json:"flushAfterBytes" yaml:"FlushAfterBytes"`
+}
+
+// Options 将配置转换为等价的配置项，可以与其他WithXxx混合使用
+func (c SocketConfig) Options() []SocketOptionFunc {
+	return []SocketOptionFunc{
+		WithWriteReadBufferSize(c.WriteReadBufferSize),
+		WithSendQueueLength(c.SendQueueLength),
+		WithHeartbeatFailMaxTimes(c.HeartbeatFailMaxTimes),
+		WithWriteDeadline(time.Duration(c.WriteDeadline)),
+		WithReadDeadline(time.Duration(c.ReadDeadline)),
+		WithPingPeriod(time.Duration(c.PingPeriod)),
+		WithPingMsg(c.PingMsg),
+		WithRoomHistory(c.RoomHistorySize),
+		WithRoomRateLimit(c.RoomRateLimit),
+		WithRoomLimits(RoomLimits{InboundPerSecond: c.RoomInboundLimit, BroadcastsPerSecond: c.RoomBroadcastLimit}),
+		WithMaxMessageSize(c.MaxMessageSize),
+		WithTCPKeepAlive(time.Duration(c.TCPKeepAlive)),
+		WithUpgradeBodyLimit(c.UpgradeBodyLimit),
+		WithUpgradeTimeout(time.Duration(c.UpgradeTimeout)),
+		WithEnableCompression(c.EnableCompression),
+		WithInjectTimestamp(c.InjectTimestamp),
+		WithStrictOrdering(c.StrictOrdering),
+		WithFlushInterval(time.Duration(c.FlushInterval)),
+		WithFlushAfterBytes(c.FlushAfterBytes),
+	}
+}
+
+// Validate 使用与NewSocket相同的规则校验配置，handler不属于配置项，不参与校验
+func (c SocketConfig) Validate() error {
+	opt := &SocketOption{}
+	for _, apply := range c.Options() {
+		apply(opt)
+	}
+	opt.handler = noopHandler{}
+	return validateOption(opt)
+}
+
+// NewSocketFromConfig opts在配置之后生效，用于传入handler、logger等无法写在配置文件中的选项
+func NewSocketFromConfig(cfg SocketConfig, opts ...SocketOptionFunc) (SocketClientInterface, error) {
+	return NewSocket(append(cfg.Options(), opts...)...)
+}
+
+type noopHandler struct{}
+
+func (noopHandler) OnMessage(Message) {}
+
+func (noopHandler) OnError(string, error) {}
+
+func (noopHandler) OnClose(string) {}
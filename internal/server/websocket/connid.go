@@ -0,0 +1,73 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// ConnectionIDHeader 升级响应中携带连接标识的响应头
+	ConnectionIDHeader = "X-Connection-Id"
+	// ConnectionIDLabel WithMetricLabels允许该名称时，统计中的标签包含连接标识
+	ConnectionIDLabel = "connection_id"
+)
+
+// WithIDGenerator Connect的subkey为空时由fn生成连接标识，例如加上机房或Pod前缀，默认为ULID。
+// fn返回空字符串或与在线连接重复时握手失败
+func WithIDGenerator(fn func(*gin.Context) string) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.idGenerator = fn
+	}
+}
+
+// ID 与Key相同，客户端从X-Connection-Id响应头或welcome消息中读取同一个值
+func (s *SocketClient) ID() string {
+	return s.key
+}
+
+// generateID 生成的标识为空返回500，与在线连接重复返回409
+func (s *Socket) generateID(ctx *gin.Context) (string, error) {
+	generate := s.opts.idGenerator
+	if generate == nil {
+		generate = func(*gin.Context) string { return NewULID() }
+	}
+	id := generate(ctx)
+	if id == "" {
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return "", newError("", "upgrade", fmt.Errorf("%w: id generator returned an empty id", ErrUpgradeFailed))
+	}
+	s.mu.RLock()
+	_, exists := s.clients[id]
+	s.mu.RUnlock()
+	if exists {
+		ctx.AbortWithStatus(http.StatusConflict)
+		return "", newError(id, "upgrade", fmt.Errorf("%w: connection id already in use", ErrDuplicateSession))
+	}
+	return id, nil
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewULID 26个字符的ULID：前10个字符为毫秒时间戳，按字典序排序即按生成时间排序，后16个字符随机
+func NewULID() string {
+	var raw [16]byte
+	ms := uint64(time.Now().UnixMilli())
+	binary.BigEndian.PutUint16(raw[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(raw[2:6], uint32(ms))
+	_, _ = rand.Read(raw[6:])
+	var out [26]byte
+	// 128位按5位一组编码，最高的两位补零
+	hi := binary.BigEndian.Uint64(raw[0:8])
+	lo := binary.BigEndian.Uint64(raw[8:16])
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
@@ -0,0 +1,6 @@
+//go:build !unix
+
+package server
+
+// newProcessCPUSampler 当前平台不支持默认采样，需要通过WithCPUSampler提供
+var newProcessCPUSampler func() func() (float64, error)
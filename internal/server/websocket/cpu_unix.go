@@ -0,0 +1,34 @@
+//go:build unix
+
+package server
+
+import (
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// newProcessCPUSampler 按getrusage统计的进程用户态与内核态CPU时间计算两次采样之间的使用率，
+// 除以GOMAXPROCS得到占全部可用CPU的比例
+var newProcessCPUSampler = func() func() (float64, error) {
+	var (
+		lastCPU  time.Duration
+		lastWall time.Time
+	)
+	return func() (float64, error) {
+		var usage syscall.Rusage
+		if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+			return 0, err
+		}
+		cpu := time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+		now := time.Now()
+		var load float64
+		if !lastWall.IsZero() {
+			if wall := now.Sub(lastWall); wall > 0 {
+				load = float64(cpu-lastCPU) / float64(wall) / float64(runtime.GOMAXPROCS(0))
+			}
+		}
+		lastCPU, lastWall = cpu, now
+		return min(max(load, 0), 1), nil
+	}
+}
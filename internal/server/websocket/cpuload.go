@@ -0,0 +1,96 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"skeleton/internal/server/websocket/wirepb"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+// cpuResumeRatio CPU使用率降到阈值的该比例以下时恢复，避免在阈值附近反复暂停
+const cpuResumeRatio = 0.8
+
+// flowControlNotice 未开启protobuf编码时的流控通知，开启时发送带FlowControl的Envelope
+type flowControlNotice struct {
+	Type   string `json:"type"`
+	Paused bool   `json:"paused"`
+	Reason string `json:"reason"`
+}
+
+// WithCPULoadMonitor 每隔interval采样一次进程的CPU使用率(占全部可用CPU的比例，取值[0, 1])，
+// 超过threshold时向所有连接广播暂停通知{"type":"flow_control","paused":true,"reason":"cpu"}，
+// 降到threshold*0.8以下时广播paused为false的恢复通知；开启WithProtobufEncoding时改为发送Envelope.flow_control。
+// 暂停期间新建立的连接在welcome之后立即收到暂停通知。服务端不会因此拒绝消息，是否放缓由客户端决定
+func WithCPULoadMonitor(threshold float64, interval time.Duration) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.cpuThreshold = threshold
+		opt.cpuInterval = interval
+	}
+}
+
+// WithCPUSampler 替换默认的CPU采样方式，例如按容器的cgroup配额计算，返回值为[0, 1]的使用率
+func WithCPUSampler(fn func() (float64, error)) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.cpuSampler = fn
+	}
+}
+
+type cpuMonitor struct {
+	mu     sync.Mutex
+	load   float64
+	paused atomic.Bool
+}
+
+// CPULoad 最近一次采样的CPU使用率以及当前是否处于暂停状态，未配置WithCPULoadMonitor时为0和false
+func (s *Socket) CPULoad() (load float64, paused bool) {
+	s.cpu.mu.Lock()
+	defer s.cpu.mu.Unlock()
+	return s.cpu.load, s.cpu.paused.Load()
+}
+
+func (s *Socket) monitorCPU() {
+	defer s.recoverPanic("")
+	sample := s.opts.cpuSampler
+	if sample == nil {
+		sample = newProcessCPUSampler()
+	}
+	ticker := time.NewTicker(s.opts.cpuInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		load, err := sample()
+		if err != nil {
+			s.logWarning("", "cpu", err)
+			continue
+		}
+		s.cpu.mu.Lock()
+		s.cpu.load = load
+		s.cpu.mu.Unlock()
+		switch {
+		case load > s.opts.cpuThreshold && s.cpu.paused.CompareAndSwap(false, true):
+			s.broadcastFlowControl(true)
+		case load < s.opts.cpuThreshold*cpuResumeRatio && s.cpu.paused.CompareAndSwap(true, false):
+			s.broadcastFlowControl(false)
+		}
+	}
+}
+
+func (s *Socket) broadcastFlowControl(paused bool) {
+	for _, key := range s.GetAllKeys() {
+		s.sendFlowControl(key, paused)
+	}
+}
+
+func (s *Socket) sendFlowControl(key string, paused bool) {
+	if !s.opts.protobufEncoding {
+		s.sendNotice(key, flowControlNotice{Type: "flow_control", Paused: paused, Reason: "cpu"})
+		return
+	}
+	envelope := &wirepb.Envelope{Type: "flow_control", Control: &wirepb.Envelope_FlowControl{FlowControl: &wirepb.FlowControl{Paused: paused}}}
+	if data, err := proto.Marshal(envelope); err == nil {
+		_ = s.SendTo(key, websocket.BinaryMessage, data)
+	}
+}
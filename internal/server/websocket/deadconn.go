@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// tcpEstablished Linux tcp_info.tcpi_state中ESTABLISHED的取值
+const tcpEstablished = 1
+
+// WithDeadConnectionDetector 每隔interval通过TCP_INFO检查所有在线连接的TCP状态，不是ESTABLISHED时
+// (例如对端已断开、内核已放弃重传)回调OnError(ErrDeadConnection)并关闭连接，比等待读写截止时间更快发现死连接。
+// 只支持Linux，其他平台NewSocket返回错误；底层不是*net.TCPConn的连接(例如自定义传输层)不检查
+func WithDeadConnectionDetector(interval time.Duration) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.deadConnInterval = interval
+	}
+}
+
+func (s *Socket) detectDeadConnections() {
+	defer s.recoverPanic("")
+	ticker := time.NewTicker(s.opts.deadConnInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.RLock()
+		clients := make([]*SocketClient, 0, len(s.clients))
+		for _, client := range s.clients {
+			if client.State() == OnlineState {
+				clients = append(clients, client)
+			}
+		}
+		s.mu.RUnlock()
+		for _, client := range clients {
+			client.checkTCPState()
+		}
+	}
+}
+
+func (s *SocketClient) checkTCPState() {
+	tcpConn, ok := s.conn.UnderlyingConn().(*net.TCPConn)
+	if !ok {
+		return
+	}
+	state, err := tcpState(tcpConn)
+	if err != nil {
+		// 连接已被关闭时同样取不到文件描述符，交给读写循环处理
+		s.socket.logWarning(s.key, "tcp_info", err)
+		return
+	}
+	if state == tcpEstablished {
+		return
+	}
+	s.reportError(newError(s.key, "tcp_info", fmt.Errorf("%w: tcp state %d", ErrDeadConnection, state)))
+	s.close()
+}
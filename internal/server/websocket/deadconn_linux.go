@@ -0,0 +1,33 @@
+//go:build linux
+
+package server
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// tcpState 通过getsockopt(TCP_INFO)读取tcpi_state
+var tcpState = func(conn *net.TCPConn) (uint8, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		info    syscall.TCPInfo
+		sockErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		size := uint32(syscall.SizeofTCPInfo)
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			sockErr = errno
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return info.State, sockErr
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package server
+
+import "net"
+
+// tcpState 当前平台不支持TCP_INFO，WithDeadConnectionDetector在NewSocket时被拒绝
+var tcpState func(conn *net.TCPConn) (uint8, error)
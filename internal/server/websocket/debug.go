@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	httppprof "net/http/pprof"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultDebugPrefix RegisterPProfHandlers的prefix为空时使用的路由前缀
+const DefaultDebugPrefix = "/debug/ws"
+
+// GoroutineProfile 按run和WithHeartbeatGoroutineLabel设置的pprof标签统计的goroutine数
+type GoroutineProfile struct {
+	Total int `json:"total"`
+	// Connections 带ws_conn标签的goroutine数，每个在线连接有读写两个
+	Connections int `json:"connections"`
+	// Heartbeat 按ws_heartbeat标签的取值统计
+	Heartbeat map[string]int `json:"heartbeat,omitempty"`
+	// PerConnection goroutine数最多的连接，用于发现泄漏
+	PerConnection []ConnectionGoroutines `json:"per_connection,omitempty"`
+}
+
+type ConnectionGoroutines struct {
+	Key        string `json:"key"`
+	Goroutines int    `json:"goroutines"`
+}
+
+// ConnectionProfile /connections中每个在线连接的状态
+type ConnectionProfile struct {
+	Key        string      `json:"key"`
+	State      ClientState `json:"state"`
+	QueueLen   int         `json:"queue_len"`
+	QueueCap   int         `json:"queue_cap"`
+	QueueBytes int64       `json:"queue_bytes"`
+	Degraded   bool        `json:"degraded,omitempty"`
+	Stats      SocketStats `json:"stats"`
+}
+
+// DebugStats /stats的响应体
+type DebugStats struct {
+	Hub        HubStats `json:"hub"`
+	Goroutines int      `json:"goroutines"`
+	HeapInuse  uint64   `json:"heap_inuse"`
+	NumGC      uint32   `json:"num_gc"`
+}
+
+// RegisterPProfHandlers 注册websocket相关的诊断接口，prefix为空时为/debug/ws：
+// GET prefix/goroutines 按连接和心跳标签统计goroutine，带debug=1或2时返回net/http/pprof的goroutine分析原文；
+// GET prefix/connections 在线连接的Stats和发送队列占用，按队列占用从高到低排列，limit限制返回数量；
+// GET prefix/stats HubStats以及进程的goroutine数和堆内存。
+// 接口会暴露连接标识和标签，应只挂在内网或加上鉴权中间件的路由上
+func (s *Socket) RegisterPProfHandlers(router *gin.Engine, prefix string) {
+	if prefix == "" {
+		prefix = DefaultDebugPrefix
+	}
+	group := router.Group(strings.TrimSuffix(prefix, "/"))
+	group.GET("/goroutines", s.goroutinesHandler)
+	group.GET("/connections", s.connectionsHandler)
+	group.GET("/stats", s.debugStatsHandler)
+}
+
+func (s *Socket) goroutinesHandler(ctx *gin.Context) {
+	if ctx.Query("debug") != "" {
+		httppprof.Handler("goroutine").ServeHTTP(ctx.Writer, ctx.Request)
+		return
+	}
+	profile, err := goroutineProfile(queryLimit(ctx, 10))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, profile)
+}
+
+func (s *Socket) connectionsHandler(ctx *gin.Context) {
+	s.mu.RLock()
+	profiles := make([]ConnectionProfile, 0, len(s.clients))
+	for _, client := range s.clients {
+		if client.State() != OnlineState {
+			continue
+		}
+		profiles = append(profiles, ConnectionProfile{
+			Key:        client.key,
+			State:      client.State(),
+			QueueLen:   len(client.send),
+			QueueCap:   cap(client.send),
+			QueueBytes: client.queuedBytes.Load(),
+			Degraded:   client.degraded,
+			Stats:      client.Stats(),
+		})
+	}
+	s.mu.RUnlock()
+	sort.Slice(profiles, func(i, j int) bool {
+		if profiles[i].QueueLen != profiles[j].QueueLen {
+			return profiles[i].QueueLen > profiles[j].QueueLen
+		}
+		return profiles[i].Key < profiles[j].Key
+	})
+	if limit := queryLimit(ctx, 0); limit > 0 && len(profiles) > limit {
+		profiles = profiles[:limit]
+	}
+	ctx.JSON(http.StatusOK, profiles)
+}
+
+func (s *Socket) debugStatsHandler(ctx *gin.Context) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	ctx.JSON(http.StatusOK, DebugStats{
+		Hub:        s.HubStats(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapInuse:  mem.HeapInuse,
+		NumGC:      mem.NumGC,
+	})
+}
+
+func queryLimit(ctx *gin.Context, def int) int {
+	if n, err := strconv.Atoi(ctx.Query("limit")); err == nil && n >= 0 {
+		return n
+	}
+	return def
+}
+
+// goroutineProfile 解析debug=1格式的goroutine分析，每条记录以"数量 @ 地址"开头，带标签时下一行为"# labels: {...}"
+func goroutineProfile(top int) (GoroutineProfile, error) {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return GoroutineProfile{}, err
+	}
+	profile := GoroutineProfile{Total: runtime.NumGoroutine()}
+	perConn := make(map[string]int)
+	count := 0
+	scanner := bufio.NewScanner(&buf)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if n, _, ok := strings.Cut(line, " @ "); ok {
+			count, _ = strconv.Atoi(n)
+			continue
+		}
+		raw, ok := strings.CutPrefix(line, "# labels: ")
+		if !ok {
+			continue
+		}
+		var labels map[string]string
+		if json.Unmarshal([]byte(raw), &labels) != nil {
+			continue
+		}
+		if key, ok := labels["ws_conn"]; ok {
+			profile.Connections += count
+			perConn[key] += count
+		}
+		if label, ok := labels["ws_heartbeat"]; ok {
+			if profile.Heartbeat == nil {
+				profile.Heartbeat = make(map[string]int)
+			}
+			profile.Heartbeat[label] += count
+		}
+	}
+	for key, n := range perConn {
+		profile.PerConnection = append(profile.PerConnection, ConnectionGoroutines{Key: key, Goroutines: n})
+	}
+	sort.Slice(profile.PerConnection, func(i, j int) bool {
+		a, b := profile.PerConnection[i], profile.PerConnection[j]
+		if a.Goroutines != b.Goroutines {
+			return a.Goroutines > b.Goroutines
+		}
+		return a.Key < b.Key
+	})
+	if len(profile.PerConnection) > top {
+		profile.PerConnection = profile.PerConnection[:top]
+	}
+	return profile, scanner.Err()
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SchemaVersionParam 客户端在握手的查询参数或X-Schema-Version请求头中声明支持的消息版本
+const SchemaVersionParam = "schema_version"
+
+type downgradeEncoder struct {
+	version int
+	encode  func(newMsg []byte) ([]byte, error)
+}
+
+// WithSchemaVersion 服务端当前的消息版本，未声明版本的客户端视为当前版本
+func WithSchemaVersion(current int) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.schemaVersion = current
+	}
+}
+
+// WithDowngradeEncoder encoder将clientVersion+1版本的消息转换为clientVersion版本。客户端版本低于WithSchemaVersion时，
+// 每条出站消息从当前版本开始逐级经过版本不低于客户端版本的encoder，例如当前版本3、客户端版本1时依次经过2和1的encoder。
+// 在写入转换器之后执行，返回错误时该消息被丢弃并记录日志
+func WithDowngradeEncoder(clientVersion int, encoder func(newMsg []byte) ([]byte, error)) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.downgradeEncoders = append(opt.downgradeEncoders, downgradeEncoder{version: clientVersion, encode: encoder})
+	}
+}
+
+// SchemaVersion 握手时协商的消息版本
+func (s *SocketClient) SchemaVersion() int {
+	return s.schemaVersion
+}
+
+// negotiateSchema 记录客户端版本并选出需要经过的encoder，按版本从高到低排列
+func (s *SocketClient) negotiateSchema(ctx *gin.Context) {
+	opts := s.socket.opts
+	s.schemaVersion = opts.schemaVersion
+	declared := ctx.Query(SchemaVersionParam)
+	if declared == "" {
+		declared = ctx.GetHeader("X-Schema-Version")
+	}
+	if version, err := strconv.Atoi(declared); err == nil && version < opts.schemaVersion {
+		s.schemaVersion = version
+	}
+	for _, encoder := range opts.downgradeEncoders {
+		if encoder.version >= s.schemaVersion {
+			s.downgrades = append(s.downgrades, encoder)
+		}
+	}
+	sort.SliceStable(s.downgrades, func(i, j int) bool { return s.downgrades[i].version > s.downgrades[j].version })
+}
+
+func (s *SocketClient) downgrade(data []byte) ([]byte, error) {
+	var err error
+	for _, encoder := range s.downgrades {
+		if data, err = encoder.encode(data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultDrainGracePeriod StartDrain之后预计的下线时间
+const defaultDrainGracePeriod = 30 * time.Second
+
+// WithDrainGracePeriod StartDrain之后预计多久下线，用于draining通知中的shutdown_at和拒绝升级时的Retry-After，默认30秒
+func WithDrainGracePeriod(d time.Duration) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.drainGracePeriod = d
+	}
+}
+
+// DrainState 排空状态，Draining为false时其余字段为零值
+type DrainState struct {
+	Draining   bool      `json:"draining"`
+	Reason     string    `json:"reason,omitempty"`
+	ShutdownAt time.Time `json:"shutdownAt,omitempty"`
+}
+
+// drainNotice 开始排空时推送给所有在线连接
+type drainNotice struct {
+	Type       string    `json:"type"`
+	Reason     string    `json:"reason"`
+	ShutdownAt time.Time `json:"shutdown_at"`
+}
+
+type drainControl struct {
+	mu    sync.RWMutex
+	state DrainState
+}
+
+// StartDrain 进入排空模式：新的升级请求返回503和Retry-After，已有连接照常工作，
+// 并向所有在线连接推送一次{"type":"draining","reason":"...","shutdown_at":"..."}，客户端可提前重连到其他节点。
+// 已处于排空模式时不重复推送；Health报告为不就绪
+func (s *Socket) StartDrain(reason string) {
+	state, started := s.drain.start(reason, s.opts.drainGracePeriod)
+	if !started {
+		return
+	}
+	s.rooms.FlushCoalesced()
+	for _, ns := range s.namespaces {
+		ns.rooms.FlushCoalesced()
+	}
+	for _, key := range s.GetAllKeys() {
+		s.sendNotice(key, drainNotice{Type: "draining", Reason: state.Reason, ShutdownAt: state.ShutdownAt})
+	}
+}
+
+// StopDrain 退出排空模式，重新接受升级
+func (s *Socket) StopDrain() {
+	s.drain.stop()
+}
+
+func (s *Socket) DrainState() DrainState {
+	return s.drain.get()
+}
+
+// start 已处于排空模式时started为false
+func (d *drainControl) start(reason string, grace time.Duration) (state DrainState, started bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state.Draining {
+		return d.state, false
+	}
+	d.state = DrainState{Draining: true, Reason: reason, ShutdownAt: time.Now().Add(grace).Truncate(time.Second)}
+	return d.state, true
+}
+
+func (d *drainControl) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.state = DrainState{}
+}
+
+func (d *drainControl) get() DrainState {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.state
+}
+
+// rejectDraining 排空期间以503结束握手，Retry-After为距预计下线的秒数
+func (s *Socket) rejectDraining(ctx *gin.Context, key string) error {
+	return rejectDrainState(ctx, key, s.DrainState())
+}
+
+func rejectDrainState(ctx *gin.Context, key string, state DrainState) error {
+	if !state.Draining {
+		return nil
+	}
+	retryAfter := int(time.Until(state.ShutdownAt).Seconds())
+	ctx.Header("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+	ctx.AbortWithStatus(http.StatusServiceUnavailable)
+	return newError(key, "upgrade", ErrDraining)
+}
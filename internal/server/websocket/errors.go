@@ -0,0 +1,160 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrConnectionClosed       = errors.New("websocket: connection closed")
+	ErrWriteTimeout           = errors.New("websocket: write timeout")
+	ErrQueueFull              = errors.New("websocket: send queue full")
+	ErrMessageTooLarge        = errors.New("websocket: message too large")
+	ErrUpgradeFailed          = errors.New("websocket: upgrade failed")
+	ErrUpgradeTimeout         = errors.New("websocket: upgrade timeout")
+	ErrInvalidMigrationToken  = errors.New("websocket: invalid migration token")
+	ErrDraining               = errors.New("websocket: server draining")
+	ErrStreamNotFound         = errors.New("websocket: stream not found")
+	ErrChannelExists          = errors.New("websocket: channel already open")
+	ErrRoomNotFound           = errors.New("websocket: room not found")
+	ErrSessionNotFound        = errors.New("websocket: session not found")
+	ErrNotRoomMember          = errors.New("websocket: not a room member")
+	ErrAlreadyClosed          = errors.New("websocket: already closed")
+	ErrInvalidOption          = errors.New("websocket: invalid option")
+	ErrOptionNotAdjustable    = errors.New("websocket: option cannot be changed on a live connection")
+	ErrUnknownMessageType     = errors.New("websocket: unknown message type")
+	ErrPanic                  = errors.New("websocket: panic")
+	ErrInvalidEnvelope        = errors.New("websocket: invalid envelope")
+	ErrDuplicateSession       = errors.New("websocket: duplicate session")
+	ErrRateLimited            = errors.New("websocket: rate limited")
+	ErrUnsupportedContentType = errors.New("websocket: unsupported content type")
+	ErrInvalidPayload         = errors.New("websocket: invalid payload")
+	ErrUnknownCodec           = errors.New("websocket: unknown codec")
+	ErrTooManyPendingAcks     = errors.New("websocket: too many pending acks")
+	ErrMessageTypeNotAllowed  = errors.New("websocket: message type not allowed")
+	ErrOverloaded             = errors.New("websocket: server overloaded")
+	ErrQueueTimeout           = errors.New("websocket: queue wait timeout")
+	ErrUnknownNamespace       = errors.New("websocket: unknown namespace")
+	ErrInvalidTopic           = errors.New("websocket: invalid topic")
+	ErrTooManySubscriptions   = errors.New("websocket: too many topic subscriptions")
+	ErrDeadConnection         = errors.New("websocket: dead connection")
+	ErrNotOpen                = errors.New("websocket: connection not open")
+	ErrAlreadyReading         = errors.New("websocket: read loop already running")
+	ErrClosed                 = errors.New("websocket: connection closing")
+)
+
+// Stage 错误发生的阶段，同样的"i/o timeout"可能来自读、写或心跳，日志和监控按该字段区分
+type Stage string
+
+const (
+	StageRead      Stage = "read"
+	StageWrite     Stage = "write"
+	StageHeartbeat Stage = "heartbeat"
+	StageDispatch  Stage = "dispatch"
+	StageUpgrade   Stage = "upgrade"
+	// StageAPI 调用WriteMessage、Rooms等公开方法时直接返回的错误
+	StageAPI Stage = "api"
+)
+
+// WSError 携带连接标识、操作名与发生阶段的错误，可通过errors.Is匹配上面的哨兵错误
+type WSError struct {
+	ConnID string
+	Op     string
+	Stage  Stage
+	Time   time.Time
+	Err    error
+}
+
+func (e *WSError) Error() string {
+	if e.ConnID == "" {
+		return fmt.Sprintf("%s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("%s %s: %v", e.Op, e.ConnID, e.Err)
+}
+
+func (e *WSError) Unwrap() error {
+	return e.Err
+}
+
+func newError(connID, op string, err error) error {
+	return &WSError{ConnID: connID, Op: op, Stage: stageOf(op), Time: time.Now(), Err: err}
+}
+
+// stageOf 由操作名推断阶段，读写循环之外的操作都属于公开方法的调用
+func stageOf(op string) Stage {
+	switch {
+	case op == "read":
+		return StageRead
+	case op == "write" || op == "stream" || op == "close":
+		return StageWrite
+	case op == "heartbeat" || op == "tcp_info":
+		return StageHeartbeat
+	case op == "dispatch" || op == "ping" || op == "pong" || op == "demultiplex" || strings.HasPrefix(op, "route"):
+		return StageDispatch
+	case op == "upgrade" || op == "keepalive":
+		return StageUpgrade
+	default:
+		return StageAPI
+	}
+}
+
+// ErrorStage 返回err链中WSError的阶段，不是本包产生的错误时返回空字符串
+func ErrorStage(err error) Stage {
+	var wsErr *WSError
+	if errors.As(err, &wsErr) {
+		return wsErr.Stage
+	}
+	return ""
+}
+
+// panicError 将recover得到的值转换为错误，值本身是error时保留在错误链中
+func panicError(r any) error {
+	if e, ok := r.(error); ok {
+		return fmt.Errorf("%w: %w", ErrPanic, e)
+	}
+	return fmt.Errorf("%w: %v", ErrPanic, r)
+}
+
+// wrapError 将底层错误归类到对应的哨兵错误，同时保留原始错误
+func wrapError(sentinel, cause error) error {
+	if cause == nil {
+		return sentinel
+	}
+	return fmt.Errorf("%w: %w", sentinel, cause)
+}
+
+func classifyReadError(err error) error {
+	if errors.Is(err, websocket.ErrReadLimit) {
+		return wrapError(ErrMessageTooLarge, err)
+	}
+	return wrapError(ErrConnectionClosed, err)
+}
+
+// isExpectedClose 对端正常关闭或直接断开属于连接的正常结束，不作为错误回调
+func isExpectedClose(err error) bool {
+	return websocket.IsCloseError(err,
+		websocket.CloseNormalClosure,
+		websocket.CloseGoingAway,
+		websocket.CloseNoStatusReceived,
+		websocket.CloseAbnormalClosure,
+	)
+}
+
+// isCloseError 对端回复的关闭帧，我方已发送关闭帧时无论关闭码是什么都属于正常结束
+func isCloseError(err error) bool {
+	var closeErr *websocket.CloseError
+	return errors.As(err, &closeErr)
+}
+
+func classifyWriteError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return wrapError(ErrWriteTimeout, err)
+	}
+	return wrapError(ErrConnectionClosed, err)
+}
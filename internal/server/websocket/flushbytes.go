@@ -0,0 +1,44 @@
+package server
+
+import "net/http"
+
+// connFlusher 由写循环持有，底层连接带缓冲(实现了http.Flusher或Flush() error)时按WithFlushAfterBytes刷新
+type connFlusher struct {
+	flush     func() error
+	threshold int64
+	// flushedAt 上次刷新时的bytesSent
+	flushedAt int64
+}
+
+// newConnFlusher 底层连接不带缓冲时返回nil，写循环不做任何额外处理
+func newConnFlusher(s *SocketClient) *connFlusher {
+	f := &connFlusher{threshold: int64(s.socket.opts.flushAfterBytes)}
+	switch conn := s.conn.UnderlyingConn().(type) {
+	case http.Flusher:
+		f.flush = func() error {
+			conn.Flush()
+			return nil
+		}
+	case interface{ Flush() error }:
+		f.flush = conn.Flush
+	default:
+		return nil
+	}
+	return f
+}
+
+// after 在写循环写出数据后调用：自上次刷新写出的字节数超过阈值、阈值为0或发送队列已空时刷新，
+// 避免数据停留在缓冲区中等不到下一条消息。force用于ping、close等不计入bytesSent的控制帧
+func (f *connFlusher) after(s *SocketClient, force bool) error {
+	if f == nil {
+		return nil
+	}
+	written := s.bytesSent.Load() - f.flushedAt
+	if !force && (written == 0 || f.threshold > 0 && written <= f.threshold && len(s.send) > 0) {
+		return nil
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	f.flushedAt = s.bytesSent.Load()
+	return f.flush()
+}
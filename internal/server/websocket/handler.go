@@ -0,0 +1,95 @@
+package server
+
+import (
+	"log"
+
+	"go.uber.org/zap"
+)
+
+// OpenHandler 可选接口，handler实现后在连接注册完成、开始读写之前回调
+type OpenHandler interface {
+	OnOpen(client *SocketClient)
+}
+
+// PingHandler 可选接口，收到客户端ping并回复pong之后回调
+type PingHandler interface {
+	OnPing(key string, appData string)
+}
+
+// PongHandler 可选接口，收到pong并刷新读取截止时间之后回调
+type PongHandler interface {
+	OnPong(key string, appData string)
+}
+
+// BaseHandler 所有回调均为空实现，嵌入后只需覆盖关心的方法
+type BaseHandler struct{}
+
+func (BaseHandler) OnMessage(Message) {}
+
+func (BaseHandler) OnError(string, error) {}
+
+func (BaseHandler) OnClose(string) {}
+
+func (BaseHandler) OnOpen(*SocketClient) {}
+
+func (BaseHandler) OnPing(string, string) {}
+
+func (BaseHandler) OnPong(string, string) {}
+
+// HandlerFuncs 以函数字段的方式实现MessageHandler及各个可选接口，nil字段视为空操作，
+// ErrorFunc为nil时使用配置的logger记录错误
+type HandlerFuncs struct {
+	MessageFunc func(message Message)
+	ErrorFunc   func(key string, err error)
+	CloseFunc   func(key string)
+	OpenFunc    func(client *SocketClient)
+	PingFunc    func(key string, appData string)
+	PongFunc    func(key string, appData string)
+	socket      *Socket
+}
+
+func (h *HandlerFuncs) bind(socket *Socket) {
+	h.socket = socket
+}
+
+func (h *HandlerFuncs) OnMessage(message Message) {
+	if h.MessageFunc != nil {
+		h.MessageFunc(message)
+	}
+}
+
+func (h *HandlerFuncs) OnError(key string, err error) {
+	if h.ErrorFunc != nil {
+		h.ErrorFunc(key, err)
+		return
+	}
+	if h.socket != nil && h.socket.opts.logger != nil {
+		h.socket.opts.logger.Error(err.Error(), h.socket.logFields(key, zap.String("stage", string(ErrorStage(err))))...)
+	} else {
+		log.Printf("websocket error: %s, stage: %s, client: %s\n", err, ErrorStage(err), key)
+	}
+}
+
+func (h *HandlerFuncs) OnClose(key string) {
+	if h.CloseFunc != nil {
+		h.CloseFunc(key)
+	}
+}
+
+func (h *HandlerFuncs) OnOpen(client *SocketClient) {
+	if h.OpenFunc != nil {
+		h.OpenFunc(client)
+	}
+}
+
+func (h *HandlerFuncs) OnPing(key string, appData string) {
+	if h.PingFunc != nil {
+		h.PingFunc(key, appData)
+	}
+}
+
+func (h *HandlerFuncs) OnPong(key string, appData string) {
+	if h.PongFunc != nil {
+		h.PongFunc(key, appData)
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HandshakeInfo 升级时对握手请求的快照，只保留请求头、URL等元信息，
+// 不保留请求体和gin.Context，连接建立后可安全读取
+type HandshakeInfo struct {
+	Header      http.Header
+	URL         url.URL
+	Host        string
+	RemoteAddr  string
+	ClientIP    string
+	Subprotocol string
+	Compression bool
+	ConnectedAt time.Time
+}
+
+// Query 解析握手URL中的查询参数
+func (h HandshakeInfo) Query() url.Values {
+	return h.URL.Query()
+}
+
+// ConnInfo 连接的基本信息，在gin handler中记录日志、路由时无需断言到具体类型
+type ConnInfo struct {
+	ID          string
+	ClientIP    string
+	ConnectedAt time.Time
+	Subprotocol string
+	Labels      map[string]string
+}
+
+func newHandshakeInfo(r *http.Request, clientIP, subprotocol string, compression bool) HandshakeInfo {
+	info := HandshakeInfo{
+		Header:      r.Header.Clone(),
+		URL:         *r.URL,
+		Host:        r.Host,
+		RemoteAddr:  r.RemoteAddr,
+		ClientIP:    clientIP,
+		Subprotocol: subprotocol,
+		Compression: compression,
+		ConnectedAt: time.Now(),
+	}
+	if r.URL.User != nil {
+		user := *r.URL.User
+		info.URL.User = &user
+	}
+	return info
+}
+
+func (h HandshakeInfo) clone() HandshakeInfo {
+	h.Header = h.Header.Clone()
+	return h
+}
+
+// offersCompression 客户端在握手中是否请求了permessage-deflate扩展
+func offersCompression(r *http.Request) bool {
+	for _, ext := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, part := range strings.Split(ext, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
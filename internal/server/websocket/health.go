@@ -0,0 +1,136 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HealthThresholds 判定不就绪的阈值，零值表示不检查该项
+type HealthThresholds struct {
+	// MaxConnections 连接数达到该值时不再就绪，让负载均衡把新用户调度到其他实例
+	MaxConnections int
+	// MaxQueuePressure 发送队列占用比例的P99超过该值时不就绪，取值(0, 1]
+	MaxQueuePressure float64
+	// MaxEventBacklog 事件转发缓冲区占用比例超过该值时不就绪，取值(0, 1]
+	MaxEventBacklog float64
+}
+
+// WithHealthThresholds 设置Health和ReadyHandler判定不就绪的阈值，不设置时只检查消息总线的连通性
+func WithHealthThresholds(thresholds HealthThresholds) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.healthThresholds = thresholds
+	}
+}
+
+// BackplaneChecker WithPubSub配置的消息总线实现该接口时，Health调用Ping检查连通性
+type BackplaneChecker interface {
+	Ping() error
+}
+
+// QueuePressure 所有连接发送队列占用比例(队列长度/容量)的分布
+type QueuePressure struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// BackplaneHealth 只在配置了WithPubSub时出现在HealthReport中
+type BackplaneHealth struct {
+	Connected bool   `json:"connected"`
+	Error     string `json:"error,omitempty"`
+}
+
+// HealthReport Reasons列出所有不满足的条件，Ready为false时不为空
+type HealthReport struct {
+	Ready          bool             `json:"ready"`
+	Reasons        []string         `json:"reasons,omitempty"`
+	Connections    int              `json:"connections"`
+	MaxConnections int              `json:"maxConnections,omitempty"`
+	QueuePressure  QueuePressure    `json:"queuePressure"`
+	EventBacklog   float64          `json:"eventBacklog"`
+	Backplane      *BackplaneHealth `json:"backplane,omitempty"`
+	Drain          DrainState       `json:"drain"`
+}
+
+// Health 汇总连接数、发送队列压力、事件转发积压和消息总线状态，按WithHealthThresholds判定是否就绪
+func (s *Socket) Health() HealthReport {
+	thresholds := s.opts.healthThresholds
+	report := HealthReport{MaxConnections: thresholds.MaxConnections}
+	var pressures []float64
+	s.mu.RLock()
+	for _, client := range s.clients {
+		if client.State() != OnlineState {
+			continue
+		}
+		report.Connections++
+		if c := cap(client.send); c > 0 {
+			pressures = append(pressures, float64(len(client.send))/float64(c))
+		}
+	}
+	s.mu.RUnlock()
+	report.QueuePressure = queuePressure(pressures)
+	if s.events != nil {
+		report.EventBacklog = float64(len(s.events.queue)) / float64(cap(s.events.queue))
+	}
+	if s.opts.pubSub != nil {
+		report.Backplane = s.rooms.backplaneHealth()
+	}
+
+	if thresholds.MaxConnections > 0 && report.Connections >= thresholds.MaxConnections {
+		report.Reasons = append(report.Reasons, fmt.Sprintf("connections %d reached the cap of %d", report.Connections, thresholds.MaxConnections))
+	}
+	if thresholds.MaxQueuePressure > 0 && report.QueuePressure.P99 > thresholds.MaxQueuePressure {
+		report.Reasons = append(report.Reasons, fmt.Sprintf("send queue pressure p99 %.2f exceeds %.2f", report.QueuePressure.P99, thresholds.MaxQueuePressure))
+	}
+	if thresholds.MaxEventBacklog > 0 && report.EventBacklog > thresholds.MaxEventBacklog {
+		report.Reasons = append(report.Reasons, fmt.Sprintf("event sink backlog %.2f exceeds %.2f", report.EventBacklog, thresholds.MaxEventBacklog))
+	}
+	if report.Backplane != nil && !report.Backplane.Connected {
+		report.Reasons = append(report.Reasons, "pubsub backplane disconnected")
+	}
+	if report.Drain = s.DrainState(); report.Drain.Draining {
+		report.Reasons = append(report.Reasons, "draining: "+report.Drain.Reason)
+	}
+	report.Ready = len(report.Reasons) == 0
+	return report
+}
+
+// ReadyHandler 供Kubernetes readiness探针使用，就绪时返回200，否则返回503，响应体为HealthReport
+func (s *Socket) ReadyHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		report := s.Health()
+		status := http.StatusOK
+		if !report.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		ctx.JSON(status, report)
+	}
+}
+
+func queuePressure(ratios []float64) QueuePressure {
+	if len(ratios) == 0 {
+		return QueuePressure{}
+	}
+	sort.Float64s(ratios)
+	at := func(p float64) float64 {
+		return ratios[int(p*float64(len(ratios)-1))]
+	}
+	return QueuePressure{P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: ratios[len(ratios)-1]}
+}
+
+// backplaneHealth 订阅通道被关闭视为断开；消息总线实现了BackplaneChecker时再检查Ping
+func (m *RoomManager) backplaneHealth() *BackplaneHealth {
+	if m.unsubscribed.Load() {
+		return &BackplaneHealth{Error: "subscription closed"}
+	}
+	if checker, ok := m.socket.opts.pubSub.(BackplaneChecker); ok {
+		if err := checker.Ping(); err != nil {
+			return &BackplaneHealth{Error: err.Error()}
+		}
+	}
+	return &BackplaneHealth{Connected: true}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// GoroutinePool 执行心跳发送的协程池，与ants等协程池的Submit签名一致，池已满时返回错误
+type GoroutinePool interface {
+	Submit(task func()) error
+}
+
+// WithHeartbeatGoroutineLabel 心跳由写循环发送，没有单独的goroutine；设置后写循环带有pprof标签ws_heartbeat=label，
+// 在goroutine分析(如/debug/pprof/goroutine?debug=1)中可按该标签统计心跳占用的goroutine和栈内存。
+// 心跳中再创建的goroutine会继承该标签，也可用pprof.SetGoroutineLabels(ctx)把标签传给其他goroutine
+func WithHeartbeatGoroutineLabel(label string) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.heartbeatLabel = label
+	}
+}
+
+// WithHeartbeatExecutor ping帧交给pool发送，网络较慢时不占用写循环，也不为每次心跳新建goroutine；
+// 上一次ping尚未发出时跳过本次心跳，Submit返回错误时退回到写循环中发送
+func WithHeartbeatExecutor(pool GoroutinePool) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.heartbeatExecutor = pool
+	}
+}
+
+// heartbeat 返回false时写循环退出
+func (s *SocketClient) heartbeat() bool {
+	pool := s.socket.opts.heartbeatExecutor
+	if pool == nil {
+		return s.sendPing()
+	}
+	if !s.pingInFlight.CompareAndSwap(false, true) {
+		return true
+	}
+	err := pool.Submit(func() {
+		defer s.pingInFlight.Store(false)
+		if !s.sendPing() {
+			s.close()
+		}
+	})
+	if err != nil {
+		s.pingInFlight.Store(false)
+		return s.sendPing()
+	}
+	return true
+}
+
+// sendPing 连续失败达到heartbeatFailMaxTimes时报告错误并返回false
+func (s *SocketClient) sendPing() bool {
+	deadline := time.Now().Add(s.options().writeDeadline)
+	if err := s.conn.WriteControl(websocket.PingMessage, []byte(s.options().pingMsg), deadline); err != nil {
+		if int(s.heartbeatFailures.Add(1)) >= s.options().heartbeatFailMaxTimes {
+			s.reportError(newError(s.key, "heartbeat", classifyWriteError(err)))
+			return false
+		}
+		return true
+	}
+	s.heartbeatFailures.Store(0)
+	return true
+}
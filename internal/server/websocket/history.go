@@ -0,0 +1,260 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// StoredMessage 历史存储中的一条房间广播，Seq由HistoryStore在Append时分配，同一房间内递增
+type StoredMessage struct {
+	Seq         uint64
+	Room        string
+	MessageType int
+	Data        []byte
+	CreatedAt   time.Time
+}
+
+// HistoryStore 房间历史消息存储，可基于Redis等实现跨节点共享
+type HistoryStore interface {
+	// Append 追加一条消息并返回分配的Seq，超出保留上限时由实现决定淘汰策略
+	Append(room string, msg StoredMessage) (uint64, error)
+	// List 按Seq升序返回Seq小于beforeSeq的最近limit条消息，beforeSeq为0时从最新的消息开始
+	List(room string, limit int, beforeSeq uint64) ([]StoredMessage, error)
+	// Clear 删除房间的所有历史消息
+	Clear(room string) error
+}
+
+// HistoryConfig Store必须设置。Enabled为false时只记录通过RoomManager.SetHistoryEnabled开启的房间；
+// Redact在写入存储之前处理消息内容，返回nil时该消息不写入
+type HistoryConfig struct {
+	Store   HistoryStore
+	Enabled bool
+	Redact  func(room string, messageType int, data []byte) []byte
+}
+
+// WithMessageHistory 房间广播写入store，可通过RoomManager.History或room.history消息分页读取。
+// 与WithRoomHistory互相独立，后者只在加入房间时补发最近的消息。配置了WithPubSub时每个节点各自写入收到的广播
+func WithMessageHistory(cfg HistoryConfig) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.history = &cfg
+	}
+}
+
+// HistoryRetention 每个房间保留的历史消息上限，两项都必须设置
+type HistoryRetention struct {
+	MaxMessages int
+	MaxAge      time.Duration
+}
+
+// MemoryHistoryStore 进程内的历史消息存储，每个房间一个固定容量的环形缓冲区，超过MaxAge的消息不再返回
+type MemoryHistoryStore struct {
+	retention HistoryRetention
+	mu        sync.Mutex
+	rooms     map[string]*historyRing
+}
+
+type historyRing struct {
+	buf   []StoredMessage
+	start int
+	size  int
+	seq   uint64
+}
+
+func NewMemoryHistoryStore(retention HistoryRetention) (*MemoryHistoryStore, error) {
+	if retention.MaxMessages <= 0 || retention.MaxAge <= 0 {
+		return nil, fmt.Errorf("%w: history retention must be positive, got %+v", ErrInvalidOption, retention)
+	}
+	return &MemoryHistoryStore{
+		retention: retention,
+		rooms:     make(map[string]*historyRing),
+	}, nil
+}
+
+func (h *MemoryHistoryStore) Append(room string, msg StoredMessage) (uint64, error) {
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ring, ok := h.rooms[room]
+	if !ok {
+		ring = &historyRing{buf: make([]StoredMessage, h.retention.MaxMessages)}
+		h.rooms[room] = ring
+	}
+	ring.seq++
+	msg.Seq, msg.Room = ring.seq, room
+	if ring.size < len(ring.buf) {
+		ring.buf[(ring.start+ring.size)%len(ring.buf)] = msg
+		ring.size++
+	} else {
+		ring.buf[ring.start] = msg
+		ring.start = (ring.start + 1) % len(ring.buf)
+	}
+	return msg.Seq, nil
+}
+
+func (h *MemoryHistoryStore) List(room string, limit int, beforeSeq uint64) ([]StoredMessage, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ring, ok := h.rooms[room]
+	if !ok || limit <= 0 {
+		return []StoredMessage{}, nil
+	}
+	expired := time.Now().Add(-h.retention.MaxAge)
+	messages := []StoredMessage{}
+	for i := ring.size - 1; i >= 0 && len(messages) < limit; i-- {
+		msg := ring.buf[(ring.start+i)%len(ring.buf)]
+		if msg.CreatedAt.Before(expired) {
+			break
+		}
+		if beforeSeq == 0 || msg.Seq < beforeSeq {
+			messages = append(messages, msg)
+		}
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+func (h *MemoryHistoryStore) Clear(room string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.rooms, room)
+	return nil
+}
+
+// SetHistoryEnabled 单独开启或关闭房间的历史记录，覆盖HistoryConfig.Enabled，关闭时不删除已有的消息
+func (m *RoomManager) SetHistoryEnabled(name string, enabled bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.historyEnabled[name] = enabled
+}
+
+func (m *RoomManager) historyOn(name string) bool {
+	cfg := m.socket.opts.history
+	if cfg == nil {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if enabled, ok := m.historyEnabled[name]; ok {
+		return enabled
+	}
+	return cfg.Enabled
+}
+
+// History 分页读取房间的历史消息，按Seq升序返回beforeSeq之前最近的limit条，beforeSeq为0时从最新的消息开始
+func (m *RoomManager) History(name string, limit int, beforeSeq uint64) ([]StoredMessage, error) {
+	cfg := m.socket.opts.history
+	if cfg == nil {
+		return []StoredMessage{}, nil
+	}
+	messages, err := cfg.Store.List(m.storeKey(name), limit, beforeSeq)
+	if err != nil {
+		return nil, newError("", "history", err)
+	}
+	return messages, nil
+}
+
+// recordHistory 在投递广播时调用，存储失败只记录日志，不影响投递
+func (m *RoomManager) recordHistory(room *Room, msg RoomMessage) {
+	if !m.historyOn(room.name) {
+		return
+	}
+	cfg := m.socket.opts.history
+	data := msg.Data
+	if cfg.Redact != nil {
+		if data = cfg.Redact(room.name, msg.MessageType, data); data == nil {
+			return
+		}
+	}
+	if _, err := cfg.Store.Append(m.storeKey(room.name), StoredMessage{MessageType: msg.MessageType, Data: data, CreatedAt: msg.CreatedAt}); err != nil {
+		if logger := m.socket.opts.logger; logger != nil {
+			logger.Warn(newError("", "history", err).Error(), zap.String("room", room.name))
+		}
+	}
+}
+
+// RoomHistoryAction 房间成员通过该消息类型请求历史消息，由MessageRouter.HandleRoomHistory注册
+const RoomHistoryAction = "room.history"
+
+// maxHistoryPage room.history单次返回的最大条数
+const maxHistoryPage = 100
+
+// RoomHistoryRequest room.history的请求数据，limit为0或超过100时按100处理
+type RoomHistoryRequest struct {
+	Room      string `json:"room"`
+	Limit     int    `json:"limit"`
+	BeforeSeq uint64 `json:"before_seq"`
+}
+
+// RoomHistoryEntry 文本消息放在text中，二进制消息放在binary中
+type RoomHistoryEntry struct {
+	Seq       uint64    `json:"seq"`
+	Text      string    `json:"text,omitempty"`
+	Binary    []byte    `json:"binary,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RoomHistoryReply 按请求连接协商的编码发送，type为room.history
+type RoomHistoryReply struct {
+	Type string `json:"type"`
+	Data struct {
+		Room     string             `json:"room"`
+		Messages []RoomHistoryEntry `json:"messages"`
+	} `json:"data"`
+}
+
+// HandleRoomHistory 注册room.history消息的处理，只有房间成员可以读取
+func (r *MessageRouter) HandleRoomHistory() {
+	r.Emits(RoomHistoryAction, RoomHistoryReply{})
+	Handle(r, RoomHistoryAction, func(key string, req RoomHistoryRequest) error {
+		if r.socket == nil {
+			return ErrSessionNotFound
+		}
+		rooms := r.socket.rooms
+		room, ok := rooms.Room(req.Room)
+		if !ok {
+			return ErrRoomNotFound
+		}
+		room.mu.RLock()
+		_, member := room.members[key]
+		room.mu.RUnlock()
+		if !member {
+			return ErrNotRoomMember
+		}
+		if req.Limit <= 0 || req.Limit > maxHistoryPage {
+			req.Limit = maxHistoryPage
+		}
+		messages, err := rooms.History(req.Room, req.Limit, req.BeforeSeq)
+		if err != nil {
+			return err
+		}
+		reply := RoomHistoryReply{Type: RoomHistoryAction}
+		reply.Data.Room = req.Room
+		reply.Data.Messages = make([]RoomHistoryEntry, 0, len(messages))
+		for _, msg := range messages {
+			entry := RoomHistoryEntry{Seq: msg.Seq, CreatedAt: msg.CreatedAt}
+			if msg.MessageType == websocket.BinaryMessage {
+				entry.Binary = msg.Data
+			} else {
+				entry.Text = string(msg.Data)
+			}
+			reply.Data.Messages = append(reply.Data.Messages, entry)
+		}
+		return r.socket.SendJSON(key, reply)
+	})
+}
+
+// storeKey 租户的房间在HistoryStore中以"租户/房间"存储，避免不同租户的同名房间混在一起
+func (m *RoomManager) storeKey(name string) string {
+	if m.namespace == "" {
+		return name
+	}
+	return m.namespace + "/" + name
+}
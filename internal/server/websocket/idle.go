@@ -0,0 +1,84 @@
+package server
+
+import "time"
+
+// defaultIdleGracePeriod 发出空闲提醒到关闭连接之间的时间
+const defaultIdleGracePeriod = 30 * time.Second
+
+// idleNotice 空闲超时前的提醒，CloseInMs毫秒内双方都没有数据帧时以4408关闭
+type idleNotice struct {
+	Type      string `json:"type"`
+	CloseInMs int64  `json:"close_in_ms"`
+}
+
+// WithIdleTimeout 双方超过d没有数据帧(ping/pong等控制帧不算)时发送{"type":"idle","close_in_ms":...}提醒，
+// 再经过WithIdleGracePeriod仍没有数据帧时以4408(CloseIdleTimeout)关闭，用于回收浏览器仍在响应心跳但应用已不再使用的连接。
+// 活动按SocketStats的BytesSent、BytesReceived是否变化判断，检测间隔为d的四分之一。
+// 不大于0时不检测；可通过UpdateOption按连接调整，例如客户端切到后台时缩短，传入负数表示该连接不再检测
+func WithIdleTimeout(d time.Duration) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.idleTimeout = d
+	}
+}
+
+// WithIdleGracePeriod 空闲提醒之后到关闭连接的时间，默认30s
+func WithIdleGracePeriod(d time.Duration) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.idleGracePeriod = d
+	}
+}
+
+// idleTracker 由写循环持有，不需要加锁
+type idleTracker struct {
+	ticker   *time.Ticker
+	activity int64
+	since    time.Time
+	warnedAt time.Time
+}
+
+// reset 按当前配置重建检测计时器，返回的通道在未开启检测时为nil
+func (t *idleTracker) reset(s *SocketClient) <-chan time.Time {
+	if t.ticker != nil {
+		t.ticker.Stop()
+		t.ticker = nil
+	}
+	timeout := s.options().idleTimeout
+	if timeout <= 0 {
+		return nil
+	}
+	t.ticker = time.NewTicker(max(timeout/4, 10*time.Millisecond))
+	t.activity, t.since, t.warnedAt = s.activity(), time.Now(), time.Time{}
+	return t.ticker.C
+}
+
+func (t *idleTracker) stop() {
+	if t.ticker != nil {
+		t.ticker.Stop()
+	}
+}
+
+// check 返回false表示连接已因空闲关闭
+func (t *idleTracker) check(s *SocketClient, now time.Time) bool {
+	if activity := s.activity(); activity != t.activity {
+		t.activity, t.since, t.warnedAt = activity, now, time.Time{}
+		return true
+	}
+	grace := s.socket.opts.idleGracePeriod
+	switch {
+	case !t.warnedAt.IsZero() && now.Sub(t.warnedAt) >= grace:
+		_ = s.closeWith(CloseIdleTimeout, "idle timeout")
+		return false
+	case t.warnedAt.IsZero() && now.Sub(t.since) >= s.options().idleTimeout:
+		if messageType, data, err := s.encodeNotice(idleNotice{Type: "idle", CloseInMs: grace.Milliseconds()}); err == nil {
+			_ = s.write(messageType, data)
+		}
+		// 提醒本身不算活动
+		t.activity, t.warnedAt = s.activity(), now
+	}
+	return true
+}
+
+// activity 已收发的数据帧字节数之和，只在变化时视为有活动
+func (s *SocketClient) activity() int64 {
+	return s.bytesSent.Load() + s.bytesReceived.Load()
+}
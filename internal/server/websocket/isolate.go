@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// defaultPanicEscalationCount、defaultPanicEscalationWindow 1分钟内5次panic时关闭连接
+	defaultPanicEscalationCount  = 5
+	defaultPanicEscalationWindow = time.Minute
+)
+
+// PanicError OnMessage(包括中间件和路由处理函数)中panic转换成的错误，errors.Is(err, ErrPanic)成立，
+// panic的值为error时也保留在错误链中
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrPanic, e.Value)
+}
+
+func (e *PanicError) Unwrap() []error {
+	if err, ok := e.Value.(error); ok {
+		return []error{ErrPanic, err}
+	}
+	return []error{ErrPanic}
+}
+
+// WithIsolatePanics 开启后OnMessage中的panic只影响当前消息：回调OnError(阶段为dispatch的*WSError，
+// 可用errors.As取出带调用栈的*PanicError)，向客户端发送{"type":"error","reason":"internal_error"}后继续读取，
+// 不再经过WithContinueOnError判断。短时间内反复panic时按WithPanicEscalation关闭连接
+func WithIsolatePanics(enabled bool) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.isolatePanics = enabled
+	}
+}
+
+// WithPanicEscalation 开启WithIsolatePanics时，window内panic达到n次则以1011关闭连接，避免无限循环崩溃，默认1分钟5次
+func WithPanicEscalation(n int, window time.Duration) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.panicEscalationCount = n
+		opt.panicEscalationWindow = window
+	}
+}
+
+// errorNotice 隔离panic后发给客户端的通知，不包含panic的内容
+type errorNotice struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// isolatePanic 处理隔离模式下的panic，返回false表示已达到升级阈值并关闭了连接
+func (s *SocketClient) isolatePanic(err error) bool {
+	s.reportError(err)
+	now := time.Now()
+	window := s.socket.opts.panicEscalationWindow
+	recent := s.recentPanics[:0]
+	for _, at := range s.recentPanics {
+		if now.Sub(at) < window {
+			recent = append(recent, at)
+		}
+	}
+	s.recentPanics = append(recent, now)
+	if len(s.recentPanics) >= s.socket.opts.panicEscalationCount {
+		_ = s.CloseWithReason(websocket.CloseInternalServerErr, "repeated handler panics", nil)
+		return false
+	}
+	if messageType, data, err := s.encodeNotice(errorNotice{Type: "error", Reason: "internal_error"}); err == nil {
+		_ = s.enqueue(messageType, data)
+	}
+	return true
+}
+
+func isPanic(err error) bool {
+	return errors.Is(err, ErrPanic)
+}
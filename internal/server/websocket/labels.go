@@ -0,0 +1,139 @@
+package server
+
+import (
+	"sort"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	maxLabels           = 8
+	maxLabelKeyLength   = 32
+	maxLabelValueLength = 64
+)
+
+// WithLabelExtractor 升级时从握手请求(请求头、查询参数等)提取连接标签，例如客户端版本、平台、接口等级。
+// 标签在连接建立后不可修改，自动附加到该连接的日志中；最多保留8个(按键名排序)，
+// 键超过32字节的丢弃，值超过64字节的截断
+func WithLabelExtractor(fn func(ctx *gin.Context) map[string]string) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.labelExtractor = fn
+	}
+}
+
+// WithMetricLabels 只有列出的标签会出现在Stats中，避免版本号等高基数的标签进入监控指标
+func WithMetricLabels(keys ...string) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.metricLabels = append(opt.metricLabels, keys...)
+	}
+}
+
+func extractLabels(ctx *gin.Context, fn func(ctx *gin.Context) map[string]string) map[string]string {
+	if fn == nil {
+		return nil
+	}
+	raw := fn(ctx)
+	keys := make([]string, 0, len(raw))
+	for k := range raw {
+		if k != "" && len(k) <= maxLabelKeyLength {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	if len(keys) > maxLabels {
+		keys = keys[:maxLabels]
+	}
+	labels := make(map[string]string, len(keys))
+	for _, k := range keys {
+		labels[k] = truncateLabel(raw[k])
+	}
+	return labels
+}
+
+func truncateLabel(value string) string {
+	limit := maxLabelValueLength
+	if len(value) <= limit {
+		return value
+	}
+	for limit > 0 && !utf8.RuneStart(value[limit]) {
+		limit--
+	}
+	return value[:limit]
+}
+
+// Labels 返回标签的副本，修改返回值不影响连接
+func (s *SocketClient) Labels() map[string]string {
+	return copyLabels(s.labels, nil)
+}
+
+// metricLabels 按WithMetricLabels过滤后的标签，允许ConnectionIDLabel时加上连接标识；属于某个租户时总是带上NamespaceLabel
+func (s *SocketClient) metricLabels() map[string]string {
+	allowed := s.socket.opts.metricLabels
+	if len(allowed) == 0 && s.namespace == nil {
+		return nil
+	}
+	var labels map[string]string
+	if len(allowed) > 0 {
+		labels = copyLabels(s.labels, allowed)
+	}
+	if s.namespace != nil {
+		if labels == nil {
+			labels = make(map[string]string, 1)
+		}
+		labels[NamespaceLabel] = s.namespace.name
+	}
+	for _, name := range allowed {
+		if name == ConnectionIDLabel {
+			if labels == nil {
+				labels = make(map[string]string, 1)
+			}
+			labels[ConnectionIDLabel] = s.key
+		}
+	}
+	return labels
+}
+
+func copyLabels(labels map[string]string, allowed []string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(labels))
+	if allowed == nil {
+		for k, v := range labels {
+			out[k] = v
+		}
+		return out
+	}
+	for _, k := range allowed {
+		if v, ok := labels[k]; ok {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// logFields 该连接日志的公共字段，标签在连接建立后不再修改，可以直接引用
+func (s *SocketClient) logFields(fields ...zap.Field) []zap.Field {
+	fields = append([]zap.Field{zap.String("key", s.key)}, fields...)
+	if len(s.labels) > 0 {
+		fields = append(fields, zap.Any("labels", s.labels))
+	}
+	return fields
+}
+
+// logFields 只有连接标识时查找连接补充标签。remove中的panic可能在持有锁时记录日志，拿不到锁时不带标签
+func (s *Socket) logFields(key string, fields ...zap.Field) []zap.Field {
+	if key != "" && s.mu.TryRLock() {
+		client, ok := s.clients[key]
+		s.mu.RUnlock()
+		if ok {
+			return client.logFields(fields...)
+		}
+	}
+	return append([]zap.Field{zap.String("key", key)}, fields...)
+}
@@ -0,0 +1,114 @@
+package server
+
+// connPhase SocketClient的内部生命周期，只能按created→open→draining→closed单向推进，每一步都是state上的CAS：
+//   - created 尚未完成升级，零值SocketClient也处于该阶段
+//   - open 升级完成，可以收发消息
+//   - draining 已通过SendClose发出关闭帧，等待对端回应；读循环照常运行，不再接受新的发送
+//   - closed 关闭流程已开始，只有进入该阶段的那一次调用执行清理并回调OnClose，Done随之关闭
+//
+// 对外的ClientState中open和draining都是OnlineState，其余为OffLineState
+type connPhase int32
+
+const (
+	phaseCreated connPhase = iota
+	phaseOpen
+	phaseDraining
+	phaseClosed
+)
+
+// readingFlag 与阶段保存在同一个原子变量中，表示读写循环已经启动；两个读循环同时读取会破坏gorilla/websocket的帧解析状态
+const (
+	readingFlag int32 = 1 << 8
+	phaseMask         = readingFlag - 1
+)
+
+func (s *SocketClient) phase() connPhase {
+	return connPhase(s.state.Load() & phaseMask)
+}
+
+// advance 从from推进到to，保留读写循环标记；当前阶段不是from时返回false
+func (s *SocketClient) advance(from, to connPhase) bool {
+	for {
+		old := s.state.Load()
+		if connPhase(old&phaseMask) != from {
+			return false
+		}
+		if s.state.CompareAndSwap(old, old&^phaseMask|int32(to)) {
+			return true
+		}
+	}
+}
+
+// markClosed open或draining进入closed，并发调用时只有一个返回true
+func (s *SocketClient) markClosed() bool {
+	if !s.advance(phaseOpen, phaseClosed) && !s.advance(phaseDraining, phaseClosed) {
+		return false
+	}
+	close(s.done)
+	return true
+}
+
+// startReading 设置读写循环标记，open和draining之外的阶段或已经启动时返回对应的错误
+func (s *SocketClient) startReading() error {
+	for {
+		old := s.state.Load()
+		switch connPhase(old & phaseMask) {
+		case phaseCreated:
+			return newError(s.key, "run", ErrNotOpen)
+		case phaseClosed:
+			return newError(s.key, "run", wrapError(ErrClosed, ErrConnectionClosed))
+		}
+		if old&readingFlag != 0 {
+			return newError(s.key, "run", ErrAlreadyReading)
+		}
+		if s.state.CompareAndSwap(old, old|readingFlag) {
+			return nil
+		}
+	}
+}
+
+// requireOpen 只能在open阶段调用的公开方法入口处检查，立即返回错误而不触碰尚未建立或已经关闭的底层连接。
+// legacy为该方法原来在连接关闭时返回的哨兵错误，与ErrClosed一起包装，errors.Is(err, ErrConnectionClosed)等判断仍然成立
+func (s *SocketClient) requireOpen(op string, legacy error) error {
+	if s.phase() == phaseOpen {
+		return nil
+	}
+	return s.phaseError(op, legacy)
+}
+
+// requireLive 与requireOpen相同，但draining阶段也可以调用
+func (s *SocketClient) requireLive(op string, legacy error) error {
+	if p := s.phase(); p == phaseOpen || p == phaseDraining {
+		return nil
+	}
+	return s.phaseError(op, legacy)
+}
+
+func (s *SocketClient) phaseError(op string, legacy error) error {
+	if s.phase() == phaseCreated {
+		return newError(s.key, op, ErrNotOpen)
+	}
+	return newError(s.key, op, wrapError(ErrClosed, legacy))
+}
+
+// stopReading 读循环退出或不再启动时调用，唤醒ReadPumpChan的订阅者以及等待pong、确认的调用方
+func (s *SocketClient) stopReading(err error) {
+	s.finishReaders(err)
+	s.cancelPings()
+	s.cancelAcks()
+}
+
+// Run 启动读写循环，open和draining阶段可用。Connect注册连接后已经调用，只有NewSocketClient创建的连接需要自行调用；
+// 读写循环已经启动时返回ErrAlreadyReading，升级完成之前返回ErrNotOpen，关闭之后返回ErrClosed，都不会影响已有的读写循环
+func (s *SocketClient) Run() error {
+	if err := s.startReading(); err != nil {
+		return err
+	}
+	s.run()
+	return nil
+}
+
+// Done 连接进入closed阶段时关闭，任意阶段可用；零值SocketClient返回nil
+func (s *SocketClient) Done() <-chan struct{} {
+	return s.done
+}
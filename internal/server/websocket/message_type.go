@@ -0,0 +1,46 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// MessageTypes 默认的消息类型注册表，日志中通过它输出可读的消息类型名称
+var MessageTypes = NewMessageTypeRegistry()
+
+type MessageTypeRegistry struct {
+	mu    sync.RWMutex
+	names map[int]string
+}
+
+// NewMessageTypeRegistry 创建注册表并预先注册websocket标准消息类型
+func NewMessageTypeRegistry() *MessageTypeRegistry {
+	return &MessageTypeRegistry{
+		names: map[int]string{
+			websocket.TextMessage:   "TextMessage",
+			websocket.BinaryMessage: "BinaryMessage",
+			websocket.CloseMessage:  "CloseMessage",
+			websocket.PingMessage:   "PingMessage",
+			websocket.PongMessage:   "PongMessage",
+		},
+	}
+}
+
+// Register 注册自定义的应用层消息类型，例如Register(100, "ai_response")
+func (r *MessageTypeRegistry) Register(mt int, name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names[mt] = name
+}
+
+// Name 返回消息类型名称，未注册的类型返回MessageType(n)
+func (r *MessageTypeRegistry) Name(mt int) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if name, ok := r.names[mt]; ok {
+		return name
+	}
+	return fmt.Sprintf("MessageType(%d)", mt)
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// MigrationTokenParam 客户端重连时携带迁移令牌的查询参数，也可以放在X-Migration-Token请求头中
+const MigrationTokenParam = "migration_token"
+
+// MigrationState 迁移令牌中记录的连接状态。Rooms为房间到签发时历史存储中最新Seq的映射，
+// 新节点从该Seq之后补发，没有配置WithMessageHistory时为0
+type MigrationState struct {
+	Key       string            `json:"key"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Rooms     map[string]uint64 `json:"rooms,omitempty"`
+	Nonce     string            `json:"nonce"`
+	ExpiresAt time.Time         `json:"exp"`
+	KeyID     string            `json:"kid"`
+}
+
+// MigrationIssuer 排空节点签发迁移令牌
+type MigrationIssuer interface {
+	Sign(state MigrationState) (string, error)
+}
+
+// MigrationValidator 新节点校验迁移令牌，同一令牌只能成功校验一次
+type MigrationValidator interface {
+	Verify(token string) (MigrationState, error)
+}
+
+// WithMigrationIssuer RequestReconnect在reconnect通知中附带由issuer签发的迁移令牌
+func WithMigrationIssuer(issuer MigrationIssuer) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.migrationIssuer = issuer
+	}
+}
+
+// WithMigrationAcceptor 升级时接受迁移令牌：连接沿用原来的标识和标签，重新加入原来的房间，
+// 并从记录的Seq之后补发历史消息。令牌无效时按普通连接处理
+func WithMigrationAcceptor(validator MigrationValidator) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.migrationValidator = validator
+	}
+}
+
+// MigrationKey HMAC签名密钥，ID写入令牌用于校验时选择密钥
+type MigrationKey struct {
+	ID     string
+	Secret []byte
+}
+
+// NonceStore 记录已使用的令牌，多节点部署时需要共享，例如基于Redis SETNX实现
+type NonceStore interface {
+	// Consume 首次使用返回true，expires之后可以删除该记录
+	Consume(nonce string, expires time.Time) (bool, error)
+}
+
+// MigrationSigner HMAC-SHA256签名的迁移令牌，同时实现MigrationIssuer和MigrationValidator
+type MigrationSigner struct {
+	mu     sync.RWMutex
+	keys   []MigrationKey
+	ttl    time.Duration
+	nonces NonceStore
+}
+
+// NewMigrationSigner keys中第一个用于签名，全部用于校验；nonces为nil时使用进程内存储
+func NewMigrationSigner(ttl time.Duration, nonces NonceStore, keys ...MigrationKey) (*MigrationSigner, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("%w: migration token ttl must be positive, got %s", ErrInvalidOption, ttl)
+	}
+	if nonces == nil {
+		nonces = NewMemoryNonceStore()
+	}
+	signer := &MigrationSigner{ttl: ttl, nonces: nonces}
+	if err := signer.SetKeys(keys...); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// SetKeys 轮换密钥：新密钥放在第一个，保留旧密钥直到用它签发的令牌全部过期
+func (m *MigrationSigner) SetKeys(keys ...MigrationKey) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("%w: at least one migration key is required", ErrInvalidOption)
+	}
+	for _, key := range keys {
+		if key.ID == "" || len(key.Secret) < 32 {
+			return fmt.Errorf("%w: migration key %q needs an id and a secret of at least 32 bytes", ErrInvalidOption, key.ID)
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys = append([]MigrationKey(nil), keys...)
+	return nil
+}
+
+func (m *MigrationSigner) Sign(state MigrationState) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	m.mu.RLock()
+	key := m.keys[0]
+	m.mu.RUnlock()
+	state.Nonce = hex.EncodeToString(nonce)
+	state.ExpiresAt = time.Now().Add(m.ttl).Truncate(time.Millisecond)
+	state.KeyID = key.ID
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(sign(key.Secret, encoded)), nil
+}
+
+func (m *MigrationSigner) Verify(token string) (MigrationState, error) {
+	var state MigrationState
+	encoded, mac, ok := strings.Cut(token, ".")
+	if !ok {
+		return state, ErrInvalidMigrationToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return state, wrapError(ErrInvalidMigrationToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(mac)
+	if err != nil {
+		return state, wrapError(ErrInvalidMigrationToken, err)
+	}
+	if err = json.Unmarshal(payload, &state); err != nil {
+		return state, wrapError(ErrInvalidMigrationToken, err)
+	}
+	secret, ok := m.secret(state.KeyID)
+	if !ok || !hmac.Equal(signature, sign(secret, encoded)) {
+		return state, fmt.Errorf("%w: bad signature", ErrInvalidMigrationToken)
+	}
+	if !time.Now().Before(state.ExpiresAt) {
+		return state, fmt.Errorf("%w: expired", ErrInvalidMigrationToken)
+	}
+	first, err := m.nonces.Consume(state.Nonce, state.ExpiresAt)
+	if err != nil {
+		return state, err
+	}
+	if !first {
+		return state, fmt.Errorf("%w: already used", ErrInvalidMigrationToken)
+	}
+	return state, nil
+}
+
+func (m *MigrationSigner) secret(id string) ([]byte, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, key := range m.keys {
+		if key.ID == id {
+			return key.Secret, true
+		}
+	}
+	return nil, false
+}
+
+func sign(secret []byte, payload string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// MemoryNonceStore 单节点使用的NonceStore，过期记录在写入时清理
+type MemoryNonceStore struct {
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{used: make(map[string]time.Time)}
+}
+
+func (s *MemoryNonceStore) Consume(nonce string, expires time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for n, exp := range s.used {
+		if now.After(exp) {
+			delete(s.used, n)
+		}
+	}
+	if _, ok := s.used[nonce]; ok {
+		return false, nil
+	}
+	s.used[nonce] = expires
+	return true, nil
+}
+
+// RequestReconnect 请求客户端重连到其他节点：发送type为closing、code为CloseServerDraining的通知，
+// 配置了WithMigrationIssuer时detail中附带migration_token，随后关闭连接
+func (s *Socket) RequestReconnect(key string) error {
+	client, err := s.Client(key)
+	if err != nil {
+		return err
+	}
+	detail := map[string]any{}
+	if issuer := s.opts.migrationIssuer; issuer != nil {
+		token, err := issuer.Sign(s.migrationState(client))
+		if err != nil {
+			return newError(key, "migrate", err)
+		}
+		detail[MigrationTokenParam] = token
+	}
+	return client.CloseWithReason(CloseServerDraining, "reconnect", detail)
+}
+
+func (s *Socket) migrationState(client *SocketClient) MigrationState {
+	state := MigrationState{Key: client.key, Labels: client.Labels(), Rooms: make(map[string]uint64)}
+	rooms := client.rooms()
+	for _, room := range rooms.roomsOf(client.key) {
+		var seq uint64
+		if latest, err := rooms.History(room, 1, 0); err == nil && len(latest) > 0 {
+			seq = latest[0].Seq
+		}
+		state.Rooms[room] = seq
+	}
+	return state
+}
+
+// acceptMigration 校验请求中的迁移令牌，没有令牌或令牌无效时返回nil
+func (s *Socket) acceptMigration(ctx *gin.Context) *MigrationState {
+	validator := s.opts.migrationValidator
+	if validator == nil {
+		return nil
+	}
+	token := ctx.Query(MigrationTokenParam)
+	if token == "" {
+		token = ctx.GetHeader("X-Migration-Token")
+	}
+	if token == "" {
+		return nil
+	}
+	state, err := validator.Verify(token)
+	if err != nil {
+		if logger := s.opts.logger; logger != nil {
+			logger.Warn(newError("", "migrate", err).Error(), zap.String("client_ip", ctx.ClientIP()))
+		}
+		return nil
+	}
+	return &state
+}
+
+// restoreMigration 在读写循环启动之前重新加入房间并补发记录的Seq之后的历史消息，
+// 任一房间加入失败时退出已加入的房间
+func (s *Socket) restoreMigration(client *SocketClient, state *MigrationState) error {
+	var joined []string
+	rooms := client.rooms()
+	for room := range state.Rooms {
+		if err := rooms.Join(room, client.key); err != nil {
+			for _, name := range joined {
+				rooms.Leave(name, client.key)
+			}
+			return err
+		}
+		joined = append(joined, room)
+	}
+	for room, seq := range state.Rooms {
+		missed, err := rooms.History(room, maxHistoryPage, 0)
+		if err != nil {
+			client.reportError(err)
+			continue
+		}
+		for _, msg := range missed {
+			if msg.Seq > seq {
+				_ = client.enqueue(msg.MessageType, msg.Data)
+			}
+		}
+	}
+	return nil
+}
+
+// migratedLabels 令牌中的标签作为基础，本次握手提取到的同名标签优先
+func migratedLabels(state *MigrationState, fn func(ctx *gin.Context) map[string]string) func(ctx *gin.Context) map[string]string {
+	return func(ctx *gin.Context) map[string]string {
+		labels := make(map[string]string, len(state.Labels))
+		for k, v := range state.Labels {
+			labels[k] = v
+		}
+		if fn != nil {
+			for k, v := range fn(ctx) {
+				labels[k] = v
+			}
+		}
+		return labels
+	}
+}
+
+func (m *RoomManager) roomsOf(key string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var names []string
+	for name, room := range m.rooms {
+		room.mu.RLock()
+		if _, ok := room.members[key]; ok {
+			names = append(names, name)
+		}
+		room.mu.RUnlock()
+	}
+	return names
+}
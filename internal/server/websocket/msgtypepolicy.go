@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// MessageTypePolicy 收到WithAllowedMessageTypes之外的数据帧时的处理方式
+type MessageTypePolicy int
+
+const (
+	// MessageTypeClose 回调OnError后以1003(unsupported data)关闭连接
+	MessageTypeClose MessageTypePolicy = iota
+	// MessageTypeDrop 丢弃该消息并回调OnError，连接继续读取
+	MessageTypeDrop
+)
+
+// WithAllowedMessageTypes 只接受指定类型(websocket.TextMessage、websocket.BinaryMessage)的入站数据帧，
+// 例如纯JSON接口只允许文本帧、音频通道只允许二进制帧。控制帧不受限制；
+// 被拒绝的消息不会到达OnMessage、路由和编码层，计入SocketStats.DisallowedMessages
+func WithAllowedMessageTypes(types ...int) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.allowedMessageTypes = types
+	}
+}
+
+// WithMessageTypePolicy 不允许的消息的处理方式，默认MessageTypeClose
+func WithMessageTypePolicy(policy MessageTypePolicy) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.messageTypePolicy = policy
+	}
+}
+
+// admitMessageType 返回false表示消息被拒绝，closed为true时连接已关闭
+func (s *SocketClient) admitMessageType(messageType int) (ok, closed bool) {
+	allowed := s.socket.opts.allowedMessageTypes
+	if len(allowed) == 0 {
+		return true, false
+	}
+	for _, t := range allowed {
+		if t == messageType {
+			return true, false
+		}
+	}
+	s.disallowedCount.Add(1)
+	s.reportError(newError(s.key, "dispatch", fmt.Errorf("%w: %s", ErrMessageTypeNotAllowed, MessageTypes.Name(messageType))))
+	if s.socket.opts.messageTypePolicy == MessageTypeDrop {
+		return false, false
+	}
+	_ = s.closeWith(websocket.CloseUnsupportedData, "message type not allowed")
+	return false, true
+}
@@ -0,0 +1,193 @@
+package server
+
+import "sync"
+
+// channelEnvelope 多路复用时每条消息的外层结构
+type channelEnvelope struct {
+	Channel string `json:"channel"`
+	Data    string `json:"data"`
+}
+
+// Multiplexer 在同一条物理连接上承载多个逻辑通道，作为MessageHandler传给WithHandler使用
+type Multiplexer struct {
+	socket   *Socket
+	fallback MessageHandler
+	mu       sync.RWMutex
+	channels map[string]map[string]*Channel
+}
+
+type Channel struct {
+	id      string
+	key     string
+	handler MessageHandler
+	mux     *Multiplexer
+}
+
+// NewMultiplexer fallback用于处理未携带通道信息或通道未打开的消息，可以为nil
+func NewMultiplexer(fallback MessageHandler) *Multiplexer {
+	return &Multiplexer{
+		fallback: fallback,
+		channels: make(map[string]map[string]*Channel),
+	}
+}
+
+func (m *Multiplexer) bind(socket *Socket) {
+	m.socket = socket
+}
+
+// OpenChannel 在连接key上打开id通道，该通道的入站消息交由handler处理，同一连接上id重复时返回ErrChannelExists。
+// 一个Multiplexer服务于hub上的所有连接，因此需要key指明连接；返回的Channel只提供该通道的收发，不是完整的SocketClientInterface
+func (m *Multiplexer) OpenChannel(key, id string, handler MessageHandler) (*Channel, error) {
+	if m.socket == nil || m.socket.GetClientState(key) != OnlineState {
+		return nil, newError(key, "open channel", ErrConnectionClosed)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	channels, ok := m.channels[key]
+	if !ok {
+		channels = make(map[string]*Channel)
+		m.channels[key] = channels
+	}
+	if _, ok := channels[id]; ok {
+		return nil, newError(key, "open channel", ErrChannelExists)
+	}
+	channel := &Channel{id: id, key: key, handler: handler, mux: m}
+	channels[id] = channel
+	return channel, nil
+}
+
+func (m *Multiplexer) CloseChannel(key, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	channels, ok := m.channels[key]
+	if !ok {
+		return newError(key, "close channel", ErrStreamNotFound)
+	}
+	if _, ok = channels[id]; !ok {
+		return newError(key, "close channel", ErrStreamNotFound)
+	}
+	delete(channels, id)
+	if len(channels) == 0 {
+		delete(m.channels, key)
+	}
+	return nil
+}
+
+func (m *Multiplexer) envelopeCodec() Codec {
+	if m.socket != nil && m.socket.opts.serializer != nil {
+		return m.socket.defaultCodec()
+	}
+	return JSONSerializer{}
+}
+
+func (m *Multiplexer) channel(key, id string) (*Channel, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	channel, ok := m.channels[key][id]
+	return channel, ok
+}
+
+func (m *Multiplexer) OnMessage(message Message) {
+	key := message.Subkeys[0]
+	var envelope channelEnvelope
+	if err := m.envelopeCodec().Unmarshal(message.Data, &envelope); err != nil || envelope.Channel == "" {
+		if m.fallback != nil {
+			m.fallback.OnMessage(message)
+		}
+		return
+	}
+	channel, ok := m.channel(key, envelope.Channel)
+	if !ok {
+		if m.fallback != nil {
+			m.fallback.OnMessage(message)
+		} else {
+			m.OnError(key, newError(key, "demultiplex", ErrStreamNotFound))
+		}
+		return
+	}
+	channel.handler.OnMessage(Message{
+		MessageType: message.MessageType,
+		Subkeys:     message.Subkeys,
+		Data:        []byte(envelope.Data),
+	})
+}
+
+func (m *Multiplexer) OnError(key string, err error) {
+	for _, channel := range m.channelsOf(key) {
+		channel.handler.OnError(key, err)
+	}
+	if m.fallback != nil {
+		m.fallback.OnError(key, err)
+	}
+}
+
+func (m *Multiplexer) OnOpen(client *SocketClient) {
+	if h, ok := m.fallback.(OpenHandler); ok {
+		h.OnOpen(client)
+	}
+}
+
+func (m *Multiplexer) OnPing(key string, appData string) {
+	if h, ok := m.fallback.(PingHandler); ok {
+		h.OnPing(key, appData)
+	}
+}
+
+func (m *Multiplexer) OnPong(key string, appData string) {
+	if h, ok := m.fallback.(PongHandler); ok {
+		h.OnPong(key, appData)
+	}
+}
+
+func (m *Multiplexer) OnClose(key string) {
+	m.mu.Lock()
+	channels := m.channels[key]
+	delete(m.channels, key)
+	m.mu.Unlock()
+	for _, channel := range channels {
+		channel.handler.OnClose(key)
+	}
+	if m.fallback != nil {
+		m.fallback.OnClose(key)
+	}
+}
+
+func (m *Multiplexer) channelsOf(key string) []*Channel {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	channels := make([]*Channel, 0, len(m.channels[key]))
+	for _, channel := range m.channels[key] {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+func (c *Channel) ID() string {
+	return c.id
+}
+
+func (c *Channel) Key() string {
+	return c.key
+}
+
+// WriteMessage 将数据包装为{"channel":"<id>","data":"..."}后发送到所属连接，
+// 配置了WithSerializer时外层结构按它编码并使用其帧类型
+func (c *Channel) WriteMessage(messageType int, data []byte) error {
+	codec := c.mux.envelopeCodec()
+	payload, err := codec.Marshal(channelEnvelope{Channel: c.id, Data: string(data)})
+	if err != nil {
+		return newError(c.key, "send", err)
+	}
+	if c.mux.socket.opts.serializer != nil {
+		messageType = codec.MessageType()
+	}
+	return c.mux.socket.WriteMessage(Message{
+		MessageType: messageType,
+		Subkeys:     []string{c.key},
+		Data:        payload,
+	})
+}
+
+func (c *Channel) Close() error {
+	return c.mux.CloseChannel(c.key, c.id)
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// NamespaceLabel 连接所属的租户，由WithLabelExtractor从鉴权信息(例如令牌中的workspace)中提供，连接建立后不可修改
+const NamespaceLabel = "namespace"
+
+// NamespaceLimits 单个租户的限制，零值表示不限制
+type NamespaceLimits struct {
+	// MaxConnections 租户的在线连接数上限，超出时以503结束握手并返回ErrOverloaded
+	MaxConnections int
+	// Rooms 租户内房间默认的流量限制，取代WithRoomLimits
+	Rooms RoomLimits
+}
+
+// NamespaceStats Rejected为因连接数上限或排空被拒绝的升级次数
+type NamespaceStats struct {
+	Connections int
+	Rejected    int64
+	Draining    bool
+	Rooms       RoomStats
+}
+
+// WithNamespaces 声明进程内的租户及各自的限制。配置后每个连接必须带有NamespaceLabel标签且取值在声明的范围内，
+// 否则以403结束握手并返回ErrUnknownNamespace。不同租户的房间、用户(SessionLabel)、广播、连接数和房间限制互相独立，
+// 租户名作为namespace标签出现在Stats中，声明的集合即为该标签的全部取值
+func WithNamespaces(namespaces map[string]NamespaceLimits) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.namespaces = namespaces
+	}
+}
+
+// Namespace 一个租户范围内的hub，只能访问属于该租户的连接和房间
+type Namespace struct {
+	name     string
+	socket   *Socket
+	limits   NamespaceLimits
+	rooms    *RoomManager
+	drain    drainControl
+	rejected atomic.Int64
+	topics   *TopicTree
+}
+
+func newNamespace(socket *Socket, name string, limits NamespaceLimits) *Namespace {
+	ns := &Namespace{
+		name:   name,
+		socket: socket,
+		limits: limits,
+		rooms:  newRoomManager(socket, name, limits.Rooms),
+	}
+	if socket.opts.topicLimit > 0 {
+		ns.topics = NewTopicTree()
+	}
+	return ns
+}
+
+// Namespace 返回WithNamespaces声明的租户，未声明时返回ErrUnknownNamespace
+func (s *Socket) Namespace(name string) (*Namespace, error) {
+	ns, ok := s.namespaces[name]
+	if !ok {
+		return nil, newError("", "namespace", fmt.Errorf("%w: %q", ErrUnknownNamespace, name))
+	}
+	return ns, nil
+}
+
+// Namespaces 声明的租户名，按字典序排列
+func (s *Socket) Namespaces() []string {
+	names := make([]string, 0, len(s.namespaces))
+	for name := range s.namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AdminBroadcast 跨租户广播，例如系统维护通知。namespaces为空时发给所有租户的全部连接，
+// 租户自身的Broadcast只能发给本租户
+func (s *Socket) AdminBroadcast(messageType int, data []byte, namespaces ...string) error {
+	if len(namespaces) == 0 {
+		namespaces = s.Namespaces()
+	}
+	targets := make([]*Namespace, 0, len(namespaces))
+	for _, name := range namespaces {
+		ns, err := s.Namespace(name)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, ns)
+	}
+	for _, ns := range targets {
+		ns.Broadcast(messageType, data)
+	}
+	return nil
+}
+
+// Namespace 连接所属的租户，未配置WithNamespaces时为nil
+func (s *SocketClient) Namespace() *Namespace {
+	return s.namespace
+}
+
+// rooms 连接可以加入的房间：所属租户的房间或Socket.Rooms()
+func (s *SocketClient) rooms() *RoomManager {
+	if s.namespace != nil {
+		return s.namespace.rooms
+	}
+	return s.socket.rooms
+}
+
+// admitNamespace 升级之前按NamespaceLabel分配租户，检查租户是否声明、是否排空以及连接数上限
+func (s *Socket) admitNamespace(ctx *gin.Context, client *SocketClient) error {
+	if len(s.opts.namespaces) == 0 {
+		return nil
+	}
+	name := client.labels[NamespaceLabel]
+	ns, ok := s.namespaces[name]
+	if !ok {
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return newError(client.key, "upgrade", fmt.Errorf("%w: %q", ErrUnknownNamespace, name))
+	}
+	if err := rejectDrainState(ctx, client.key, ns.DrainState()); err != nil {
+		ns.rejected.Add(1)
+		return err
+	}
+	if limit := ns.limits.MaxConnections; limit > 0 && len(ns.clients()) >= limit {
+		ns.rejected.Add(1)
+		ctx.Header("Retry-After", "5")
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+		return newError(client.key, "upgrade", fmt.Errorf("%w: namespace %q reached %d connections", ErrOverloaded, name, limit))
+	}
+	client.namespace = ns
+	return nil
+}
+
+func (n *Namespace) Name() string {
+	return n.name
+}
+
+// Rooms 租户内的房间，与Socket.Rooms()及其他租户的房间互相独立，只有本租户的连接可以加入
+func (n *Namespace) Rooms() *RoomManager {
+	return n.rooms
+}
+
+func (n *Namespace) clients() []*SocketClient {
+	n.socket.mu.RLock()
+	defer n.socket.mu.RUnlock()
+	var clients []*SocketClient
+	for _, client := range n.socket.clients {
+		if client.namespace == n && client.State() == OnlineState {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// Keys 租户内在线连接的标识
+func (n *Namespace) Keys() []string {
+	clients := n.clients()
+	keys := make([]string, 0, len(clients))
+	for _, client := range clients {
+		keys = append(keys, client.key)
+	}
+	return keys
+}
+
+// Client 查找租户内的连接，其他租户的连接视为不存在
+func (n *Namespace) Client(key string) (*SocketClient, error) {
+	client, err := n.socket.Client(key)
+	if err != nil || client.namespace != n {
+		return nil, newError(key, "lookup", ErrSessionNotFound)
+	}
+	return client, nil
+}
+
+// SendTo 只能发给本租户的连接
+func (n *Namespace) SendTo(key string, messageType int, data []byte) error {
+	client, err := n.Client(key)
+	if err != nil {
+		return err
+	}
+	return client.enqueue(messageType, data)
+}
+
+// SendToUser 发给本租户内SessionLabel为userID的所有连接，返回发送成功的连接数。其他租户的同名用户不受影响
+func (n *Namespace) SendToUser(userID string, messageType int, data []byte) int {
+	sent := 0
+	for _, client := range n.clients() {
+		if client.labels[SessionLabel] == userID && client.enqueue(messageType, data) == nil {
+			sent++
+		}
+	}
+	return sent
+}
+
+// SendToUserWithAck 见Socket.SendToUserWithAck，只包含本租户的连接
+func (n *Namespace) SendToUserWithAck(ctx context.Context, userID string, messageType int, data []byte) (map[string]error, error) {
+	return n.socket.sendToUserWithAck(ctx, n, userID, messageType, data)
+}
+
+// Broadcast 发给本租户的全部在线连接，发送队列已满的连接被跳过
+func (n *Namespace) Broadcast(messageType int, data []byte) {
+	for _, client := range n.clients() {
+		_ = client.enqueue(messageType, data)
+	}
+}
+
+// StartDrain 只排空本租户：该租户新的升级返回503，在线连接收到draining通知，其他租户不受影响
+func (n *Namespace) StartDrain(reason string) {
+	state, started := n.drain.start(reason, n.socket.opts.drainGracePeriod)
+	if !started {
+		return
+	}
+	n.rooms.FlushCoalesced()
+	for _, client := range n.clients() {
+		n.socket.sendNotice(client.key, drainNotice{Type: "draining", Reason: state.Reason, ShutdownAt: state.ShutdownAt})
+	}
+}
+
+func (n *Namespace) StopDrain() {
+	n.drain.stop()
+}
+
+func (n *Namespace) DrainState() DrainState {
+	return n.drain.get()
+}
+
+// Shutdown 以1001(going away)关闭本租户的全部连接，通常在StartDrain之后调用
+func (n *Namespace) Shutdown(reason string) {
+	n.rooms.FlushCoalesced()
+	for _, client := range n.clients() {
+		_ = client.closeWith(websocket.CloseGoingAway, reason)
+	}
+}
+
+func (n *Namespace) Stats() NamespaceStats {
+	return NamespaceStats{
+		Connections: len(n.clients()),
+		Rejected:    n.rejected.Load(),
+		Draining:    n.DrainState().Draining,
+		Rooms:       n.rooms.Stats(),
+	}
+}
+
+// admits 租户的连接只能加入该租户的房间，不属于任何租户的连接只能加入Socket.Rooms()的房间
+func (m *RoomManager) admits(client *SocketClient) bool {
+	if client.namespace == nil {
+		return m.namespace == ""
+	}
+	return client.namespace.name == m.namespace
+}
@@ -0,0 +1,54 @@
+// Package natssink 基于NATS的EventSink实现
+package natssink
+
+import (
+	server "skeleton/internal/server/websocket"
+
+	"github.com/nats-io/nats.go"
+)
+
+// KeyHeader 连接标识写入的消息头，NATS的subject中没有分区键的概念
+const KeyHeader = "Ws-Key"
+
+// Sink topic作为NATS subject发布，连接不由Sink管理，调用方负责重连策略和关闭
+type Sink struct {
+	conn *nats.Conn
+}
+
+var _ server.EventSink = (*Sink)(nil)
+
+func New(conn *nats.Conn) *Sink {
+	return &Sink{conn: conn}
+}
+
+func (s *Sink) Publish(topic string, key string, payload []byte) error {
+	msg := nats.NewMsg(topic)
+	msg.Header.Set(KeyHeader, key)
+	msg.Data = payload
+	return s.conn.PublishMsg(msg)
+}
+
+// Flush 每批事件发布后调用，等待服务端确认收到
+func (s *Sink) Flush() error {
+	return s.conn.Flush()
+}
+
+// BusPublisher 入站消息以prefix加会话标识作为subject发布，消息类型写入KeyHeader
+type BusPublisher struct {
+	conn   *nats.Conn
+	prefix string
+}
+
+var _ server.MessageBusPublisher = (*BusPublisher)(nil)
+
+// NewBusPublisher prefix例如"ws.inbound."，会话标识中不应包含空格和NATS通配符
+func NewBusPublisher(conn *nats.Conn, prefix string) *BusPublisher {
+	return &BusPublisher{conn: conn, prefix: prefix}
+}
+
+func (p *BusPublisher) Publish(topic string, key []byte, value []byte) error {
+	msg := nats.NewMsg(p.prefix + topic)
+	msg.Header.Set(KeyHeader, string(key))
+	msg.Data = value
+	return p.conn.PublishMsg(msg)
+}
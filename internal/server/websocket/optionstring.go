@@ -0,0 +1,184 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// String 按字段顺序逐行输出"名称: 值"，用于排查配置问题，例如logger.Debug("connection options", zap.Stringer("opts", opts))。
+// 回调和接口只输出是否设置或实现类型，不输出内容；通过Socket.Options、SocketClient.Options取得时包含默认值
+func (o SocketOption) String() string {
+	var b strings.Builder
+	line := func(name string, value any) {
+		fmt.Fprintf(&b, "%s: %v\n", name, value)
+	}
+	line("writeReadBufferSize", o.writeReadBufferSize)
+	line("sendQueueLength", o.sendQueueLength)
+	line("heartbeatFailMaxTimes", o.heartbeatFailMaxTimes)
+	line("writeDeadline", o.writeDeadline)
+	line("readDeadline", o.readDeadline)
+	line("noReadDeadline", o.noReadDeadline)
+	line("allowNoLiveness", o.allowNoLiveness)
+	line("pingPeriod", o.pingPeriod)
+	line("pingMsg", fmt.Sprintf("%q", o.pingMsg))
+	line("roomHistorySize", o.roomHistorySize)
+	line("roomRateLimit", o.roomRateLimit)
+	line("maxMessageSize", o.maxMessageSize)
+	line("tcpKeepAlive", o.tcpKeepAlive)
+	line("e2eLatencyProbe", optionSet(o.e2eLatencyProbe))
+	line("pubSub", optionType(o.pubSub))
+	line("upgradeBodyLimit", o.upgradeBodyLimit)
+	line("upgradeTimeout", o.upgradeTimeout)
+	line("enableCompression", o.enableCompression)
+	line("continueOnError", optionSet(o.continueOnError))
+	line("writeTransformers", len(o.writeTransformers))
+	line("injectTimestamp", o.injectTimestamp)
+	line("protobufEncoding", o.protobufEncoding)
+	line("panicHandler", optionSet(o.panicHandler))
+	line("flushInterval", o.flushInterval)
+	line("labelExtractor", optionSet(o.labelExtractor))
+	line("metricLabels", o.metricLabels)
+	if o.eventSink != nil {
+		line("eventSink", fmt.Sprintf("%T topicPrefix=%q actions=%v buffer=%d batch=%d",
+			o.eventSink.Sink, o.eventSink.TopicPrefix, o.eventSink.Actions, o.eventSink.BufferSize, o.eventSink.BatchSize))
+	} else {
+		line("eventSink", "unset")
+	}
+	line("writeLatencyThreshold", o.writeLatencyThreshold)
+	line("writeLatencyWarning", optionSet(o.writeLatencyWarning))
+	line("pendingStore", optionType(o.pendingStore))
+	line("duplicatePolicy", o.duplicatePolicy)
+	line("roomLimits", fmt.Sprintf("%+v", o.roomLimits))
+	line("roomLimitHook", optionSet(o.roomLimitHook))
+	line("contentTypes", o.contentTypes)
+	if o.history != nil {
+		line("history", fmt.Sprintf("%T enabled=%t", o.history.Store, o.history.Enabled))
+	} else {
+		line("history", "unset")
+	}
+	line("healthThresholds", fmt.Sprintf("%+v", o.healthThresholds))
+	line("migrationIssuer", optionType(o.migrationIssuer))
+	line("migrationValidator", optionType(o.migrationValidator))
+	line("strictOrdering", o.strictOrdering)
+	line("schemaVersion", o.schemaVersion)
+	versions := make([]int, 0, len(o.downgradeEncoders))
+	for _, encoder := range o.downgradeEncoders {
+		versions = append(versions, encoder.version)
+	}
+	line("downgradeEncoders", versions)
+	line("namedCodecs", sortedKeys(o.namedCodecs))
+	line("defaultCodec", fmt.Sprintf("%q", o.defaultCodec))
+	line("healthScoreFormula", optionSet(o.healthScoreFormula))
+	line("slowStartBudget", o.slowStartBudget)
+	line("slowStartWindow", o.slowStartWindow)
+	line("slowStartPolicy", o.slowStartPolicy)
+	line("slowStartGlobal", o.slowStartGlobal)
+	line("serializer", optionType(o.serializer))
+	line("statsInterval", o.statsInterval)
+	line("statsCallback", optionSet(o.statsCallback))
+	line("maxPendingAcks", o.maxPendingAcks)
+	line("drainGracePeriod", o.drainGracePeriod)
+	line("idGenerator", optionSet(o.idGenerator))
+	line("heartbeatLabel", fmt.Sprintf("%q", o.heartbeatLabel))
+	line("heartbeatExecutor", optionType(o.heartbeatExecutor))
+	line("isolatePanics", o.isolatePanics)
+	line("panicEscalationCount", o.panicEscalationCount)
+	line("panicEscalationWindow", o.panicEscalationWindow)
+	allowed := make([]string, 0, len(o.allowedMessageTypes))
+	for _, mt := range o.allowedMessageTypes {
+		allowed = append(allowed, MessageTypes.Name(mt))
+	}
+	line("allowedMessageTypes", allowed)
+	line("messageTypePolicy", o.messageTypePolicy)
+	line("admissionController", optionSet(o.admissionController))
+	if o.admissionThresholds != nil {
+		t := o.admissionThresholds
+		line("admissionThresholds", fmt.Sprintf("maxConnections=%d degradeConnections=%d maxQueuedBytes=%d degradeQueuedBytes=%d load=%s maxLoad=%v degradeLoad=%v retryAfter=%s",
+			t.MaxConnections, t.DegradeConnections, t.MaxQueuedBytes, t.DegradeQueuedBytes, optionSet(t.Load), t.MaxLoad, t.DegradeLoad, t.RetryAfter))
+	} else {
+		line("admissionThresholds", "unset")
+	}
+	line("sessionStore", optionType(o.sessionStore))
+	line("sessionTTL", o.sessionTTL)
+	line("queueWaitTimeout", o.queueWaitTimeout)
+	line("cpuThreshold", o.cpuThreshold)
+	line("cpuInterval", o.cpuInterval)
+	line("cpuSampler", optionSet(o.cpuSampler))
+	if o.serverConfig != nil {
+		line("serverConfig", fmt.Sprintf("server=%q extra=%v", o.serverConfig.server, sortedKeys(o.serverConfig.extra)))
+	} else {
+		line("serverConfig", "unset")
+	}
+	line("sampleRate", o.sampleRate)
+	line("sampler", optionSet(o.sampler))
+	line("sessionSampling", o.sessionSampling)
+	namespaces := make([]string, 0, len(o.namespaces))
+	for _, name := range sortedKeys(o.namespaces) {
+		namespaces = append(namespaces, fmt.Sprintf("%s%+v", name, o.namespaces[name]))
+	}
+	line("namespaces", namespaces)
+	line("shadowHandler", optionType(o.shadowHandler))
+	line("topicLimit", o.topicLimit)
+	line("clientMetrics", optionSet(o.clientMetrics))
+	line("clientMetricsInterval", o.clientMetricsInterval)
+	line("idleTimeout", o.idleTimeout)
+	line("idleGracePeriod", o.idleGracePeriod)
+	line("busPublisher", optionType(o.busPublisher))
+	line("flushAfterBytes", o.flushAfterBytes)
+	line("deadConnInterval", o.deadConnInterval)
+	line("recvAcks", o.recvAcks)
+	line("recvAckEvery", o.recvAckEvery)
+	line("recvAckInterval", o.recvAckInterval)
+	line("reapInterval", o.reapInterval)
+	line("reapThreshold", o.reapThreshold)
+	line("handler", optionType(o.handler))
+	line("logger", optionSet(o.logger))
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// optionSet 回调、指针类型的配置项只输出是否设置
+func optionSet(v any) string {
+	if v == nil || reflect.ValueOf(v).IsNil() {
+		return "unset"
+	}
+	return "set"
+}
+
+// optionType 接口类型的配置项输出实现类型
+func optionType(v any) string {
+	if v == nil {
+		return "unset"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Options 生效的配置，包含默认值
+func (s *Socket) Options() SocketOption {
+	return *s.opts
+}
+
+// Options 该连接生效的配置，包含通过UpdateOption或降级接受调整后的值
+func (s *SocketClient) Options() SocketOption {
+	opts := *s.socket.opts
+	settings := s.options()
+	opts.writeDeadline = settings.writeDeadline
+	opts.readDeadline = settings.readDeadline
+	opts.noReadDeadline = settings.noReadDeadline
+	opts.allowNoLiveness = settings.allowNoLiveness
+	opts.pingPeriod = settings.pingPeriod
+	opts.pingMsg = settings.pingMsg
+	opts.heartbeatFailMaxTimes = settings.heartbeatFailMaxTimes
+	opts.idleTimeout = settings.idleTimeout
+	return opts
+}
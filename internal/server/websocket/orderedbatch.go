@@ -0,0 +1,67 @@
+package server
+
+import "sort"
+
+type orderedWrite struct {
+	client      *SocketClient
+	messageType int
+	data        []byte
+}
+
+// OrderedBatch 跨多个连接按添加顺序写出一组消息，例如多模态回复中由不同goroutine生成的文本、图片和音频。
+// Flush时按连接标识的顺序获得所有相关连接的写锁，依次直接写出后再全部释放，期间这些连接不会写出其他数据帧。
+// 消息不经过发送队列和写入转换器，与CloseWithReason相同计入OutOfOrderMessagesSent
+type OrderedBatch struct {
+	writes []orderedWrite
+}
+
+func NewOrderedBatch() *OrderedBatch {
+	return &OrderedBatch{}
+}
+
+func (b *OrderedBatch) Add(client *SocketClient, messageType int, data []byte) {
+	b.writes = append(b.writes, orderedWrite{client: client, messageType: messageType, data: data})
+}
+
+func (b *OrderedBatch) Len() int {
+	return len(b.writes)
+}
+
+// Flush 写出并清空批次，某条消息写出失败时返回错误，之后的消息不再写出
+func (b *OrderedBatch) Flush() error {
+	writes := b.writes
+	b.writes = nil
+	if len(writes) == 0 {
+		return nil
+	}
+	seen := make(map[*SocketClient]bool, len(writes))
+	var clients []*SocketClient
+	for _, w := range writes {
+		if !seen[w.client] {
+			seen[w.client] = true
+			clients = append(clients, w.client)
+		}
+	}
+	// 固定的加锁顺序，避免两个批次交叉持有写锁
+	sort.Slice(clients, func(i, j int) bool { return clients[i].key < clients[j].key })
+	for _, client := range clients {
+		if client.State() != OnlineState {
+			return newError(client.key, "write", ErrConnectionClosed)
+		}
+		client.noteDirectWrite()
+	}
+	for _, client := range clients {
+		client.writeMu.Lock()
+	}
+	defer func() {
+		for _, client := range clients {
+			client.writeMu.Unlock()
+		}
+	}()
+	for _, w := range writes {
+		if _, err := w.client.writeFrameLocked(w.messageType, w.data, w.client.options().writeDeadline, nil); err != nil {
+			return newError(w.client.key, "write", classifyWriteError(err))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package server
+
+import "github.com/gorilla/websocket"
+
+// WithStrictOrdering 写出时为每条JSON对象文本消息加上"_seq"字段，同一连接内从1开始连续递增，
+// 客户端可据此检测丢失或乱序。序号在持有写锁时分配，与实际写出的顺序一致，包括CloseWithReason等绕过发送队列的写入；
+// 二进制消息和非JSON对象的文本消息不占用序号。不能与WithFlushInterval同时使用，合并后的JSON数组无法逐条加序号
+func WithStrictOrdering(enabled bool) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.strictOrdering = enabled
+	}
+}
+
+// stampSequence 在writeMu内调用
+func (s *SocketClient) stampSequence(messageType int, data []byte) []byte {
+	if !s.socket.opts.strictOrdering || messageType != websocket.TextMessage {
+		return data
+	}
+	stamped := prependJSONField(data, "_seq", int64(s.outSeq.Load()+1))
+	if len(stamped) != len(data) {
+		s.outSeq.Add(1)
+		s.markSessionDirty()
+	}
+	return stamped
+}
+
+// noteDirectWrite 绕过发送队列写出的消息在队列非空时会越过先发送的消息。
+// 开启严格顺序后序号按实际写出顺序分配，客户端看到的顺序总是连续的，不再计数
+func (s *SocketClient) noteDirectWrite() {
+	if !s.socket.opts.strictOrdering && s.send != nil && len(s.send) > 0 {
+		s.outOfOrder.Add(1)
+	}
+}
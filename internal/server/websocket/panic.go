@@ -0,0 +1,49 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+
+	"go.uber.org/zap"
+)
+
+// WithPanicHandler 包内启动的所有goroutine(读写循环、心跳、广播订阅等)以及其中调用的回调发生panic时通知fn，
+// stack为panic时的调用栈，connID与连接无关时为空。默认使用配置的logger记录。
+// fn只用于记录和上报，连接是否关闭由发生panic的位置决定：读写循环中的panic会关闭该连接，
+// OnMessage中的panic按WithIsolatePanics、WithContinueOnError的规则处理；fn自身的panic会被恢复并记录
+func WithPanicHandler(fn func(recovered any, stack []byte, connID string)) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.panicHandler = fn
+	}
+}
+
+func (s *Socket) notifyPanic(recovered any, connID string) {
+	stack := debug.Stack()
+	if s.opts.panicHandler == nil {
+		s.logPanic(recovered, stack, connID)
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			s.logPanic(fmt.Sprintf("panic handler: %v (while handling %v)", r, recovered), debug.Stack(), connID)
+		}
+	}()
+	s.opts.panicHandler(recovered, stack, connID)
+}
+
+// recoverPanic 作为没有其他清理逻辑的goroutine的defer使用
+func (s *Socket) recoverPanic(connID string) {
+	if r := recover(); r != nil {
+		s.notifyPanic(r, connID)
+	}
+}
+
+func (s *Socket) logPanic(recovered any, stack []byte, connID string) {
+	if s.opts.logger != nil {
+		s.opts.logger.Error(fmt.Sprintf("websocket panic: %v", recovered),
+			s.logFields(connID, zap.ByteString("stack", stack))...)
+	} else {
+		log.Printf("websocket panic: %v, client: %s\n%s", recovered, connID, stack)
+	}
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// PendingMessage 连接不在线时暂存的消息，Cursor由PendingStore在Append时分配，同一连接标识内递增
+type PendingMessage struct {
+	Cursor      uint64
+	MessageType int
+	Data        []byte
+	Time        time.Time
+}
+
+// PendingStore 离线消息存储，key为连接标识(通常是用户ID)，可基于Redis等实现跨节点共享
+type PendingStore interface {
+	// Append 追加一条消息，超出容量时由实现决定淘汰策略
+	Append(key string, msg PendingMessage) error
+	// DrainSince 按顺序返回Cursor大于cursor的消息，不删除
+	DrainSince(key string, cursor uint64) ([]PendingMessage, error)
+	// Trim 删除Cursor不大于cursor的消息
+	Trim(key string, cursor uint64) error
+}
+
+// WithPendingStore SendTo的目标连接不在线时消息写入store，同一连接标识再次Connect时，
+// 在OnOpen和任何实时消息之前按顺序补发，补发成功的消息从store中删除
+func WithPendingStore(store PendingStore) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.pendingStore = store
+	}
+}
+
+// PendingLimits 每个连接标识的离线消息上限，三项都必须设置
+type PendingLimits struct {
+	MaxMessages int
+	MaxBytes    int64
+	MaxAge      time.Duration
+}
+
+// MemoryPendingStore 单节点使用的进程内离线消息存储，超出条数或字节数上限时淘汰最早的消息，
+// 超过MaxAge的消息不再补发
+type MemoryPendingStore struct {
+	limits    PendingLimits
+	mu        sync.Mutex
+	queues    map[string]*pendingQueue
+	lastSweep time.Time
+}
+
+type pendingQueue struct {
+	messages []PendingMessage
+	bytes    int64
+	cursor   uint64
+}
+
+func NewMemoryPendingStore(limits PendingLimits) (*MemoryPendingStore, error) {
+	if limits.MaxMessages <= 0 || limits.MaxBytes <= 0 || limits.MaxAge <= 0 {
+		return nil, fmt.Errorf("%w: pending store limits must all be positive, got %+v", ErrInvalidOption, limits)
+	}
+	return &MemoryPendingStore{
+		limits:    limits,
+		queues:    make(map[string]*pendingQueue),
+		lastSweep: time.Now(),
+	}, nil
+}
+
+func (p *MemoryPendingStore) Append(key string, msg PendingMessage) error {
+	if int64(len(msg.Data)) > p.limits.MaxBytes {
+		return fmt.Errorf("%w: %d bytes exceeds the pending limit of %d", ErrMessageTooLarge, len(msg.Data), p.limits.MaxBytes)
+	}
+	if msg.Time.IsZero() {
+		msg.Time = time.Now()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep(msg.Time)
+	q, ok := p.queues[key]
+	if !ok {
+		q = &pendingQueue{}
+		p.queues[key] = q
+	}
+	q.cursor++
+	msg.Cursor = q.cursor
+	q.messages = append(q.messages, msg)
+	q.bytes += int64(len(msg.Data))
+	for len(q.messages) > p.limits.MaxMessages || q.bytes > p.limits.MaxBytes {
+		q.drop(1)
+	}
+	return nil
+}
+
+func (p *MemoryPendingStore) DrainSince(key string, cursor uint64) ([]PendingMessage, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	q, ok := p.queues[key]
+	if !ok {
+		return nil, nil
+	}
+	q.expire(time.Now().Add(-p.limits.MaxAge))
+	var messages []PendingMessage
+	for _, msg := range q.messages {
+		if msg.Cursor > cursor {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
+
+func (p *MemoryPendingStore) Trim(key string, cursor uint64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	q, ok := p.queues[key]
+	if !ok {
+		return nil
+	}
+	n := 0
+	for n < len(q.messages) && q.messages[n].Cursor <= cursor {
+		n++
+	}
+	q.drop(n)
+	// 保留cursor计数，之后追加的消息Cursor继续递增
+	return nil
+}
+
+// sweep 每隔MaxAge清理一次所有过期消息，长期不再连接的标识不会一直占用内存
+func (p *MemoryPendingStore) sweep(now time.Time) {
+	if now.Sub(p.lastSweep) < p.limits.MaxAge {
+		return
+	}
+	p.lastSweep = now
+	for key, q := range p.queues {
+		q.expire(now.Add(-p.limits.MaxAge))
+		if len(q.messages) == 0 {
+			delete(p.queues, key)
+		}
+	}
+}
+
+// expire Time由调用方传入，不一定按Cursor递增，需要逐条判断
+func (q *pendingQueue) expire(before time.Time) {
+	kept := q.messages[:0:0]
+	for _, msg := range q.messages {
+		if msg.Time.Before(before) {
+			q.bytes -= int64(len(msg.Data))
+		} else {
+			kept = append(kept, msg)
+		}
+	}
+	q.messages = kept
+}
+
+func (q *pendingQueue) drop(n int) {
+	for _, msg := range q.messages[:n] {
+		q.bytes -= int64(len(msg.Data))
+	}
+	q.messages = append(q.messages[:0:0], q.messages[n:]...)
+}
+
+// keyLocks 按连接标识分段加锁，保证补发离线消息与实时发送的先后顺序
+type keyLocks [64]sync.Mutex
+
+func (l *keyLocks) lock(key string) func() {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	mu := &l[h.Sum32()%uint32(len(l))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// sendOrStore 连接不在线或已关闭时写入离线存储
+func (s *Socket) sendOrStore(key string, messageType int, data []byte) error {
+	defer s.pendingLocks.lock(key)()
+	s.mu.RLock()
+	client, ok := s.clients[key]
+	s.mu.RUnlock()
+	if ok {
+		err := client.enqueue(messageType, data)
+		if !errors.Is(err, ErrConnectionClosed) {
+			return err
+		}
+	}
+	if messageType == 0 {
+		messageType = websocket.TextMessage
+	}
+	if err := s.opts.pendingStore.Append(key, PendingMessage{MessageType: messageType, Data: data, Time: time.Now()}); err != nil {
+		return newError(key, "pending", err)
+	}
+	return nil
+}
+
+// deliverPending 在写循环启动之前直接写出离线消息，调用方持有该标识的锁。
+// 写出失败时停止补发，未送达的消息留在存储中，连接随后由读写循环按断开处理
+func (s *Socket) deliverPending(client *SocketClient) {
+	store := s.opts.pendingStore
+	messages, err := store.DrainSince(client.key, 0)
+	if err != nil {
+		client.reportError(newError(client.key, "pending", err))
+		return
+	}
+	var delivered uint64
+	for _, msg := range messages {
+		data, err := client.transform(msg.MessageType, msg.Data)
+		if err != nil {
+			client.logError(fmt.Sprintf("websocket message dropped by write transformer: %s, client: %s", err, client.key))
+		} else if err = client.write(msg.MessageType, data); err != nil {
+			client.reportWriteError(err)
+			break
+		}
+		delivered = msg.Cursor
+	}
+	if delivered > 0 {
+		if err = store.Trim(client.key, delivered); err != nil {
+			client.reportError(newError(client.key, "pending", err))
+		}
+	}
+}
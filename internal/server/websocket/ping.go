@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// pingPayloadPrefix 主动ping的负载前缀，后接递增序号，与心跳的WithPingMsg区分
+const pingPayloadPrefix = "rtt:"
+
+// Ping 发送一个负载唯一的ping并等待对应的pong，返回往返时延。与自动心跳互不影响，
+// 收到的pong同样刷新读取截止时间；ctx结束或连接关闭时返回错误。只在open阶段可用
+func (s *SocketClient) Ping(ctx context.Context) (time.Duration, error) {
+	if err := s.requireOpen("heartbeat", ErrConnectionClosed); err != nil {
+		return 0, err
+	}
+	arrived := make(chan time.Time, 1)
+	s.pingMu.Lock()
+	if s.pingsClosed {
+		s.pingMu.Unlock()
+		return 0, newError(s.key, "heartbeat", ErrConnectionClosed)
+	}
+	if s.pingWaiters == nil {
+		s.pingWaiters = make(map[string]chan time.Time)
+	}
+	s.pingSeq++
+	payload := pingPayloadPrefix + strconv.FormatUint(s.pingSeq, 10)
+	s.pingWaiters[payload] = arrived
+	s.pingMu.Unlock()
+	defer func() {
+		s.pingMu.Lock()
+		delete(s.pingWaiters, payload)
+		s.pingMu.Unlock()
+	}()
+
+	deadline := time.Now().Add(s.options().writeDeadline)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	start := time.Now()
+	if err := s.conn.WriteControl(websocket.PingMessage, []byte(payload), deadline); err != nil {
+		return 0, newError(s.key, "heartbeat", classifyWriteError(err))
+	}
+	select {
+	case at, ok := <-arrived:
+		if !ok {
+			return 0, newError(s.key, "heartbeat", ErrConnectionClosed)
+		}
+		rtt := at.Sub(start)
+		s.pingRTT.Store(int64(rtt))
+		return rtt, nil
+	case <-ctx.Done():
+		return 0, newError(s.key, "heartbeat", ctx.Err())
+	}
+}
+
+// matchPong 在pong处理函数中调用，唤醒等待该负载的Ping
+func (s *SocketClient) matchPong(payload string, at time.Time) {
+	s.pingMu.Lock()
+	defer s.pingMu.Unlock()
+	if arrived, ok := s.pingWaiters[payload]; ok {
+		arrived <- at
+		delete(s.pingWaiters, payload)
+	}
+}
+
+// cancelPings 读循环退出后不会再收到pong，唤醒所有等待中的Ping
+func (s *SocketClient) cancelPings() {
+	s.pingMu.Lock()
+	defer s.pingMu.Unlock()
+	for _, arrived := range s.pingWaiters {
+		close(arrived)
+	}
+	s.pingWaiters = nil
+	s.pingsClosed = true
+}
+
+// Ping 对指定连接发送ping并等待pong，返回往返时延，连接不存在时返回ErrSessionNotFound
+func (s *Socket) Ping(ctx context.Context, key string) (time.Duration, error) {
+	s.mu.RLock()
+	client, ok := s.clients[key]
+	s.mu.RUnlock()
+	if !ok {
+		return 0, newError(key, "heartbeat", ErrSessionNotFound)
+	}
+	return client.Ping(ctx)
+}
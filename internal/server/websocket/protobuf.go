@@ -0,0 +1,40 @@
+package server
+
+import (
+	"skeleton/internal/server/websocket/wirepb"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+// WithProtobufEncoding 使用proto/envelope.proto定义的Envelope作为线上格式：入站二进制帧解码到Message.Envelope，
+// 解码失败按OnMessage出错处理；WriteMessage发送的消息都编码为Envelope，未设置Envelope时以Data作为Envelope.data。
+// SendTo、SendReader直接发送原始字节，不经过编码
+func WithProtobufEncoding() SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.protobufEncoding = true
+	}
+}
+
+func (s *Socket) encode(message Message) (int, []byte, error) {
+	envelope := message.Envelope
+	if envelope == nil {
+		if !s.opts.protobufEncoding {
+			return message.MessageType, message.Data, nil
+		}
+		envelope = &wirepb.Envelope{Data: message.Data}
+	}
+	data, err := proto.Marshal(envelope)
+	if err != nil {
+		return 0, nil, err
+	}
+	return websocket.BinaryMessage, data, nil
+}
+
+func decodeEnvelope(data []byte) (*wirepb.Envelope, error) {
+	envelope := &wirepb.Envelope{}
+	if err := proto.Unmarshal(data, envelope); err != nil {
+		return nil, wrapError(ErrInvalidEnvelope, err)
+	}
+	return envelope, nil
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// roomBroadcastChannel 房间广播在消息总线上使用的频道
+const roomBroadcastChannel = "websocket:room:broadcast"
+
+// PubSub 多实例部署时用于跨节点广播的消息总线，可基于Redis、NATS等实现
+type PubSub interface {
+	Publish(channel string, msg []byte) error
+	Subscribe(channel string) (<-chan []byte, error)
+}
+
+type roomEnvelope struct {
+	Namespace   string `json:"namespace,omitempty"`
+	Room        string `json:"room"`
+	MessageType int    `json:"type"`
+	Data        []byte `json:"data"`
+}
+
+func (m *RoomManager) publish(name string, messageType int, data []byte) error {
+	payload, err := json.Marshal(roomEnvelope{Namespace: m.namespace, Room: name, MessageType: messageType, Data: data})
+	if err != nil {
+		return newError("", "broadcast", err)
+	}
+	if err = m.socket.opts.pubSub.Publish(roomBroadcastChannel, payload); err != nil {
+		return newError("", "broadcast", err)
+	}
+	return nil
+}
+
+// subscribe 订阅总线上的房间广播，并投递给本节点上的房间成员
+func (m *RoomManager) subscribe() error {
+	messages, err := m.socket.opts.pubSub.Subscribe(roomBroadcastChannel)
+	if err != nil {
+		return newError("", "subscribe", err)
+	}
+	go func() {
+		for payload := range messages {
+			m.receive(payload)
+		}
+		m.unsubscribed.Store(true)
+	}()
+	return nil
+}
+
+func (m *RoomManager) receive(payload []byte) {
+	defer m.socket.recoverPanic("")
+	var envelope roomEnvelope
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return
+	}
+	target := m
+	if envelope.Namespace != "" {
+		ns, ok := m.socket.namespaces[envelope.Namespace]
+		if !ok {
+			return
+		}
+		target = ns.rooms
+	}
+	if room, ok := target.Room(envelope.Room); ok {
+		target.deliver(room, envelope.MessageType, envelope.Data)
+	}
+}
+
+// LocalPubSub 单节点部署使用的进程内消息总线
+type LocalPubSub struct {
+	mu          sync.RWMutex
+	subscribers map[string][]chan []byte
+}
+
+func NewLocalPubSub() *LocalPubSub {
+	return &LocalPubSub{subscribers: make(map[string][]chan []byte)}
+}
+
+func (p *LocalPubSub) Publish(channel string, msg []byte) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, ch := range p.subscribers[channel] {
+		ch <- msg
+	}
+	return nil
+}
+
+func (p *LocalPubSub) Subscribe(channel string) (<-chan []byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ch := make(chan []byte, 1024)
+	p.subscribers[channel] = append(p.subscribers[channel], ch)
+	return ch, nil
+}
+
+// Unsubscribe 取消Subscribe返回的订阅并关闭该通道，订阅不存在时不做任何事。
+// 关闭Socket使用的订阅通道后Health报告消息总线断开
+func (p *LocalPubSub) Unsubscribe(channel string, sub <-chan []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	subscribers := p.subscribers[channel]
+	for i, ch := range subscribers {
+		if ch == sub {
+			p.subscribers[channel] = append(subscribers[:i:i], subscribers[i+1:]...)
+			close(ch)
+			return
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// QueueDepthStats HubStats中在线连接当前发送队列深度(消息数)的分布，在快照时计算
+type QueueDepthStats struct {
+	P50 int
+	P95 int
+	P99 int
+	Max int
+}
+
+// countEnqueued 由入队路径调用，在入队的同时更新高水位，不会错过两次采样之间的短暂峰值
+func (s *SocketClient) countEnqueued(n int) {
+	raiseWatermark(&s.queuePeakMsgs, s.queuedMessages.Add(1))
+	raiseWatermark(&s.queuePeakBytes, s.queuedBytes.Add(int64(n)))
+}
+
+// countDequeued 由写循环在取出消息时调用，包括排队超时被丢弃的消息
+func (s *SocketClient) countDequeued(n int) {
+	s.queuedMessages.Add(-1)
+	s.queuedBytes.Add(-int64(n))
+}
+
+func raiseWatermark(peak *atomic.Int64, current int64) {
+	for {
+		old := peak.Load()
+		if current <= old || peak.CompareAndSwap(old, current) {
+			return
+		}
+	}
+}
+
+// ResetWatermarks 将发送队列的高水位重置为当前深度，用于统计某段时间内的峰值
+func (s *SocketClient) ResetWatermarks() {
+	s.queuePeakMsgs.Store(s.queuedMessages.Load())
+	s.queuePeakBytes.Store(s.queuedBytes.Load())
+}
+
+func queueDepthStats(depths []int) QueueDepthStats {
+	if len(depths) == 0 {
+		return QueueDepthStats{}
+	}
+	sort.Ints(depths)
+	at := func(p float64) int {
+		return depths[int(float64(len(depths)-1)*p)]
+	}
+	return QueueDepthStats{P50: at(0.50), P95: at(0.95), P99: at(0.99), Max: depths[len(depths)-1]}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// WithQueueWaitTimeout 消息在发送队列中等待超过d仍未开始写出时丢弃，计入SocketStats.QueueWaitDrops，
+// 与写入失败分开统计。写入截止时间只约束写出本身，不包含排队时间；对实时性要求高的消息，迟到不如不到。
+// 单条消息可通过SendOpts.QueueWait覆盖，默认不限制
+func WithQueueWaitTimeout(d time.Duration) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.queueWaitTimeout = d
+	}
+}
+
+// queueDeadline 不为每条消息创建定时器，只记录截止时间，由写循环在出队时检查
+func (s *SocketClient) queueDeadline(wait time.Duration) time.Time {
+	if wait == 0 {
+		wait = s.socket.opts.queueWaitTimeout
+	}
+	if wait <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(wait)
+}
+
+// expired 在写循环出队时调用，返回true时丢弃该消息
+func (s *SocketClient) expired(message outbound, now time.Time) bool {
+	if message.deadline.IsZero() || now.Before(message.deadline) {
+		return false
+	}
+	s.queueWaitDrops.Add(1)
+	return true
+}
+
+// SendWait 与SendBytesOpt相同经由发送队列写出，队列已满时等待空位而不是立即返回ErrQueueFull。
+// 排队等待时间(opts.QueueWait或WithQueueWaitTimeout)从调用时开始计算，包含等待空位的时间：
+// 超时仍未入队时返回ErrQueueTimeout并计入QueueWaitDrops，入队后超时仍由写循环丢弃；ctx结束返回ctx的错误。只在open阶段可用
+func (s *SocketClient) SendWait(ctx context.Context, messageType int, data []byte, opts SendOpts) error {
+	if err := s.requireOpen("send", ErrConnectionClosed); err != nil {
+		return err
+	}
+	message := outbound{messageType: messageType, data: data, compress: opts.Compress, deadline: s.queueDeadline(opts.QueueWait), key: opts.Key}
+	var timeout <-chan time.Time
+	if !message.deadline.IsZero() {
+		// 每次调用只有一个定时器，在截止时间唤醒
+		timer := time.NewTimer(time.Until(message.deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	s.queueWaiters.Add(1)
+	defer s.queueWaiters.Add(-1)
+	for {
+		err := s.enqueueOutbound(message)
+		if err == nil || !errors.Is(err, ErrQueueFull) {
+			return err
+		}
+		select {
+		case <-s.queueFreed:
+		case <-s.sendDone:
+		case <-timeout:
+			s.queueWaitDrops.Add(1)
+			return newError(s.key, "send", ErrQueueTimeout)
+		case <-ctx.Done():
+			return newError(s.key, "send", ctx.Err())
+		}
+	}
+}
+
+// notifyQueueFreed 写循环每取出一条消息时唤醒一个等待中的SendWait，没有等待者时不做任何事
+func (s *SocketClient) notifyQueueFreed() {
+	if s.queueWaiters.Load() == 0 {
+		return
+	}
+	select {
+	case s.queueFreed <- struct{}{}:
+	default:
+	}
+}
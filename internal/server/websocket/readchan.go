@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"sync"
+)
+
+// IncomingMessage ReadPumpChan中的一条入站消息，Done为true时读循环已经退出，
+// Err为导致退出的错误(正常关闭时为nil)，随后通道被关闭
+type IncomingMessage struct {
+	Type int
+	Data []byte
+	Err  error
+	Done bool
+}
+
+type readSubscriber struct {
+	ctx    context.Context
+	stop   func() bool
+	mu     sync.Mutex
+	ch     chan IncomingMessage
+	closed bool
+}
+
+// ReadPumpChan 以通道的形式订阅该连接的入站消息，可配合for range使用，不需要实现MessageHandler。
+// 只能收到订阅之后的消息，handler的OnMessage仍会照常回调；消息在读循环中逐个投递，
+// 消费过慢会阻塞读取，与OnMessage处理过慢的效果相同。ctx结束后通道被关闭，不再投递Done消息。
+// 可以多次调用，与读循环本身互不影响；读循环已退出或不会再启动(升级完成之前为ErrNotOpen，未启动就已关闭为ErrClosed)时
+// 通道立即收到Done消息
+func (s *SocketClient) ReadPumpChan(ctx context.Context) <-chan IncomingMessage {
+	sub := &readSubscriber{ctx: ctx, ch: make(chan IncomingMessage, 1)}
+	s.readersMu.Lock()
+	err := s.readErr
+	if !s.readDone && s.state.Load()&readingFlag == 0 {
+		// 尚未启动读循环，只有之后还能启动时才登记订阅
+		err = s.requireLive("read", ErrConnectionClosed)
+	}
+	if s.readDone || err != nil {
+		s.readersMu.Unlock()
+		go func() {
+			defer s.socket.recoverPanic(s.key)
+			sub.finish(&IncomingMessage{Err: err, Done: true})
+		}()
+		return sub.ch
+	}
+	// stop必须在登记之前赋值：读循环随时可能退出，finishReaders会在释放readersMu之后调用它
+	sub.stop = context.AfterFunc(ctx, func() {
+		s.readersMu.Lock()
+		delete(s.readers, sub)
+		s.readersMu.Unlock()
+		sub.finish(nil)
+	})
+	if ctx.Err() == nil {
+		if s.readers == nil {
+			s.readers = make(map[*readSubscriber]struct{})
+		}
+		s.readers[sub] = struct{}{}
+	}
+	s.readersMu.Unlock()
+	return sub.ch
+}
+
+func (s *SocketClient) dispatchReaders(message IncomingMessage) {
+	s.readersMu.Lock()
+	if len(s.readers) == 0 {
+		s.readersMu.Unlock()
+		return
+	}
+	subs := make([]*readSubscriber, 0, len(s.readers))
+	for sub := range s.readers {
+		subs = append(subs, sub)
+	}
+	s.readersMu.Unlock()
+	for _, sub := range subs {
+		sub.deliver(message)
+	}
+}
+
+// finishReaders 读循环退出时调用，向所有订阅者投递Done消息并关闭通道
+func (s *SocketClient) finishReaders(err error) {
+	s.readersMu.Lock()
+	s.readDone = true
+	s.readErr = err
+	subs := s.readers
+	s.readers = nil
+	s.readersMu.Unlock()
+	for sub := range subs {
+		sub.stop()
+		go func(sub *readSubscriber) {
+			defer s.socket.recoverPanic(s.key)
+			sub.finish(&IncomingMessage{Err: err, Done: true})
+		}(sub)
+	}
+}
+
+func (r *readSubscriber) deliver(message IncomingMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	select {
+	case r.ch <- message:
+	case <-r.ctx.Done():
+	}
+}
+
+// finish 只关闭一次通道，final不为nil时先尝试投递
+func (r *readSubscriber) finish(final *IncomingMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if final != nil {
+		select {
+		case r.ch <- *final:
+		case <-r.ctx.Done():
+		}
+	}
+	r.closed = true
+	close(r.ch)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+type readWriter struct {
+	key      string
+	writer   MessageWriter
+	messages <-chan IncomingMessage
+	mu       sync.Mutex
+	pending  []byte
+	err      error
+}
+
+// NewReadWriter 将连接key包装为io.ReadWriter，便于SSH、VNC等基于流的库通过websocket隧道通信。
+// Read依次返回二进制消息中的字节，一条消息可以分多次读取，没有数据时阻塞，文本消息被忽略，
+// 连接关闭后返回io.EOF或导致关闭的错误；Write将p作为一条二进制消息发送。
+// 创建后到达的二进制消息都会被保留给Read，读取过慢会阻塞该连接的读循环
+func NewReadWriter(socket SocketClientInterface, key string) (io.ReadWriter, error) {
+	messages, err := socket.ReadPumpChan(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &readWriter{key: key, writer: socket, messages: messages}, nil
+}
+
+func (rw *readWriter) Read(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	for len(rw.pending) == 0 {
+		if rw.err != nil {
+			return 0, rw.err
+		}
+		message, ok := <-rw.messages
+		switch {
+		case !ok:
+			rw.err = io.EOF
+		case message.Done:
+			rw.err = message.Err
+			if rw.err == nil {
+				rw.err = io.EOF
+			}
+		case message.Type == websocket.BinaryMessage:
+			rw.pending = message.Data
+		}
+	}
+	n := copy(p, rw.pending)
+	rw.pending = rw.pending[n:]
+	return n, nil
+}
+
+// Write 发送队列会持有数据直到写出，因此先复制p，满足io.Writer不保留p的约定
+func (rw *readWriter) Write(p []byte) (int, error) {
+	data := make([]byte, len(p))
+	copy(data, p)
+	if err := rw.writer.SendTo(rw.key, websocket.BinaryMessage, data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// WithStaleConnectionReaper 每隔interval扫描一次所有连接，回收心跳和读取截止时间本应处理、却因异常(例如OnMessage阻塞、
+// 会话存储卡住关闭流程)仍留在连接表中的连接：
+//   - 在线连接超过max(threshold, 该连接的健康上限)没有任何入站数据帧、ping或pong时，以4004(CloseStaleConnection)关闭。
+//     健康上限为pingPeriod*(heartbeatFailMaxTimes+1)与读取截止时间中的较大者，按UpdateOption调整后的值计算；
+//     既没有心跳也没有读取截止时间(WithNoReadDeadline配合WithAllowNoLiveness)的连接允许长期空闲，不会因此回收
+//   - 已开始关闭但连续两次扫描仍未从连接表中移除的连接直接移除
+//
+// 回收次数见HubStats.ReapedConnections。扫描只在复制连接列表时持有读锁，之后逐个读取原子计数，不加连接级的锁
+func WithStaleConnectionReaper(interval, threshold time.Duration) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.reapInterval = interval
+		opt.reapThreshold = threshold
+	}
+}
+
+type staleReaper struct {
+	reaped atomic.Int64
+	// closing 上一次扫描时已不在线但仍在连接表中的连接，只在扫描goroutine中使用
+	closing map[*SocketClient]struct{}
+}
+
+func (s *Socket) reapStaleConnections() {
+	defer s.recoverPanic("")
+	ticker := time.NewTicker(s.opts.reapInterval)
+	defer ticker.Stop()
+	var clients []*SocketClient
+	for now := range ticker.C {
+		s.mu.RLock()
+		clients = clients[:0]
+		for _, client := range s.clients {
+			clients = append(clients, client)
+		}
+		s.mu.RUnlock()
+		closing := make(map[*SocketClient]struct{})
+		for _, client := range clients {
+			if client.State() != OnlineState {
+				if _, seen := s.reaper.closing[client]; seen {
+					if !client.reaping.Swap(true) {
+						s.reaper.reaped.Add(1)
+					}
+					s.removeClient(client)
+				} else {
+					closing[client] = struct{}{}
+				}
+				continue
+			}
+			if client.stale(now, s.opts.reapThreshold) && client.reaping.CompareAndSwap(false, true) {
+				s.reaper.reaped.Add(1)
+				// 关闭流程会回调OnClose，可能正是卡住的handler，不能阻塞扫描
+				go func(client *SocketClient) {
+					defer s.recoverPanic(client.key)
+					s.logWarning(client.key, "reap", ErrDeadConnection)
+					_ = client.closeWith(CloseStaleConnection, "stale connection")
+				}(client)
+			}
+		}
+		s.reaper.closing = closing
+		clear(clients)
+	}
+}
+
+// removeClient 只移除仍是该连接的表项，同一标识可能已有新连接；
+// 不在连接表中的连接(已被替换或由NewSocketClient创建)只关闭其发送队列并清理标签
+func (s *Socket) removeClient(client *SocketClient) {
+	s.mu.RLock()
+	current := s.clients[client.key] == client
+	s.mu.RUnlock()
+	if current {
+		s.remove(client.key)
+		return
+	}
+	client.closeSend()
+	s.tags.removeAll(client)
+}
+
+// stale 最近一次入站活动距now超过threshold和健康上限中的较大者
+func (s *SocketClient) stale(now time.Time, threshold time.Duration) bool {
+	settings := s.options()
+	var healthy time.Duration
+	if settings.pingPeriod > 0 {
+		healthy = settings.pingPeriod * time.Duration(settings.heartbeatFailMaxTimes+1)
+	}
+	if !settings.noReadDeadline {
+		healthy = max(healthy, settings.readDeadline)
+	}
+	if healthy == 0 {
+		return false
+	}
+	return now.Sub(s.lastInbound()) > max(threshold, healthy)
+}
+
+// lastInbound 最近一次收到数据帧、ping或pong的时间，都没有时为建立连接的时间
+func (s *SocketClient) lastInbound() time.Time {
+	last := max(s.lastReadAt.Load(), s.lastPongAt.Load())
+	if last == 0 {
+		return s.handshake.ConnectedAt
+	}
+	return time.Unix(0, last)
+}
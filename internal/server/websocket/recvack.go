@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxReceiveAhead 比已确认序号超前超过该数量的消息不分发也不记录，客户端需在空缺补齐后重发
+const maxReceiveAhead = 1024
+
+// receivedNotice 累计确认帧，表示序号不大于Through的消息都已处理
+type receivedNotice struct {
+	Type    string `json:"type"`
+	Through int64  `json:"through"`
+}
+
+// WithReceiveAcks 开启入站消息的累计确认：客户端在JSON对象文本消息中带上"_seq":n(从任意正整数开始连续递增)，
+// 每成功分发every条或距上一条未确认消息超过interval时发送{"type":"received","through":k}，k为连续收到的最大序号，
+// 客户端可以丢弃不大于k的重发缓冲。连接上第一条带序号的消息确定起点；乱序到达的消息照常分发，空缺补齐后k一次前进；
+// 已处理过的序号(不大于k或已乱序收到)视为重发，不再交给OnMessage，计入SocketStats.DuplicatesSuppressed并立即回复确认。
+// OnMessage返回错误或panic的消息不算收到，客户端重发后会再次分发。every、interval不大于0时不按该条件发送，两者不能都不大于0
+func WithReceiveAcks(every int, interval time.Duration) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.recvAckEvery = every
+		opt.recvAckInterval = interval
+		opt.recvAcks = true
+	}
+}
+
+// receiveAcks 读循环和定时器共用，由mu保护
+type receiveAcks struct {
+	mu      sync.Mutex
+	started bool
+	through int64
+	ahead   map[int64]struct{}
+	// pending 上次确认之后成功分发的消息数
+	pending int
+	timer   *time.Timer
+}
+
+// receiveSeq 返回消息的序号，没有序号时为0；skip为true时消息是重发或超前太多，不应分发
+func (s *SocketClient) receiveSeq(messageType int, data []byte) (seq int64, skip bool) {
+	if !s.socket.opts.recvAcks || messageType != websocket.TextMessage || !bytes.Contains(data, []byte(`"_seq"`)) {
+		return 0, false
+	}
+	var stamped struct {
+		Seq *int64 `json:"_seq"`
+	}
+	if json.Unmarshal(data, &stamped) != nil || stamped.Seq == nil || *stamped.Seq <= 0 {
+		return 0, false
+	}
+	seq = *stamped.Seq
+	r := &s.recvAcks
+	r.mu.Lock()
+	if !r.started {
+		r.started, r.through = true, seq-1
+	}
+	_, seen := r.ahead[seq]
+	through := r.through
+	r.mu.Unlock()
+	switch {
+	case seq <= through || seen:
+		s.recvDuplicates.Add(1)
+		s.sendReceived()
+		return seq, true
+	case seq > through+maxReceiveAhead:
+		s.socket.logWarning(s.key, "receive ack", fmt.Errorf("%w: seq %d is more than %d ahead of %d", ErrInvalidPayload, seq, maxReceiveAhead, through))
+		return seq, true
+	}
+	return seq, false
+}
+
+// markReceived 读循环在OnMessage成功返回后调用
+func (s *SocketClient) markReceived(seq int64) {
+	if seq == 0 {
+		return
+	}
+	opts := s.socket.opts
+	r := &s.recvAcks
+	r.mu.Lock()
+	if seq == r.through+1 {
+		r.through = seq
+		for {
+			if _, ok := r.ahead[r.through+1]; !ok {
+				break
+			}
+			delete(r.ahead, r.through+1)
+			r.through++
+		}
+	} else if seq > r.through {
+		if r.ahead == nil {
+			r.ahead = make(map[int64]struct{})
+		}
+		r.ahead[seq] = struct{}{}
+	}
+	r.pending++
+	due := opts.recvAckEvery > 0 && r.pending >= opts.recvAckEvery
+	if !due && r.timer == nil && opts.recvAckInterval > 0 {
+		r.timer = time.AfterFunc(opts.recvAckInterval, s.sendReceived)
+	}
+	r.mu.Unlock()
+	if due {
+		s.sendReceived()
+	}
+}
+
+// sendReceived 经由发送队列发送累计确认，队列已满时由下一次确认覆盖
+func (s *SocketClient) sendReceived() {
+	r := &s.recvAcks
+	r.mu.Lock()
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	r.pending = 0
+	through := r.through
+	r.mu.Unlock()
+	if s.State() != OnlineState {
+		return
+	}
+	messageType, data, err := s.encodeNotice(receivedNotice{Type: "received", Through: through})
+	if err == nil {
+		err = s.enqueue(messageType, data)
+	}
+	if err != nil {
+		s.socket.logWarning(s.key, "receive ack", err)
+	}
+}
+
+// ReceivedThrough 累计确认的序号，未开启WithReceiveAcks或尚未收到带序号的消息时为0
+func (s *SocketClient) ReceivedThrough() int64 {
+	s.recvAcks.mu.Lock()
+	defer s.recvAcks.mu.Unlock()
+	return s.recvAcks.through
+}
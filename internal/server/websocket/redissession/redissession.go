@@ -0,0 +1,68 @@
+// Package redissession 基于Redis的SessionStateStore实现
+package redissession
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	server "skeleton/internal/server/websocket"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// DefaultPrefix 会话状态的键前缀，完整的键为前缀加恢复令牌
+	DefaultPrefix = "ws:session:"
+	// opTimeout 单次读写的超时时间，读写在握手和持久化的goroutine中执行
+	opTimeout = 3 * time.Second
+)
+
+// Store 状态按JSON保存在字符串键中，连接不由Store管理，调用方负责关闭
+type Store struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+var _ server.SessionStateStore = (*Store)(nil)
+
+// New prefix为空时使用DefaultPrefix
+func New(client redis.UniversalClient, prefix string) *Store {
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	return &Store{client: client, prefix: prefix}
+}
+
+// WithRedisSessionPersistence 等同于server.WithSessionPersistence(New(client, ""), ttl)
+func WithRedisSessionPersistence(client redis.UniversalClient, ttl time.Duration) server.SocketOptionFunc {
+	return server.WithSessionPersistence(New(client, ""), ttl)
+}
+
+func (s *Store) Save(token string, state server.SessionState, ttl time.Duration) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	return s.client.Set(ctx, s.prefix+token, data, ttl).Err()
+}
+
+func (s *Store) Load(token string) (server.SessionState, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	data, err := s.client.Get(ctx, s.prefix+token).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return server.SessionState{}, false, nil
+	}
+	if err != nil {
+		return server.SessionState{}, false, err
+	}
+	var state server.SessionState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return server.SessionState{}, false, err
+	}
+	return state, true, nil
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type RoomMessage struct {
+	MessageType int
+	Data        []byte
+	CreatedAt   time.Time
+	// Coalesced 受BroadcastsPerSecond限制时，该广播替换掉的同一窗口内的广播数量
+	Coalesced int64
+}
+
+type Room struct {
+	name                string
+	mu                  sync.RWMutex
+	members             map[string]struct{}
+	history             *roomHistory
+	limiter             *tokenBucket
+	limits              RoomLimits
+	inbound             *tokenBucket
+	lastBroadcast       time.Time
+	pending             *RoomMessage
+	pendingCoalesced    int64
+	delayed             []delayedSend
+	delaying            bool
+	inboundRejected     atomic.Int64
+	broadcastsCoalesced atomic.Int64
+	suppressedCount     atomic.Int64
+}
+
+type RoomManager struct {
+	socket              *Socket
+	mu                  sync.RWMutex
+	rooms               map[string]*Room
+	limits              map[string]RoomLimits
+	historyEnabled      map[string]bool
+	unsubscribed        atomic.Bool
+	inboundRejected     atomic.Int64
+	broadcastsCoalesced atomic.Int64
+	suppressedCount     atomic.Int64
+	coalesceMu          sync.Mutex
+	coalescers          map[string]*roomCoalescer
+	namespace           string
+	defaultLimits       RoomLimits
+}
+
+// newRoomManager namespace为空时是Socket.Rooms()，limits为房间默认的流量限制
+func newRoomManager(socket *Socket, namespace string, limits RoomLimits) *RoomManager {
+	return &RoomManager{
+		socket:         socket,
+		namespace:      namespace,
+		defaultLimits:  limits,
+		rooms:          make(map[string]*Room),
+		limits:         make(map[string]RoomLimits),
+		historyEnabled: make(map[string]bool),
+		coalescers:     make(map[string]*roomCoalescer),
+	}
+}
+
+// Join 加入房间，开启历史消息时会向新成员补发最近的消息，补发的消息总是排在加入之后的广播之前。
+// 最后一个成员离开时房间连同历史消息一起删除
+func (m *RoomManager) Join(name, key string) error {
+	client, err := m.socket.Client(key)
+	if err != nil || client.State() != OnlineState {
+		return newError(key, "join", ErrConnectionClosed)
+	}
+	if !m.admits(client) {
+		return newError(key, "join", ErrSessionNotFound)
+	}
+	m.mu.Lock()
+	room, ok := m.rooms[name]
+	if !ok {
+		room = newRoom(name, m.socket.opts, m.defaultLimits)
+		if limits, ok := m.limits[name]; ok {
+			room.setLimits(limits)
+		}
+		m.rooms[name] = room
+	}
+	room.mu.Lock()
+	room.members[key] = struct{}{}
+	// 登记成员和补发历史消息在同一把锁内完成：并发的广播要在锁释放后才能看到新成员，入队时一定排在历史消息之后
+	err = m.replayHistory(client, room.history.list())
+	room.mu.Unlock()
+	m.mu.Unlock()
+	client.markSessionDirty()
+	return err
+}
+
+// replayHistory 调用方持有房间锁，只写入发送队列不等待写出
+func (m *RoomManager) replayHistory(client *SocketClient, history []RoomMessage) error {
+	for _, msg := range history {
+		messageType, data, err := m.socket.encode(Message{MessageType: msg.MessageType, Data: msg.Data})
+		if err != nil {
+			return newError(client.key, "join", err)
+		}
+		if err = client.enqueue(messageType, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *RoomManager) Leave(name, key string) {
+	m.mu.Lock()
+	if room, ok := m.rooms[name]; ok {
+		m.leave(room, key)
+	}
+	m.mu.Unlock()
+	m.socket.markSessionDirty(key)
+}
+
+func (m *RoomManager) Room(name string) (*Room, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	room, ok := m.rooms[name]
+	return room, ok
+}
+
+// Broadcast 向房间内所有在线成员发送消息，并记录到历史消息中；配置了WithPubSub时经由消息总线投递到所有节点。
+// 房间有BroadcastCoalesced暂存的广播时先投递暂存的广播
+func (m *RoomManager) Broadcast(name string, messageType int, data []byte) error {
+	return m.ordered(name, func() error { return m.broadcast(name, messageType, data) })
+}
+
+func (m *RoomManager) broadcast(name string, messageType int, data []byte) error {
+	if m.socket.opts.pubSub != nil {
+		return m.publish(name, messageType, data)
+	}
+	room, ok := m.Room(name)
+	if !ok {
+		return newError("", "broadcast", ErrRoomNotFound)
+	}
+	m.deliver(room, messageType, data)
+	return nil
+}
+
+// SendFrom 房间成员key向房间发送消息。超出RoomLimits.InboundPerSecond的消息被拒绝并返回ErrRateLimited；
+// 配置了WithRoomRateLimit时受房间级总速率限制：超出限制的消息不会被丢弃，而是向发送者推送rate_limited通知后立即返回nil，
+// 消息在房间的延迟队列中按发送顺序等到令牌可用时经由Broadcast投递，不会阻塞调用方。
+// 延迟队列最多容纳5秒的消息，已满时拒绝并返回ErrRateLimited，发送者收到带"rejected":true的rate_limited通知
+func (m *RoomManager) SendFrom(name, key string, messageType int, data []byte) error {
+	room, ok := m.Room(name)
+	if !ok {
+		return newError(key, "room send", ErrRoomNotFound)
+	}
+	room.mu.RLock()
+	_, member := room.members[key]
+	room.mu.RUnlock()
+	if !member {
+		return newError(key, "room send", ErrNotRoomMember)
+	}
+	if err := m.admitInbound(room, key); err != nil {
+		return err
+	}
+	if room.limiter != nil {
+		wait := room.limiter.reserve()
+		queued, err := m.deferSend(room, wait, messageType, data)
+		if err != nil {
+			notice := rateLimitedNotice(wait)
+			notice["room"], notice["rejected"] = name, true
+			m.socket.sendNotice(key, notice)
+			return newError(key, "room send", err)
+		}
+		if wait > 0 {
+			m.socket.sendNotice(key, rateLimitedNotice(wait))
+		}
+		if queued {
+			return nil
+		}
+	}
+	return m.Broadcast(name, messageType, data)
+}
+
+func rateLimitedNotice(wait time.Duration) map[string]any {
+	return map[string]any{
+		"type":           "rate_limited",
+		"retry_after_ms": wait.Milliseconds(),
+	}
+}
+
+func (m *RoomManager) deliver(room *Room, messageType int, data []byte) {
+	msg := RoomMessage{MessageType: messageType, Data: data, CreatedAt: time.Now()}
+	if m.throttleBroadcast(room, msg) {
+		m.deliverNow(room, msg)
+	}
+}
+
+// deliverNow 合并过的文本JSON广播加上"_coalesced"字段标明替换掉的广播数量，历史消息中保留原始内容
+func (m *RoomManager) deliverNow(room *Room, msg RoomMessage) {
+	room.mu.Lock()
+	room.history.push(msg)
+	members := room.memberKeys()
+	room.mu.Unlock()
+	m.recordHistory(room, msg)
+
+	messageType, data := msg.MessageType, msg.Data
+	if msg.Coalesced > 0 && messageType != websocket.BinaryMessage {
+		data = prependJSONField(data, "_coalesced", msg.Coalesced)
+	}
+	for _, key := range members {
+		if m.socket.GetClientState(key) != OnlineState {
+			continue
+		}
+		_ = m.socket.WriteMessage(Message{
+			MessageType: messageType,
+			Subkeys:     []string{key},
+			Data:        data,
+		})
+	}
+}
+
+func (m *RoomManager) leaveAll(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, room := range m.rooms {
+		m.leave(room, key)
+	}
+}
+
+func (m *RoomManager) leave(room *Room, key string) {
+	room.mu.Lock()
+	delete(room.members, key)
+	// 没有成员的房间连同历史消息一起删除，否则房间频繁创建销毁时rooms会无限增长
+	empty := len(room.members) == 0
+	room.mu.Unlock()
+	if empty {
+		delete(m.rooms, room.name)
+		// 调用方持有m.mu，暂存的合并广播在另一个goroutine中投递
+		go m.flushCoalesced(room.name)
+	}
+}
+
+func newRoom(name string, opts *SocketOption, limits RoomLimits) *Room {
+	room := &Room{
+		name:    name,
+		members: make(map[string]struct{}),
+	}
+	if opts.roomHistorySize > 0 {
+		room.history = newRoomHistory(opts.roomHistorySize)
+	}
+	if opts.roomRateLimit > 0 {
+		room.limiter = newTokenBucket(opts.roomRateLimit)
+	}
+	room.setLimits(limits)
+	return room
+}
+
+func (r *Room) Name() string {
+	return r.name
+}
+
+func (r *Room) Members() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.memberKeys()
+}
+
+// History 按时间顺序返回房间保留的历史消息
+func (r *Room) History() []RoomMessage {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.history.list()
+}
+
+func (r *Room) ClearHistory() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.history.clear()
+}
+
+func (r *Room) memberKeys() []string {
+	keys := make([]string, 0, len(r.members))
+	for key := range r.members {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// roomHistory 固定容量的环形缓冲区，写满后覆盖最早的消息
+type roomHistory struct {
+	buf   []RoomMessage
+	start int
+	size  int
+}
+
+func newRoomHistory(capacity int) *roomHistory {
+	return &roomHistory{buf: make([]RoomMessage, capacity)}
+}
+
+func (h *roomHistory) push(msg RoomMessage) {
+	if h == nil {
+		return
+	}
+	if h.size < len(h.buf) {
+		h.buf[(h.start+h.size)%len(h.buf)] = msg
+		h.size++
+		return
+	}
+	h.buf[h.start] = msg
+	h.start = (h.start + 1) % len(h.buf)
+}
+
+func (h *roomHistory) list() []RoomMessage {
+	if h == nil {
+		return []RoomMessage{}
+	}
+	messages := make([]RoomMessage, 0, h.size)
+	for i := 0; i < h.size; i++ {
+		messages = append(messages, h.buf[(h.start+i)%len(h.buf)])
+	}
+	return messages
+}
+
+func (h *roomHistory) clear() {
+	if h == nil {
+		return
+	}
+	h.buf = make([]RoomMessage, len(h.buf))
+	h.start, h.size = 0, 0
+}
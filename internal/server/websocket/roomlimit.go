@@ -0,0 +1,262 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// RoomLimits 房间级的流量控制，零值表示不限制
+type RoomLimits struct {
+	// InboundPerSecond 房间内所有成员通过SendFrom发送消息的总速率上限，超出的消息被拒绝，
+	// 发送者收到rate_limited通知。与WithRoomRateLimit不同，后者让消息进入延迟队列而不是拒绝
+	InboundPerSecond int
+	// BroadcastsPerSecond 房间广播的频率上限，同一窗口内多余的广播被合并，窗口结束时只投递最新的一条
+	BroadcastsPerSecond int
+}
+
+func (l RoomLimits) validate() error {
+	if l.InboundPerSecond < 0 || l.BroadcastsPerSecond < 0 {
+		return fmt.Errorf("%w: room limits must be positive, got %+v", ErrInvalidOption, l)
+	}
+	return nil
+}
+
+func (l RoomLimits) broadcastInterval() time.Duration {
+	if l.BroadcastsPerSecond <= 0 {
+		return 0
+	}
+	return time.Second / time.Duration(l.BroadcastsPerSecond)
+}
+
+// 触发房间限制的事件类型
+const (
+	RoomInboundRejected    = "inbound_rejected"
+	RoomBroadcastCoalesced = "broadcast_coalesced"
+)
+
+// RoomLimitEvent Key为被拒绝消息的发送者，合并广播时为空
+type RoomLimitEvent struct {
+	Room string
+	Kind string
+	Key  string
+}
+
+// RoomStats 房间限制的计数
+type RoomStats struct {
+	Members             int
+	InboundRejected     int64
+	BroadcastsCoalesced int64
+	// BroadcastsSuppressed 被BroadcastCoalesced窗口内更新的广播替换掉的次数
+	BroadcastsSuppressed int64
+}
+
+// WithRoomLimits 所有房间默认的流量限制，单个房间可通过RoomManager.SetRoomLimits覆盖
+func WithRoomLimits(limits RoomLimits) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.roomLimits = limits
+	}
+}
+
+// WithRoomLimitHook 每次拒绝入站消息或合并广播时回调，用于告警。fn在发送消息的调用方或定时器中同步执行，应尽快返回
+func WithRoomLimitHook(fn func(event RoomLimitEvent)) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.roomLimitHook = fn
+	}
+}
+
+// SetRoomLimits 运行时调整房间的流量限制，房间尚未创建时在创建后生效，覆盖WithRoomLimits的默认值
+func (m *RoomManager) SetRoomLimits(name string, limits RoomLimits) error {
+	if err := limits.validate(); err != nil {
+		return newError("", "room limits", err)
+	}
+	m.mu.Lock()
+	m.limits[name] = limits
+	room, ok := m.rooms[name]
+	m.mu.Unlock()
+	if ok {
+		room.setLimits(limits)
+	}
+	return nil
+}
+
+// RoomLimits 房间当前生效的流量限制
+func (m *RoomManager) RoomLimits(name string) RoomLimits {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if limits, ok := m.limits[name]; ok {
+		return limits
+	}
+	return m.defaultLimits
+}
+
+// Stats 所有房间(包括已删除的房间)累计的限制计数，Members为当前在线的房间成员总数
+func (m *RoomManager) Stats() RoomStats {
+	m.mu.RLock()
+	members := 0
+	for _, room := range m.rooms {
+		room.mu.RLock()
+		members += len(room.members)
+		room.mu.RUnlock()
+	}
+	m.mu.RUnlock()
+	return RoomStats{
+		Members:              members,
+		InboundRejected:      m.inboundRejected.Load(),
+		BroadcastsCoalesced:  m.broadcastsCoalesced.Load(),
+		BroadcastsSuppressed: m.suppressedCount.Load(),
+	}
+}
+
+func (r *Room) Stats() RoomStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return RoomStats{
+		Members:              len(r.members),
+		InboundRejected:      r.inboundRejected.Load(),
+		BroadcastsCoalesced:  r.broadcastsCoalesced.Load(),
+		BroadcastsSuppressed: r.suppressedCount.Load(),
+	}
+}
+
+func (r *Room) setLimits(limits RoomLimits) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if limits.InboundPerSecond != r.limits.InboundPerSecond {
+		r.inbound = nil
+		if limits.InboundPerSecond > 0 {
+			r.inbound = newTokenBucket(limits.InboundPerSecond)
+		}
+	}
+	r.limits = limits
+}
+
+// admitInbound SendFrom超出InboundPerSecond时拒绝，向发送者推送rate_limited通知
+func (m *RoomManager) admitInbound(room *Room, key string) error {
+	room.mu.RLock()
+	inbound := room.inbound
+	room.mu.RUnlock()
+	if inbound == nil {
+		return nil
+	}
+	ok, wait := inbound.allow()
+	if ok {
+		return nil
+	}
+	room.inboundRejected.Add(1)
+	m.inboundRejected.Add(1)
+	m.socket.sendNotice(key, map[string]any{
+		"type":           "rate_limited",
+		"room":           room.name,
+		"rejected":       true,
+		"retry_after_ms": wait.Milliseconds(),
+	})
+	m.notifyLimit(RoomLimitEvent{Room: room.name, Kind: RoomInboundRejected, Key: key})
+	return newError(key, "room send", ErrRateLimited)
+}
+
+// throttleBroadcast 返回true时立即投递；否则消息作为窗口内最新的广播暂存，替换掉之前暂存的广播，
+// 窗口结束时由定时器投递
+func (m *RoomManager) throttleBroadcast(room *Room, msg RoomMessage) bool {
+	room.mu.Lock()
+	interval := room.limits.broadcastInterval()
+	now := time.Now()
+	if interval <= 0 || (room.pending == nil && now.Sub(room.lastBroadcast) >= interval) {
+		room.lastBroadcast = now
+		room.mu.Unlock()
+		return true
+	}
+	replaced := room.pending != nil
+	if replaced {
+		room.pendingCoalesced++
+	} else {
+		time.AfterFunc(room.lastBroadcast.Add(interval).Sub(now), func() { m.flushBroadcast(room) })
+	}
+	room.pending = &msg
+	room.mu.Unlock()
+
+	if replaced {
+		room.broadcastsCoalesced.Add(1)
+		m.broadcastsCoalesced.Add(1)
+		m.notifyLimit(RoomLimitEvent{Room: room.name, Kind: RoomBroadcastCoalesced})
+	}
+	return false
+}
+
+func (m *RoomManager) flushBroadcast(room *Room) {
+	defer m.socket.recoverPanic("")
+	room.mu.Lock()
+	msg, coalesced := room.pending, room.pendingCoalesced
+	room.pending, room.pendingCoalesced = nil, 0
+	room.lastBroadcast = time.Now()
+	room.mu.Unlock()
+	if msg != nil {
+		msg.Coalesced = coalesced
+		m.deliverNow(room, *msg)
+	}
+}
+
+// delayedSend 超出WithRoomRateLimit的消息，到due时投递
+type delayedSend struct {
+	due         time.Time
+	messageType int
+	data        []byte
+}
+
+// maxRoomDelay 延迟队列最多容纳WithRoomRateLimit速率下这段时间内的消息，超出时拒绝而不是继续排队
+const maxRoomDelay = 5 * time.Second
+
+// deferSend 需要等待或者前面还有未投递的延迟消息时把消息放入房间的延迟队列并返回true，
+// 后者保证令牌恢复后立即发送的消息不会越过排队中的消息。队列已满时返回ErrRateLimited
+func (m *RoomManager) deferSend(room *Room, wait time.Duration, messageType int, data []byte) (bool, error) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if wait <= 0 && !room.delaying {
+		return false, nil
+	}
+	if len(room.delayed) >= int(room.limiter.rate*maxRoomDelay.Seconds()) {
+		return false, ErrRateLimited
+	}
+	room.delayed = append(room.delayed, delayedSend{due: time.Now().Add(wait), messageType: messageType, data: data})
+	if !room.delaying {
+		room.delaying = true
+		time.AfterFunc(wait, func() { m.flushDelayed(room) })
+	}
+	return true, nil
+}
+
+// flushDelayed 按顺序投递已经到期的延迟消息，队列清空之前delaying保持为true，同一时刻只有一个flushDelayed在运行
+func (m *RoomManager) flushDelayed(room *Room) {
+	defer m.socket.recoverPanic("")
+	for {
+		room.mu.Lock()
+		now := time.Now()
+		n := 0
+		for n < len(room.delayed) && !room.delayed[n].due.After(now) {
+			n++
+		}
+		due := append([]delayedSend(nil), room.delayed[:n]...)
+		room.delayed = room.delayed[n:]
+		if n == 0 {
+			if len(room.delayed) == 0 {
+				room.delaying = false
+			} else {
+				time.AfterFunc(room.delayed[0].due.Sub(now), func() { m.flushDelayed(room) })
+			}
+			room.mu.Unlock()
+			return
+		}
+		room.mu.Unlock()
+		// 与直接发送一样经由Broadcast：先投递暂存的合并广播，配置了WithPubSub时发布到所有节点，房间已删除时丢弃
+		for _, d := range due {
+			_ = m.Broadcast(room.name, d.messageType, d.data)
+		}
+	}
+}
+
+func (m *RoomManager) notifyLimit(event RoomLimitEvent) {
+	if m.socket.opts.roomLimitHook == nil {
+		return
+	}
+	defer m.socket.recoverPanic("")
+	m.socket.opts.roomLimitHook(event)
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// routeEnvelope 路由消息的外层结构，type决定交给哪个处理函数，data按注册时的类型解析。
+// 启用protobuf编码时取Envelope的type和data，data同样是JSON
+type routeEnvelope struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+type route struct {
+	payload reflect.Type
+	handle  func(key string, data json.RawMessage) error
+}
+
+// MessageRouter 按消息中的type字段分发到类型化的处理函数，作为MessageHandler传给WithHandler使用。
+// 注册时记录了每种消息的数据类型，SchemaInspector据此生成文档
+type MessageRouter struct {
+	fallback MessageHandler
+	socket   *Socket
+	mu       sync.RWMutex
+	routes   map[string]route
+	emits    map[string]reflect.Type
+}
+
+// NewMessageRouter fallback用于处理非JSON或未注册type的消息，以及OnError、OnClose等回调，可以为nil
+func NewMessageRouter(fallback MessageHandler) *MessageRouter {
+	return &MessageRouter{
+		fallback: fallback,
+		routes:   make(map[string]route),
+		emits:    make(map[string]reflect.Type),
+	}
+}
+
+// Handle 注册msgType的处理函数，data解析为T后回调，fn返回的错误交给OnError，同名注册会覆盖
+func Handle[T any](r *MessageRouter, msgType string, fn func(key string, payload T) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[msgType] = route{
+		payload: reflect.TypeOf((*T)(nil)).Elem(),
+		handle: func(key string, data json.RawMessage) error {
+			var payload T
+			if len(data) > 0 {
+				if err := json.Unmarshal(data, &payload); err != nil {
+					return err
+				}
+			}
+			return fn(key, payload)
+		},
+	}
+}
+
+// Emits 声明服务端会推送的msgType及其数据结构，只用于生成文档，不影响发送
+func (r *MessageRouter) Emits(msgType string, payload any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.emits[msgType] = reflect.TypeOf(payload)
+}
+
+func (r *MessageRouter) OnMessage(message Message) {
+	key := message.Subkeys[0]
+	var envelope routeEnvelope
+	if message.Envelope != nil {
+		envelope = routeEnvelope{Type: message.Envelope.Type, Data: message.Envelope.Data}
+	} else if message.ContentType != "" && message.ContentType != ContentTypeJSON {
+		if !msgpackEnvelope(message.Payload, &envelope) {
+			r.unrouted(key, message)
+			return
+		}
+	} else if err := json.Unmarshal(message.Data, &envelope); err != nil {
+		r.unrouted(key, message)
+		return
+	}
+	if envelope.Type == "" {
+		r.unrouted(key, message)
+		return
+	}
+	r.mu.RLock()
+	route, ok := r.routes[envelope.Type]
+	r.mu.RUnlock()
+	if !ok {
+		r.unrouted(key, message)
+		return
+	}
+	if err := route.handle(key, envelope.Data); err != nil {
+		r.OnError(key, newError(key, "route "+envelope.Type, err))
+	} else if r.socket != nil {
+		r.socket.emitAction(key, envelope.Type, envelope.Data)
+	}
+}
+
+// msgpackEnvelope MsgPack等非JSON编码的data转换为JSON，处理函数不需要区分连接的编码
+func msgpackEnvelope(payload any, envelope *routeEnvelope) bool {
+	fields, ok := payload.(map[string]any)
+	if !ok {
+		return false
+	}
+	envelope.Type, _ = fields["type"].(string)
+	if data, ok := fields["data"]; ok {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return false
+		}
+		envelope.Data = raw
+	}
+	return true
+}
+
+func (r *MessageRouter) bind(socket *Socket) {
+	r.socket = socket
+}
+
+func (r *MessageRouter) unrouted(key string, message Message) {
+	if r.fallback != nil {
+		r.fallback.OnMessage(message)
+	} else {
+		r.OnError(key, newError(key, "route", ErrUnknownMessageType))
+	}
+}
+
+func (r *MessageRouter) OnError(key string, err error) {
+	if r.fallback != nil {
+		r.fallback.OnError(key, err)
+	}
+}
+
+func (r *MessageRouter) OnOpen(client *SocketClient) {
+	if h, ok := r.fallback.(OpenHandler); ok {
+		h.OnOpen(client)
+	}
+}
+
+func (r *MessageRouter) OnClose(key string) {
+	if r.fallback != nil {
+		r.fallback.OnClose(key)
+	}
+}
+
+// messageTypes 返回按名称排序的入站、出站消息类型
+func (r *MessageRouter) messageTypes() (accepts, emits []namedType) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for name, route := range r.routes {
+		accepts = append(accepts, namedType{name, route.payload})
+	}
+	for name, t := range r.emits {
+		emits = append(emits, namedType{name, t})
+	}
+	sort.Slice(accepts, func(i, j int) bool { return accepts[i].name < accepts[j].name })
+	sort.Slice(emits, func(i, j int) bool { return emits[i].name < emits[j].name })
+	return accepts, emits
+}
+
+type namedType struct {
+	name string
+	t    reflect.Type
+}
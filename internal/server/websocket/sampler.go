@@ -0,0 +1,75 @@
+package server
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+)
+
+// Direction 采样消息的方向
+type Direction int
+
+const (
+	DirectionInbound Direction = iota
+	DirectionOutbound
+)
+
+func (d Direction) String() string {
+	if d == DirectionOutbound {
+		return "outbound"
+	}
+	return "inbound"
+}
+
+// WithSampler 按rate(取值[0, 1])抽样入站和出站的数据帧交给fn，用于离线评估模型质量而不必全量归档。
+// 入站消息在到达OnMessage之前采样，不包含ack等协议帧；出站消息在写出成功后采样，包含_seq等服务端注入的字段。
+// fn在读写循环中同步执行，data不能在fn返回后继续使用，耗时的处理应复制后交给其他goroutine
+func WithSampler(rate float64, fn func(direction Direction, mt int, data []byte)) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.sampleRate = rate
+		opt.sampler = fn
+	}
+}
+
+// WithSessionSampling 按会话而不是按消息抽样：连接建立时以SessionLabel(没有时为连接标识)的哈希决定是否采样，
+// 同一会话的全部消息要么都被采样要么都不采样，重连后结果不变
+func WithSessionSampling(enabled bool) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.sessionSampling = enabled
+	}
+}
+
+// sessionSampled 会话标识的FNV-1a哈希映射到[0, 1)后与采样率比较。只差最后几个字符的标识FNV的高位相近，
+// 先经过murmur3的fmix64打散
+func (s *Socket) sessionSampled(client *SocketClient) bool {
+	id := client.labels[SessionLabel]
+	if id == "" {
+		id = client.key
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(id))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return float64(x)/math.MaxUint64 < s.opts.sampleRate
+}
+
+// sample 按消息采样时使用math/rand的全局随机源，未设置种子时无锁
+func (s *SocketClient) sample(direction Direction, mt int, data []byte) {
+	opts := s.socket.opts
+	if opts.sampler == nil {
+		return
+	}
+	if opts.sessionSampling {
+		if !s.sessionSampled {
+			return
+		}
+	} else if rand.Float64() >= opts.sampleRate {
+		return
+	}
+	defer s.socket.recoverPanic(s.key)
+	opts.sampler(direction, mt, data)
+}
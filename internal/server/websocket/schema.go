@@ -0,0 +1,168 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SchemaInspector 根据MessageRouter中注册的消息类型生成OpenAPI 3.1兼容的文档，
+// 数据结构以JSON Schema的形式放在components.schemas中，消息列表放在x-websocket扩展字段中
+type SchemaInspector struct {
+	title   string
+	routers []*MessageRouter
+}
+
+func NewSchemaInspector(title string, routers ...*MessageRouter) *SchemaInspector {
+	return &SchemaInspector{title: title, routers: routers}
+}
+
+// Document 每次调用都重新生成，路由在运行中新增的消息类型也会体现出来
+func (i *SchemaInspector) Document() map[string]any {
+	g := &schemaGenerator{schemas: make(map[string]any)}
+	accepts := make(map[string]any)
+	emits := make(map[string]any)
+	for _, router := range i.routers {
+		in, out := router.messageTypes()
+		for _, m := range in {
+			accepts[m.name] = g.envelope(m.name, m.t)
+		}
+		for _, m := range out {
+			emits[m.name] = g.envelope(m.name, m.t)
+		}
+	}
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   i.title,
+			"version": "1.0.0",
+		},
+		"paths": map[string]any{},
+		"components": map[string]any{
+			"schemas": g.schemas,
+		},
+		"x-websocket": map[string]any{
+			"accepts": accepts,
+			"emits":   emits,
+		},
+	}
+}
+
+// Handler 以gin handler的形式返回文档，例如挂载到/ws/schema
+func (i *SchemaInspector) Handler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, i.Document())
+	}
+}
+
+type schemaGenerator struct {
+	schemas map[string]any
+}
+
+// envelope 描述{"type":"<name>","data":...}形式的完整消息
+func (g *schemaGenerator) envelope(name string, t reflect.Type) map[string]any {
+	properties := map[string]any{
+		"type": map[string]any{"type": "string", "const": name},
+	}
+	if t != nil {
+		properties["data"] = g.schemaOf(t)
+	}
+	return map[string]any{
+		"type":       "object",
+		"properties": properties,
+		"required":   []string{"type"},
+	}
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+func (g *schemaGenerator) schemaOf(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]any{"type": "array", "items": g.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, ok := g.schemas[t.Name()]; !ok {
+			// 先占位，避免自引用的结构体无限递归
+			g.schemas[t.Name()] = map[string]any{}
+			g.schemas[t.Name()] = g.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		return map[string]any{}
+	}
+}
+
+// object 按encoding/json的规则展开结构体字段：忽略未导出字段和"-"，omitempty的字段不是必填，
+// 没有json标签的匿名结构体字段合并到外层
+func (g *schemaGenerator) object(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	required := make([]string, 0)
+	g.fields(t, properties, &required)
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (g *schemaGenerator) fields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			g.fields(fieldType, properties, required)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = g.schemaOf(field.Type)
+		if !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Pointer {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package server
+
+import "time"
+
+// healthLatencyBudget 时延达到该值时扣满0.5分
+const healthLatencyBudget = time.Second
+
+// WithHealthScoreFormula 替换HealthScore的默认公式，fn的结果被限制在[0, 1]
+func WithHealthScoreFormula(fn func(stats SocketStats) float64) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.healthScoreFormula = fn
+	}
+}
+
+// DefaultHealthScore 1.0 - (HeartbeatFailures / HeartbeatFailMaxTimes) * 0.5 - latencyPenalty，
+// latencyPenalty取E2ELatencyP99和PingRTT中较大者，每秒扣0.5分，最多扣0.5分
+func DefaultHealthScore(stats SocketStats) float64 {
+	score := 1.0
+	if stats.HeartbeatFailMaxTimes > 0 {
+		score -= float64(stats.HeartbeatFailures) / float64(stats.HeartbeatFailMaxTimes) * 0.5
+	}
+	latency := max(stats.E2ELatencyP99, stats.PingRTT)
+	return score - min(float64(latency)/float64(healthLatencyBudget), 1)*0.5
+}
+
+// HealthScore 连接健康度，1.0最好，0最差，默认按DefaultHealthScore计算
+func (s *SocketClient) HealthScore() float64 {
+	formula := s.socket.opts.healthScoreFormula
+	if formula == nil {
+		formula = DefaultHealthScore
+	}
+	return min(max(formula(s.Stats()), 0), 1)
+}
+
+// HealthScore 按连接标识计算健康度
+func (s *Socket) HealthScore(key string) (float64, error) {
+	client, err := s.Client(key)
+	if err != nil {
+		return 0, err
+	}
+	return client.HealthScore(), nil
+}
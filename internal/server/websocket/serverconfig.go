@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ServerConfigType 连接建立后服务端发送的限制声明的消息类型
+const ServerConfigType = "server.config"
+
+// ServerConfig 连接生效的限制，时长以毫秒表示，未配置的限制为0。
+// Extra为WithServerConfigFrame传入的自定义字段，客户端不认识的字段应当忽略
+type ServerConfig struct {
+	Server          string         `json:"server,omitempty"`
+	SchemaVersion   int            `json:"schema_version"`
+	Codec           string         `json:"codec,omitempty"`
+	Subprotocol     string         `json:"subprotocol,omitempty"`
+	MaxMessageSize  int64          `json:"max_message_size"`
+	SendQueueLength int            `json:"send_queue_length"`
+	RoomRateLimit   int            `json:"room_rate_limit"`
+	SlowStartBudget int            `json:"slow_start_budget"`
+	SlowStartWindow int64          `json:"slow_start_window_ms"`
+	MaxPendingAcks  int            `json:"max_pending_acks"`
+	PingInterval    int64          `json:"ping_interval_ms"`
+	ReadTimeout     int64          `json:"read_timeout_ms"`
+	MaxMissedPongs  int            `json:"max_missed_pongs"`
+	PongRequired    bool           `json:"pong_required"`
+	Extra           map[string]any `json:"extra,omitempty"`
+}
+
+// serverConfigFrame 发给客户端的格式{"type":"server.config","data":{...}}
+type serverConfigFrame struct {
+	Type string       `json:"type"`
+	Data ServerConfig `json:"data"`
+}
+
+type serverConfigOption struct {
+	server string
+	extra  map[string]any
+}
+
+// WithServerConfigFrame 连接建立后在welcome之后、OnOpen之前发送server.config，声明该连接生效的消息大小、速率、
+// 心跳等限制，客户端据此调整自身行为而不必写死服务端配置。server为服务端标识或版本，extra随消息原样下发
+func WithServerConfigFrame(server string, extra map[string]any) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.serverConfig = &serverConfigOption{server: server, extra: extra}
+	}
+}
+
+// ServerConfig 该连接当前生效的限制，反映校验后的默认值以及UpdateOption、过载降级的调整
+func (s *SocketClient) ServerConfig() ServerConfig {
+	opts := s.socket.opts
+	settings := s.options()
+	cfg := ServerConfig{
+		SchemaVersion:   s.schemaVersion,
+		Codec:           s.codecName,
+		Subprotocol:     s.Subprotocol(),
+		MaxMessageSize:  opts.maxMessageSize,
+		SendQueueLength: opts.sendQueueLength,
+		RoomRateLimit:   opts.roomRateLimit,
+		SlowStartBudget: opts.slowStartBudget,
+		SlowStartWindow: opts.slowStartWindow.Milliseconds(),
+		MaxPendingAcks:  opts.maxPendingAcks,
+	}
+	if settings.pingPeriod > 0 {
+		cfg.PingInterval = settings.pingPeriod.Milliseconds()
+		cfg.MaxMissedPongs = settings.heartbeatFailMaxTimes
+	}
+	if !settings.noReadDeadline {
+		cfg.ReadTimeout = settings.readDeadline.Milliseconds()
+		cfg.PongRequired = settings.pingPeriod > 0
+	}
+	if opts.serverConfig != nil {
+		cfg.Server = opts.serverConfig.server
+		cfg.Extra = opts.serverConfig.extra
+	}
+	return cfg
+}
+
+// sendServerConfig 未配置WithServerConfigFrame时不发送
+func (s *SocketClient) sendServerConfig() {
+	if s.socket.opts.serverConfig == nil {
+		return
+	}
+	if err := s.SendJSON(serverConfigFrame{Type: ServerConfigType, Data: s.ServerConfig()}); err != nil {
+		s.reportError(err)
+	}
+}
+
+// ParseServerConfig 供Go客户端解析收到的消息，不是server.config时ok为false
+func ParseServerConfig(data []byte) (cfg ServerConfig, ok bool) {
+	var frame serverConfigFrame
+	if err := json.Unmarshal(data, &frame); err != nil || frame.Type != ServerConfigType {
+		return ServerConfig{}, false
+	}
+	return frame.Data, true
+}
+
+// Durations 把毫秒字段换算为time.Duration
+func (c ServerConfig) Durations() (pingInterval, readTimeout time.Duration) {
+	return time.Duration(c.PingInterval) * time.Millisecond, time.Duration(c.ReadTimeout) * time.Millisecond
+}
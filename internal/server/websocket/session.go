@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SessionLabel 判断重复会话使用的标签，由WithLabelExtractor提供，没有该标签的连接不参与检查
+const SessionLabel = "user_id"
+
+// DuplicatePolicy 同一用户(SessionLabel相同)再次连接时的处理方式
+type DuplicatePolicy int
+
+const (
+	// AllowMultiple 不检查，默认值
+	AllowMultiple DuplicatePolicy = iota
+	// CloseOldest 接受新连接，已有的连接以CloseLoggedInElsewhere关闭
+	CloseOldest
+	// CloseNewest 完成升级后立即以CloseLoggedInElsewhere关闭新连接，客户端可读到关闭码
+	CloseNewest
+	// ErrorOnDuplicate 拒绝升级，握手返回409，Connect返回ErrDuplicateSession
+	ErrorOnDuplicate
+)
+
+// WithDuplicateSessionPolicy 按SessionLabel标签检测同一用户的多个连接，需要配合WithLabelExtractor使用
+func WithDuplicateSessionPolicy(policy DuplicatePolicy) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.duplicatePolicy = policy
+	}
+}
+
+// sessionsOf 返回同一租户内该用户其他在线连接
+func (s *Socket) sessionsOf(userID string, except *SocketClient) []*SocketClient {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var clients []*SocketClient
+	for key, client := range s.clients {
+		if key != except.key && client.State() == OnlineState && client.labels[SessionLabel] == userID &&
+			client.namespace == except.namespace {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// rejectDuplicate 升级之前检查，ErrorOnDuplicate时直接以409结束握手
+func (s *Socket) rejectDuplicate(ctx *gin.Context, client *SocketClient) error {
+	userID := client.labels[SessionLabel]
+	if s.opts.duplicatePolicy != ErrorOnDuplicate || userID == "" || len(s.sessionsOf(userID, client)) == 0 {
+		return nil
+	}
+	ctx.AbortWithStatus(http.StatusConflict)
+	return newError(client.key, "upgrade", ErrDuplicateSession)
+}
+
+// admitSession 升级之后在该用户的锁内再次检查并注册，避免并发连接同时通过检查。
+// 返回需要关闭的旧连接，由调用方在释放锁之后关闭
+func (s *Socket) admitSession(client *SocketClient) ([]*SocketClient, error) {
+	userID := client.labels[SessionLabel]
+	if s.opts.duplicatePolicy == AllowMultiple || userID == "" {
+		s.register(client)
+		return nil, nil
+	}
+	defer s.sessionLocks.lock(userID)()
+	existing := s.sessionsOf(userID, client)
+	if len(existing) > 0 && s.opts.duplicatePolicy != CloseOldest {
+		client.reject(CloseLoggedInElsewhere, "duplicate session")
+		return nil, newError(client.key, "upgrade", ErrDuplicateSession)
+	}
+	s.register(client)
+	return existing, nil
+}
+
+// reject 关闭尚未注册、尚未启动读写循环的连接，不回调OnClose
+func (s *SocketClient) reject(code int, reason string) {
+	_ = s.SendClose(code, reason)
+	s.markClosed()
+	_ = s.conn.Close()
+}
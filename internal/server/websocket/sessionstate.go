@@ -0,0 +1,276 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	// SessionResumeParam 客户端重连时携带恢复令牌的查询参数，也可以放在X-Session-Resume-Token请求头中
+	SessionResumeParam = "resume_token"
+	// SessionResumeHeader 升级响应中下发恢复令牌的响应头，重连时可原样放在请求头中
+	SessionResumeHeader = "X-Session-Resume-Token"
+	// sessionPersistQueue 等待写入存储的连接数上限，已满时本次变更等下一次变更再写入
+	sessionPersistQueue = 1024
+	// sessionSweepInterval MemorySessionStore清理过期会话的最小间隔
+	sessionSweepInterval = time.Minute
+)
+
+// welcome消息中data.session的取值，未配置WithSessionPersistence时不出现
+const (
+	SessionNew     = "new"
+	SessionResumed = "resumed"
+	// SessionExpired 携带的恢复令牌无效或已超过恢复窗口，服务端建立了新的会话，客户端需要重新订阅和同步
+	SessionExpired = "expired"
+)
+
+// SessionState 持久化的会话状态。Metadata为连接Store中的内容按JSON编码的结果，
+// 恢复后的值是json.Unmarshal到any的结果(对象为map[string]any，数字为float64)，无法按JSON编码的值不会保存
+type SessionState struct {
+	Key       string                     `json:"key"`
+	Labels    map[string]string          `json:"labels,omitempty"`
+	Metadata  map[string]json.RawMessage `json:"metadata,omitempty"`
+	Seq       uint64                     `json:"seq"`
+	UpdatedAt time.Time                  `json:"updatedAt"`
+	// Rooms 加入的房间及保存时房间历史的最新Seq，恢复时重新加入并补发之后的历史消息
+	Rooms map[string]uint64 `json:"rooms,omitempty"`
+	// Topics WithTopicSubscriptions的订阅，恢复时重新订阅
+	Topics []string `json:"topics,omitempty"`
+}
+
+// SessionStateStore 按恢复令牌保存会话状态，多节点部署时需要共享存储，Redis实现见redissession子包
+type SessionStateStore interface {
+	// Save 覆盖写入，ttl之后过期
+	Save(token string, state SessionState, ttl time.Duration) error
+	// Load 令牌不存在或已过期时返回false
+	Load(token string) (SessionState, bool, error)
+}
+
+// WithSessionPersistence 连接建立以及Store内容、WithStrictOrdering的序号、房间、主题订阅变化时，将会话状态异步写入store并刷新ttl，
+// 连接断开时再写入一次，ttl即为断开后的恢复窗口。每个连接在X-Session-Resume-Token响应头和welcome消息中收到恢复令牌，
+// 断线或进程崩溃后客户端带上令牌重连到任意节点，沿用原来的连接标识、标签、Store内容和序号，重新加入房间并补发错过的房间历史，
+// 恢复主题订阅；发给该连接标识的消息由WithPendingStore补发。welcome消息的data.session为resumed、new或expired，
+// expired表示令牌无效或已过期，客户端需要按新会话重新同步
+func WithSessionPersistence(store SessionStateStore, ttl time.Duration) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.sessionStore = store
+		opt.sessionTTL = ttl
+	}
+}
+
+// resumedSession 握手时确定的恢复令牌，state不为nil时表示恢复了已有会话
+type resumedSession struct {
+	token  string
+	state  *SessionState
+	status string
+}
+
+// resumeSession 令牌无效时分配新令牌，不影响握手
+func (s *Socket) resumeSession(ctx *gin.Context) *resumedSession {
+	if s.opts.sessionStore == nil {
+		return nil
+	}
+	token := ctx.Query(SessionResumeParam)
+	if token == "" {
+		token = ctx.GetHeader(SessionResumeHeader)
+	}
+	if token == "" {
+		return &resumedSession{token: newResumeToken(), status: SessionNew}
+	}
+	state, ok, err := s.opts.sessionStore.Load(token)
+	if err != nil {
+		s.logWarning("", "session", err)
+	} else if ok && state.Key != "" {
+		return &resumedSession{token: token, state: &state, status: SessionResumed}
+	}
+	return &resumedSession{token: newResumeToken(), status: SessionExpired}
+}
+
+func newResumeToken() string {
+	var raw [16]byte
+	_, _ = rand.Read(raw[:])
+	return hex.EncodeToString(raw[:])
+}
+
+// restoreSession 在读写循环启动之前恢复Store内容、序号和主题订阅，之后开始跟踪变更。房间由restoreMigration恢复
+func (s *SocketClient) restoreSession(resumed *resumedSession) {
+	if resumed == nil {
+		return
+	}
+	if state := resumed.state; state != nil {
+		for name, raw := range state.Metadata {
+			var value any
+			if json.Unmarshal(raw, &value) == nil {
+				s.store.Set(name, value)
+			}
+		}
+		s.outSeq.Store(state.Seq)
+		for _, pattern := range state.Topics {
+			if err := s.Subscribe(pattern); err != nil {
+				s.socket.logWarning(s.key, "session", err)
+			}
+		}
+	}
+	s.store.mu.Lock()
+	s.store.onChange = s.markSessionDirty
+	s.store.mu.Unlock()
+	s.markSessionDirty()
+}
+
+// markSessionDirty 同一连接尚未写入的多次变更只写入一次
+func (s *SocketClient) markSessionDirty() {
+	if s.resumeToken == "" || !s.sessionDirty.CompareAndSwap(false, true) {
+		return
+	}
+	select {
+	case s.socket.sessions <- s:
+	default:
+		s.sessionDirty.Store(false)
+	}
+}
+
+// markSessionDirty 见SocketClient.markSessionDirty，连接不存在时不做任何事
+func (s *Socket) markSessionDirty(key string) {
+	if s.opts.sessionStore == nil {
+		return
+	}
+	if client, err := s.Client(key); err == nil {
+		client.markSessionDirty()
+	}
+}
+
+// sessionState 连接已关闭时返回断开时保存的状态，没有时返回false，避免用清空后的Store覆盖已保存的状态
+func (s *SocketClient) sessionState() (SessionState, bool) {
+	if final := s.sessionFinal.Load(); final != nil {
+		return *final, true
+	}
+	if s.State() != OnlineState {
+		return SessionState{}, false
+	}
+	state := s.snapshotSession()
+	return state, s.State() == OnlineState
+}
+
+func (s *SocketClient) snapshotSession() SessionState {
+	state := SessionState{Key: s.key, Labels: s.Labels(), Seq: s.outSeq.Load(), UpdatedAt: time.Now()}
+	s.store.Range(func(name string, value any) bool {
+		if raw, err := json.Marshal(value); err == nil {
+			if state.Metadata == nil {
+				state.Metadata = make(map[string]json.RawMessage)
+			}
+			state.Metadata[name] = raw
+		}
+		return true
+	})
+	if rooms := s.socket.migrationState(s).Rooms; len(rooms) > 0 {
+		state.Rooms = rooms
+	}
+	state.Topics = s.Topics()
+	return state
+}
+
+// persistFinalSession 连接关闭时在清空Store、退出房间之前调用，断开时的状态一定会写入，恢复窗口从此刻开始计算
+func (s *SocketClient) persistFinalSession() {
+	if s.resumeToken == "" {
+		return
+	}
+	state := s.snapshotSession()
+	s.sessionFinal.Store(&state)
+	if s.sessionDirty.CompareAndSwap(false, true) {
+		go func() { s.socket.sessions <- s }()
+	}
+}
+
+// persistSessions 单个goroutine依次写入，存储较慢时变更在队列中合并
+func (s *Socket) persistSessions() {
+	for client := range s.sessions {
+		client.sessionDirty.Store(false)
+		state, ok := client.sessionState()
+		if !ok {
+			continue
+		}
+		if err := s.opts.sessionStore.Save(client.resumeToken, state, s.opts.sessionTTL); err != nil {
+			s.logWarning(client.key, "session", err)
+		}
+	}
+}
+
+// logWarning 记录后台任务中不影响连接的错误
+func (s *Socket) logWarning(key, op string, err error) {
+	err = newError(key, op, err)
+	if logger := s.opts.logger; logger != nil {
+		logger.Warn(err.Error(), s.logFields(key, zap.String("stage", string(ErrorStage(err))))...)
+	}
+}
+
+// ResumeToken 恢复令牌，未配置WithSessionPersistence时为空
+func (s *SocketClient) ResumeToken() string {
+	return s.resumeToken
+}
+
+// MemorySessionStore 单节点使用的进程内SessionStateStore，过期的会话在Load时删除，
+// 并在Save时每分钟最多清理一次
+type MemorySessionStore struct {
+	mu        sync.Mutex
+	sessions  map[string]memorySession
+	lastSweep time.Time
+}
+
+type memorySession struct {
+	state     SessionState
+	expiresAt time.Time
+}
+
+var _ SessionStateStore = (*MemorySessionStore)(nil)
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]memorySession), lastSweep: time.Now()}
+}
+
+func (m *MemorySessionStore) Save(token string, state SessionState, ttl time.Duration) error {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Sub(m.lastSweep) >= sessionSweepInterval {
+		m.sweep(now)
+	}
+	m.sessions[token] = memorySession{state: state, expiresAt: now.Add(ttl)}
+	return nil
+}
+
+func (m *MemorySessionStore) Load(token string) (SessionState, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[token]
+	if !ok {
+		return SessionState{}, false, nil
+	}
+	if !time.Now().Before(session.expiresAt) {
+		delete(m.sessions, token)
+		return SessionState{}, false, nil
+	}
+	return session.state, true, nil
+}
+
+// Len 清理过期会话后剩余的会话数
+func (m *MemorySessionStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep(time.Now())
+	return len(m.sessions)
+}
+
+func (m *MemorySessionStore) sweep(now time.Time) {
+	for token, session := range m.sessions {
+		if !now.Before(session.expiresAt) {
+			delete(m.sessions, token)
+		}
+	}
+	m.lastSweep = now
+}
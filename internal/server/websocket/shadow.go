@@ -0,0 +1,49 @@
+package server
+
+import "github.com/gorilla/websocket"
+
+// WithShadowHandler 每条入站消息交给主处理器之后，再复制一份在单独的goroutine中交给shadow.OnMessage，
+// 用于同时把流量送给线上模型和候选模型做A/B对比。shadow只接收OnMessage，它的panic和解码错误只记录日志(WithPanicHandler或logger)，
+// 不影响主处理器和连接；主处理器panic时不再转发该消息
+func WithShadowHandler(shadow MessageHandler) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.shadowHandler = shadow
+	}
+}
+
+// shadowCopy 在主处理器之前复制Data和Subkeys，主处理器修改消息不会影响shadow；未配置WithShadowHandler时返回nil
+func (s *SocketClient) shadowCopy(message Message) *Message {
+	if s.socket.opts.shadowHandler == nil {
+		return nil
+	}
+	return &Message{
+		MessageType: message.MessageType,
+		Subkeys:     append([]string(nil), message.Subkeys...),
+		Data:        append([]byte(nil), message.Data...),
+	}
+}
+
+// shadowMessage Envelope、Payload在shadow的goroutine中重新解码，不与主处理器共享
+func (s *SocketClient) shadowMessage(message *Message) {
+	if message == nil {
+		return
+	}
+	opts := s.socket.opts
+	go func() {
+		defer s.socket.recoverPanic(s.key)
+		var err error
+		if opts.protobufEncoding && message.MessageType == websocket.BinaryMessage {
+			if message.Envelope, err = decodeEnvelope(message.Data); err != nil {
+				s.socket.logWarning(s.key, "shadow", err)
+				return
+			}
+		}
+		if len(opts.contentTypes) > 0 || len(opts.namedCodecs) > 0 || opts.serializer != nil {
+			if err = s.decodePayload(message); err != nil {
+				s.socket.logWarning(s.key, "shadow", err)
+				return
+			}
+		}
+		opts.shadowHandler.OnMessage(*message)
+	}()
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSinkBufferSize  = 1024
+	defaultSinkBatchSize   = 100
+	defaultSinkTopicPrefix = "websocket."
+)
+
+// 转发到EventSink的事件，topic为TopicPrefix加事件名
+const (
+	SinkEventConnect    = "connect"
+	SinkEventDisconnect = "disconnect"
+	SinkEventAction     = "action"
+	SinkEventStreamEnd  = "stream_end"
+)
+
+// EventSink 将连接事件转发到Kafka、NATS等外部系统，key为连接标识，可用作分区键。
+// Publish在独立的goroutine中调用，实现了Flush() error时每批事件发布后调用一次
+type EventSink interface {
+	Publish(topic string, key string, payload []byte) error
+}
+
+// EventSinkConfig 选择转发的事件，未开启的事件不会产生任何开销
+type EventSinkConfig struct {
+	Sink        EventSink
+	TopicPrefix string
+	Connect     bool
+	Disconnect  bool
+	StreamEnd   bool
+	// Actions 需要转发的MessageRouter消息类型，只有处理成功的消息会被转发
+	Actions []string
+	// BufferSize 待发布事件的缓冲数量，已满时丢弃新事件，默认1024
+	BufferSize int
+	// BatchSize 每批最多发布的事件数量，默认100
+	BatchSize int
+}
+
+// EventSinkStats 事件转发的计数，Dropped为缓冲区已满被丢弃的数量，Failed为Publish返回错误或panic的数量
+type EventSinkStats struct {
+	Published int64
+	Dropped   int64
+	Failed    int64
+}
+
+// WithEventSink 通过带缓冲的异步队列将选定的事件转发到sink，发布慢或失败只会丢弃事件并计数，不会阻塞连接
+func WithEventSink(cfg EventSinkConfig) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.eventSink = &cfg
+	}
+}
+
+type sinkEvent struct {
+	topic   string
+	key     string
+	payload []byte
+}
+
+// ConnectEvent connect事件的内容
+type ConnectEvent struct {
+	ID          string            `json:"id"`
+	ClientIP    string            `json:"clientIP"`
+	Subprotocol string            `json:"subprotocol,omitempty"`
+	ConnectedAt time.Time         `json:"connectedAt"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// DisconnectEvent disconnect事件的内容，连接关闭时的汇总
+type DisconnectEvent struct {
+	ID            string            `json:"id"`
+	ConnectedAt   time.Time         `json:"connectedAt"`
+	Duration      time.Duration     `json:"duration"`
+	BytesSent     int64             `json:"bytesSent"`
+	BytesReceived int64             `json:"bytesReceived"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	// CloseCode、CloseReason 关闭码及其CloseCodeDescription
+	CloseCode   int    `json:"closeCode"`
+	CloseReason string `json:"closeReason"`
+}
+
+// ActionEvent action事件的内容，Data为路由消息中的原始data
+type ActionEvent struct {
+	ID   string          `json:"id"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+	Time time.Time       `json:"time"`
+}
+
+// StreamEndEvent stream_end事件的内容，记录一次SendReader的用量
+type StreamEndEvent struct {
+	ID          string        `json:"id"`
+	MessageType int           `json:"messageType"`
+	Bytes       int64         `json:"bytes"`
+	Duration    time.Duration `json:"duration"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// eventPump 在manager内部缓冲、分批发布事件
+type eventPump struct {
+	socket    *Socket
+	cfg       EventSinkConfig
+	actions   map[string]bool
+	queue     chan sinkEvent
+	published atomic.Int64
+	dropped   atomic.Int64
+	failed    atomic.Int64
+}
+
+func newEventPump(socket *Socket, cfg EventSinkConfig) *eventPump {
+	if cfg.TopicPrefix == "" {
+		cfg.TopicPrefix = defaultSinkTopicPrefix
+	}
+	if cfg.BufferSize == 0 {
+		cfg.BufferSize = defaultSinkBufferSize
+	}
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = defaultSinkBatchSize
+	}
+	p := &eventPump{
+		socket:  socket,
+		cfg:     cfg,
+		actions: make(map[string]bool, len(cfg.Actions)),
+		queue:   make(chan sinkEvent, cfg.BufferSize),
+	}
+	for _, action := range cfg.Actions {
+		p.actions[action] = true
+	}
+	return p
+}
+
+// emit 非阻塞地加入队列，编码失败和队列已满都计为丢弃
+func (p *eventPump) emit(event, key string, v any) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		p.dropped.Add(1)
+		return
+	}
+	select {
+	case p.queue <- sinkEvent{topic: p.cfg.TopicPrefix + event, key: key, payload: payload}:
+	default:
+		p.dropped.Add(1)
+	}
+}
+
+func (p *eventPump) run() {
+	batch := make([]sinkEvent, 0, p.cfg.BatchSize)
+	for event := range p.queue {
+		batch = append(batch[:0], event)
+	drain:
+		for len(batch) < p.cfg.BatchSize {
+			select {
+			case event = <-p.queue:
+				batch = append(batch, event)
+			default:
+				break drain
+			}
+		}
+		for _, event := range batch {
+			if p.publish(event) {
+				p.published.Add(1)
+			} else {
+				p.failed.Add(1)
+			}
+		}
+		if flusher, ok := p.cfg.Sink.(interface{ Flush() error }); ok {
+			p.flush(flusher)
+		}
+	}
+}
+
+func (p *eventPump) publish(event sinkEvent) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.socket.notifyPanic(r, event.key)
+			ok = false
+		}
+	}()
+	return p.cfg.Sink.Publish(event.topic, event.key, event.payload) == nil
+}
+
+func (p *eventPump) flush(flusher interface{ Flush() error }) {
+	defer p.socket.recoverPanic("")
+	_ = flusher.Flush()
+}
+
+func (p *eventPump) stats() EventSinkStats {
+	return EventSinkStats{
+		Published: p.published.Load(),
+		Dropped:   p.dropped.Load(),
+		Failed:    p.failed.Load(),
+	}
+}
+
+// EventSinkStats 未配置WithEventSink时返回零值
+func (s *Socket) EventSinkStats() EventSinkStats {
+	if s.events == nil {
+		return EventSinkStats{}
+	}
+	return s.events.stats()
+}
+
+func (s *Socket) emitConnect(client *SocketClient) {
+	if s.events == nil || !s.events.cfg.Connect {
+		return
+	}
+	s.events.emit(SinkEventConnect, client.key, ConnectEvent{
+		ID:          client.key,
+		ClientIP:    client.handshake.ClientIP,
+		Subprotocol: client.handshake.Subprotocol,
+		ConnectedAt: client.handshake.ConnectedAt,
+		Labels:      client.labels,
+	})
+}
+
+func (s *Socket) emitDisconnect(client *SocketClient) {
+	if s.events == nil || !s.events.cfg.Disconnect {
+		return
+	}
+	code, _ := client.LastClose()
+	s.events.emit(SinkEventDisconnect, client.key, DisconnectEvent{
+		ID:            client.key,
+		ConnectedAt:   client.handshake.ConnectedAt,
+		Duration:      time.Since(client.handshake.ConnectedAt),
+		BytesSent:     client.bytesSent.Load(),
+		BytesReceived: client.bytesReceived.Load(),
+		Labels:        client.labels,
+		CloseCode:     code,
+		CloseReason:   CloseCodeDescription(code),
+	})
+}
+
+func (s *Socket) emitAction(key, msgType string, data json.RawMessage) {
+	if s.events == nil || !s.events.actions[msgType] {
+		return
+	}
+	s.events.emit(SinkEventAction, key, ActionEvent{ID: key, Type: msgType, Data: data, Time: time.Now()})
+}
+
+func (s *Socket) emitStreamEnd(key string, messageType int, bytes int64, duration time.Duration, err error) {
+	if s.events == nil || !s.events.cfg.StreamEnd {
+		return
+	}
+	event := StreamEndEvent{ID: key, MessageType: messageType, Bytes: bytes, Duration: duration}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	s.events.emit(SinkEventStreamEnd, key, event)
+}
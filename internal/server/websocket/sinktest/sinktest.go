@@ -0,0 +1,132 @@
+// Package sinktest EventSink实现的一致性测试，Kafka等其他实现可以在自己的测试中调用Run
+package sinktest
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	server "skeleton/internal/server/websocket"
+)
+
+const receiveTimeout = 5 * time.Second
+
+// Record 订阅方收到的一条消息
+type Record struct {
+	Topic   string
+	Key     string
+	Payload []byte
+}
+
+// Harness 被测的EventSink，以及从其后端读取消息的方式
+type Harness struct {
+	Sink server.EventSink
+	// Receive 在Publish之前调用，返回之后发布到topic的消息
+	Receive func(t *testing.T, topic string) <-chan Record
+}
+
+var topicSeq atomic.Int64
+
+// Run 每个子测试调用一次newHarness，使用互不相同的topic
+func Run(t *testing.T, newHarness func(t *testing.T) Harness) {
+	t.Run("delivers topic key and payload", func(t *testing.T) {
+		h := newHarness(t)
+		topic := newTopic()
+		records := h.Receive(t, topic)
+		publish(t, h.Sink, topic, "conn-1", []byte(`{"id":"conn-1"}`))
+		got := receive(t, records)
+		if got.Topic != topic || got.Key != "conn-1" || !bytes.Equal(got.Payload, []byte(`{"id":"conn-1"}`)) {
+			t.Fatalf("unexpected record %+v", got)
+		}
+	})
+
+	t.Run("preserves order for a key", func(t *testing.T) {
+		h := newHarness(t)
+		topic := newTopic()
+		records := h.Receive(t, topic)
+		for i := 0; i < 100; i++ {
+			publish(t, h.Sink, topic, "conn-1", []byte(fmt.Sprint(i)))
+		}
+		for i := 0; i < 100; i++ {
+			if got := receive(t, records); string(got.Payload) != fmt.Sprint(i) {
+				t.Fatalf("expected payload %d, got %s", i, got.Payload)
+			}
+		}
+	})
+
+	t.Run("concurrent publish", func(t *testing.T) {
+		h := newHarness(t)
+		topic := newTopic()
+		records := h.Receive(t, topic)
+		const workers, each = 8, 50
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < each; i++ {
+					if err := h.Sink.Publish(topic, fmt.Sprint("conn-", w), []byte(fmt.Sprint(w, "-", i))); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		flush(t, h.Sink)
+		seen := make(map[string]bool, workers*each)
+		for len(seen) < workers*each {
+			got := receive(t, records)
+			if seen[string(got.Payload)] {
+				t.Fatalf("duplicate payload %s", got.Payload)
+			}
+			seen[string(got.Payload)] = true
+		}
+	})
+
+	t.Run("empty payload", func(t *testing.T) {
+		h := newHarness(t)
+		topic := newTopic()
+		records := h.Receive(t, topic)
+		publish(t, h.Sink, topic, "conn-1", nil)
+		if got := receive(t, records); len(got.Payload) != 0 || got.Key != "conn-1" {
+			t.Fatalf("unexpected record %+v", got)
+		}
+	})
+}
+
+func newTopic() string {
+	return fmt.Sprintf("sinktest.%d.%d", time.Now().UnixNano(), topicSeq.Add(1))
+}
+
+func publish(t *testing.T, sink server.EventSink, topic, key string, payload []byte) {
+	t.Helper()
+	if err := sink.Publish(topic, key, payload); err != nil {
+		t.Fatal(err)
+	}
+	flush(t, sink)
+}
+
+// flush 与manager一致，实现了Flush的sink在发布后调用
+func flush(t *testing.T, sink server.EventSink) {
+	t.Helper()
+	if flusher, ok := sink.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func receive(t *testing.T, records <-chan Record) Record {
+	t.Helper()
+	select {
+	case record := <-records:
+		return record
+	case <-time.After(receiveTimeout):
+		t.Fatal("timed out waiting for published record")
+		return Record{}
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SlowStartPolicy 慢启动期间超出预算的入站消息的处理方式
+type SlowStartPolicy int
+
+const (
+	// SlowStartDefer 读循环等待令牌后再分发，消息不会丢失，客户端的发送通过TCP背压放缓
+	SlowStartDefer SlowStartPolicy = iota
+	// SlowStartReject 丢弃消息并回复{"type":"rate_limited","reason":"slow_start","retry_after_ms":n}
+	SlowStartReject
+)
+
+// SlowStartStats 所有连接在慢启动期间被延后和拒绝的消息数
+type SlowStartStats struct {
+	Deferred int64 `json:"deferred"`
+	Rejected int64 `json:"rejected"`
+}
+
+// WithSlowStart 连接建立后的window内，入站消息在budget条之后按budget/window的速率放行，
+// 避免大量客户端同时重连后立即全量同步压垮后端。window之后不再限制
+func WithSlowStart(budget int, window time.Duration) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.slowStartBudget = budget
+		opt.slowStartWindow = window
+	}
+}
+
+// WithSlowStartPolicy 超出预算的消息的处理方式，默认SlowStartDefer
+func WithSlowStartPolicy(policy SlowStartPolicy) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.slowStartPolicy = policy
+	}
+}
+
+// WithSlowStartGlobalBudget 所有处于慢启动期间的连接共享的入站消息速率(条/秒)，让整体负载平滑上升
+func WithSlowStartGlobalBudget(messagesPerSecond int) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.slowStartGlobal = messagesPerSecond
+	}
+}
+
+type slowStart struct {
+	global   *tokenBucket
+	deferred atomic.Int64
+	rejected atomic.Int64
+}
+
+func newSlowStart(opts *SocketOption) *slowStart {
+	if opts.slowStartBudget <= 0 {
+		return nil
+	}
+	s := &slowStart{}
+	if opts.slowStartGlobal > 0 {
+		s.global = newTokenBucket(opts.slowStartGlobal)
+	}
+	return s
+}
+
+func newSlowStartBucket(budget int, window time.Duration) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(budget) / window.Seconds(),
+		burst:  float64(budget),
+		tokens: float64(budget),
+		last:   time.Now(),
+	}
+}
+
+// admitSlowStart 在读循环中分发消息之前调用，返回false时丢弃该消息
+func (s *SocketClient) admitSlowStart() bool {
+	state := s.socket.slowStart
+	if state == nil || time.Since(s.handshake.ConnectedAt) >= s.socket.opts.slowStartWindow {
+		return true
+	}
+	if s.socket.opts.slowStartPolicy == SlowStartReject {
+		ok, wait := s.slowStartBucket.allow()
+		if ok && state.global != nil {
+			ok, wait = state.global.allow()
+		}
+		if ok {
+			return true
+		}
+		state.rejected.Add(1)
+		s.socket.sendNotice(s.key, map[string]any{
+			"type":           "rate_limited",
+			"reason":         "slow_start",
+			"retry_after_ms": wait.Milliseconds(),
+		})
+		return false
+	}
+	wait := s.slowStartBucket.reserve()
+	if state.global != nil {
+		wait = max(wait, state.global.reserve())
+	}
+	if wait > 0 {
+		state.deferred.Add(1)
+		time.Sleep(wait)
+	}
+	return true
+}
+
+// SlowStartStats 未配置WithSlowStart时为零值
+func (s *Socket) SlowStartStats() SlowStartStats {
+	if s.slowStart == nil {
+		return SlowStartStats{}
+	}
+	return SlowStartStats{Deferred: s.slowStart.deferred.Load(), Rejected: s.slowStart.rejected.Load()}
+}
@@ -1,20 +1,113 @@
 package server
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 
+	"skeleton/internal/server/websocket/wirepb"
+
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 )
 
+const (
+	defaultSendQueueLength = 256
+	maxSendQueueLength     = 16384
+)
+
 type SocketOption struct {
 	writeReadBufferSize   int
+	sendQueueLength       int
 	heartbeatFailMaxTimes int
 	writeDeadline         time.Duration
 	readDeadline          time.Duration
+	noReadDeadline        bool
+	allowNoLiveness       bool
 	pingPeriod            time.Duration
 	pingMsg               string
+	roomHistorySize       int
+	roomRateLimit         int
+	maxMessageSize        int64
+	tcpKeepAlive          time.Duration
+	e2eLatencyProbe       func(latency time.Duration)
+	pubSub                PubSub
+	upgradeBodyLimit      int64
+	upgradeTimeout        time.Duration
+	enableCompression     bool
+	continueOnError       func(err error) bool
+	writeTransformers     []func(mt int, data []byte) ([]byte, error)
+	injectTimestamp       bool
+	protobufEncoding      bool
+	panicHandler          func(recovered any, stack []byte, connID string)
+	flushInterval         time.Duration
+	labelExtractor        func(ctx *gin.Context) map[string]string
+	metricLabels          []string
+	eventSink             *EventSinkConfig
+	writeLatencyThreshold float64
+	writeLatencyWarning   func(elapsed time.Duration)
+	pendingStore          PendingStore
+	duplicatePolicy       DuplicatePolicy
+	roomLimits            RoomLimits
+	roomLimitHook         func(event RoomLimitEvent)
+	contentTypes          []string
+	history               *HistoryConfig
+	healthThresholds      HealthThresholds
+	migrationIssuer       MigrationIssuer
+	migrationValidator    MigrationValidator
+	strictOrdering        bool
+	schemaVersion         int
+	downgradeEncoders     []downgradeEncoder
+	namedCodecs           map[string]Codec
+	defaultCodec          string
+	healthScoreFormula    func(stats SocketStats) float64
+	slowStartBudget       int
+	slowStartWindow       time.Duration
+	slowStartPolicy       SlowStartPolicy
+	slowStartGlobal       int
+	serializer            Serializer
+	statsInterval         time.Duration
+	statsCallback         func(SocketStats)
+	maxPendingAcks        int
+	drainGracePeriod      time.Duration
+	idGenerator           func(*gin.Context) string
+	heartbeatLabel        string
+	heartbeatExecutor     GoroutinePool
+	isolatePanics         bool
+	panicEscalationCount  int
+	panicEscalationWindow time.Duration
+	allowedMessageTypes   []int
+	messageTypePolicy     MessageTypePolicy
+	admissionController   func() AdmissionDecision
+	admissionThresholds   *AdmissionThresholds
+	sessionStore          SessionStateStore
+	sessionTTL            time.Duration
+	queueWaitTimeout      time.Duration
+	cpuThreshold          float64
+	cpuInterval           time.Duration
+	cpuSampler            func() (float64, error)
+	serverConfig          *serverConfigOption
+	sampleRate            float64
+	sampler               func(direction Direction, mt int, data []byte)
+	sessionSampling       bool
+	namespaces            map[string]NamespaceLimits
+	shadowHandler         MessageHandler
+	topicLimit            int
+	clientMetrics         func(connID string, m ClientMetrics)
+	clientMetricsInterval time.Duration
+	idleTimeout           time.Duration
+	idleGracePeriod       time.Duration
+	busPublisher          MessageBusPublisher
+	flushAfterBytes       int
+	deadConnInterval      time.Duration
+	recvAcks              bool
+	recvAckEvery          int
+	recvAckInterval       time.Duration
+	reapInterval          time.Duration
+	reapThreshold         time.Duration
 	handler               MessageHandler
 	logger                *zap.Logger
 }
@@ -25,36 +118,171 @@ type MessageHandler interface {
 	OnClose(key string)
 }
 
-type SocketClientInterface interface {
+// MessageWriter 只负责推送消息，例如只需要通知客户端的服务依赖该接口即可
+type MessageWriter interface {
 	WriteMessage(message Message) error
+	SendTo(key string, messageType int, data []byte) error
+	SendJSON(key string, v any) error
+	SendToOpt(key string, messageType int, data []byte, opts SendOpts) error
+	BroadcastWhere(pred func(ConnView) bool, messageType int, data []byte) BroadcastResult
+	BroadcastTag(tag string, messageType int, data []byte) BroadcastResult
+	SendToUserWithAck(ctx context.Context, userID string, messageType int, data []byte) (map[string]error, error)
+	WriterFor(key string, messageType int) (*WriterSession, error)
+}
+
+// MessageReader 以通道的形式读取指定连接的入站消息
+type MessageReader interface {
+	ReadPumpChan(ctx context.Context, key string) (<-chan IncomingMessage, error)
+}
+
+// ClientRegistry 查询当前连接及其状态
+type ClientRegistry interface {
 	GetAllKeys() []string
 	GetClientState(key string) ClientState
-	Connect(ctx *gin.Context, subkey string)
+	Client(key string) (*SocketClient, error)
+	Stats(key string) (SocketStats, error)
+	Info(key string) (ConnInfo, error)
+	Subprotocol(key string) (string, error)
+	ByTag(tag string) []*SocketClient
 }
 
+// Closer 主动关闭连接，Done用于等待连接关闭完成
+type Closer interface {
+	Close(key string) error
+	Done(key string) (<-chan struct{}, error)
+	CloseWithReason(key string, code int, reason string, detail map[string]any) error
+	RequestReconnect(key string) error
+	CloseTag(tag string, code int, reason string) int
+}
+
+var (
+	_ MessageWriter         = (*Socket)(nil)
+	_ MessageReader         = (*Socket)(nil)
+	_ ClientRegistry        = (*Socket)(nil)
+	_ Closer                = (*Socket)(nil)
+	_ SocketClientInterface = (*Socket)(nil)
+)
+
+// SocketClientInterface 以上各接口的并集，新代码建议只依赖实际用到的接口
+type SocketClientInterface interface {
+	MessageWriter
+	MessageReader
+	ClientRegistry
+	Closer
+	Connect(ctx *gin.Context, subkey string) error
+	Rooms() *RoomManager
+	EventSinkStats() EventSinkStats
+	SlowStartStats() SlowStartStats
+	AdmissionStats() AdmissionStats
+	CPULoad() (load float64, paused bool)
+	HubStats() HubStats
+	Options() SocketOption
+	OnStats(d time.Duration, fn func(HubStats)) (stop func(), err error)
+	StartDrain(reason string)
+	StopDrain()
+	DrainState() DrainState
+	Health() HealthReport
+	HealthScore(key string) (float64, error)
+	Ping(ctx context.Context, key string) (time.Duration, error)
+	ReadyHandler() gin.HandlerFunc
+	RegisterPProfHandlers(router *gin.Engine, prefix string)
+	Namespace(name string) (*Namespace, error)
+	AdminBroadcast(messageType int, data []byte, namespaces ...string) error
+	Publish(topic string, payload any) (int, error)
+}
+
+var _ SocketClientInterface = (*Socket)(nil)
+
+// Message MessageType为0时按TextMessage发送
 type Message struct {
 	MessageType int
 	Subkeys     []string
 	Data        []byte
+	// Envelope 发送时不为nil则编码为protobuf二进制帧，忽略MessageType和Data；
+	// 启用WithProtobufEncoding后入站的二进制帧解码到该字段
+	Envelope *wirepb.Envelope
+	// ContentType、Payload 启用WithContentTypeNegotiation后，入站消息按连接协商的编码解码到Payload
+	ContentType string
+	Payload     any
 }
 
 type Socket struct {
-	clients    map[string]*SocketClient
-	unregister chan string
-	opts       *SocketOption
+	mu           sync.RWMutex
+	clients      map[string]*SocketClient
+	unregister   chan *SocketClient
+	rooms        *RoomManager
+	namespaces   map[string]*Namespace
+	topics       *TopicTree
+	opts         *SocketOption
+	events       *eventPump
+	pendingLocks keyLocks
+	sessionLocks keyLocks
+	slowStart    *slowStart
+	stats        statsScheduler
+	drain        drainControl
+	admission    admissionCounters
+	sessions     chan *SocketClient
+	cpu          cpuMonitor
+	reaper       staleReaper
+	tags         tagIndex
 }
 
 func NewSocket(opts ...SocketOptionFunc) (SocketClientInterface, error) {
 	sOpt := &SocketOption{}
 	socket := &Socket{
 		clients:    make(map[string]*SocketClient),
-		unregister: make(chan string),
+		unregister: make(chan *SocketClient),
 	}
 	for _, opt := range opts {
 		opt.apply(sOpt)
 	}
+	if err := validateOption(sOpt); err != nil {
+		return nil, err
+	}
 	defaultOption(sOpt)
 	socket.opts = sOpt
+	socket.rooms = newRoomManager(socket, "", sOpt.roomLimits)
+	if sOpt.topicLimit > 0 {
+		socket.topics = NewTopicTree()
+	}
+	if len(sOpt.namespaces) > 0 {
+		socket.namespaces = make(map[string]*Namespace, len(sOpt.namespaces))
+		for name, limits := range sOpt.namespaces {
+			socket.namespaces[name] = newNamespace(socket, name, limits)
+		}
+	}
+	socket.slowStart = newSlowStart(sOpt)
+	if sOpt.admissionThresholds != nil {
+		sOpt.admissionController = socket.thresholdAdmission(*sOpt.admissionThresholds)
+	}
+	if sOpt.pubSub != nil {
+		if err := socket.rooms.subscribe(); err != nil {
+			return nil, err
+		}
+	}
+	if h, ok := sOpt.handler.(interface{ bind(*Socket) }); ok {
+		h.bind(socket)
+	}
+	if sOpt.eventSink != nil {
+		socket.events = newEventPump(socket, *sOpt.eventSink)
+		go socket.events.run()
+	}
+	if sOpt.statsCallback != nil {
+		socket.startStats()
+	}
+	if sOpt.cpuThreshold > 0 {
+		go socket.monitorCPU()
+	}
+	if sOpt.deadConnInterval > 0 {
+		go socket.detectDeadConnections()
+	}
+	if sOpt.reapInterval > 0 {
+		go socket.reapStaleConnections()
+	}
+	if sOpt.sessionStore != nil {
+		socket.sessions = make(chan *SocketClient, sessionPersistQueue)
+		go socket.persistSessions()
+	}
 	go socket.listen()
 	return socket, nil
 }
@@ -62,31 +290,205 @@ func NewSocket(opts ...SocketOptionFunc) (SocketClientInterface, error) {
 func (s *Socket) listen() {
 	for {
 		select {
-		case key := <-s.unregister:
-			if client, ok := s.clients[key]; ok {
-				delete(s.clients, key)
-				close(client.send)
-			}
+		case client := <-s.unregister:
+			s.removeClient(client)
 		}
 	}
 }
 
-func (s *Socket) Connect(ctx *gin.Context, subkey string) {
-	client, ok := s.clients[subkey]
-	if ok && client.state == OnlineState {
+// remove 单个连接的清理出现panic时不能让listen退出，否则后续的注销都会阻塞
+func (s *Socket) remove(key string) {
+	defer s.recoverPanic(key)
+	s.mu.Lock()
+	client, ok := s.clients[key]
+	if ok {
+		delete(s.clients, key)
+		client.closeSend()
+	}
+	s.mu.Unlock()
+	if ok {
+		client.releaseTopics()
+		s.tags.removeAll(client)
+	}
+	if ok && client.namespace != nil {
+		client.namespace.rooms.leaveAll(key)
 		return
 	}
-	s.clients[subkey] = NewSocketClient(ctx, subkey, s)
+	s.rooms.leaveAll(key)
+}
+
+// Connect 配置了WithMigrationAcceptor且请求携带有效的迁移令牌时，连接标识使用令牌中记录的标识，不使用subkey；
+// StartDrain之后返回ErrDraining并以503结束握手。subkey为空时按WithIDGenerator生成连接标识，
+// 调用方可从响应头X-Connection-Id读取
+func (s *Socket) Connect(ctx *gin.Context, subkey string) error {
+	if err := s.rejectDraining(ctx, subkey); err != nil {
+		return err
+	}
+	admission, err := s.admit(ctx, subkey)
+	if err != nil {
+		return err
+	}
+	generated := subkey == ""
+	if generated {
+		if subkey, err = s.generateID(ctx); err != nil {
+			return err
+		}
+	}
+	migrated := s.acceptMigration(ctx)
+	var resumed *resumedSession
+	if migrated == nil {
+		// 恢复的会话沿用原来的连接标识和标签，与迁移令牌的处理方式相同
+		if resumed = s.resumeSession(ctx); resumed != nil && resumed.state != nil {
+			migrated = &MigrationState{Key: resumed.state.Key, Labels: resumed.state.Labels, Rooms: resumed.state.Rooms}
+		}
+	}
+	if migrated != nil && migrated.Key != "" {
+		subkey = migrated.Key
+	}
+	if s.GetClientState(subkey) == OnlineState {
+		return nil
+	}
+	client, err := newSocketClient(ctx, subkey, s, migrated, resumed)
+	if err != nil {
+		return err
+	}
+	client.degraded = admission.Action == AdmissionDegrade
+	client.sessionSampled = s.opts.sessionSampling && s.sessionSampled(client)
+	var unlock func()
+	if s.opts.pendingStore != nil {
+		unlock = s.pendingLocks.lock(subkey)
+	}
+	replaced, err := s.admitSession(client)
+	if err == nil && unlock != nil {
+		s.deliverPending(client)
+	}
+	if unlock != nil {
+		unlock()
+	}
+	if err != nil {
+		return err
+	}
+	for _, old := range replaced {
+		_ = old.closeWith(CloseLoggedInElsewhere, "logged in elsewhere")
+	}
+	if migrated != nil {
+		if err = s.restoreMigration(client, migrated); err != nil {
+			client.reportError(newError(client.key, "migrate", err))
+		}
+	}
+	if client.degraded {
+		if err = client.UpdateOption(admission.Options...); err != nil {
+			client.reportError(newError(client.key, "admission", err))
+		}
+	}
+	client.restoreSession(resumed)
+	client.idGenerated = generated
+	client.sendWelcome()
+	client.sendServerConfig()
+	if s.cpu.paused.Load() {
+		s.sendFlowControl(client.key, true)
+	}
+	if h, ok := s.opts.handler.(OpenHandler); ok {
+		h.OnOpen(client)
+	}
+	s.emitConnect(client)
+	if err = client.Run(); errors.Is(err, ErrClosed) {
+		// OnOpen等回调中已关闭连接，读循环不再启动，由这里唤醒等待读取、pong和确认的调用方
+		client.stopReading(nil)
+	}
+	return nil
+}
+
+func (s *Socket) register(client *SocketClient) {
+	s.mu.Lock()
+	s.clients[client.key] = client
+	s.mu.Unlock()
+}
+
+func (s *Socket) Rooms() *RoomManager {
+	return s.rooms
+}
+
+func (s *Socket) Stats(key string) (SocketStats, error) {
+	client, err := s.Client(key)
+	if err != nil {
+		return SocketStats{}, err
+	}
+	return client.Stats(), nil
+}
+
+func (s *Socket) Info(key string) (ConnInfo, error) {
+	client, err := s.Client(key)
+	if err != nil {
+		return ConnInfo{}, err
+	}
+	return client.Info(), nil
+}
+
+// Subprotocol 见SocketClient.Subprotocol，连接不存在时返回ErrConnectionClosed
+func (s *Socket) Subprotocol(key string) (string, error) {
+	client, err := s.Client(key)
+	if err != nil {
+		return "", err
+	}
+	return client.Subprotocol(), nil
+}
+
+// Client 获取已注册的连接，连接不存在时返回ErrConnectionClosed
+func (s *Socket) Client(key string) (*SocketClient, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	client, ok := s.clients[key]
+	if !ok {
+		return nil, newError(key, "lookup", ErrConnectionClosed)
+	}
+	return client, nil
+}
+
+func (s *Socket) Close(key string) error {
+	client, err := s.Client(key)
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
+
+// Done 返回连接的SocketClient.Done，连接关闭后通道关闭；连接不存在时返回ErrConnectionClosed
+func (s *Socket) Done(key string) (<-chan struct{}, error) {
+	client, err := s.Client(key)
+	if err != nil {
+		return nil, err
+	}
+	return client.Done(), nil
+}
+
+// ReadPumpChan 见SocketClient.ReadPumpChan
+func (s *Socket) ReadPumpChan(ctx context.Context, key string) (<-chan IncomingMessage, error) {
+	client, err := s.Client(key)
+	if err != nil {
+		return nil, err
+	}
+	return client.ReadPumpChan(ctx), nil
+}
+
+// CloseWithReason 关闭指定连接并告知客户端关闭原因，见SocketClient.CloseWithReason
+func (s *Socket) CloseWithReason(key string, code int, reason string, detail map[string]any) error {
+	client, err := s.Client(key)
+	if err != nil {
+		return err
+	}
+	return client.CloseWithReason(code, reason, detail)
 }
 
 func (s *Socket) GetAllKeys() []string {
-	clients := s.clients
-	if len(clients) == 0 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.clients) == 0 {
 		return []string{}
 	}
-	keys := make([]string, 0, len(clients))
-	for k, c := range clients {
-		if c.state == OnlineState {
+	keys := make([]string, 0, len(s.clients))
+	for k, c := range s.clients {
+		if c.State() == OnlineState {
 			keys = append(keys, k)
 		}
 	}
@@ -94,32 +496,79 @@ func (s *Socket) GetAllKeys() []string {
 }
 
 func (s *Socket) GetClientState(key string) ClientState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	client, ok := s.clients[key]
 	if !ok {
 		return OffLineState
 	}
-	return client.state
+	return client.State()
 }
 
 func (s *Socket) WriteMessage(message Message) error {
+	clients, err := s.targets(message.Subkeys)
+	if err != nil {
+		return err
+	}
+	messageType, data, err := s.encode(message)
+	if err != nil {
+		return newError("", "send", err)
+	}
 	if len(message.Subkeys) == 0 {
-		for _, client := range s.clients {
-			if client.state == OnlineState {
-				client.send <- message.Data
+		var errs []error
+		for _, client := range clients {
+			if err := client.enqueue(messageType, data); err != nil {
+				errs = append(errs, err)
 			}
 		}
-	} else {
-		for _, key := range message.Subkeys {
-			client, ok := s.clients[key]
-			if !ok || client.state == OffLineState {
-				return errors.New("Connect does not exist")
-			}
-			client.send <- message.Data
+		return errors.Join(errs...)
+	}
+	for _, client := range clients {
+		if err := client.enqueue(messageType, data); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// SendTo 按连接标识发送消息，适用于后台任务等没有gin上下文的场景，连接不存在时返回ErrSessionNotFound；
+// 配置了WithPendingStore时改为写入离线存储，待该标识重新连接后补发
+func (s *Socket) SendTo(key string, messageType int, data []byte) error {
+	if s.opts.pendingStore != nil {
+		return s.sendOrStore(key, messageType, data)
+	}
+	s.mu.RLock()
+	client, ok := s.clients[key]
+	s.mu.RUnlock()
+	if !ok {
+		return newError(key, "send", ErrSessionNotFound)
+	}
+	return client.enqueue(messageType, data)
+}
+
+func (s *Socket) targets(keys []string) ([]*SocketClient, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(keys) == 0 {
+		clients := make([]*SocketClient, 0, len(s.clients))
+		for _, client := range s.clients {
+			if client.State() == OnlineState {
+				clients = append(clients, client)
+			}
+		}
+		return clients, nil
+	}
+	clients := make([]*SocketClient, 0, len(keys))
+	for _, key := range keys {
+		client, ok := s.clients[key]
+		if !ok || client.State() == OffLineState {
+			return nil, newError(key, "send", ErrConnectionClosed)
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
 func defaultOption(opts *SocketOption) {
 	if opts.pingPeriod == 0 {
 		opts.pingPeriod = 20 * time.Second
@@ -130,6 +579,27 @@ func defaultOption(opts *SocketOption) {
 	if opts.writeReadBufferSize == 0 {
 		opts.writeReadBufferSize = 20480
 	}
+	if opts.sendQueueLength == 0 {
+		opts.sendQueueLength = defaultSendQueueLength
+	}
+	if opts.drainGracePeriod == 0 {
+		opts.drainGracePeriod = defaultDrainGracePeriod
+	}
+	if opts.maxPendingAcks == 0 {
+		opts.maxPendingAcks = defaultMaxPendingAcks
+	}
+	if opts.clientMetricsInterval == 0 {
+		opts.clientMetricsInterval = defaultClientMetricsInterval
+	}
+	if opts.idleGracePeriod == 0 {
+		opts.idleGracePeriod = defaultIdleGracePeriod
+	}
+	if opts.panicEscalationCount == 0 {
+		opts.panicEscalationCount = defaultPanicEscalationCount
+	}
+	if opts.panicEscalationWindow == 0 {
+		opts.panicEscalationWindow = defaultPanicEscalationWindow
+	}
 	if opts.heartbeatFailMaxTimes == 0 {
 		opts.heartbeatFailMaxTimes = 4
 	}
@@ -138,6 +608,235 @@ func defaultOption(opts *SocketOption) {
 	}
 }
 
+// validateOption 校验显式设置的配置项，零值会在defaultOption中取默认值，不视为错误
+func validateOption(opts *SocketOption) error {
+	var errs []error
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%w: "+format, append([]any{ErrInvalidOption}, args...)...))
+	}
+	if opts.handler == nil {
+		invalid("handler is required")
+	}
+	if opts.writeReadBufferSize < 0 {
+		invalid("buffer size must be positive, got %d", opts.writeReadBufferSize)
+	}
+	if opts.sendQueueLength < 0 || opts.sendQueueLength > maxSendQueueLength {
+		invalid("send queue length must be between 1 and %d, got %d", maxSendQueueLength, opts.sendQueueLength)
+	}
+	if opts.writeDeadline < 0 {
+		invalid("write deadline must be positive, got %s", opts.writeDeadline)
+	}
+	if opts.readDeadline < 0 {
+		invalid("read deadline must be positive, got %s", opts.readDeadline)
+	}
+	if opts.heartbeatFailMaxTimes < 0 {
+		invalid("heartbeat fail max times must be positive, got %d", opts.heartbeatFailMaxTimes)
+	}
+	if opts.maxMessageSize < 0 {
+		invalid("max message size must be positive, got %d", opts.maxMessageSize)
+	}
+	if opts.upgradeBodyLimit < 0 {
+		invalid("upgrade body limit must be positive, got %d", opts.upgradeBodyLimit)
+	}
+	if opts.upgradeTimeout < 0 {
+		invalid("upgrade timeout must be positive, got %s", opts.upgradeTimeout)
+	}
+	if opts.tcpKeepAlive < 0 {
+		invalid("tcp keepalive interval must be positive, got %s", opts.tcpKeepAlive)
+	}
+	if opts.roomRateLimit < 0 {
+		invalid("room rate limit must be positive, got %d", opts.roomRateLimit)
+	}
+	if err := opts.roomLimits.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if opts.roomHistorySize < 0 {
+		invalid("room history size must be positive, got %d", opts.roomHistorySize)
+	}
+	if sink := opts.eventSink; sink != nil {
+		if sink.Sink == nil {
+			invalid("event sink is required")
+		}
+		if sink.BufferSize < 0 || sink.BatchSize < 0 {
+			invalid("event sink buffer and batch size must be positive, got %d and %d", sink.BufferSize, sink.BatchSize)
+		}
+	}
+	if opts.history != nil && opts.history.Store == nil {
+		invalid("history store is required")
+	}
+	if t := opts.healthThresholds; t.MaxConnections < 0 || t.MaxQueuePressure < 0 || t.MaxQueuePressure > 1 ||
+		t.MaxEventBacklog < 0 || t.MaxEventBacklog > 1 {
+		invalid("health thresholds out of range: %+v", t)
+	}
+	if opts.writeLatencyWarning != nil && (opts.writeLatencyThreshold <= 0 || opts.writeLatencyThreshold > 1) {
+		invalid("write latency warning threshold must be in (0, 1], got %v", opts.writeLatencyThreshold)
+	}
+	if opts.duplicatePolicy < AllowMultiple || opts.duplicatePolicy > ErrorOnDuplicate {
+		invalid("unknown duplicate session policy %d", opts.duplicatePolicy)
+	}
+	if opts.duplicatePolicy != AllowMultiple && opts.labelExtractor == nil {
+		invalid("duplicate session policy requires a label extractor providing %q", SessionLabel)
+	}
+	for _, contentType := range opts.contentTypes {
+		if _, ok := codecs[contentType]; !ok {
+			invalid("unsupported content type %q", contentType)
+		}
+	}
+	if len(opts.contentTypes) > 0 && opts.protobufEncoding {
+		invalid("content type negotiation cannot be combined with protobuf encoding")
+	}
+	for name, c := range opts.namedCodecs {
+		if c == nil {
+			invalid("codec %q is nil", name)
+		}
+	}
+	if len(opts.namedCodecs) > 0 {
+		if _, ok := opts.namedCodecs[opts.defaultCodecName()]; !ok {
+			invalid("default codec %q is not registered", opts.defaultCodecName())
+		}
+		if len(opts.contentTypes) > 0 || opts.protobufEncoding {
+			invalid("codecs cannot be combined with content type negotiation or protobuf encoding")
+		}
+	} else if opts.defaultCodec != "" {
+		invalid("default codec requires codecs")
+	}
+	if opts.slowStartBudget < 0 || (opts.slowStartBudget > 0) != (opts.slowStartWindow > 0) {
+		invalid("slow start needs a positive budget and window, got %d and %s", opts.slowStartBudget, opts.slowStartWindow)
+	}
+	for _, t := range opts.allowedMessageTypes {
+		if t != websocket.TextMessage && t != websocket.BinaryMessage {
+			invalid("allowed message types only accept text and binary, got %d", t)
+		}
+	}
+	if opts.messageTypePolicy < MessageTypeClose || opts.messageTypePolicy > MessageTypeDrop {
+		invalid("unknown message type policy %d", opts.messageTypePolicy)
+	}
+	if opts.slowStartPolicy < SlowStartDefer || opts.slowStartPolicy > SlowStartReject {
+		invalid("unknown slow start policy %d", opts.slowStartPolicy)
+	}
+	if opts.slowStartGlobal < 0 || (opts.slowStartGlobal > 0 && opts.slowStartBudget == 0) {
+		invalid("slow start global budget requires slow start, got %d", opts.slowStartGlobal)
+	}
+	if opts.serializer != nil && (len(opts.contentTypes) > 0 || len(opts.namedCodecs) > 0 || opts.protobufEncoding) {
+		invalid("serializer cannot be combined with per-connection codecs or protobuf encoding")
+	}
+	if (opts.statsCallback != nil || opts.statsInterval != 0) && (opts.statsCallback == nil || opts.statsInterval < minStatsInterval) {
+		invalid("stats interval must be at least %s with a callback, got %s", minStatsInterval, opts.statsInterval)
+	}
+	if opts.drainGracePeriod < 0 {
+		invalid("drain grace period must be positive, got %s", opts.drainGracePeriod)
+	}
+	if opts.maxPendingAcks < 0 {
+		invalid("max pending acks must be positive, got %d", opts.maxPendingAcks)
+	}
+	versions := make(map[int]bool, len(opts.downgradeEncoders))
+	for _, encoder := range opts.downgradeEncoders {
+		if encoder.encode == nil || encoder.version >= opts.schemaVersion || versions[encoder.version] {
+			invalid("downgrade encoder for version %d must be unique and below schema version %d", encoder.version, opts.schemaVersion)
+		}
+		versions[encoder.version] = true
+	}
+	if opts.strictOrdering && opts.flushInterval > 0 {
+		invalid("strict ordering cannot be combined with flush interval")
+	}
+	if opts.flushInterval < 0 {
+		invalid("flush interval must be positive, got %s", opts.flushInterval)
+	}
+	if opts.recvAcks && opts.recvAckEvery <= 0 && opts.recvAckInterval <= 0 {
+		invalid("receive acks need a positive message count or interval")
+	}
+	if opts.reapInterval < 0 || opts.reapThreshold < 0 || (opts.reapInterval > 0) != (opts.reapThreshold > 0) {
+		invalid("stale connection reaper needs a positive interval and threshold, got %s and %s", opts.reapInterval, opts.reapThreshold)
+	}
+	if opts.deadConnInterval < 0 {
+		invalid("dead connection detector interval must be positive, got %s", opts.deadConnInterval)
+	}
+	if opts.deadConnInterval > 0 && tcpState == nil {
+		invalid("dead connection detection is only supported on linux")
+	}
+	if opts.flushAfterBytes < 0 {
+		invalid("flush after bytes must not be negative, got %d", opts.flushAfterBytes)
+	}
+	if len(opts.pingMsg) > maxControlPayload {
+		invalid("ping payload is %d bytes, control frames allow at most %d", len(opts.pingMsg), maxControlPayload)
+	}
+	if opts.pingPeriod < 0 && opts.heartbeatFailMaxTimes != 0 {
+		invalid("heartbeat is disabled but heartbeat fail max times is set to %d", opts.heartbeatFailMaxTimes)
+	}
+	if opts.cpuThreshold < 0 || opts.cpuThreshold > 1 {
+		invalid("cpu load threshold must be in (0, 1], got %v", opts.cpuThreshold)
+	}
+	if opts.cpuThreshold > 0 && opts.cpuInterval <= 0 {
+		invalid("cpu load monitor interval must be positive, got %s", opts.cpuInterval)
+	}
+	if opts.cpuThreshold > 0 && opts.cpuSampler == nil && newProcessCPUSampler == nil {
+		invalid("cpu sampling is not supported on this platform, use WithCPUSampler")
+	}
+	if opts.sampleRate < 0 || opts.sampleRate > 1 {
+		invalid("sample rate must be in [0, 1], got %v", opts.sampleRate)
+	}
+	if opts.sampleRate > 0 && opts.sampler == nil {
+		invalid("sampler callback is required")
+	}
+	if opts.sessionSampling && opts.sampler == nil {
+		invalid("session sampling requires WithSampler")
+	}
+	for name, limits := range opts.namespaces {
+		if name == "" {
+			invalid("namespace name must not be empty")
+		}
+		if limits.MaxConnections < 0 {
+			invalid("namespace %q max connections must be positive, got %d", name, limits.MaxConnections)
+		}
+		if err := limits.Rooms.validate(); err != nil {
+			invalid("namespace %q: %v", name, err)
+		}
+	}
+	if opts.topicLimit < 0 {
+		invalid("topic subscription limit must be positive, got %d", opts.topicLimit)
+	}
+	if opts.clientMetricsInterval < 0 {
+		invalid("client metrics interval must be positive, got %s", opts.clientMetricsInterval)
+	}
+	if opts.idleGracePeriod < 0 {
+		invalid("idle grace period must be positive, got %s", opts.idleGracePeriod)
+	}
+	if opts.queueWaitTimeout < 0 {
+		invalid("queue wait timeout must be positive, got %s", opts.queueWaitTimeout)
+	}
+	if opts.sessionStore != nil && opts.sessionTTL <= 0 {
+		invalid("session persistence ttl must be positive, got %s", opts.sessionTTL)
+	}
+	if opts.admissionController != nil && opts.admissionThresholds != nil {
+		invalid("admission controller and admission thresholds cannot be used together")
+	}
+	if t := opts.admissionThresholds; t != nil {
+		if _, fields := adjustableOptions(t.DegradedOptions); len(fields) > 0 {
+			invalid("degraded options can only adjust deadlines and heartbeat, got %v", fields)
+		}
+	}
+	if opts.panicEscalationCount < 0 || opts.panicEscalationWindow < 0 {
+		invalid("panic escalation must be positive, got %d in %s", opts.panicEscalationCount, opts.panicEscalationWindow)
+	}
+	if opts.pingPeriod < 0 && (opts.heartbeatExecutor != nil || opts.heartbeatLabel != "") {
+		invalid("heartbeat is disabled but a heartbeat executor or label is set")
+	}
+
+	if opts.noReadDeadline && opts.readDeadline != 0 {
+		invalid("read deadline %s is set but read deadline is disabled", opts.readDeadline)
+	}
+	if opts.noReadDeadline && opts.pingPeriod < 0 && !opts.allowNoLiveness {
+		invalid("read deadline and heartbeat are both disabled, dead connections would never be detected")
+	}
+
+	effective := *opts
+	defaultOption(&effective)
+	if !effective.noReadDeadline && effective.pingPeriod > 0 && effective.pingPeriod >= effective.readDeadline {
+		invalid("ping period %s must be less than read deadline %s", effective.pingPeriod, effective.readDeadline)
+	}
+	return errors.Join(errs...)
+}
+
 type SocketOptionInterface interface {
 	apply(*SocketOption)
 }
@@ -154,18 +853,48 @@ func WithHandler(handler MessageHandler) SocketOptionFunc {
 	}
 }
 
+func WithLogger(logger *zap.Logger) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.logger = logger
+	}
+}
+
+// WithWriteReadBufferSize 设置Upgrader的读写缓冲区大小，不影响发送队列长度
 func WithWriteReadBufferSize(size int) SocketOptionFunc {
 	return func(opt *SocketOption) {
 		opt.writeReadBufferSize = size
 	}
 }
 
+// WithSendQueueLength 每个连接发送队列可缓存的消息条数，默认256
+func WithSendQueueLength(n int) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.sendQueueLength = n
+	}
+}
+
 func WithReadDeadline(deadline time.Duration) SocketOptionFunc {
 	return func(opt *SocketOption) {
 		opt.readDeadline = deadline
 	}
 }
 
+// WithNoReadDeadline 不设置读取截止时间，收到pong也不再刷新，适合长时间无入站消息、由心跳负责探活的连接。
+// 心跳失败计数照常生效；与关闭心跳同时使用时需要再传入WithAllowNoLiveness，否则校验不通过
+func WithNoReadDeadline() SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.noReadDeadline = true
+	}
+}
+
+// WithAllowNoLiveness 明确接受既无读取截止时间也无心跳的连接，对端异常掉线时只能依赖TCP层发现
+func WithAllowNoLiveness() SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.allowNoLiveness = true
+	}
+}
+
+// WithHeartbeatFailMaxTimes 连续发送ping失败达到该次数时关闭连接，任意一次成功即重新计数，默认4次
 func WithHeartbeatFailMaxTimes(heartbeatFailMaxTimes int) SocketOptionFunc {
 	return func(opt *SocketOption) {
 		opt.heartbeatFailMaxTimes = heartbeatFailMaxTimes
@@ -178,6 +907,7 @@ func WithWriteDeadline(writeDeadline time.Duration) SocketOptionFunc {
 	}
 }
 
+// WithPingPeriod 心跳间隔，传入负数时关闭心跳
 func WithPingPeriod(pingPeriod time.Duration) SocketOptionFunc {
 	return func(opt *SocketOption) {
 		opt.pingPeriod = pingPeriod
@@ -189,3 +919,118 @@ func WithPingMsg(pingMsg string) SocketOptionFunc {
 		opt.pingMsg = pingMsg
 	}
 }
+
+// WithRoomHistory 每个房间保留最近size条广播消息，新成员加入时补发
+func WithRoomHistory(size int) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.roomHistorySize = size
+	}
+}
+
+// WithRoomRateLimit 每个房间内所有成员通过RoomManager.SendFrom发送消息的总速率(条/秒)
+func WithRoomRateLimit(messagesPerSecond int) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.roomRateLimit = messagesPerSecond
+	}
+}
+
+// WithMaxMessageSize 限制单条入站消息的字节数，超出时以ErrMessageTooLarge断开连接
+func WithMaxMessageSize(size int64) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.maxMessageSize = size
+	}
+}
+
+// WithTCPKeepAlive 升级完成后开启底层TCP连接的keepalive，配合应用层心跳更快发现被防火墙丢弃的连接
+func WithTCPKeepAlive(interval time.Duration) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.tcpKeepAlive = interval
+	}
+}
+
+// WithE2ELatencyProbe 从入站JSON消息的_sent_ts字段(毫秒时间戳)计算客户端发送到OnMessage调用前的端到端延迟
+func WithE2ELatencyProbe(fn func(latency time.Duration)) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.e2eLatencyProbe = fn
+	}
+}
+
+// WithPubSub 房间广播通过消息总线发布，各节点订阅后投递给本地连接
+func WithPubSub(bus PubSub) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.pubSub = bus
+	}
+}
+
+// WithUpgradeBodyLimit 限制升级握手请求体的字节数，Content-Length超过限制的请求以413拒绝(ErrUpgradeFailed、ErrMessageTooLarge)，
+// 不超过限制的请求体在升级前读完丢弃
+func WithUpgradeBodyLimit(bytes int64) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.upgradeBodyLimit = bytes
+	}
+}
+
+// WithUpgradeTimeout 升级时写出101响应的超时时间，客户端迟迟不读取响应时不会一直占用处理握手的goroutine，
+// 超时后Connect返回同时匹配ErrUpgradeFailed和ErrUpgradeTimeout的错误
+func WithUpgradeTimeout(d time.Duration) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.upgradeTimeout = d
+	}
+}
+
+// WithEnableCompression 开启permessage-deflate压缩协商
+func WithEnableCompression(enabled bool) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.enableCompression = enabled
+	}
+}
+
+// WithContinueOnError OnMessage发生panic时默认断开连接，predicate返回true的错误在回调OnError后继续读取。
+// panic的值为error时可通过errors.Is/As识别，例如对JSON解析失败等业务错误放行；
+// 连接本身的读取错误无法恢复，始终断开
+func WithContinueOnError(predicate func(err error) bool) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.continueOnError = predicate
+	}
+}
+
+// WithWriteTransformer 在写循环中、消息写出之前依次执行转换器，可用于脱敏、内容审核等，多次调用会追加。
+// 任一转换器返回错误时该消息被丢弃并记录日志，连接不受影响；SendReader的流式消息和控制帧不经过转换器
+func WithWriteTransformer(fn ...func(mt int, data []byte) ([]byte, error)) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.writeTransformers = append(opt.writeTransformers, fn...)
+	}
+}
+
+// WithInjectTimestamp 在写循环中为每条消息加上服务端时间戳(Unix纳秒)，用于延迟测试：
+// JSON对象文本消息加入"_server_ts"字段，二进制消息在开头加上8字节大端序时间戳，其他文本消息不变
+func WithInjectTimestamp(enabled bool) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.injectTimestamp = enabled
+	}
+}
+
+// WithWriteLatencyWarning 单条消息写出耗时超过threshold倍的写入截止时间时回调fn，例如0.8，
+// 用于在慢客户端真正超时断开之前提前告警。fn在写循环中同步调用，应尽快返回
+func WithWriteLatencyWarning(threshold float64, fn func(elapsed time.Duration)) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.writeLatencyThreshold = threshold
+		opt.writeLatencyWarning = fn
+	}
+}
+
+// WithFlushInterval 文本消息先在写循环中缓冲，每隔d合并为一个JSON数组帧发送，适合高频的token流式输出。
+// 消息本身是JSON时原样作为数组元素，否则编码为JSON字符串；二进制消息会先触发一次合并发送以保持顺序
+func WithFlushInterval(d time.Duration) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.flushInterval = d
+	}
+}
+
+// WithFlushAfterBytes 底层连接带写缓冲(自定义传输层实现了http.Flusher或Flush() error)时，写循环累计写出超过n字节
+// 或发送队列已空时才刷新一次，减少小消息的系统调用。默认0表示每次写出后都刷新；普通TCP连接不受影响
+func WithFlushAfterBytes(n int) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.flushAfterBytes = n
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SocketStats 单个连接的统计快照
+type SocketStats struct {
+	Key             string
+	E2ELatencyP99   time.Duration
+	BytesSent       int64
+	BytesReceived   int64
+	SendBytesPerSec float64
+	// OutOfOrderMessagesSent 绕过发送队列的写入越过已排队消息的次数，开启WithStrictOrdering时总是0
+	OutOfOrderMessagesSent int64
+	// HeartbeatFailures 当前连续发送ping失败的次数，达到HeartbeatFailMaxTimes时连接被关闭
+	HeartbeatFailures     int
+	HeartbeatFailMaxTimes int
+	// PingRTT 最近一次Ping测得的往返时延，未调用过Ping时为0
+	PingRTT time.Duration
+	// LastCloseCode、LastCloseReason 连接的关闭码及其CloseCodeDescription，尚未关闭时为0和空
+	LastCloseCode   int
+	LastCloseReason string
+	// DisallowedMessages 被WithAllowedMessageTypes拒绝的入站消息数
+	DisallowedMessages int64
+	// QueueWaitDrops 超过排队等待时间而丢弃的消息数，不包含写入失败
+	QueueWaitDrops int64
+	// QueueCancelled 通过CancelQueued、CancelQueuedWhere取消的消息数
+	QueueCancelled int64
+	// ReceivedThrough、DuplicatesSuppressed WithReceiveAcks累计确认的序号，以及因重发而没有分发的消息数
+	ReceivedThrough      int64
+	DuplicatesSuppressed int64
+	// ClientMetrics 客户端最近一次上报的指标，未开启WithClientMetricsHandler或尚未上报时为nil
+	ClientMetrics *ClientMetrics
+	// MetricsViolations 超长、过于频繁或格式不正确而被丢弃的client.metrics帧数
+	MetricsViolations int64
+	// BusPublishErrors WithMessageBusPublisher发布失败的消息数
+	BusPublishErrors int64
+	// QueueDepth、QueueBytes 发送队列当前的消息数和字节数；QueueDepthPeak、QueueBytesPeak为连接建立
+	// 或上次ResetWatermarks以来的最大值，由入队路径维护，不依赖采样
+	QueueDepth     int
+	QueueBytes     int64
+	QueueDepthPeak int
+	QueueBytesPeak int64
+	// Labels 只包含WithMetricLabels允许的标签
+	Labels map[string]string
+}
+
+func (s *SocketClient) Stats() SocketStats {
+	closeCode, _ := s.LastClose()
+	var closeReason string
+	if closeCode != 0 {
+		closeReason = CloseCodeDescription(closeCode)
+	}
+	return SocketStats{
+		Key:                    s.key,
+		E2ELatencyP99:          s.e2eLatency.percentile(0.99),
+		BytesSent:              s.bytesSent.Load(),
+		BytesReceived:          s.bytesReceived.Load(),
+		SendBytesPerSec:        s.sendRate.perSecond(),
+		OutOfOrderMessagesSent: s.outOfOrder.Load(),
+		HeartbeatFailures:      s.HeartbeatFailures(),
+		HeartbeatFailMaxTimes:  s.options().heartbeatFailMaxTimes,
+		PingRTT:                time.Duration(s.pingRTT.Load()),
+		LastCloseCode:          closeCode,
+		LastCloseReason:        closeReason,
+		DisallowedMessages:     s.disallowedCount.Load(),
+		QueueWaitDrops:         s.queueWaitDrops.Load(),
+		QueueCancelled:         s.queueCancelled.Load(),
+		ReceivedThrough:        s.ReceivedThrough(),
+		DuplicatesSuppressed:   s.recvDuplicates.Load(),
+		ClientMetrics:          s.ClientMetrics(),
+		MetricsViolations:      s.metricsRejected.Load(),
+		BusPublishErrors:       s.busErrors.Load(),
+		QueueDepth:             int(s.queuedMessages.Load()),
+		QueueBytes:             s.queuedBytes.Load(),
+		QueueDepthPeak:         int(s.queuePeakMsgs.Load()),
+		QueueBytesPeak:         s.queuePeakBytes.Load(),
+		Labels:                 s.metricLabels(),
+	}
+}
+
+// BytesSentAtomic 已写出的数据帧负载字节数，只做一次原子读取，适合高频采集
+func (s *SocketClient) BytesSentAtomic() int64 {
+	return s.bytesSent.Load()
+}
+
+// BytesReceivedAtomic 已读取的数据帧负载字节数
+func (s *SocketClient) BytesReceivedAtomic() int64 {
+	return s.bytesReceived.Load()
+}
+
+func (s *SocketClient) countSent(n int) {
+	s.bytesSent.Add(int64(n))
+	s.sendRate.add(int64(n))
+}
+
+const (
+	rateBuckets        = 10
+	rateBucketDuration = time.Second / rateBuckets
+)
+
+// rateWindow 按100ms分桶统计最近1秒的字节数
+type rateWindow struct {
+	mu      sync.Mutex
+	buckets [rateBuckets]int64
+	epochs  [rateBuckets]int64
+}
+
+func (w *rateWindow) add(n int64) {
+	epoch := time.Now().UnixNano() / int64(rateBucketDuration)
+	slot := epoch % rateBuckets
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.epochs[slot] != epoch {
+		w.epochs[slot] = epoch
+		w.buckets[slot] = 0
+	}
+	w.buckets[slot] += n
+}
+
+func (w *rateWindow) perSecond() float64 {
+	epoch := time.Now().UnixNano() / int64(rateBucketDuration)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var total int64
+	for i := range w.buckets {
+		if epoch-w.epochs[i] < rateBuckets {
+			total += w.buckets[i]
+		}
+	}
+	return float64(total)
+}
+
+// latencyWindow 保留最近的若干个延迟样本用于计算分位数
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+const latencyWindowSize = 256
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.samples == nil {
+		w.samples = make([]time.Duration, latencyWindowSize)
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % len(w.samples)
+	if w.next == 0 {
+		w.full = true
+	}
+}
+
+func (w *latencyWindow) percentile(p float64) time.Duration {
+	w.mu.Lock()
+	n := w.next
+	if w.full {
+		n = len(w.samples)
+	}
+	if n == 0 {
+		w.mu.Unlock()
+		return 0
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, w.samples[:n])
+	w.mu.Unlock()
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(float64(n-1)*p)]
+}
+
+// sentTimestamp 客户端在JSON消息中注入的发送时间，单位毫秒(与Date.now()一致)
+type sentTimestamp struct {
+	SentTs *int64 `json:"_sent_ts"`
+}
+
+func (s *SocketClient) probeE2ELatency(data []byte) {
+	var ts sentTimestamp
+	if err := json.Unmarshal(data, &ts); err != nil || ts.SentTs == nil {
+		return
+	}
+	latency := time.Since(time.UnixMilli(*ts.SentTs))
+	if latency < 0 {
+		latency = 0
+	}
+	s.e2eLatency.add(latency)
+	s.socket.opts.e2eLatencyProbe(latency)
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// minStatsInterval 统计回调的最短间隔
+	minStatsInterval = time.Second
+	// statsTick 共享定时器的精度，回调的实际间隔最多晚这么久
+	statsTick = 100 * time.Millisecond
+)
+
+// HubStats OnStats回调的全局统计快照
+type HubStats struct {
+	At            time.Time
+	Connections   int
+	BytesSent     int64
+	BytesReceived int64
+	Rooms         RoomStats
+	SlowStart     SlowStartStats
+	QueuedBytes   int64
+	// QueueDepth 在线连接当前发送队列消息数的分位数
+	QueueDepth QueueDepthStats
+	Admission  AdmissionStats
+	// ReapedConnections WithStaleConnectionReaper累计回收的连接数
+	ReapedConnections int64
+	// Namespaces 按租户统计，未配置WithNamespaces时为nil
+	Namespaces map[string]NamespaceStats
+}
+
+// WithStatsInterval 每隔d对每个在线连接回调一次Stats快照，d不能小于1秒。所有连接共用一个定时器，
+// 回调在定时器的goroutine中依次执行，不占用读写循环；连接关闭后不再回调
+func WithStatsInterval(d time.Duration, fn func(SocketStats)) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.statsInterval = d
+		opt.statsCallback = fn
+	}
+}
+
+type hubStatsSub struct {
+	mu       sync.Mutex
+	interval time.Duration
+	due      time.Time
+	fn       func(HubStats)
+	stopped  bool
+}
+
+type statsScheduler struct {
+	mu      sync.Mutex
+	subs    []*hubStatsSub
+	running bool
+}
+
+// OnStats 每隔d回调一次全局统计，d不能小于1秒。与WithStatsInterval共用定时器；
+// stop返回后不会再回调，不能在fn中调用stop
+func (s *Socket) OnStats(d time.Duration, fn func(HubStats)) (stop func(), err error) {
+	if d < minStatsInterval || fn == nil {
+		return nil, fmt.Errorf("%w: stats interval must be at least %s, got %s", ErrInvalidOption, minStatsInterval, d)
+	}
+	sub := &hubStatsSub{interval: d, due: time.Now().Add(d), fn: fn}
+	s.stats.mu.Lock()
+	s.stats.subs = append(s.stats.subs, sub)
+	s.stats.mu.Unlock()
+	s.startStats()
+	return func() {
+		sub.mu.Lock()
+		sub.stopped = true
+		sub.mu.Unlock()
+		s.stats.mu.Lock()
+		defer s.stats.mu.Unlock()
+		for i, other := range s.stats.subs {
+			if other == sub {
+				s.stats.subs = append(s.stats.subs[:i], s.stats.subs[i+1:]...)
+				break
+			}
+		}
+	}, nil
+}
+
+// HubStats 当前的全局统计快照
+func (s *Socket) HubStats() HubStats {
+	stats := HubStats{At: time.Now(), Rooms: s.rooms.Stats(), SlowStart: s.SlowStartStats(), Admission: s.AdmissionStats(),
+		ReapedConnections: s.reaper.reaped.Load()}
+	s.mu.RLock()
+	depths := make([]int, 0, len(s.clients))
+	for _, client := range s.clients {
+		if client.State() != OnlineState {
+			continue
+		}
+		stats.Connections++
+		stats.BytesSent += client.bytesSent.Load()
+		stats.BytesReceived += client.bytesReceived.Load()
+		stats.QueuedBytes += client.queuedBytes.Load()
+		depths = append(depths, int(client.queuedMessages.Load()))
+	}
+	s.mu.RUnlock()
+	stats.QueueDepth = queueDepthStats(depths)
+	for name, ns := range s.namespaces {
+		if stats.Namespaces == nil {
+			stats.Namespaces = make(map[string]NamespaceStats, len(s.namespaces))
+		}
+		stats.Namespaces[name] = ns.Stats()
+	}
+	return stats
+}
+
+func (s *Socket) startStats() {
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	if s.stats.running {
+		return
+	}
+	s.stats.running = true
+	go s.runStats()
+}
+
+// runStats 没有连接级回调且全局订阅都已取消时退出，再次OnStats时重新启动
+func (s *Socket) runStats() {
+	ticker := time.NewTicker(statsTick)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if s.opts.statsCallback != nil {
+			s.fireConnStats(now)
+		}
+		s.stats.mu.Lock()
+		subs := append([]*hubStatsSub(nil), s.stats.subs...)
+		if len(subs) == 0 && s.opts.statsCallback == nil {
+			s.stats.running = false
+			s.stats.mu.Unlock()
+			return
+		}
+		s.stats.mu.Unlock()
+		var snapshot *HubStats
+		for _, sub := range subs {
+			sub.mu.Lock()
+			if !sub.stopped && !now.Before(sub.due) {
+				if snapshot == nil {
+					stats := s.HubStats()
+					snapshot = &stats
+				}
+				sub.due = now.Add(sub.interval)
+				s.statsCall("", func() { sub.fn(*snapshot) })
+			}
+			sub.mu.Unlock()
+		}
+	}
+}
+
+func (s *Socket) fireConnStats(now time.Time) {
+	s.mu.RLock()
+	clients := make([]*SocketClient, 0, len(s.clients))
+	for _, client := range s.clients {
+		clients = append(clients, client)
+	}
+	s.mu.RUnlock()
+	for _, client := range clients {
+		if client.statsDue.IsZero() {
+			client.statsDue = client.handshake.ConnectedAt.Add(s.opts.statsInterval)
+		}
+		if now.Before(client.statsDue) || client.State() != OnlineState {
+			continue
+		}
+		client.statsDue = now.Add(s.opts.statsInterval)
+		s.statsCall(client.key, func() { s.opts.statsCallback(client.Stats()) })
+	}
+}
+
+// statsCall 回调中的panic不会终止定时器
+func (s *Socket) statsCall(key string, fn func()) {
+	defer s.recoverPanic(key)
+	fn()
+}
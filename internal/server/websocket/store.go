@@ -0,0 +1,75 @@
+package server
+
+import "sync"
+
+// Store 连接级别的键值存储，用于在会话过程中保存会话ID、功能开关等随时变化的状态。
+// 并发安全，连接关闭并回调OnClose之后自动清空；升级时的握手信息见Handshake，不可修改
+type Store struct {
+	mu     sync.RWMutex
+	values map[string]any
+	// onChange Set、Delete之后回调，用于WithSessionPersistence
+	onChange func()
+}
+
+func (s *Store) Set(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]any)
+	}
+	s.values[key] = value
+	s.changed()
+}
+
+func (s *Store) Get(key string) (any, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.values[key]
+	return value, ok
+}
+
+func (s *Store) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	s.changed()
+}
+
+// changed 在持有锁时调用，onChange不能再访问Store
+func (s *Store) changed() {
+	if s.onChange != nil {
+		s.onChange()
+	}
+}
+
+// Range 遍历当前内容的快照，fn返回false时停止，fn中可以安全地调用Set、Delete
+func (s *Store) Range(fn func(key string, value any) bool) {
+	s.mu.RLock()
+	snapshot := make(map[string]any, len(s.values))
+	for k, v := range s.values {
+		snapshot[k] = v
+	}
+	s.mu.RUnlock()
+	for k, v := range snapshot {
+		if !fn(k, v) {
+			return
+		}
+	}
+}
+
+func (s *Store) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = nil
+}
+
+// StoreValue 按类型读取，键不存在或类型不匹配时返回零值和false
+func StoreValue[T any](store *Store, key string) (T, bool) {
+	value, ok := store.Get(key)
+	if !ok {
+		var zero T
+		return zero, false
+	}
+	typed, ok := value.(T)
+	return typed, ok
+}
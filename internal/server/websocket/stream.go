@@ -0,0 +1,203 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const streamChunkSize = 32 * 1024
+
+// SendReader 将r中的数据作为一条完整的websocket消息发送，不会一次性读入内存。
+// size>=0时要求r恰好提供size字节，小于0时读到EOF为止。发送期间持有写锁，队列中的消息会等待其完成，
+// 写入截止时间按每个分片刷新，只要数据持续写出就不会超时。
+// 注意：r返回错误或者提供的数据不足size字节时，该消息已无法补救，连接会在释放写锁之前断开，
+// 对端不会收到被截断的消息，队列中等待的消息也不会再写出。只在open阶段可用
+func (s *SocketClient) SendReader(messageType int, r io.Reader, size int64) error {
+	if err := s.requireOpen("stream", ErrConnectionClosed); err != nil {
+		return err
+	}
+	if size >= 0 {
+		r = io.LimitReader(r, size)
+	}
+	s.noteDirectWrite()
+	start := time.Now()
+	written, err := s.stream(messageType, r, size)
+	s.socket.emitStreamEnd(s.key, messageType, written, time.Since(start), err)
+	if err != nil {
+		err = newError(s.key, "stream", err)
+		s.close()
+		return err
+	}
+	return nil
+}
+
+func (s *SocketClient) stream(messageType int, r io.Reader, size int64) (written int64, err error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.writesCanceled.Load() {
+		return 0, classifyWriteError(websocket.ErrCloseSent)
+	}
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.options().writeDeadline)); err != nil {
+		return 0, classifyWriteError(err)
+	}
+	w, err := s.conn.NextWriter(messageType)
+	if err != nil {
+		return 0, classifyWriteError(err)
+	}
+	defer func() {
+		if err != nil {
+			s.abortMessageLocked()
+		}
+	}()
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			if s.writesCanceled.Load() {
+				return written, classifyWriteError(websocket.ErrCloseSent)
+			}
+			if err = s.conn.SetWriteDeadline(time.Now().Add(s.options().writeDeadline)); err != nil {
+				return written, classifyWriteError(err)
+			}
+			if _, err = w.Write(buf[:n]); err != nil {
+				return written, classifyWriteError(err)
+			}
+			written += int64(n)
+			s.countSent(n)
+		}
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+	// 长度不足时不能调用w.Close，那样会发出最终帧，对端收到的是一条被截断却完整的消息
+	if size >= 0 && written != size {
+		return written, fmt.Errorf("reader provided %d of %d bytes: %w", written, size, io.ErrUnexpectedEOF)
+	}
+	if err = w.Close(); err != nil {
+		return written, classifyWriteError(err)
+	}
+	return written, nil
+}
+
+// abortMessageLocked 消息写到一半失败时调用，调用方持有writeMu。释放写锁之后的下一次NextWriter会先以最终帧结束这条消息，
+// 因此在释放之前取消写入并断开底层连接
+func (s *SocketClient) abortMessageLocked() {
+	s.writesCanceled.Store(true)
+	_ = s.conn.UnderlyingConn().Close()
+}
+
+// WriterSession 手动控制分片的单条消息写入，由WriterFor创建。使用期间持有连接的写锁，
+// 队列中的消息和其他直接写入都会等待，必须调用Close释放
+type WriterSession struct {
+	client  *SocketClient
+	w       io.WriteCloser
+	pending []byte
+	written int64
+	err     error
+	closed  bool
+}
+
+// WriterFor 获取写锁并开始一条新消息，返回的WriterSession基于gorilla的NextWriter。
+// 不经过发送队列和写入转换器；写入失败时消息已无法补救，Close时关闭连接。只在open阶段可用
+func (s *SocketClient) WriterFor(messageType int) (*WriterSession, error) {
+	if err := s.requireOpen("stream", ErrConnectionClosed); err != nil {
+		return nil, err
+	}
+	s.noteDirectWrite()
+	s.writeMu.Lock()
+	if s.writesCanceled.Load() {
+		s.writeMu.Unlock()
+		return nil, newError(s.key, "stream", classifyWriteError(websocket.ErrCloseSent))
+	}
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.options().writeDeadline)); err != nil {
+		s.writeMu.Unlock()
+		return nil, newError(s.key, "stream", classifyWriteError(err))
+	}
+	w, err := s.conn.NextWriter(messageType)
+	if err != nil {
+		s.writeMu.Unlock()
+		return nil, newError(s.key, "stream", classifyWriteError(err))
+	}
+	return &WriterSession{client: s, w: w}, nil
+}
+
+// WriterFor 按连接标识调用SocketClient.WriterFor
+func (s *Socket) WriterFor(key string, messageType int) (*WriterSession, error) {
+	client, err := s.Client(key)
+	if err != nil {
+		return nil, err
+	}
+	return client.WriterFor(messageType)
+}
+
+// Write 数据先缓存在会话中，由Flush或Close发出
+func (ws *WriterSession) Write(p []byte) (int, error) {
+	if ws.closed {
+		return 0, newError(ws.client.key, "stream", ErrAlreadyClosed)
+	}
+	if ws.err != nil {
+		return 0, ws.err
+	}
+	ws.pending = append(ws.pending, p...)
+	return len(p), nil
+}
+
+// Flush 将已缓存的数据作为一个非最终帧发出，并刷新写入截止时间。
+// gorilla只有在单次写入超过两倍写缓冲区(WithWriteReadBufferSize)时才立即成帧，
+// 更小的数据会留在其缓冲区中，与之后的数据合并成帧；开启压缩时帧边界由压缩器决定
+func (ws *WriterSession) Flush() error {
+	if ws.closed {
+		return newError(ws.client.key, "stream", ErrAlreadyClosed)
+	}
+	if ws.err != nil || len(ws.pending) == 0 {
+		return ws.err
+	}
+	s := ws.client
+	if s.writesCanceled.Load() {
+		ws.err = newError(s.key, "stream", classifyWriteError(websocket.ErrCloseSent))
+		return ws.err
+	}
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.options().writeDeadline)); err != nil {
+		ws.err = newError(s.key, "stream", classifyWriteError(err))
+		return ws.err
+	}
+	if _, err := ws.w.Write(ws.pending); err != nil {
+		ws.err = newError(s.key, "stream", classifyWriteError(err))
+		return ws.err
+	}
+	ws.written += int64(len(ws.pending))
+	s.countSent(len(ws.pending))
+	ws.pending = ws.pending[:0]
+	return nil
+}
+
+// Close 发出剩余数据和最终帧并释放写锁，重复调用返回ErrAlreadyClosed。
+// 写入失败时在释放写锁之前断开连接，对端不会收到被截断的消息
+func (ws *WriterSession) Close() error {
+	if ws.closed {
+		return newError(ws.client.key, "stream", ErrAlreadyClosed)
+	}
+	s := ws.client
+	err := ws.Flush()
+	if err == nil {
+		if closeErr := ws.w.Close(); closeErr != nil {
+			err = newError(s.key, "stream", classifyWriteError(closeErr))
+		}
+	}
+	ws.closed = true
+	if err != nil {
+		s.abortMessageLocked()
+	}
+	s.writeMu.Unlock()
+	if err != nil {
+		s.close()
+	}
+	return err
+}
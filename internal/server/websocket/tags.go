@@ -0,0 +1,129 @@
+package server
+
+import "sync"
+
+// tagIndex 标签到连接的倒排索引，连接自身的标签集合也由mu保护，两者总是一起修改
+type tagIndex struct {
+	mu    sync.RWMutex
+	byTag map[string]map[string]*SocketClient
+}
+
+// Tag 给连接打上标签，例如"gpu:a100"，之后可以通过ByTag、BroadcastTag、CloseTag按标签批量操作。
+// 与房间不同，标签只用于服务端寻址，不会通知客户端；空标签和已关闭的连接忽略，连接关闭时自动移除全部标签
+func (s *SocketClient) Tag(tag string) {
+	if tag == "" {
+		return
+	}
+	index := &s.socket.tags
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	// 在锁内检查：连接先变为离线再从索引中移除，不会留下已关闭连接的标签
+	if s.State() != OnlineState {
+		return
+	}
+	if s.tags == nil {
+		s.tags = make(map[string]struct{})
+	}
+	s.tags[tag] = struct{}{}
+	if index.byTag == nil {
+		index.byTag = make(map[string]map[string]*SocketClient)
+	}
+	members := index.byTag[tag]
+	if members == nil {
+		members = make(map[string]*SocketClient)
+		index.byTag[tag] = members
+	}
+	members[s.key] = s
+}
+
+// Untag 移除连接的标签，没有该标签时不做任何事
+func (s *SocketClient) Untag(tag string) {
+	index := &s.socket.tags
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	index.untag(s, tag)
+}
+
+func (s *SocketClient) HasTag(tag string) bool {
+	index := &s.socket.tags
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	_, ok := s.tags[tag]
+	return ok
+}
+
+// Tags 连接当前的标签，顺序不固定
+func (s *SocketClient) Tags() []string {
+	index := &s.socket.tags
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	tags := make([]string, 0, len(s.tags))
+	for tag := range s.tags {
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// untag 调用方持有mu；同一标识可能已是新的连接，只移除属于client的表项
+func (t *tagIndex) untag(client *SocketClient, tag string) {
+	delete(client.tags, tag)
+	members := t.byTag[tag]
+	if members[client.key] != client {
+		return
+	}
+	delete(members, client.key)
+	if len(members) == 0 {
+		delete(t.byTag, tag)
+	}
+}
+
+// removeAll 连接从连接表中移除时调用
+func (t *tagIndex) removeAll(client *SocketClient) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for tag := range client.tags {
+		t.untag(client, tag)
+	}
+}
+
+// ByTag 带有tag标签的在线连接，按倒排索引查找，不遍历全部连接；顺序不固定。包含WithNamespaces各租户的连接
+func (s *Socket) ByTag(tag string) []*SocketClient {
+	s.tags.mu.RLock()
+	defer s.tags.mu.RUnlock()
+	members := s.tags.byTag[tag]
+	clients := make([]*SocketClient, 0, len(members))
+	for _, client := range members {
+		if client.State() == OnlineState {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// BroadcastTag 向带有tag标签的在线连接发送消息，结果与BroadcastWhere相同
+func (s *Socket) BroadcastTag(tag string, messageType int, data []byte) BroadcastResult {
+	var result BroadcastResult
+	for _, client := range s.ByTag(tag) {
+		result.Matched++
+		if err := client.enqueue(messageType, data); err != nil {
+			if result.Failed == nil {
+				result.Failed = make(map[string]error)
+			}
+			result.Failed[client.key] = err
+			continue
+		}
+		result.Sent++
+	}
+	return result
+}
+
+// CloseTag 以code、reason关闭带有tag标签的全部在线连接，返回关闭的连接数，例如下线一批GPU节点上的会话
+func (s *Socket) CloseTag(tag string, code int, reason string) int {
+	var closed int
+	for _, client := range s.ByTag(tag) {
+		if client.closeWith(code, reason) == nil {
+			closed++
+		}
+	}
+	return closed
+}
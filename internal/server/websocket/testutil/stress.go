@@ -0,0 +1,287 @@
+// Package testutil websocket服务的压测工具，在TestLoad*等测试中模拟大量并发连接
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const defaultStressRate = 10
+
+// StressOption 压测参数
+type StressOption func(*stressConfig)
+
+type stressConfig struct {
+	rate    float64
+	payload func(conn int, seq int64) []byte
+	dialer  *websocket.Dialer
+	header  http.Header
+}
+
+// WithRate 每个连接每秒发送的消息数，默认10
+func WithRate(perSecond float64) StressOption {
+	return func(c *stressConfig) {
+		c.rate = perSecond
+	}
+}
+
+// WithPayload 附加在每条消息中的内容，必须是JSON对象，压测字段stress_conn、stress_seq会合并进去
+func WithPayload(fn func(conn int, seq int64) []byte) StressOption {
+	return func(c *stressConfig) {
+		c.payload = fn
+	}
+}
+
+// WithDialer 替换默认的websocket.DefaultDialer，例如设置子协议或TLS
+func WithDialer(dialer *websocket.Dialer, header http.Header) StressOption {
+	return func(c *stressConfig) {
+		c.dialer = dialer
+		c.header = header
+	}
+}
+
+// StressReport Latency为发出消息到收到带有相同stress_conn、stress_seq的回复的时间，服务端不回显时为空；
+// Throughput为每秒收到的回复数
+type StressReport struct {
+	Connections    int
+	DialErrors     int64
+	SendErrors     int64
+	ReadErrors     int64
+	Sent           int64
+	Received       int64
+	Duration       time.Duration
+	SendThroughput float64
+	Throughput     float64
+	LatencyP50     time.Duration
+	LatencyP90     time.Duration
+	LatencyP99     time.Duration
+	LatencyMax     time.Duration
+}
+
+func (r StressReport) String() string {
+	return fmt.Sprintf("conns=%d sent=%d recv=%d dial_err=%d send_err=%d read_err=%d send=%.0f/s recv=%.0f/s p50=%s p90=%s p99=%s max=%s",
+		r.Connections, r.Sent, r.Received, r.DialErrors, r.SendErrors, r.ReadErrors, r.SendThroughput, r.Throughput,
+		r.LatencyP50, r.LatencyP90, r.LatencyP99, r.LatencyMax)
+}
+
+// stressProbe 写入每条消息并由服务端原样带回的字段
+type stressProbe struct {
+	Conn *int  `json:"stress_conn"`
+	Seq  int64 `json:"stress_seq"`
+}
+
+// StressClient n个并发连接，按WithRate的速率发送JSON文本消息并统计回显时延、错误和吞吐量
+type StressClient struct {
+	url  string
+	n    int
+	cfg  stressConfig
+	mu   sync.Mutex
+	lat  []time.Duration
+	open int
+	// started、finished 发送阶段的起止时间，Report按此计算吞吐量
+	started  time.Time
+	finished time.Time
+
+	dialErrors atomic.Int64
+	sendErrors atomic.Int64
+	readErrors atomic.Int64
+	sent       atomic.Int64
+	received   atomic.Int64
+}
+
+// NewStressClient url中的{i}被替换为连接序号，便于按路径区分连接标识，例如ws://host/socket/load-{i}
+func NewStressClient(url string, n int, opts ...StressOption) *StressClient {
+	cfg := stressConfig{rate: defaultStressRate, dialer: websocket.DefaultDialer}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return &StressClient{url: url, n: n, cfg: cfg}
+}
+
+// Run 并发建立全部连接后发送d时长的消息，再等待最多1秒接收回复，然后关闭连接。
+// 只有全部连接都建立失败时返回错误，部分失败计入DialErrors
+func (c *StressClient) Run(ctx context.Context, d time.Duration) error {
+	if c.cfg.rate <= 0 {
+		return fmt.Errorf("stress rate must be positive, got %v", c.cfg.rate)
+	}
+	conns := make([]*websocket.Conn, c.n)
+	var firstErr error
+	var errOnce sync.Once
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, _, err := c.cfg.dialer.DialContext(ctx, strings.ReplaceAll(c.url, "{i}", strconv.Itoa(i)), c.cfg.header)
+			if err != nil {
+				c.dialErrors.Add(1)
+				errOnce.Do(func() { firstErr = err })
+				return
+			}
+			conns[i] = conn
+		}(i)
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	c.open = c.n - int(c.dialErrors.Load())
+	c.started = time.Now()
+	c.mu.Unlock()
+	if c.open == 0 && c.n > 0 {
+		return fmt.Errorf("all %d connections failed: %w", c.n, firstErr)
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	for i, conn := range conns {
+		if conn == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, conn *websocket.Conn) {
+			defer wg.Done()
+			c.runConn(sendCtx, i, conn)
+		}(i, conn)
+	}
+	<-sendCtx.Done()
+	c.mu.Lock()
+	c.finished = time.Now()
+	c.mu.Unlock()
+	wg.Wait()
+	return nil
+}
+
+// runConn 发送结束后最多再等待1秒，直到收到全部回复
+func (c *StressClient) runConn(ctx context.Context, i int, conn *websocket.Conn) {
+	var pendingMu sync.Mutex
+	pending := make(map[int64]time.Time)
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure) && !errors.Is(err, net.ErrClosed) {
+					c.readErrors.Add(1)
+				}
+				return
+			}
+			var probe stressProbe
+			if json.Unmarshal(data, &probe) != nil || probe.Conn == nil || *probe.Conn != i {
+				continue
+			}
+			pendingMu.Lock()
+			sentAt, ok := pending[probe.Seq]
+			delete(pending, probe.Seq)
+			pendingMu.Unlock()
+			if ok {
+				c.received.Add(1)
+				c.record(time.Since(sentAt))
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / c.cfg.rate))
+	defer ticker.Stop()
+	var seq int64
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+		}
+		seq++
+		data := c.message(i, seq)
+		pendingMu.Lock()
+		pending[seq] = time.Now()
+		pendingMu.Unlock()
+		_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			c.sendErrors.Add(1)
+			break
+		}
+		c.sent.Add(1)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		pendingMu.Lock()
+		remaining := len(pending)
+		pendingMu.Unlock()
+		if remaining == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	_ = conn.Close()
+	<-readDone
+}
+
+func (c *StressClient) message(i int, seq int64) []byte {
+	probe := fmt.Sprintf(`{"stress_conn":%d,"stress_seq":%d`, i, seq)
+	if c.cfg.payload == nil {
+		return []byte(probe + "}")
+	}
+	body := strings.TrimSpace(string(c.cfg.payload(i, seq)))
+	if len(body) < 2 || body[0] != '{' || body == "{}" {
+		return []byte(probe + "}")
+	}
+	return []byte(probe + "," + body[1:])
+}
+
+func (c *StressClient) record(d time.Duration) {
+	c.mu.Lock()
+	c.lat = append(c.lat, d)
+	c.mu.Unlock()
+}
+
+// Report 可以在Run期间调用，得到截至当前的结果
+func (c *StressClient) Report() StressReport {
+	c.mu.Lock()
+	latencies := append([]time.Duration(nil), c.lat...)
+	report := StressReport{Connections: c.open}
+	if !c.started.IsZero() {
+		end := c.finished
+		if end.IsZero() {
+			end = time.Now()
+		}
+		report.Duration = end.Sub(c.started)
+	}
+	c.mu.Unlock()
+
+	report.DialErrors = c.dialErrors.Load()
+	report.SendErrors = c.sendErrors.Load()
+	report.ReadErrors = c.readErrors.Load()
+	report.Sent = c.sent.Load()
+	report.Received = c.received.Load()
+	if seconds := report.Duration.Seconds(); seconds > 0 {
+		report.SendThroughput = float64(report.Sent) / seconds
+		report.Throughput = float64(report.Received) / seconds
+	}
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		report.LatencyP50 = percentile(latencies, 0.50)
+		report.LatencyP90 = percentile(latencies, 0.90)
+		report.LatencyP99 = percentile(latencies, 0.99)
+		report.LatencyMax = latencies[len(latencies)-1]
+	}
+	return report
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
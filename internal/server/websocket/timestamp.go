@@ -0,0 +1,38 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// injectTimestamp 直接在原始JSON的开头插入字段而不是解析后重新序列化，保留字段顺序和数值精度
+func injectTimestamp(messageType int, data []byte, nanos int64) []byte {
+	if messageType == websocket.BinaryMessage {
+		stamped := make([]byte, 8, 8+len(data))
+		binary.BigEndian.PutUint64(stamped, uint64(nanos))
+		return append(stamped, data...)
+	}
+	return prependJSONField(data, "_server_ts", nanos)
+}
+
+// prependJSONField 在JSON对象的开头插入整数字段，data不是JSON对象时原样返回
+func prependJSONField(data []byte, name string, value int64) []byte {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) == 0 || trimmed[0] != '{' || !json.Valid(data) {
+		return data
+	}
+	body := bytes.TrimLeft(trimmed[1:], " \t\r\n")
+	stamped := make([]byte, 0, len(data)+len(name)+24)
+	stamped = append(stamped, '{')
+	stamped = strconv.AppendQuote(stamped, name)
+	stamped = append(stamped, ':')
+	stamped = strconv.AppendInt(stamped, value, 10)
+	if body[0] != '}' {
+		stamped = append(stamped, ',')
+	}
+	return append(stamped, body...)
+}
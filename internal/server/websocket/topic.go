@@ -0,0 +1,205 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// 主题按"."分层，订阅时*匹配恰好一层，>只能出现在最后，匹配之后的一层或多层
+const (
+	topicSeparator = "."
+	topicWildcard  = "*"
+	topicTail      = ">"
+)
+
+// TopicTree 按层级组织的订阅前缀树，Match只走与主题相关的分支，开销与订阅总数无关。
+// 订阅者以字符串标识(hub中为连接标识)，并发安全
+type TopicTree struct {
+	mu    sync.RWMutex
+	root  *topicNode
+	byID  map[string]map[string]struct{}
+	count int
+}
+
+type topicNode struct {
+	children map[string]*topicNode
+	subs     map[string]struct{}
+}
+
+func NewTopicTree() *TopicTree {
+	return &TopicTree{root: &topicNode{}, byID: make(map[string]map[string]struct{})}
+}
+
+// ValidTopicPattern 层级不能为空，*和>必须单独成层，>只能是最后一层
+func ValidTopicPattern(pattern string) error {
+	levels := strings.Split(pattern, topicSeparator)
+	for i, level := range levels {
+		switch {
+		case level == "":
+			return fmt.Errorf("%w: empty level in %q", ErrInvalidTopic, pattern)
+		case level == topicTail && i != len(levels)-1:
+			return fmt.Errorf("%w: %q must be the last level in %q", ErrInvalidTopic, topicTail, pattern)
+		case level != topicWildcard && level != topicTail && strings.ContainsAny(level, topicWildcard+topicTail):
+			return fmt.Errorf("%w: wildcard must be a whole level in %q", ErrInvalidTopic, pattern)
+		}
+	}
+	return nil
+}
+
+// validTopic 发布的主题不能含通配符
+func validTopic(topic string) error {
+	if err := ValidTopicPattern(topic); err != nil {
+		return err
+	}
+	if strings.ContainsAny(topic, topicWildcard+topicTail) {
+		return fmt.Errorf("%w: wildcards are not allowed when publishing %q", ErrInvalidTopic, topic)
+	}
+	return nil
+}
+
+// Subscribe 重复订阅返回false
+func (t *TopicTree) Subscribe(pattern, id string) (bool, error) {
+	if err := ValidTopicPattern(pattern); err != nil {
+		return false, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	node := t.root
+	for _, level := range strings.Split(pattern, topicSeparator) {
+		child, ok := node.children[level]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[string]*topicNode)
+			}
+			child = &topicNode{}
+			node.children[level] = child
+		}
+		node = child
+	}
+	if _, ok := node.subs[id]; ok {
+		return false, nil
+	}
+	if node.subs == nil {
+		node.subs = make(map[string]struct{})
+	}
+	node.subs[id] = struct{}{}
+	if t.byID[id] == nil {
+		t.byID[id] = make(map[string]struct{})
+	}
+	t.byID[id][pattern] = struct{}{}
+	t.count++
+	return true, nil
+}
+
+// Unsubscribe 没有该订阅时返回false
+func (t *TopicTree) Unsubscribe(pattern, id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.unsubscribe(pattern, id)
+}
+
+// RemoveAll 删除id的全部订阅，返回删除的数量
+func (t *TopicTree) RemoveAll(id string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	removed := 0
+	for pattern := range t.byID[id] {
+		if t.unsubscribe(pattern, id) {
+			removed++
+		}
+	}
+	return removed
+}
+
+// unsubscribe 调用方持有写锁，删除后沿路径清理空节点
+func (t *TopicTree) unsubscribe(pattern, id string) bool {
+	levels := strings.Split(pattern, topicSeparator)
+	path := make([]*topicNode, 0, len(levels)+1)
+	node := t.root
+	path = append(path, node)
+	for _, level := range levels {
+		if node = node.children[level]; node == nil {
+			return false
+		}
+		path = append(path, node)
+	}
+	if _, ok := node.subs[id]; !ok {
+		return false
+	}
+	delete(node.subs, id)
+	for i := len(levels) - 1; i >= 0; i-- {
+		child := path[i+1]
+		if len(child.subs) > 0 || len(child.children) > 0 {
+			break
+		}
+		delete(path[i].children, levels[i])
+	}
+	if patterns := t.byID[id]; patterns != nil {
+		delete(patterns, pattern)
+		if len(patterns) == 0 {
+			delete(t.byID, id)
+		}
+	}
+	t.count--
+	return true
+}
+
+// Patterns id当前的订阅
+func (t *TopicTree) Patterns(id string) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	patterns := make([]string, 0, len(t.byID[id]))
+	for pattern := range t.byID[id] {
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// Count id的订阅数
+func (t *TopicTree) Count(id string) int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.byID[id])
+}
+
+// Len 订阅总数
+func (t *TopicTree) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.count
+}
+
+// Match 订阅了与topic匹配的模式的id，同一个id只出现一次
+func (t *TopicTree) Match(topic string) []string {
+	levels := strings.Split(topic, topicSeparator)
+	matched := make(map[string]struct{})
+	t.mu.RLock()
+	t.root.match(levels, matched)
+	t.mu.RUnlock()
+	ids := make([]string, 0, len(matched))
+	for id := range matched {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (n *topicNode) match(levels []string, matched map[string]struct{}) {
+	if len(levels) == 0 {
+		for id := range n.subs {
+			matched[id] = struct{}{}
+		}
+		return
+	}
+	if tail := n.children[topicTail]; tail != nil {
+		for id := range tail.subs {
+			matched[id] = struct{}{}
+		}
+	}
+	if child := n.children[levels[0]]; child != nil {
+		child.match(levels[1:], matched)
+	}
+	if wildcard := n.children[topicWildcard]; wildcard != nil {
+		wildcard.match(levels[1:], matched)
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// topicFrame 客户端订阅{"type":"subscribe","topic":"jobs.1234.*"}，取消订阅{"type":"unsubscribe","topic":"..."}，
+// 服务端回复subscribed、unsubscribed或subscribe_error
+type topicFrame struct {
+	Type   string `json:"type"`
+	Topic  string `json:"topic"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// topicEvent Publish推送给订阅者的消息
+type topicEvent struct {
+	Type  string `json:"type"`
+	Topic string `json:"topic"`
+	Data  any    `json:"data"`
+}
+
+// WithTopicSubscriptions 开启主题订阅，每个连接最多订阅limit个模式。开启后读循环处理订阅帧，不会交给OnMessage；
+// 连接关闭时自动取消其全部订阅。属于WithNamespaces租户的连接只能收到本租户Namespace.Publish的消息
+func WithTopicSubscriptions(limit int) SocketOptionFunc {
+	return func(opt *SocketOption) {
+		opt.topicLimit = limit
+	}
+}
+
+// Publish 向订阅了匹配模式的连接推送{"type":"event","topic":"...","data":payload}，按连接协商的编码序列化，
+// 返回成功入队的连接数。只包含不属于任何租户的连接
+func (s *Socket) Publish(topic string, payload any) (int, error) {
+	return s.publish(s.topics, nil, topic, payload)
+}
+
+// Publish 见Socket.Publish，只推送给本租户的连接
+func (n *Namespace) Publish(topic string, payload any) (int, error) {
+	return n.socket.publish(n.topics, n, topic, payload)
+}
+
+func (s *Socket) publish(tree *TopicTree, ns *Namespace, topic string, payload any) (int, error) {
+	if tree == nil {
+		return 0, newError("", "publish", fmt.Errorf("%w: topic subscriptions are not enabled", ErrInvalidTopic))
+	}
+	if err := validTopic(topic); err != nil {
+		return 0, newError("", "publish", err)
+	}
+	keys := tree.Match(topic)
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	type encoded struct {
+		messageType int
+		data        []byte
+	}
+	// 同一编码的连接只序列化一次
+	frames := make(map[string]encoded)
+	event := topicEvent{Type: "event", Topic: topic, Data: payload}
+	delivered := 0
+	s.mu.RLock()
+	clients := make([]*SocketClient, 0, len(keys))
+	for _, key := range keys {
+		if client, ok := s.clients[key]; ok && client.namespace == ns && client.State() == OnlineState {
+			clients = append(clients, client)
+		}
+	}
+	s.mu.RUnlock()
+	for _, client := range clients {
+		frame, ok := frames[client.codecName]
+		if !ok {
+			messageType, data, err := client.encodeNotice(event)
+			if err != nil {
+				return delivered, newError(client.key, "publish", err)
+			}
+			frame = encoded{messageType, data}
+			frames[client.codecName] = frame
+		}
+		if client.enqueue(frame.messageType, frame.data) == nil {
+			delivered++
+		}
+	}
+	return delivered, nil
+}
+
+// topicTree 连接所属租户的订阅树，未开启WithTopicSubscriptions时为nil
+func (s *SocketClient) topicTree() *TopicTree {
+	if s.namespace != nil {
+		return s.namespace.topics
+	}
+	return s.socket.topics
+}
+
+// Subscribe 由服务端为连接订阅主题，超出WithTopicSubscriptions的数量时返回ErrTooManySubscriptions。open和draining阶段可用
+func (s *SocketClient) Subscribe(pattern string) error {
+	if err := s.requireLive("subscribe", ErrConnectionClosed); err != nil {
+		return err
+	}
+	tree := s.topicTree()
+	if tree == nil {
+		return newError(s.key, "subscribe", fmt.Errorf("%w: topic subscriptions are not enabled", ErrInvalidTopic))
+	}
+	if err := ValidTopicPattern(pattern); err != nil {
+		return newError(s.key, "subscribe", err)
+	}
+	s.topicMu.Lock()
+	defer s.topicMu.Unlock()
+	if s.topicsClosed {
+		return newError(s.key, "subscribe", ErrConnectionClosed)
+	}
+	if tree.Count(s.key) >= s.socket.opts.topicLimit {
+		return newError(s.key, "subscribe", ErrTooManySubscriptions)
+	}
+	added, err := tree.Subscribe(pattern, s.key)
+	if added {
+		s.markSessionDirty()
+	}
+	return err
+}
+
+// Unsubscribe 没有该订阅时不做任何事
+func (s *SocketClient) Unsubscribe(pattern string) {
+	if tree := s.topicTree(); tree != nil && tree.Unsubscribe(pattern, s.key) {
+		s.markSessionDirty()
+	}
+}
+
+// Topics 连接当前订阅的模式
+func (s *SocketClient) Topics() []string {
+	tree := s.topicTree()
+	if tree == nil {
+		return nil
+	}
+	return tree.Patterns(s.key)
+}
+
+// handleTopicFrame 返回true表示是订阅帧，已处理
+func (s *SocketClient) handleTopicFrame(messageType int, data []byte) bool {
+	if s.socket.opts.topicLimit == 0 || messageType != websocket.TextMessage || len(data) > 1024 ||
+		!bytes.Contains(data, []byte(`subscribe"`)) {
+		return false
+	}
+	var frame topicFrame
+	if err := json.Unmarshal(data, &frame); err != nil || (frame.Type != "subscribe" && frame.Type != "unsubscribe") {
+		return false
+	}
+	reply := topicFrame{Type: frame.Type + "d", Topic: frame.Topic}
+	if frame.Type == "unsubscribe" {
+		s.Unsubscribe(frame.Topic)
+	} else if err := s.Subscribe(frame.Topic); err != nil {
+		reply.Type, reply.Reason = "subscribe_error", subscribeErrorReason(err)
+	}
+	if messageType, data, err := s.encodeNotice(reply); err == nil {
+		_ = s.enqueue(messageType, data)
+	}
+	return true
+}
+
+func subscribeErrorReason(err error) string {
+	switch {
+	case errors.Is(err, ErrTooManySubscriptions):
+		return "limit"
+	case errors.Is(err, ErrInvalidTopic):
+		return "invalid_topic"
+	}
+	return "closed"
+}
+
+// releaseTopics 连接注销时取消其全部订阅，与Subscribe互斥，避免注销之后再写入订阅
+func (s *SocketClient) releaseTopics() {
+	tree := s.topicTree()
+	if tree == nil {
+		return
+	}
+	s.topicMu.Lock()
+	defer s.topicMu.Unlock()
+	s.topicsClosed = true
+	tree.RemoveAll(s.key)
+}
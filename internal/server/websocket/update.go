@@ -0,0 +1,148 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// clientSettings 可在连接建立后通过UpdateOption调整的配置，整体替换，读取方无需加锁
+type clientSettings struct {
+	writeDeadline         time.Duration
+	readDeadline          time.Duration
+	noReadDeadline        bool
+	allowNoLiveness       bool
+	pingPeriod            time.Duration
+	pingMsg               string
+	heartbeatFailMaxTimes int
+	idleTimeout           time.Duration
+}
+
+func newClientSettings(opts *SocketOption) *clientSettings {
+	return &clientSettings{
+		writeDeadline:         opts.writeDeadline,
+		readDeadline:          opts.readDeadline,
+		noReadDeadline:        opts.noReadDeadline,
+		allowNoLiveness:       opts.allowNoLiveness,
+		pingPeriod:            opts.pingPeriod,
+		pingMsg:               opts.pingMsg,
+		heartbeatFailMaxTimes: opts.heartbeatFailMaxTimes,
+		idleTimeout:           opts.idleTimeout,
+	}
+}
+
+func (s *SocketClient) options() *clientSettings {
+	return s.settings.Load()
+}
+
+// UpdateOption 调整在线连接的配置，例如客户端切到后台时放宽读取截止时间、降低心跳频率。
+// 只支持WithWriteDeadline、WithReadDeadline、WithPingPeriod、WithPingMsg、WithHeartbeatFailMaxTimes、WithIdleTimeout，
+// 其他配置项返回ErrOptionNotAdjustable，整批配置不生效。新的心跳周期、空闲超时立即重置各自的计时器，
+// 读取截止时间立即按新值刷新，写入截止时间从下一次写入开始生效；
+// 使用WithNoReadDeadline创建的连接不能再设置读取截止时间。open和draining阶段可用
+func (s *SocketClient) UpdateOption(opts ...SocketOptionFunc) error {
+	if err := s.requireLive("update option", ErrConnectionClosed); err != nil {
+		return err
+	}
+	changed, fields := adjustableOptions(opts)
+	if len(fields) > 0 {
+		return newError(s.key, "update option",
+			fmt.Errorf("%w: %s", ErrOptionNotAdjustable, strings.Join(fields, ", ")))
+	}
+
+	s.settingsMu.Lock()
+	next := *s.options()
+	if next.noReadDeadline && changed.readDeadline != 0 {
+		s.settingsMu.Unlock()
+		return newError(s.key, "update option",
+			fmt.Errorf("%w: readDeadline (read deadline is disabled)", ErrOptionNotAdjustable))
+	}
+	if changed.writeDeadline != 0 {
+		next.writeDeadline = changed.writeDeadline
+	}
+	if changed.readDeadline != 0 {
+		next.readDeadline = changed.readDeadline
+	}
+	if changed.pingPeriod != 0 {
+		next.pingPeriod = changed.pingPeriod
+	}
+	if changed.pingMsg != "" {
+		next.pingMsg = changed.pingMsg
+	}
+	if changed.heartbeatFailMaxTimes != 0 {
+		next.heartbeatFailMaxTimes = changed.heartbeatFailMaxTimes
+	}
+	if changed.idleTimeout != 0 {
+		next.idleTimeout = changed.idleTimeout
+	}
+	if err := next.validate(); err != nil {
+		s.settingsMu.Unlock()
+		return newError(s.key, "update option", err)
+	}
+	s.settings.Store(&next)
+	s.settingsMu.Unlock()
+
+	if changed.readDeadline != 0 {
+		_ = s.conn.SetReadDeadline(time.Now().Add(next.readDeadline))
+	}
+	if changed.pingPeriod != 0 || changed.idleTimeout != 0 {
+		select {
+		case s.settingsChanged <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (c *clientSettings) validate() error {
+	var errs []error
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%w: "+format, append([]any{ErrInvalidOption}, args...)...))
+	}
+	if c.writeDeadline < 0 {
+		invalid("write deadline must be positive, got %s", c.writeDeadline)
+	}
+	if c.readDeadline < 0 {
+		invalid("read deadline must be positive, got %s", c.readDeadline)
+	}
+	if c.heartbeatFailMaxTimes < 0 {
+		invalid("heartbeat fail max times must be positive, got %d", c.heartbeatFailMaxTimes)
+	}
+	if len(c.pingMsg) > maxControlPayload {
+		invalid("ping payload is %d bytes, control frames allow at most %d", len(c.pingMsg), maxControlPayload)
+	}
+	if c.noReadDeadline && c.pingPeriod < 0 && !c.allowNoLiveness {
+		invalid("read deadline and heartbeat are both disabled, dead connections would never be detected")
+	}
+	if !c.noReadDeadline && c.pingPeriod > 0 && c.pingPeriod >= c.readDeadline {
+		invalid("ping period %s must be less than read deadline %s", c.pingPeriod, c.readDeadline)
+	}
+	return errors.Join(errs...)
+}
+
+// adjustableOptions 汇总opts设置的配置，fields为其中不能在线调整的配置项，
+// 只有写入、读取截止时间、心跳和空闲超时可以通过UpdateOption在线调整
+func adjustableOptions(opts []SocketOptionFunc) (changed *SocketOption, fields []string) {
+	changed = &SocketOption{}
+	for _, apply := range opts {
+		apply(changed)
+	}
+	rest := *changed
+	rest.writeDeadline, rest.readDeadline, rest.pingPeriod, rest.pingMsg, rest.heartbeatFailMaxTimes = 0, 0, 0, "", 0
+	rest.idleTimeout = 0
+	return changed, setFields(rest)
+}
+
+// setFields 返回被配置项设置过(非零值)的字段名
+func setFields(opt SocketOption) []string {
+	var fields []string
+	v := reflect.ValueOf(opt)
+	for i := 0; i < v.NumField(); i++ {
+		if !v.Field(i).IsZero() {
+			fields = append(fields, v.Type().Field(i).Name)
+		}
+	}
+	return fields
+}
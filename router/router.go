@@ -30,5 +30,8 @@ func (*AppRouter) Add(server *gin.Engine) {
 	index := &controller.Index{}
 	server.GET("/hello", index.Hello)
 
-	server.GET("/socket", (&controller.Socket{}).Connect)
+	socket := &controller.Socket{}
+	server.GET("/socket", socket.Connect)
+	server.GET("/ws/schema", socket.Schema)
+	server.GET("/ws/ready", socket.Ready)
 }
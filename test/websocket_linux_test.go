@@ -0,0 +1,43 @@
+package test
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	AppSocket "skeleton/internal/server/websocket"
+)
+
+func TestSocketTCPKeepAlive(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()), AppSocket.WithTCPKeepAlive(7*time.Second))
+	dialSocket(t, url+"keepalive")
+	waitOnline(t, socket, "keepalive")
+	client, err := socket.Client("keepalive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpConn, ok := client.UnderlyingConn().(*net.TCPConn)
+	if !ok {
+		t.Fatalf("expected *net.TCPConn, got %T", client.UnderlyingConn())
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enabled, idle int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if enabled, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); sockErr != nil {
+			return
+		}
+		idle, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	})
+	if err != nil || sockErr != nil {
+		t.Fatal(err, sockErr)
+	}
+	// SetKeepAlivePeriod设置的是开始探测前的空闲时间，探测间隔取决于Go版本
+	if enabled != 1 || idle != 7 {
+		t.Fatalf("expected keepalive after 7s idle, got enabled=%d idle=%d", enabled, idle)
+	}
+}
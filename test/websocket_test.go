@@ -0,0 +1,5960 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	AppSocket "skeleton/internal/server/websocket"
+	"skeleton/internal/server/websocket/natssink"
+	"skeleton/internal/server/websocket/sinktest"
+	"skeleton/internal/server/websocket/testutil"
+	"skeleton/internal/server/websocket/wirepb"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+	"github.com/ugorji/go/codec"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+type recordHandler struct {
+	mu       sync.Mutex
+	messages []AppSocket.Message
+	errs     chan error
+	closed   chan string
+}
+
+func newRecordHandler() *recordHandler {
+	return &recordHandler{
+		errs:   make(chan error, 16),
+		closed: make(chan string, 16),
+	}
+}
+
+func (h *recordHandler) OnMessage(message AppSocket.Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.messages = append(h.messages, message)
+}
+
+func (h *recordHandler) OnError(key string, err error) {
+	h.errs <- err
+}
+
+func (h *recordHandler) OnClose(key string) {
+	h.closed <- key
+}
+
+func newSocketServer(t *testing.T, opts ...AppSocket.SocketOptionFunc) (AppSocket.SocketClientInterface, string) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	socket, err := AppSocket.NewSocket(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := gin.New()
+	engine.GET("/socket/:key", func(ctx *gin.Context) {
+		_ = socket.Connect(ctx, ctx.Param("key"))
+	})
+	srv := httptest.NewServer(engine)
+	t.Cleanup(srv.Close)
+	return socket, "ws" + strings.TrimPrefix(srv.URL, "http") + "/socket/"
+}
+
+func dialSocket(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func waitOnline(t *testing.T, socket AppSocket.SocketClientInterface, key string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for socket.GetClientState(key) != AppSocket.OnlineState {
+		if time.Now().After(deadline) {
+			t.Fatalf("client %s did not come online", key)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSocketRoomHistory(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()),
+		AppSocket.WithRoomHistory(2), AppSocket.WithSendQueueLength(512))
+	rooms := socket.Rooms()
+	read := func(conn *websocket.Conn, want ...string) {
+		t.Helper()
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for _, w := range want {
+			if _, data, err := conn.ReadMessage(); err != nil || string(data) != w {
+				t.Fatalf("expected %q, got %q %v", w, data, err)
+			}
+		}
+	}
+	conns := make(map[string]*websocket.Conn)
+	join := func(key string) {
+		t.Helper()
+		conns[key] = dialSocket(t, url+key)
+		waitOnline(t, socket, key)
+		if err := rooms.Join("r", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	join("a")
+	for _, msg := range []string{"1", "2", "3"} {
+		if err := rooms.Broadcast("r", websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read(conns["a"], "1", "2", "3")
+	room, ok := rooms.Room("r")
+	if !ok {
+		t.Fatal("room should exist")
+	}
+	var history []string
+	for _, msg := range room.History() {
+		history = append(history, string(msg.Data))
+	}
+	if strings.Join(history, ",") != "2,3" {
+		t.Fatalf("history should keep the latest 2 messages, got %v", history)
+	}
+	join("b")
+	read(conns["b"], "2", "3")
+
+	room.ClearHistory()
+	if len(room.History()) != 0 {
+		t.Fatalf("history should be empty after ClearHistory")
+	}
+	join("c")
+	if err := rooms.Broadcast("r", websocket.TextMessage, []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	read(conns["c"], "4")
+
+	for _, key := range []string{"a", "b", "c"} {
+		rooms.Leave("r", key)
+	}
+	if _, ok = rooms.Room("r"); ok {
+		t.Fatal("room with history should be deleted once the last member leaves")
+	}
+
+	// 加入时补发的历史消息必须排在之后的广播之前，序号连续递增
+	join("r0")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 300; i++ {
+			_ = rooms.Broadcast("r", websocket.TextMessage, []byte(strconv.Itoa(i)))
+		}
+	}()
+	time.Sleep(time.Millisecond)
+	join("late")
+	<-done
+	conn := conns["late"]
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	prev := 0
+	for prev != 300 {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, _ := strconv.Atoi(string(data))
+		if prev != 0 && n != prev+1 {
+			t.Fatalf("history replay interleaved with live broadcasts: %d after %d", n, prev)
+		}
+		prev = n
+	}
+}
+
+func TestSocketErrors(t *testing.T) {
+	t.Run("upgrade failed", func(t *testing.T) {
+		socket, err := AppSocket.NewSocket(AppSocket.WithHandler(newRecordHandler()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/socket", nil)
+		err = socket.Connect(ctx, "plain-http")
+		if !errors.Is(err, AppSocket.ErrUpgradeFailed) {
+			t.Fatalf("expected ErrUpgradeFailed, got %v", err)
+		}
+		var wsErr *AppSocket.WSError
+		if !errors.As(err, &wsErr) || wsErr.ConnID != "plain-http" || wsErr.Op != "upgrade" || wsErr.Stage != AppSocket.StageUpgrade {
+			t.Fatalf("unexpected error context: %#v", wsErr)
+		}
+	})
+
+	t.Run("connection closed", func(t *testing.T) {
+		socket, _ := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()))
+		err := socket.WriteMessage(AppSocket.Message{
+			MessageType: websocket.TextMessage,
+			Subkeys:     []string{"missing"},
+			Data:        []byte("hello"),
+		})
+		if !errors.Is(err, AppSocket.ErrConnectionClosed) {
+			t.Fatalf("expected ErrConnectionClosed, got %v", err)
+		}
+		if err = socket.Rooms().Join("room", "missing"); !errors.Is(err, AppSocket.ErrConnectionClosed) {
+			t.Fatalf("expected ErrConnectionClosed, got %v", err)
+		}
+	})
+
+	t.Run("session not found", func(t *testing.T) {
+		socket, _ := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()))
+		err := socket.SendTo("missing", websocket.TextMessage, []byte("hello"))
+		if !errors.Is(err, AppSocket.ErrSessionNotFound) {
+			t.Fatalf("expected ErrSessionNotFound, got %v", err)
+		}
+	})
+
+	t.Run("room not found", func(t *testing.T) {
+		socket, _ := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()))
+		err := socket.Rooms().Broadcast("missing", websocket.TextMessage, []byte("hello"))
+		if !errors.Is(err, AppSocket.ErrRoomNotFound) {
+			t.Fatalf("expected ErrRoomNotFound, got %v", err)
+		}
+	})
+
+	t.Run("queue full", func(t *testing.T) {
+		socket, url := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()), AppSocket.WithSendQueueLength(1))
+		dialSocket(t, url+"slow")
+		waitOnline(t, socket, "slow")
+		payload := []byte(strings.Repeat("x", 64*1024))
+		var err error
+		for i := 0; i < 4096 && err == nil; i++ {
+			err = socket.WriteMessage(AppSocket.Message{
+				MessageType: websocket.TextMessage,
+				Subkeys:     []string{"slow"},
+				Data:        payload,
+			})
+		}
+		if !errors.Is(err, AppSocket.ErrQueueFull) {
+			t.Fatalf("expected ErrQueueFull, got %v", err)
+		}
+		var wsErr *AppSocket.WSError
+		if !errors.As(err, &wsErr) || wsErr.ConnID != "slow" || wsErr.Op != "send" || wsErr.Stage != AppSocket.StageAPI {
+			t.Fatalf("unexpected error context: %#v", wsErr)
+		}
+	})
+
+	t.Run("write timeout", func(t *testing.T) {
+		handler := newRecordHandler()
+		socket, url := newSocketServer(t, AppSocket.WithHandler(handler))
+		dialSocket(t, url+"timeout")
+		waitOnline(t, socket, "timeout")
+		client, err := socket.Client("timeout")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 截止时间在写入前已经过去
+		if err = client.UpdateOption(AppSocket.WithWriteDeadline(time.Nanosecond)); err != nil {
+			t.Fatal(err)
+		}
+		if err = client.SendJSON(map[string]string{"hello": "world"}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err = <-handler.errs:
+			if !errors.Is(err, AppSocket.ErrWriteTimeout) {
+				t.Fatalf("expected ErrWriteTimeout, got %v", err)
+			}
+			var wsErr *AppSocket.WSError
+			if !errors.As(err, &wsErr) || wsErr.ConnID != "timeout" || wsErr.Stage != AppSocket.StageWrite {
+				t.Fatalf("unexpected error context: %#v", wsErr)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("OnError was not called")
+		}
+	})
+
+	t.Run("draining", func(t *testing.T) {
+		socket, err := AppSocket.NewSocket(AppSocket.WithHandler(newRecordHandler()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		socket.StartDrain("deploy")
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/socket", nil)
+		err = socket.Connect(ctx, "late")
+		if !errors.Is(err, AppSocket.ErrDraining) {
+			t.Fatalf("expected ErrDraining, got %v", err)
+		}
+		var wsErr *AppSocket.WSError
+		if !errors.As(err, &wsErr) || wsErr.ConnID != "late" || wsErr.Stage != AppSocket.StageUpgrade {
+			t.Fatalf("unexpected error context: %#v", wsErr)
+		}
+	})
+
+	t.Run("stream not found", func(t *testing.T) {
+		err := AppSocket.NewMultiplexer(nil).CloseChannel("conn", "missing")
+		if !errors.Is(err, AppSocket.ErrStreamNotFound) {
+			t.Fatalf("expected ErrStreamNotFound, got %v", err)
+		}
+		var wsErr *AppSocket.WSError
+		if !errors.As(err, &wsErr) || wsErr.ConnID != "conn" || wsErr.Op != "close channel" {
+			t.Fatalf("unexpected error context: %#v", wsErr)
+		}
+	})
+
+	t.Run("already closed", func(t *testing.T) {
+		socket, url := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()))
+		dialSocket(t, url+"twice")
+		waitOnline(t, socket, "twice")
+		client, err := socket.Client("twice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = client.Close(); err != nil {
+			t.Fatal(err)
+		}
+		err = client.Close()
+		if !errors.Is(err, AppSocket.ErrAlreadyClosed) {
+			t.Fatalf("expected ErrAlreadyClosed, got %v", err)
+		}
+		var wsErr *AppSocket.WSError
+		if !errors.As(err, &wsErr) || wsErr.ConnID != "twice" || wsErr.Op != "close" {
+			t.Fatalf("unexpected error context: %#v", wsErr)
+		}
+	})
+
+	t.Run("message too large", func(t *testing.T) {
+		handler := newRecordHandler()
+		_, url := newSocketServer(t, AppSocket.WithHandler(handler), AppSocket.WithMaxMessageSize(8))
+		conn := dialSocket(t, url+"large")
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 64))); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-handler.errs:
+			if !errors.Is(err, AppSocket.ErrMessageTooLarge) {
+				t.Fatalf("expected ErrMessageTooLarge, got %v", err)
+			}
+			var wsErr *AppSocket.WSError
+			if !errors.As(err, &wsErr) || wsErr.ConnID != "large" {
+				t.Fatalf("unexpected error context: %#v", wsErr)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("OnError was not called")
+		}
+	})
+}
+
+// muxChannelHandler 在chanHandler的基础上记录OnClose
+type muxChannelHandler struct {
+	chanHandler
+	closed chan string
+}
+
+func newMuxChannelHandler() *muxChannelHandler {
+	return &muxChannelHandler{chanHandler: chanHandler{messages: make(chan string, 4)}, closed: make(chan string, 1)}
+}
+
+func (h *muxChannelHandler) OnClose(key string) {
+	h.closed <- key
+}
+
+func TestSocketMultiplexer(t *testing.T) {
+	fallback := newMuxChannelHandler()
+	mux := AppSocket.NewMultiplexer(fallback)
+	socket, url := newSocketServer(t, AppSocket.WithHandler(mux))
+	conn := dialSocket(t, url+"k")
+	waitOnline(t, socket, "k")
+
+	chat, code := newMuxChannelHandler(), newMuxChannelHandler()
+	chatChannel, err := mux.OpenChannel("k", "chat", chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mux.OpenChannel("k", "code", code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mux.OpenChannel("k", "chat", code); !errors.Is(err, AppSocket.ErrChannelExists) {
+		t.Fatalf("duplicate channel id should return ErrChannelExists, got %v", err)
+	}
+	if _, err = mux.OpenChannel("missing", "chat", chat); !errors.Is(err, AppSocket.ErrConnectionClosed) {
+		t.Fatalf("channel on an unknown connection should return ErrConnectionClosed, got %v", err)
+	}
+
+	expect := func(h *muxChannelHandler, want string) {
+		t.Helper()
+		select {
+		case got := <-h.messages:
+			if got != want {
+				t.Fatalf("expected %q, got %q", want, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected %q to be routed", want)
+		}
+	}
+	for _, frame := range []string{`{"channel":"chat","data":"hi"}`, `{"channel":"code","data":"x := 1"}`, "raw"} {
+		if err = conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect(chat, "hi")
+	expect(code, "x := 1")
+	expect(fallback, "raw")
+
+	if err = chatChannel.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != `{"channel":"chat","data":"hello"}` {
+		t.Fatalf("unexpected channel frame %q %v", data, err)
+	}
+
+	if err = chatChannel.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = mux.CloseChannel("k", "chat"); !errors.Is(err, AppSocket.ErrStreamNotFound) {
+		t.Fatalf("closing a closed channel should return ErrStreamNotFound, got %v", err)
+	}
+	// 已关闭通道的消息交给fallback
+	if err = conn.WriteMessage(websocket.TextMessage, []byte(`{"channel":"chat","data":"late"}`)); err != nil {
+		t.Fatal(err)
+	}
+	expect(fallback, `{"channel":"chat","data":"late"}`)
+	if _, err = mux.OpenChannel("k", "chat", chat); err != nil {
+		t.Fatalf("a closed channel id can be reopened, got %v", err)
+	}
+
+	conn.Close()
+	for name, h := range map[string]*muxChannelHandler{"chat": chat, "code": code, "fallback": fallback} {
+		select {
+		case key := <-h.closed:
+			if key != "k" {
+				t.Fatalf("unexpected close key %s", key)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s handler was not told about the closed connection", name)
+		}
+	}
+}
+
+func TestSocketOptionValidation(t *testing.T) {
+	handler := AppSocket.WithHandler(newRecordHandler())
+	cases := []struct {
+		name    string
+		opts    []AppSocket.SocketOptionFunc
+		invalid bool
+	}{
+		{"defaults", []AppSocket.SocketOptionFunc{handler}, false},
+		{"missing handler", nil, true},
+		{"negative buffer size", []AppSocket.SocketOptionFunc{handler, AppSocket.WithWriteReadBufferSize(-1)}, true},
+		{"negative read deadline", []AppSocket.SocketOptionFunc{handler, AppSocket.WithReadDeadline(-time.Second)}, true},
+		{"negative write deadline", []AppSocket.SocketOptionFunc{handler, AppSocket.WithWriteDeadline(-time.Second)}, true},
+		{"negative heartbeat fail max", []AppSocket.SocketOptionFunc{handler, AppSocket.WithHeartbeatFailMaxTimes(-1)}, true},
+		{"ping period equals read deadline", []AppSocket.SocketOptionFunc{handler, AppSocket.WithPingPeriod(30 * time.Second)}, true},
+		{"ping period exceeds read deadline", []AppSocket.SocketOptionFunc{handler, AppSocket.WithPingPeriod(time.Minute), AppSocket.WithReadDeadline(time.Second)}, true},
+		{"ping payload too large", []AppSocket.SocketOptionFunc{handler, AppSocket.WithPingMsg(strings.Repeat("p", 126))}, true},
+		{"ping payload at limit", []AppSocket.SocketOptionFunc{handler, AppSocket.WithPingMsg(strings.Repeat("p", 125))}, false},
+		{"send queue length over ceiling", []AppSocket.SocketOptionFunc{handler, AppSocket.WithSendQueueLength(1 << 20)}, true},
+		{"negative send queue length", []AppSocket.SocketOptionFunc{handler, AppSocket.WithSendQueueLength(-1)}, true},
+		{"negative tcp keepalive", []AppSocket.SocketOptionFunc{handler, AppSocket.WithTCPKeepAlive(-time.Second)}, true},
+		{"tcp keepalive", []AppSocket.SocketOptionFunc{handler, AppSocket.WithTCPKeepAlive(time.Second)}, false},
+		{"heartbeat disabled", []AppSocket.SocketOptionFunc{handler, AppSocket.WithPingPeriod(-1)}, false},
+		{"heartbeat disabled with fail max", []AppSocket.SocketOptionFunc{handler, AppSocket.WithPingPeriod(-1), AppSocket.WithHeartbeatFailMaxTimes(3)}, true},
+		{"no read deadline", []AppSocket.SocketOptionFunc{handler, AppSocket.WithNoReadDeadline(), AppSocket.WithPingPeriod(time.Minute)}, false},
+		{"no read deadline with read deadline", []AppSocket.SocketOptionFunc{handler, AppSocket.WithNoReadDeadline(), AppSocket.WithReadDeadline(time.Second)}, true},
+		{"no read deadline and no heartbeat", []AppSocket.SocketOptionFunc{handler, AppSocket.WithNoReadDeadline(), AppSocket.WithPingPeriod(-1)}, true},
+		{"write latency threshold zero", []AppSocket.SocketOptionFunc{handler, AppSocket.WithWriteLatencyWarning(0, func(time.Duration) {})}, true},
+		{"write latency threshold above one", []AppSocket.SocketOptionFunc{handler, AppSocket.WithWriteLatencyWarning(1.5, func(time.Duration) {})}, true},
+		{"duplicate policy without labels", []AppSocket.SocketOptionFunc{handler, AppSocket.WithDuplicateSessionPolicy(AppSocket.CloseOldest)}, true},
+		{"unknown content type", []AppSocket.SocketOptionFunc{handler, AppSocket.WithContentTypeNegotiation([]string{"text/csv"})}, true},
+		{"content types with protobuf", []AppSocket.SocketOptionFunc{handler, AppSocket.WithContentTypeNegotiation([]string{AppSocket.ContentTypeJSON}), AppSocket.WithProtobufEncoding()}, true},
+		{"history without store", []AppSocket.SocketOptionFunc{handler, AppSocket.WithMessageHistory(AppSocket.HistoryConfig{Enabled: true})}, true},
+		{"negative upgrade timeout", []AppSocket.SocketOptionFunc{handler, AppSocket.WithUpgradeTimeout(-time.Second)}, true},
+		{"queue pressure threshold above one", []AppSocket.SocketOptionFunc{handler, AppSocket.WithHealthThresholds(AppSocket.HealthThresholds{MaxQueuePressure: 1.5})}, true},
+		{"strict ordering with flush interval", []AppSocket.SocketOptionFunc{handler, AppSocket.WithStrictOrdering(true), AppSocket.WithFlushInterval(time.Millisecond)}, true},
+		{"no liveness acknowledged", []AppSocket.SocketOptionFunc{handler, AppSocket.WithNoReadDeadline(), AppSocket.WithPingPeriod(-1), AppSocket.WithAllowNoLiveness()}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := AppSocket.NewSocket(c.opts...)
+			if c.invalid && !errors.Is(err, AppSocket.ErrInvalidOption) {
+				t.Fatalf("expected ErrInvalidOption, got %v", err)
+			}
+			if !c.invalid && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestSocketConfig(t *testing.T) {
+	yamlConf := `
+WriteReadBufferSize: 2048
+HeartbeatFailMaxTimes: 4
+PingPeriod: 20
+ReadDeadline: "100s"
+WriteDeadline: 35s
+PingMsg: "ping"
+SendQueueLength: 32
+UpgradeTimeout: 5s
+`
+	jsonConf := `{"writeReadBufferSize":2048,"pingPeriod":"20s","readDeadline":"1m40s","writeDeadline":35,"pingMsg":"ping","sendQueueLength":32}`
+
+	decoders := map[string]func(*AppSocket.SocketConfig) error{
+		"yaml": func(cfg *AppSocket.SocketConfig) error { return yaml.Unmarshal([]byte(yamlConf), cfg) },
+		"json": func(cfg *AppSocket.SocketConfig) error { return json.Unmarshal([]byte(jsonConf), cfg) },
+	}
+	for name, decode := range decoders {
+		t.Run(name, func(t *testing.T) {
+			var cfg AppSocket.SocketConfig
+			if err := decode(&cfg); err != nil {
+				t.Fatal(err)
+			}
+			if time.Duration(cfg.PingPeriod) != 20*time.Second || time.Duration(cfg.ReadDeadline) != 100*time.Second ||
+				time.Duration(cfg.WriteDeadline) != 35*time.Second {
+				t.Fatalf("unexpected durations: %+v", cfg)
+			}
+			if err := cfg.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			gin.SetMode(gin.TestMode)
+			handler := newRecordHandler()
+			socket, err := AppSocket.NewSocketFromConfig(cfg, AppSocket.WithHandler(handler))
+			if err != nil {
+				t.Fatal(err)
+			}
+			engine := gin.New()
+			engine.GET("/socket", func(ctx *gin.Context) {
+				_ = socket.Connect(ctx, name)
+			})
+			srv := httptest.NewServer(engine)
+			defer srv.Close()
+			conn := dialSocket(t, "ws"+strings.TrimPrefix(srv.URL, "http")+"/socket")
+			waitOnline(t, socket, name)
+			if err = socket.WriteMessage(AppSocket.Message{Subkeys: []string{name}, Data: []byte("hello")}); err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, data, err := conn.ReadMessage(); err != nil || string(data) != "hello" {
+				t.Fatalf("unexpected message %q: %v", data, err)
+			}
+
+			encoded, err := json.Marshal(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded AppSocket.SocketConfig
+			if err = json.Unmarshal(encoded, &decoded); err != nil || decoded != cfg {
+				t.Fatalf("json round trip mismatch: %+v %v", decoded, err)
+			}
+		})
+	}
+
+	invalid := AppSocket.SocketConfig{PingPeriod: AppSocket.Duration(time.Minute)}
+	if err := invalid.Validate(); !errors.Is(err, AppSocket.ErrInvalidOption) {
+		t.Fatalf("expected ErrInvalidOption, got %v", err)
+	}
+}
+
+func TestSocketE2ELatencyProbe(t *testing.T) {
+	probes := make(chan time.Duration, 4)
+	handler := &chanHandler{messages: make(chan string, 4)}
+	socket, url := newSocketServer(t, AppSocket.WithHandler(handler),
+		AppSocket.WithE2ELatencyProbe(func(latency time.Duration) { probes <- latency }))
+	conn := dialSocket(t, url+"probe")
+	waitOnline(t, socket, "probe")
+
+	sentAt := time.Now().Add(-50 * time.Millisecond).UnixMilli()
+	for _, frame := range []string{fmt.Sprintf(`{"_sent_ts":%d}`, sentAt), `{"no":"timestamp"}`} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+		<-handler.messages
+	}
+	select {
+	case latency := <-probes:
+		if latency < 50*time.Millisecond || latency > 5*time.Second {
+			t.Fatalf("unexpected probe latency %s", latency)
+		}
+	default:
+		t.Fatal("probe was not called for a stamped message")
+	}
+	if len(probes) != 0 {
+		t.Fatal("probe should only run for messages carrying _sent_ts")
+	}
+	stats, err := socket.Stats("probe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.E2ELatencyP99 < 50*time.Millisecond || stats.E2ELatencyP99 > 5*time.Second {
+		t.Fatalf("unexpected E2ELatencyP99 %s", stats.E2ELatencyP99)
+	}
+}
+
+func TestSocketConnAddrs(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()))
+	conn := dialSocket(t, url+"addrs")
+	waitOnline(t, socket, "addrs")
+	client, err := socket.Client("addrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := strings.TrimPrefix(strings.TrimSuffix(url, "/socket/"), "ws://")
+	if got := client.LocalAddr().String(); got != listener {
+		t.Fatalf("LocalAddr should be the server listener %s, got %s", listener, got)
+	}
+	if got, want := client.RemoteAddr().String(), conn.LocalAddr().String(); got != want {
+		t.Fatalf("RemoteAddr should be the dialing side %s, got %s", want, got)
+	}
+	if client.UnderlyingConn().RemoteAddr().String() != client.RemoteAddr().String() {
+		t.Fatal("UnderlyingConn should be the upgraded connection")
+	}
+	var zero AppSocket.SocketClient
+	if zero.RemoteAddr() != nil || zero.LocalAddr() != nil {
+		t.Fatal("accessors on a client without a connection should return nil")
+	}
+}
+
+func TestSocketPubSub(t *testing.T) {
+	bus := AppSocket.NewLocalPubSub()
+	first, _ := bus.Subscribe("news")
+	second, _ := bus.Subscribe("news")
+	other, _ := bus.Subscribe("sports")
+	if err := bus.Publish("news", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []<-chan []byte{first, second} {
+		if got := string(<-sub); got != "hello" {
+			t.Fatalf("every subscriber should receive the message, got %q", got)
+		}
+	}
+	if len(other) != 0 {
+		t.Fatal("subscribers of other channels should not receive the message")
+	}
+	bus.Unsubscribe("news", first)
+	if _, open := <-first; open {
+		t.Fatal("Unsubscribe should close the subscription")
+	}
+	bus.Unsubscribe("news", first)
+	if err := bus.Publish("news", []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(<-second); got != "again" || len(first) != 0 {
+		t.Fatalf("only remaining subscribers should receive later messages, got %q", got)
+	}
+
+	// 两个节点共用消息总线，任一节点的房间广播投递到所有节点上的房间成员
+	shared := AppSocket.NewLocalPubSub()
+	nodeA, urlA := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()), AppSocket.WithPubSub(shared))
+	nodeB, urlB := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()), AppSocket.WithPubSub(shared))
+	connA := dialSocket(t, urlA+"a")
+	connB := dialSocket(t, urlB+"b")
+	waitOnline(t, nodeA, "a")
+	waitOnline(t, nodeB, "b")
+	if err := nodeA.Rooms().Join("lobby", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodeB.Rooms().Join("lobby", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodeA.Rooms().Broadcast("lobby", websocket.TextMessage, []byte("from a")); err != nil {
+		t.Fatal(err)
+	}
+	for name, conn := range map[string]*websocket.Conn{"a": connA, "b": connB} {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, data, err := conn.ReadMessage(); err != nil || string(data) != "from a" {
+			t.Fatalf("member %s should receive the broadcast, got %q %v", name, data, err)
+		}
+	}
+	if err := nodeB.Rooms().Broadcast("missing", websocket.TextMessage, []byte("nobody")); err != nil {
+		t.Fatalf("publishing to a room unknown locally should still succeed, got %v", err)
+	}
+}
+
+func TestSocketHandlerFuncs(t *testing.T) {
+	empty := &AppSocket.HandlerFuncs{}
+	empty.OnMessage(AppSocket.Message{})
+	empty.OnClose("key")
+	empty.OnOpen(nil)
+	empty.OnError("key", errors.New("logged by default"))
+
+	var handler AppSocket.MessageHandler = empty
+	if _, ok := handler.(AppSocket.OpenHandler); !ok {
+		t.Fatal("HandlerFuncs should satisfy OpenHandler")
+	}
+	type embedded struct{ AppSocket.BaseHandler }
+	handler = embedded{}
+	if _, ok := handler.(AppSocket.OpenHandler); !ok {
+		t.Fatal("BaseHandler should satisfy OpenHandler")
+	}
+
+	opened := make(chan string, 1)
+	received := make(chan string, 1)
+	_, url := newSocketServer(t, AppSocket.WithHandler(&AppSocket.HandlerFuncs{
+		OpenFunc:    func(client *AppSocket.SocketClient) { opened <- client.Key() },
+		MessageFunc: func(message AppSocket.Message) { received <- string(message.Data) },
+	}))
+	conn := dialSocket(t, url+"funcs")
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range []chan string{opened, received} {
+		select {
+		case <-ch:
+		case <-time.After(2 * time.Second):
+			t.Fatal("callback was not invoked")
+		}
+	}
+}
+
+type countingHandler struct {
+	messages     atomic.Int32
+	errs         atomic.Int32
+	closes       atomic.Int32
+	panicOnMsg   bool
+	panicOnError bool
+}
+
+func (h *countingHandler) OnMessage(AppSocket.Message) {
+	h.messages.Add(1)
+	if h.panicOnMsg {
+		panic("handler panic")
+	}
+}
+
+func (h *countingHandler) OnError(string, error) {
+	h.errs.Add(1)
+	if h.panicOnError {
+		panic("error handler panic")
+	}
+}
+
+func (h *countingHandler) OnClose(string) {
+	h.closes.Add(1)
+}
+
+func TestSocketUpgradeBodyLimit(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()), AppSocket.WithUpgradeBodyLimit(16))
+	addr := strings.TrimSuffix(strings.TrimPrefix(url, "ws://"), "/socket/")
+	upgrade := func(key, body string) int {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		_, _ = fmt.Fprintf(conn, "GET /socket/%s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\nContent-Length: %d\r\n\r\n%s",
+			key, addr, len(body), body)
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	if code := upgrade("small", "0123456789"); code != http.StatusSwitchingProtocols {
+		t.Fatalf("body under the limit got status %d, want 101", code)
+	}
+	waitOnline(t, socket, "small")
+
+	if code := upgrade("large", strings.Repeat("x", 64)); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("body over the limit got status %d, want 413", code)
+	}
+	if socket.GetClientState("large") == AppSocket.OnlineState {
+		t.Fatal("connection with an oversized upgrade body was registered")
+	}
+}
+
+func TestSocketCloseOnce(t *testing.T) {
+	cases := []struct {
+		name      string
+		handler   *countingHandler
+		opts      []AppSocket.SocketOptionFunc
+		terminate func(t *testing.T, socket AppSocket.SocketClientInterface, conn *websocket.Conn)
+		errs      int32
+	}{
+		{
+			name:    "client close",
+			handler: &countingHandler{},
+			terminate: func(t *testing.T, _ AppSocket.SocketClientInterface, conn *websocket.Conn) {
+				_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			},
+		},
+		{
+			name:    "abrupt disconnect",
+			handler: &countingHandler{},
+			terminate: func(t *testing.T, _ AppSocket.SocketClientInterface, conn *websocket.Conn) {
+				_ = conn.UnderlyingConn().Close()
+			},
+		},
+		{
+			name:    "read error",
+			handler: &countingHandler{},
+			opts:    []AppSocket.SocketOptionFunc{AppSocket.WithMaxMessageSize(4)},
+			terminate: func(t *testing.T, _ AppSocket.SocketClientInterface, conn *websocket.Conn) {
+				_ = conn.WriteMessage(websocket.TextMessage, []byte("too large"))
+			},
+			errs: 1,
+		},
+		{
+			name:    "server close handshake",
+			handler: &countingHandler{},
+			terminate: func(t *testing.T, socket AppSocket.SocketClientInterface, conn *websocket.Conn) {
+				client, err := socket.Client("close")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err = client.SendClose(AppSocket.CloseSlowConsumer, "slow consumer"); err != nil {
+					t.Fatal(err)
+				}
+				var closeErr *websocket.CloseError
+				if _, _, err = conn.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != AppSocket.CloseSlowConsumer {
+					t.Fatalf("expected close frame with code %d, got %v", AppSocket.CloseSlowConsumer, err)
+				}
+			},
+		},
+		{
+			name:    "handler panic",
+			handler: &countingHandler{panicOnMsg: true},
+			terminate: func(t *testing.T, _ AppSocket.SocketClientInterface, conn *websocket.Conn) {
+				_ = conn.WriteMessage(websocket.TextMessage, []byte("boom"))
+			},
+			errs: 1,
+		},
+		{
+			name:    "error handler panic",
+			handler: &countingHandler{panicOnMsg: true, panicOnError: true},
+			terminate: func(t *testing.T, _ AppSocket.SocketClientInterface, conn *websocket.Conn) {
+				_ = conn.WriteMessage(websocket.TextMessage, []byte("boom"))
+			},
+			errs: 1,
+		},
+		{
+			name:    "explicit close",
+			handler: &countingHandler{},
+			terminate: func(t *testing.T, socket AppSocket.SocketClientInterface, _ *websocket.Conn) {
+				client, err := socket.Client("close")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err = client.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if err = client.Close(); !errors.Is(err, AppSocket.ErrAlreadyClosed) {
+					t.Fatalf("expected ErrAlreadyClosed, got %v", err)
+				}
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			socket, url := newSocketServer(t, append(c.opts, AppSocket.WithHandler(c.handler))...)
+			conn := dialSocket(t, url+"close")
+			waitOnline(t, socket, "close")
+			c.terminate(t, socket, conn)
+
+			deadline := time.Now().Add(2 * time.Second)
+			for c.handler.closes.Load() == 0 && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			time.Sleep(100 * time.Millisecond)
+			if closes := c.handler.closes.Load(); closes != 1 {
+				t.Fatalf("expected OnClose once, got %d", closes)
+			}
+			if errs := c.handler.errs.Load(); errs != c.errs {
+				t.Fatalf("expected OnError %d times, got %d", c.errs, errs)
+			}
+			if socket.GetClientState("close") != AppSocket.OffLineState {
+				t.Fatal("client should be unregistered")
+			}
+		})
+	}
+}
+
+// zeroReader 无限产生数据，对端不读取时写入会阻塞在TCP缓冲区上
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestSocketHandshake(t *testing.T) {
+	opened := make(chan *AppSocket.SocketClient, 1)
+	_, url := newSocketServer(t,
+		AppSocket.WithHandler(&AppSocket.HandlerFuncs{OpenFunc: func(client *AppSocket.SocketClient) { opened <- client }}),
+		AppSocket.WithCodecs(map[string]AppSocket.Codec{"json": AppSocket.JSONCodec, "msgpack": AppSocket.MsgPackCodec}))
+	header := http.Header{"X-Trace-Id": {"trace-1"}, "Sec-WebSocket-Protocol": {"msgpack"}}
+	conn, _, err := websocket.DefaultDialer.Dial(url+"shake?room=lobby&v=2", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	var client *AppSocket.SocketClient
+	select {
+	case client = <-opened:
+	case <-time.After(2 * time.Second):
+		t.Fatal("client was not opened")
+	}
+	info := client.Handshake()
+	if got := info.Header.Get("X-Trace-Id"); got != "trace-1" {
+		t.Fatalf("recorded header = %q, want trace-1", got)
+	}
+	if info.Subprotocol != "msgpack" || info.Subprotocol != conn.Subprotocol() {
+		t.Fatalf("recorded subprotocol = %q, negotiated %q", info.Subprotocol, conn.Subprotocol())
+	}
+	if query := info.Query(); query.Get("room") != "lobby" || query.Get("v") != "2" {
+		t.Fatalf("recorded query = %v", query)
+	}
+	if info.URL.Path != "/socket/shake" || info.Host != strings.TrimPrefix(strings.TrimSuffix(url, "/socket/"), "ws://") {
+		t.Fatalf("recorded url %s on host %s", info.URL.Path, info.Host)
+	}
+	if info.RemoteAddr != conn.LocalAddr().String() || info.ConnectedAt.IsZero() {
+		t.Fatalf("recorded remote addr %s, connected at %v", info.RemoteAddr, info.ConnectedAt)
+	}
+
+	// 返回的是快照，修改不影响连接上保存的握手信息
+	info.Header.Set("X-Trace-Id", "changed")
+	if got := client.Handshake().Header.Get("X-Trace-Id"); got != "trace-1" {
+		t.Fatalf("handshake snapshot was mutated: %q", got)
+	}
+}
+
+func TestSocketConnInfo(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()),
+		AppSocket.WithCodecs(map[string]AppSocket.Codec{"json": AppSocket.JSONCodec, "msgpack": AppSocket.MsgPackCodec}))
+	before := time.Now()
+	conn, _, err := websocket.DefaultDialer.Dial(url+"info", http.Header{"Sec-WebSocket-Protocol": {"msgpack"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	waitOnline(t, socket, "info")
+
+	client, err := socket.Client("info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hubInfo, err := socket.Info("info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, info := range map[string]AppSocket.ConnInfo{"client": client.Info(), "hub": hubInfo} {
+		if info.ID != "info" || info.ClientIP != "127.0.0.1" || info.Subprotocol != "msgpack" {
+			t.Fatalf("%s: unexpected info %+v", name, info)
+		}
+		if info.ConnectedAt.Before(before) || info.ConnectedAt.After(time.Now()) {
+			t.Fatalf("%s: connected at %v, dialed at %v", name, info.ConnectedAt, before)
+		}
+	}
+	if _, err = socket.Info("missing"); !errors.Is(err, AppSocket.ErrConnectionClosed) {
+		t.Fatalf("expected ErrConnectionClosed, got %v", err)
+	}
+}
+
+func TestSocketRoomRateLimit(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()), AppSocket.WithRoomRateLimit(5))
+	rooms := socket.Rooms()
+	conns := make(map[string]*websocket.Conn)
+	for _, key := range []string{"sender", "peer"} {
+		conns[key] = dialSocket(t, url+key)
+		waitOnline(t, socket, key)
+		if err := rooms.Join("r", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 令牌桶容量为5，后两条分别需要等待约200ms和400ms，SendFrom不能在调用方的goroutine上等待
+	start := time.Now()
+	for i := 1; i <= 7; i++ {
+		if err := rooms.SendFrom("r", "sender", websocket.TextMessage, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Fatalf("SendFrom blocked the caller for %v", elapsed)
+	}
+
+	_ = conns["peer"].SetReadDeadline(time.Now().Add(2 * time.Second))
+	for i := 1; i <= 7; i++ {
+		_, data, err := conns["peer"].ReadMessage()
+		if err != nil || string(data) != strconv.Itoa(i) {
+			t.Fatalf("expected %d, got %q %v", i, data, err)
+		}
+		if i == 6 && time.Since(start) < 150*time.Millisecond {
+			t.Fatalf("rate limited message was delivered after %v", time.Since(start))
+		}
+	}
+
+	var notices, broadcasts []string
+	_ = conns["sender"].SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(broadcasts) < 7 {
+		_, data, err := conns["sender"].ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var notice struct {
+			Type         string `json:"type"`
+			RetryAfterMs int64  `json:"retry_after_ms"`
+		}
+		if json.Unmarshal(data, &notice) == nil && notice.Type == "rate_limited" {
+			if notice.RetryAfterMs <= 0 {
+				t.Fatalf("notice without retry_after_ms: %s", data)
+			}
+			notices = append(notices, string(data))
+			continue
+		}
+		broadcasts = append(broadcasts, string(data))
+	}
+	if len(notices) != 2 || strings.Join(broadcasts, ",") != "1,2,3,4,5,6,7" {
+		t.Fatalf("sender got notices %v and broadcasts %v", notices, broadcasts)
+	}
+}
+
+func TestSocketRoomRateLimitQueue(t *testing.T) {
+	t.Run("delayed sends reach other nodes", func(t *testing.T) {
+		shared := AppSocket.NewLocalPubSub()
+		nodeA, urlA := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()), AppSocket.WithPubSub(shared),
+			AppSocket.WithRoomRateLimit(5))
+		nodeB, urlB := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()), AppSocket.WithPubSub(shared))
+		dialSocket(t, urlA+"a")
+		waitOnline(t, nodeA, "a")
+		remote := dialSocket(t, urlB+"b")
+		waitOnline(t, nodeB, "b")
+		if err := nodeA.Rooms().Join("lobby", "a"); err != nil {
+			t.Fatal(err)
+		}
+		if err := nodeB.Rooms().Join("lobby", "b"); err != nil {
+			t.Fatal(err)
+		}
+		// 前5条立即发布，第6条进入延迟队列
+		for i := 1; i <= 6; i++ {
+			if err := nodeA.Rooms().SendFrom("lobby", "a", websocket.TextMessage, []byte(strconv.Itoa(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_ = remote.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for i := 1; i <= 6; i++ {
+			if _, data, err := remote.ReadMessage(); err != nil || string(data) != strconv.Itoa(i) {
+				t.Fatalf("remote node expected %d, got %q %v", i, data, err)
+			}
+		}
+	})
+
+	t.Run("full queue rejects", func(t *testing.T) {
+		socket, url := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()), AppSocket.WithRoomRateLimit(2),
+			AppSocket.WithSendQueueLength(64))
+		conn := dialSocket(t, url+"flood")
+		waitOnline(t, socket, "flood")
+		rooms := socket.Rooms()
+		if err := rooms.Join("r", "flood"); err != nil {
+			t.Fatal(err)
+		}
+		// 令牌桶容量为2，延迟队列最多容纳5秒即10条
+		for i := 0; i < 12; i++ {
+			if err := rooms.SendFrom("r", "flood", websocket.TextMessage, []byte("m")); err != nil {
+				t.Fatalf("send %d: %v", i, err)
+			}
+		}
+		if err := rooms.SendFrom("r", "flood", websocket.TextMessage, []byte("m")); !errors.Is(err, AppSocket.ErrRateLimited) {
+			t.Fatalf("expected ErrRateLimited once the delay queue is full, got %v", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var notice struct {
+				Type     string `json:"type"`
+				Rejected bool   `json:"rejected"`
+			}
+			if json.Unmarshal(data, &notice) == nil && notice.Type == "rate_limited" && notice.Rejected {
+				break
+			}
+		}
+	})
+}
+
+// gatedReader 第一次Read返回first，之后阻塞到gate关闭再返回err
+type gatedReader struct {
+	first   []byte
+	read    bool
+	started chan struct{}
+	gate    chan struct{}
+	err     error
+}
+
+func (r *gatedReader) Read(p []byte) (int, error) {
+	if !r.read {
+		r.read = true
+		close(r.started)
+		return copy(p, r.first), nil
+	}
+	<-r.gate
+	return 0, r.err
+}
+
+func TestSocketSendReaderTruncated(t *testing.T) {
+	errBroken := errors.New("broken reader")
+	cases := []struct {
+		name string
+		size int64
+		err  error
+		want error
+	}{
+		{name: "short reader", size: 10, err: io.EOF, want: io.ErrUnexpectedEOF},
+		{name: "reader error", size: -1, err: errBroken, want: errBroken},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			socket, url := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()))
+			conn := dialSocket(t, url+"stream")
+			waitOnline(t, socket, "stream")
+			client, err := socket.Client("stream")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reader := &gatedReader{first: []byte("abc"), started: make(chan struct{}), gate: make(chan struct{}), err: c.err}
+			streamErr := make(chan error, 1)
+			go func() {
+				streamErr <- client.SendReader(websocket.TextMessage, reader, c.size)
+			}()
+			<-reader.started
+			// 队列中的消息在写锁上等待，SendReader失败后不能由它的NextWriter替被放弃的消息发出最终帧
+			if err = socket.SendTo("stream", websocket.TextMessage, []byte("queued")); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(50 * time.Millisecond)
+			close(reader.gate)
+			if err = <-streamErr; !errors.Is(err, c.want) {
+				t.Fatalf("expected %v, got %v", c.want, err)
+			}
+
+			_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, data, err := conn.ReadMessage(); err == nil {
+				t.Fatalf("peer received %q from a failed stream", data)
+			}
+		})
+	}
+
+	t.Run("writer session", func(t *testing.T) {
+		socket, url := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()))
+		conn := dialSocket(t, url+"session")
+		waitOnline(t, socket, "session")
+		session, err := socket.WriterFor("session", websocket.TextMessage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = socket.SendTo("session", websocket.TextMessage, []byte("queued")); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = session.Write([]byte("partial"))
+		if err = session.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		// 截止时间在发出最终帧之前已经过去
+		client, _ := socket.Client("session")
+		if err = client.UpdateOption(AppSocket.WithWriteDeadline(time.Nanosecond)); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = session.Write([]byte("rest"))
+		if err = session.Close(); !errors.Is(err, AppSocket.ErrWriteTimeout) {
+			t.Fatalf("expected ErrWriteTimeout, got %v", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, data, err := conn.ReadMessage(); err == nil {
+			t.Fatalf("peer received %q from a failed session", data)
+		}
+	})
+}
+
+func TestSocketSendReaderQueued(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()), AppSocket.WithSendQueueLength(64))
+	conn := dialSocket(t, url+"mixed")
+	waitOnline(t, socket, "mixed")
+	client, err := socket.Client("mixed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := bytes.Repeat([]byte("x"), 512*1024)
+	streamErr := make(chan error, 1)
+	go func() {
+		streamErr <- client.SendReader(websocket.BinaryMessage, iotest.HalfReader(bytes.NewReader(payload)), int64(len(payload)))
+	}()
+	for i := 0; i < 20; i++ {
+		if err = socket.SendTo("mixed", websocket.TextMessage, []byte(fmt.Sprintf("q-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var queued []string
+	streamed := false
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(queued) < 20 || !streamed {
+		mt, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mt == websocket.BinaryMessage {
+			if streamed || !bytes.Equal(data, payload) {
+				t.Fatalf("streamed message corrupted: %d bytes", len(data))
+			}
+			streamed = true
+			continue
+		}
+		queued = append(queued, string(data))
+	}
+	for i, msg := range queued {
+		if msg != fmt.Sprintf("q-%d", i) {
+			t.Fatalf("queued messages out of order: %v", queued)
+		}
+	}
+	if err = <-streamErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSocketWriteLatencyWarning(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		threshold float64
+		warn      bool
+	}{
+		{"below threshold", 1, false},
+		{"above threshold", 1e-9, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			warnings := make(chan time.Duration, 8)
+			socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+				AppSocket.WithWriteLatencyWarning(c.threshold, func(elapsed time.Duration) { warnings <- elapsed }))
+			conn := dialSocket(t, url+"latency")
+			waitOnline(t, socket, "latency")
+			if err := socket.SendTo("latency", websocket.TextMessage, []byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := conn.ReadMessage(); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case elapsed := <-warnings:
+				if !c.warn {
+					t.Fatalf("unexpected warning after %s", elapsed)
+				}
+				if elapsed <= 0 {
+					t.Fatalf("expected positive elapsed time, got %s", elapsed)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if c.warn {
+					t.Fatal("expected a write latency warning")
+				}
+			}
+		})
+	}
+}
+
+func TestSocketCloseInterruptsWrite(t *testing.T) {
+	handler := newRecordHandler()
+	socket, url := newSocketServer(t, AppSocket.WithHandler(handler), AppSocket.WithWriteDeadline(10*time.Second))
+	dialSocket(t, url+"stalled")
+	waitOnline(t, socket, "stalled")
+	client, err := socket.Client("stalled")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streamErr := make(chan error, 1)
+	go func() {
+		streamErr <- client.SendReader(websocket.BinaryMessage, zeroReader{}, -1)
+	}()
+	// 对端不读取，写满TCP缓冲区后SendReader阻塞在写入上
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case err := <-streamErr:
+		t.Fatalf("write should be blocked, returned %v", err)
+	default:
+	}
+
+	start := time.Now()
+	_ = client.Close()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Close waited %s for the in-flight write", elapsed)
+	}
+	select {
+	case err := <-streamErr:
+		if err == nil {
+			t.Fatal("interrupted write should return an error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("in-flight write was not interrupted")
+	}
+	if client.State() != AppSocket.OffLineState {
+		t.Fatal("connection should be closed")
+	}
+}
+
+func TestSocketCloseWithReason(t *testing.T) {
+	handler := &countingHandler{}
+	socket, url := newSocketServer(t, AppSocket.WithHandler(handler))
+	conn := dialSocket(t, url+"kick")
+	waitOnline(t, socket, "kick")
+
+	reason := strings.Repeat("配额", 40)
+	if err := socket.CloseWithReason("kick", 4001, reason, map[string]any{"quota": 100}); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var notice struct {
+		Type   string         `json:"type"`
+		Code   int            `json:"code"`
+		Reason string         `json:"reason"`
+		Detail map[string]any `json:"detail"`
+	}
+	if err = json.Unmarshal(data, &notice); err != nil {
+		t.Fatal(err)
+	}
+	if notice.Type != "closing" || notice.Code != 4001 || notice.Reason != reason || notice.Detail["quota"] != float64(100) {
+		t.Fatalf("unexpected closing notice %s", data)
+	}
+	var closeErr *websocket.CloseError
+	if _, _, err = conn.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != 4001 {
+		t.Fatalf("expected close frame with code 4001, got %v", err)
+	}
+	if !strings.HasPrefix(reason, closeErr.Text) || len(closeErr.Text) > 123 {
+		t.Fatalf("close reason should be truncated on a rune boundary, got %q", closeErr.Text)
+	}
+	if err = socket.CloseWithReason("kick", 4001, "again", nil); !errors.Is(err, AppSocket.ErrConnectionClosed) && !errors.Is(err, AppSocket.ErrAlreadyClosed) {
+		t.Fatalf("expected closed session error, got %v", err)
+	}
+}
+
+func TestMessageTypeRegistry(t *testing.T) {
+	registry := AppSocket.NewMessageTypeRegistry()
+	registry.Register(100, "ai_response")
+	tests := []struct {
+		mt   int
+		want string
+	}{
+		{websocket.TextMessage, "TextMessage"},
+		{websocket.BinaryMessage, "BinaryMessage"},
+		{websocket.CloseMessage, "CloseMessage"},
+		{websocket.PingMessage, "PingMessage"},
+		{websocket.PongMessage, "PongMessage"},
+		{100, "ai_response"},
+		{101, "MessageType(101)"},
+		{-1, "MessageType(-1)"},
+	}
+	for _, tt := range tests {
+		if got := registry.Name(tt.mt); got != tt.want {
+			t.Errorf("Name(%d) = %q, want %q", tt.mt, got, tt.want)
+		}
+	}
+	if got := AppSocket.MessageTypes.Name(100); got != "MessageType(100)" {
+		t.Errorf("registries should be independent, global Name(100) = %q", got)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				registry.Register(200+i, fmt.Sprintf("custom_%d", i))
+				_ = registry.Name(200 + (i+j)%8)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 8; i++ {
+		if got, want := registry.Name(200+i), fmt.Sprintf("custom_%d", i); got != want {
+			t.Errorf("Name(%d) = %q, want %q", 200+i, got, want)
+		}
+	}
+}
+
+func TestSocketLogsMessageTypeName(t *testing.T) {
+	AppSocket.MessageTypes.Register(websocket.TextMessage, "prompt")
+	defer AppSocket.MessageTypes.Register(websocket.TextMessage, "TextMessage")
+	core, logs := observer.New(zap.DebugLevel)
+	socket, url := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()), AppSocket.WithLogger(zap.New(core)))
+	conn := dialSocket(t, url+"typed")
+	waitOnline(t, socket, "typed")
+
+	_ = conn.WriteMessage(websocket.TextMessage, []byte("hi"))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		entries := logs.FilterMessage("websocket message received").All()
+		if len(entries) > 0 {
+			if got := entries[0].ContextMap()["message_type"]; got != "prompt" {
+				t.Fatalf("expected message_type prompt, got %v", got)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("message was not logged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSocketReadPumpChan(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}), AppSocket.WithMaxMessageSize(16))
+	conn := dialSocket(t, url+"chan")
+	waitOnline(t, socket, "chan")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	messages, err := socket.ReadPumpChan(ctx, "chan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	_ = conn.WriteMessage(websocket.TextMessage, []byte("message over the read limit"))
+
+	var got []AppSocket.IncomingMessage
+	for msg := range messages {
+		got = append(got, msg)
+	}
+	if len(got) != 2 || string(got[0].Data) != "hello" || got[0].Done {
+		t.Fatalf("unexpected messages %+v", got)
+	}
+	if !got[1].Done || !errors.Is(got[1].Err, AppSocket.ErrMessageTooLarge) {
+		t.Fatalf("expected final Done message with ErrMessageTooLarge, got %+v", got[1])
+	}
+
+	cancelled, stop := context.WithCancel(context.Background())
+	conn2 := dialSocket(t, url+"cancel")
+	waitOnline(t, socket, "cancel")
+	messages, err = socket.ReadPumpChan(cancelled, "cancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	select {
+	case _, ok := <-messages:
+		if ok {
+			t.Fatal("expected channel to be closed after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed after cancel")
+	}
+	_ = conn2.WriteMessage(websocket.TextMessage, []byte("after cancel"))
+}
+
+func TestSocketReadPumpChanClose(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}))
+	// 对端断开与订阅同时发生，读循环可能在ReadPumpChan返回之前就已经退出
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("close-%d", i)
+		conn := dialSocket(t, url+key)
+		waitOnline(t, socket, key)
+		client, err := socket.Client(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go conn.Close()
+		messages := client.ReadPumpChan(context.Background())
+		timeout := time.After(2 * time.Second)
+		for open := true; open; {
+			select {
+			case _, open = <-messages:
+			case <-timeout:
+				t.Fatalf("%s: channel not closed after the connection ended", key)
+			}
+		}
+	}
+}
+
+// notifier 只依赖MessageWriter
+type notifier struct {
+	writer AppSocket.MessageWriter
+}
+
+func (n notifier) notify(key, text string) error {
+	return n.writer.SendTo(key, websocket.TextMessage, []byte(text))
+}
+
+func TestSocketNarrowInterfaces(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()))
+	conn := dialSocket(t, url+"narrow")
+	waitOnline(t, socket, "narrow")
+
+	if err := (notifier{writer: socket}).notify("narrow", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "hello" {
+		t.Fatalf("expected hello, got %q: %v", data, err)
+	}
+
+	var closer AppSocket.Closer = socket
+	done, err := closer.Done("narrow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = closer.Close("narrow"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("done was not closed")
+	}
+	if _, err = closer.Done("missing"); !errors.Is(err, AppSocket.ErrConnectionClosed) {
+		t.Fatalf("expected ErrConnectionClosed, got %v", err)
+	}
+}
+
+func TestSocketControlCallbacks(t *testing.T) {
+	pinged := make(chan string, 1)
+	errs := make(chan error, 1)
+	socket, url := newSocketServer(t,
+		AppSocket.WithPingPeriod(50*time.Millisecond),
+		AppSocket.WithHandler(&AppSocket.HandlerFuncs{
+			PingFunc: func(key, appData string) { pinged <- appData },
+			PongFunc: func(key, appData string) { panic("pong handler") },
+			ErrorFunc: func(key string, err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			},
+		}))
+	conn := dialSocket(t, url+"control")
+	waitOnline(t, socket, "control")
+	ponged := make(chan string, 1)
+	conn.SetPongHandler(func(appData string) error {
+		ponged <- appData
+		return nil
+	})
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	if err := conn.WriteControl(websocket.PingMessage, []byte("diag"), time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range []chan string{pinged, ponged} {
+		select {
+		case data := <-ch:
+			if data != "diag" {
+				t.Fatalf("unexpected ping payload %q", data)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("ping was not handled")
+		}
+	}
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "pong handler") {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("pong handler panic was not routed to OnError")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if socket.GetClientState("control") != AppSocket.OnlineState {
+		t.Fatal("a panicking pong handler should not close the connection")
+	}
+}
+
+func TestSocketContinueOnError(t *testing.T) {
+	errBadInput := errors.New("bad input")
+	received := make(chan string, 4)
+	errs := make(chan error, 4)
+	socket, url := newSocketServer(t,
+		AppSocket.WithContinueOnError(func(err error) bool { return errors.Is(err, errBadInput) }),
+		AppSocket.WithHandler(&AppSocket.HandlerFuncs{
+			MessageFunc: func(message AppSocket.Message) {
+				switch string(message.Data) {
+				case "bad":
+					panic(errBadInput)
+				case "fatal":
+					panic("fatal")
+				}
+				received <- string(message.Data)
+			},
+			ErrorFunc: func(key string, err error) { errs <- err },
+		}))
+	conn := dialSocket(t, url+"continue")
+	waitOnline(t, socket, "continue")
+
+	for _, data := range []string{"bad", "ok"} {
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(data))
+	}
+	select {
+	case data := <-received:
+		if data != "ok" {
+			t.Fatalf("unexpected message %q", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("read loop stopped after a recoverable error")
+	}
+	if err := <-errs; !errors.Is(err, errBadInput) || !errors.Is(err, AppSocket.ErrPanic) || AppSocket.ErrorStage(err) != AppSocket.StageDispatch {
+		t.Fatalf("expected recoverable error to reach OnError, got %v", err)
+	}
+
+	_ = conn.WriteMessage(websocket.TextMessage, []byte("fatal"))
+	<-errs
+	deadline := time.Now().Add(2 * time.Second)
+	for socket.GetClientState("continue") == AppSocket.OnlineState && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if socket.GetClientState("continue") == AppSocket.OnlineState {
+		t.Fatal("errors rejected by the predicate should close the connection")
+	}
+}
+
+func TestSocketWriteTransformer(t *testing.T) {
+	redact := func(mt int, data []byte) ([]byte, error) {
+		return []byte(strings.ReplaceAll(string(data), "secret", "******")), nil
+	}
+	block := func(mt int, data []byte) ([]byte, error) {
+		if strings.Contains(string(data), "blocked") {
+			return nil, errors.New("content policy")
+		}
+		return data, nil
+	}
+	upper := func(mt int, data []byte) ([]byte, error) {
+		return []byte(strings.ToUpper(string(data))), nil
+	}
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithWriteTransformer(redact, block), AppSocket.WithWriteTransformer(upper))
+	conn := dialSocket(t, url+"transform")
+	waitOnline(t, socket, "transform")
+
+	for _, data := range []string{"my secret", "blocked message", "next"} {
+		if err := socket.SendTo("transform", websocket.TextMessage, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []string{"MY ******", "NEXT"} {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Fatalf("expected %q, got %q", want, data)
+		}
+	}
+}
+
+func TestSocketUpdateOption(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithReadDeadline(time.Second), AppSocket.WithPingPeriod(500*time.Millisecond))
+	conn := dialSocket(t, url+"update")
+	waitOnline(t, socket, "update")
+	client, err := socket.Client("update")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = client.UpdateOption(AppSocket.WithSendQueueLength(8)); !errors.Is(err, AppSocket.ErrOptionNotAdjustable) {
+		t.Fatalf("expected ErrOptionNotAdjustable, got %v", err)
+	}
+	if err = client.UpdateOption(AppSocket.WithPingPeriod(2 * time.Second)); !errors.Is(err, AppSocket.ErrInvalidOption) {
+		t.Fatalf("ping period beyond the live read deadline should be rejected, got %v", err)
+	}
+
+	pings := make(chan struct{}, 64)
+	conn.SetPingHandler(func(string) error {
+		pings <- struct{}{}
+		return nil
+	})
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				_ = socket.SendTo("update", websocket.TextMessage, []byte("payload"))
+				period := time.Duration(20+i*5) * time.Millisecond
+				if err := client.UpdateOption(AppSocket.WithReadDeadline(time.Second),
+					AppSocket.WithWriteDeadline(time.Second), AppSocket.WithPingPeriod(period)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if err = client.UpdateOption(AppSocket.WithPingPeriod(20 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	for len(pings) > 0 {
+		<-pings
+	}
+	deadline := time.After(200 * time.Millisecond)
+	count := 0
+	for count < 3 {
+		select {
+		case <-pings:
+			count++
+		case <-deadline:
+			t.Fatalf("expected faster pings after update, got %d", count)
+		}
+	}
+	if socket.GetClientState("update") != AppSocket.OnlineState {
+		t.Fatal("connection should stay online")
+	}
+}
+
+type chatPrompt struct {
+	ConversationID string   `json:"conversation_id"`
+	Prompt         string   `json:"prompt"`
+	Tags           []string `json:"tags,omitempty"`
+	Reply          *chatPrompt
+}
+
+func TestSocketMessageRouter(t *testing.T) {
+	unrouted := make(chan string, 1)
+	router := AppSocket.NewMessageRouter(&AppSocket.HandlerFuncs{
+		MessageFunc: func(message AppSocket.Message) { unrouted <- string(message.Data) },
+	})
+	prompts := make(chan chatPrompt, 1)
+	AppSocket.Handle(router, "prompt", func(key string, payload chatPrompt) error {
+		prompts <- payload
+		return nil
+	})
+	router.Emits("closing", struct {
+		Code int `json:"code"`
+	}{})
+	socket, url := newSocketServer(t, AppSocket.WithHandler(router))
+	conn := dialSocket(t, url+"router")
+	waitOnline(t, socket, "router")
+
+	_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"prompt","data":{"conversation_id":"c1","prompt":"hi"}}`))
+	_ = conn.WriteMessage(websocket.TextMessage, []byte("plain text"))
+	select {
+	case payload := <-prompts:
+		if payload.ConversationID != "c1" || payload.Prompt != "hi" {
+			t.Fatalf("unexpected payload %+v", payload)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("route was not invoked")
+	}
+	select {
+	case data := <-unrouted:
+		if data != "plain text" {
+			t.Fatalf("unexpected fallback message %s", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("unrouted message should reach the fallback")
+	}
+
+	engine := gin.New()
+	engine.GET("/ws/schema", AppSocket.NewSchemaInspector("test", router).Handler())
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/ws/schema", nil))
+	var doc struct {
+		OpenAPI    string `json:"openapi"`
+		Components struct {
+			Schemas map[string]struct {
+				Required []string `json:"required"`
+			} `json:"schemas"`
+		} `json:"components"`
+		Websocket struct {
+			Accepts map[string]any `json:"accepts"`
+			Emits   map[string]any `json:"emits"`
+		} `json:"x-websocket"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	prompt, ok := doc.Components.Schemas["chatPrompt"]
+	if doc.OpenAPI == "" || !ok || doc.Websocket.Accepts["prompt"] == nil || doc.Websocket.Emits["closing"] == nil {
+		t.Fatalf("unexpected schema document %s", recorder.Body.String())
+	}
+	if strings.Join(prompt.Required, ",") != "conversation_id,prompt" {
+		t.Fatalf("unexpected required fields %v", prompt.Required)
+	}
+}
+
+func TestSocketLabels(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithLabelExtractor(func(ctx *gin.Context) map[string]string {
+			labels := map[string]string{
+				"platform": ctx.GetHeader("X-Platform"),
+				"version":  strings.Repeat("v", 100),
+			}
+			for i := 0; i < 10; i++ {
+				labels[fmt.Sprintf("z%d", i)] = "x"
+			}
+			return labels
+		}),
+		AppSocket.WithMetricLabels("platform"))
+	conn, _, err := websocket.DefaultDialer.Dial(url+"labels", http.Header{"X-Platform": {"ios"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	waitOnline(t, socket, "labels")
+	client, err := socket.Client("labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := client.Labels()
+	if len(labels) != 8 {
+		t.Fatalf("expected labels capped at 8, got %d: %v", len(labels), labels)
+	}
+	if labels["platform"] != "ios" || len(labels["version"]) != 64 {
+		t.Fatalf("unexpected labels %v", labels)
+	}
+	labels["platform"] = "web"
+	if client.Labels()["platform"] != "ios" {
+		t.Fatal("labels should not be mutable after connect")
+	}
+	if info, _ := socket.Info("labels"); info.Labels["platform"] != "ios" {
+		t.Fatalf("unexpected info labels %v", info.Labels)
+	}
+	stats, err := socket.Stats("labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Labels) != 1 || stats.Labels["platform"] != "ios" {
+		t.Fatalf("stats should only carry allowlisted labels, got %v", stats.Labels)
+	}
+}
+
+func TestSocketClientStore(t *testing.T) {
+	opened := make(chan *AppSocket.SocketClient, 1)
+	socket, url := newSocketServer(t, AppSocket.WithHandler(&AppSocket.HandlerFuncs{
+		OpenFunc: func(client *AppSocket.SocketClient) { opened <- client },
+	}))
+	conn := dialSocket(t, url+"store")
+	client := <-opened
+	waitOnline(t, socket, "store")
+
+	store := client.Store()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store.Set("conversation", "c1")
+			store.Set("turn", i)
+			store.Range(func(key string, value any) bool {
+				store.Delete("scratch")
+				return true
+			})
+		}(i)
+	}
+	wg.Wait()
+	if conversation, ok := AppSocket.StoreValue[string](store, "conversation"); !ok || conversation != "c1" {
+		t.Fatalf("unexpected conversation %q", conversation)
+	}
+	if _, ok := AppSocket.StoreValue[string](store, "turn"); ok {
+		t.Fatal("type mismatch should report false")
+	}
+
+	_ = conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for socket.GetClientState("store") == AppSocket.OnlineState && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := store.Get("conversation"); ok {
+		t.Fatal("store should be released after close")
+	}
+}
+
+func TestSocketInjectTimestamp(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}), AppSocket.WithInjectTimestamp(true))
+	conn := dialSocket(t, url+"ts")
+	waitOnline(t, socket, "ts")
+
+	before := time.Now().UnixNano()
+	_ = socket.SendTo("ts", websocket.TextMessage, []byte(`{"type":"token","data":"hi"}`))
+	_ = socket.SendTo("ts", websocket.TextMessage, []byte(`{}`))
+	_ = socket.SendTo("ts", websocket.TextMessage, []byte("plain"))
+	_ = socket.SendTo("ts", websocket.BinaryMessage, []byte{0xAB})
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	for _, wantType := range []string{"token", ""} {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg struct {
+			ServerTS int64  `json:"_server_ts"`
+			Type     string `json:"type"`
+		}
+		if err = json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("invalid JSON %s: %v", data, err)
+		}
+		if msg.ServerTS < before || msg.Type != wantType {
+			t.Fatalf("unexpected stamped message %s", data)
+		}
+	}
+	if _, data, _ := conn.ReadMessage(); string(data) != "plain" {
+		t.Fatalf("non-JSON text should be unchanged, got %q", data)
+	}
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 9 || int64(binary.BigEndian.Uint64(data)) < before || data[8] != 0xAB {
+		t.Fatalf("unexpected binary message %x", data)
+	}
+}
+
+func TestSocketByteCounters(t *testing.T) {
+	received := make(chan struct{}, 1)
+	socket, url := newSocketServer(t, AppSocket.WithHandler(&AppSocket.HandlerFuncs{
+		MessageFunc: func(AppSocket.Message) { received <- struct{}{} },
+	}))
+	conn := dialSocket(t, url+"bytes")
+	waitOnline(t, socket, "bytes")
+	client, err := socket.Client("bytes")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.WriteMessage(websocket.TextMessage, []byte("12345"))
+	<-received
+	_ = socket.SendTo("bytes", websocket.TextMessage, []byte("1234567890"))
+	if _, _, err = conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if sent, recv := client.BytesSentAtomic(), client.BytesReceivedAtomic(); sent != 10 || recv != 5 {
+		t.Fatalf("expected 10 bytes sent and 5 received, got %d and %d", sent, recv)
+	}
+	stats, err := socket.Stats("bytes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BytesSent != 10 || stats.SendBytesPerSec != 10 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestSocketProtobufEncoding(t *testing.T) {
+	router := AppSocket.NewMessageRouter(nil)
+	prompts := make(chan chatPrompt, 1)
+	AppSocket.Handle(router, "prompt", func(key string, payload chatPrompt) error {
+		prompts <- payload
+		return nil
+	})
+	socket, url := newSocketServer(t, AppSocket.WithHandler(router), AppSocket.WithProtobufEncoding(),
+		AppSocket.WithContinueOnError(func(err error) bool { return errors.Is(err, AppSocket.ErrInvalidEnvelope) }))
+	conn := dialSocket(t, url+"proto")
+	waitOnline(t, socket, "proto")
+
+	_ = conn.WriteMessage(websocket.BinaryMessage, []byte{0xff, 0xff})
+	frame, _ := proto.Marshal(&wirepb.Envelope{Type: "prompt", Data: []byte(`{"conversation_id":"c1","prompt":"hi"}`)})
+	_ = conn.WriteMessage(websocket.BinaryMessage, frame)
+	select {
+	case payload := <-prompts:
+		if payload.ConversationID != "c1" {
+			t.Fatalf("unexpected payload %+v", payload)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("protobuf envelope was not routed")
+	}
+
+	_ = socket.WriteMessage(AppSocket.Message{Subkeys: []string{"proto"}, Data: []byte("plain")})
+	_ = socket.WriteMessage(AppSocket.Message{Subkeys: []string{"proto"}, Envelope: &wirepb.Envelope{Control: &wirepb.Envelope_Ack{Ack: &wirepb.Ack{Seq: 7}}}})
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, check := range []func(*wirepb.Envelope) bool{
+		func(e *wirepb.Envelope) bool { return string(e.GetData()) == "plain" },
+		func(e *wirepb.Envelope) bool { return e.GetAck().GetSeq() == 7 },
+	} {
+		mt, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var envelope wirepb.Envelope
+		if err = proto.Unmarshal(data, &envelope); err != nil || mt != websocket.BinaryMessage || !check(&envelope) {
+			t.Fatalf("unexpected frame %d %x: %v", mt, data, err)
+		}
+	}
+}
+
+func TestSocketPanicHandler(t *testing.T) {
+	type report struct {
+		value  any
+		stack  []byte
+		connID string
+	}
+	cases := []struct {
+		name     string
+		handler  *AppSocket.HandlerFuncs
+		opts     []AppSocket.SocketOptionFunc
+		trigger  func(socket AppSocket.SocketClientInterface, conn *websocket.Conn)
+		closes   bool
+		repanics bool
+	}{
+		{
+			name:    "read loop",
+			handler: &AppSocket.HandlerFuncs{MessageFunc: func(AppSocket.Message) { panic("on message") }},
+			trigger: func(_ AppSocket.SocketClientInterface, conn *websocket.Conn) {
+				_ = conn.WriteMessage(websocket.TextMessage, []byte("boom"))
+			},
+			closes: true,
+		},
+		{
+			name:    "write loop",
+			handler: &AppSocket.HandlerFuncs{},
+			opts: []AppSocket.SocketOptionFunc{AppSocket.WithWriteTransformer(func(int, []byte) ([]byte, error) {
+				panic("transformer")
+			})},
+			trigger: func(socket AppSocket.SocketClientInterface, _ *websocket.Conn) {
+				_ = socket.SendTo("panic", websocket.TextMessage, []byte("boom"))
+			},
+			closes: true,
+		},
+		{
+			name: "control callback",
+			handler: &AppSocket.HandlerFuncs{PingFunc: func(string, string) {
+				panic("on ping")
+			}},
+			trigger: func(_ AppSocket.SocketClientInterface, conn *websocket.Conn) {
+				_ = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+			},
+		},
+		{
+			name: "close callback and panicking panic handler",
+			handler: &AppSocket.HandlerFuncs{CloseFunc: func(string) {
+				panic("on close")
+			}},
+			trigger: func(_ AppSocket.SocketClientInterface, conn *websocket.Conn) {
+				_ = conn.Close()
+			},
+			closes:   true,
+			repanics: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reports := make(chan report, 4)
+			panicHandler := func(recovered any, stack []byte, connID string) {
+				reports <- report{recovered, stack, connID}
+				if c.repanics {
+					panic("panic handler")
+				}
+			}
+			opts := append(c.opts, AppSocket.WithHandler(c.handler), AppSocket.WithPanicHandler(panicHandler))
+			socket, url := newSocketServer(t, opts...)
+			conn := dialSocket(t, url+"panic")
+			waitOnline(t, socket, "panic")
+			c.trigger(socket, conn)
+
+			select {
+			case r := <-reports:
+				if r.connID != "panic" || len(r.stack) == 0 || r.value == nil {
+					t.Fatalf("unexpected panic report %v %q", r.value, r.connID)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("panic handler was not called")
+			}
+			deadline := time.Now().Add(2 * time.Second)
+			for c.closes && socket.GetClientState("panic") == AppSocket.OnlineState && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if online := socket.GetClientState("panic") == AppSocket.OnlineState; online == c.closes {
+				t.Fatalf("expected connection closed=%v after panic", c.closes)
+			}
+		})
+	}
+}
+
+func TestSocketReadWriter(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}))
+	conn := dialSocket(t, url+"pipe")
+	waitOnline(t, socket, "pipe")
+	rw, err := AppSocket.NewReadWriter(socket, "pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.WriteMessage(websocket.BinaryMessage, []byte("hello "))
+	_ = conn.WriteMessage(websocket.TextMessage, []byte("ignored"))
+	_ = conn.WriteMessage(websocket.BinaryMessage, []byte("world"))
+	buf := make([]byte, 11)
+	if _, err = io.ReadFull(rw, buf); err != nil || string(buf) != "hello world" {
+		t.Fatalf("unexpected read %q: %v", buf, err)
+	}
+
+	if n, err := rw.Write([]byte("pong")); err != nil || n != 4 {
+		t.Fatalf("unexpected write %d: %v", n, err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if mt, data, err := conn.ReadMessage(); err != nil || mt != websocket.BinaryMessage || string(data) != "pong" {
+		t.Fatalf("unexpected frame %d %q: %v", mt, data, err)
+	}
+
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if _, err = rw.Read(buf); err != io.EOF {
+		t.Fatalf("expected io.EOF after close, got %v", err)
+	}
+}
+
+func TestSocketNoReadDeadline(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithNoReadDeadline(), AppSocket.WithPingPeriod(20*time.Millisecond))
+	conn := dialSocket(t, url+"idle")
+	waitOnline(t, socket, "idle")
+	client, err := socket.Client("idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = client.UpdateOption(AppSocket.WithReadDeadline(time.Second)); !errors.Is(err, AppSocket.ErrOptionNotAdjustable) {
+		t.Fatalf("expected ErrOptionNotAdjustable, got %v", err)
+	}
+	if err = client.UpdateOption(AppSocket.WithPingPeriod(-1)); !errors.Is(err, AppSocket.ErrInvalidOption) {
+		t.Fatalf("disabling heartbeat without a read deadline should be rejected, got %v", err)
+	}
+
+	if err = socket.SendTo("idle", websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected message %q: %v", data, err)
+	}
+	if socket.GetClientState("idle") != AppSocket.OnlineState {
+		t.Fatal("connection without read deadline should stay online")
+	}
+}
+
+func TestSocketHeartbeatFailures(t *testing.T) {
+	handler := newRecordHandler()
+	socket, url := newSocketServer(t, AppSocket.WithHandler(handler),
+		AppSocket.WithPingPeriod(20*time.Millisecond), AppSocket.WithHeartbeatFailMaxTimes(3))
+	conn := dialSocket(t, url+"heartbeat")
+	waitOnline(t, socket, "heartbeat")
+	client, err := socket.Client("heartbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for client.LastPongAt().IsZero() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if client.LastPongAt().IsZero() || client.HeartbeatFailures() != 0 {
+		t.Fatalf("expected a pong and no failures, got %v and %d", client.LastPongAt(), client.HeartbeatFailures())
+	}
+
+	// 截止时间在写入前已经过去，每次ping都会超时
+	if err = client.UpdateOption(AppSocket.WithWriteDeadline(time.Nanosecond)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-handler.errs:
+		if AppSocket.ErrorStage(err) != AppSocket.StageHeartbeat || !errors.Is(err, AppSocket.ErrWriteTimeout) {
+			t.Fatalf("expected heartbeat timeout, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not closed after consecutive heartbeat failures")
+	}
+	if failures := client.HeartbeatFailures(); failures != 3 {
+		t.Fatalf("expected close after exactly 3 consecutive failures, got %d", failures)
+	}
+}
+
+func TestSocketFlushInterval(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithFlushInterval(50*time.Millisecond))
+	conn := dialSocket(t, url+"flush")
+	waitOnline(t, socket, "flush")
+
+	for _, token := range []string{`{"token":"Hel"}`, `{"token":"lo"}`, "plain"} {
+		_ = socket.SendTo("flush", websocket.TextMessage, []byte(token))
+	}
+	_ = socket.SendTo("flush", websocket.BinaryMessage, []byte{1})
+	_ = socket.SendTo("flush", websocket.TextMessage, []byte(`"tail"`))
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []struct {
+		mt   int
+		data string
+	}{
+		{websocket.TextMessage, `[{"token":"Hel"},{"token":"lo"},"plain"]`},
+		{websocket.BinaryMessage, "\x01"},
+		{websocket.TextMessage, `["tail"]`},
+	} {
+		mt, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mt != want.mt || string(data) != want.data {
+			t.Fatalf("expected %d %q, got %d %q", want.mt, want.data, mt, data)
+		}
+	}
+}
+
+// memorySink 进程内的EventSink，按topic投递给订阅方
+type memorySink struct {
+	mu   sync.Mutex
+	subs map[string][]chan sinktest.Record
+}
+
+func newMemorySink() *memorySink {
+	return &memorySink{subs: make(map[string][]chan sinktest.Record)}
+}
+
+func (s *memorySink) Publish(topic string, key string, payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ch := range s.subs[topic] {
+		ch <- sinktest.Record{Topic: topic, Key: key, Payload: append([]byte(nil), payload...)}
+	}
+	return nil
+}
+
+func (s *memorySink) Receive(_ *testing.T, topic string) <-chan sinktest.Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan sinktest.Record, 1024)
+	s.subs[topic] = append(s.subs[topic], ch)
+	return ch
+}
+
+func TestEventSinkConformance(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		sinktest.Run(t, func(t *testing.T) sinktest.Harness {
+			sink := newMemorySink()
+			return sinktest.Harness{Sink: sink, Receive: sink.Receive}
+		})
+	})
+	t.Run("nats", func(t *testing.T) {
+		url := os.Getenv("NATS_URL")
+		if url == "" {
+			t.Skip("NATS_URL not set")
+		}
+		sinktest.Run(t, func(t *testing.T) sinktest.Harness {
+			conn, err := nats.Connect(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(conn.Close)
+			return sinktest.Harness{
+				Sink: natssink.New(conn),
+				Receive: func(t *testing.T, topic string) <-chan sinktest.Record {
+					msgs := make(chan *nats.Msg, 1024)
+					if _, err := conn.ChanSubscribe(topic, msgs); err != nil {
+						t.Fatal(err)
+					}
+					if err := conn.Flush(); err != nil {
+						t.Fatal(err)
+					}
+					records := make(chan sinktest.Record, 1024)
+					go func() {
+						for msg := range msgs {
+							records <- sinktest.Record{Topic: msg.Subject, Key: msg.Header.Get(natssink.KeyHeader), Payload: msg.Data}
+						}
+					}()
+					return records
+				},
+			}
+		})
+	})
+}
+
+// blockingSink Publish一直阻塞到release关闭
+type blockingSink struct {
+	release chan struct{}
+}
+
+func (s blockingSink) Publish(string, string, []byte) error {
+	<-s.release
+	return nil
+}
+
+func TestSocketEventSink(t *testing.T) {
+	sink := newMemorySink()
+	topics := map[string]<-chan sinktest.Record{}
+	for _, event := range []string{AppSocket.SinkEventConnect, AppSocket.SinkEventDisconnect, AppSocket.SinkEventAction, AppSocket.SinkEventStreamEnd} {
+		topics[event] = sink.Receive(t, "ws."+event)
+	}
+	router := AppSocket.NewMessageRouter(nil)
+	AppSocket.Handle(router, "echo", func(key string, payload chatPrompt) error { return nil })
+	AppSocket.Handle(router, "ignored", func(key string, payload chatPrompt) error { return nil })
+	socket, url := newSocketServer(t, AppSocket.WithHandler(router), AppSocket.WithEventSink(AppSocket.EventSinkConfig{
+		Sink:        sink,
+		TopicPrefix: "ws.",
+		Connect:     true,
+		Disconnect:  true,
+		StreamEnd:   true,
+		Actions:     []string{"echo"},
+	}))
+	conn := dialSocket(t, url+"sink")
+	waitOnline(t, socket, "sink")
+	client, err := socket.Client("sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := func(event string) sinktest.Record {
+		t.Helper()
+		select {
+		case record := <-topics[event]:
+			if record.Key != "sink" {
+				t.Fatalf("unexpected key %q", record.Key)
+			}
+			return record
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no %s event", event)
+			return sinktest.Record{}
+		}
+	}
+
+	var connected AppSocket.ConnectEvent
+	if err = json.Unmarshal(next(AppSocket.SinkEventConnect).Payload, &connected); err != nil || connected.ID != "sink" {
+		t.Fatalf("unexpected connect event %+v: %v", connected, err)
+	}
+	_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"ignored","data":{}}`))
+	_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"echo","data":{"text":"hi"}}`))
+	var action AppSocket.ActionEvent
+	if err = json.Unmarshal(next(AppSocket.SinkEventAction).Payload, &action); err != nil || action.Type != "echo" {
+		t.Fatalf("unexpected action event %+v: %v", action, err)
+	}
+
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	if err = client.SendReader(websocket.BinaryMessage, strings.NewReader("stream"), 6); err != nil {
+		t.Fatal(err)
+	}
+	var streamed AppSocket.StreamEndEvent
+	if err = json.Unmarshal(next(AppSocket.SinkEventStreamEnd).Payload, &streamed); err != nil || streamed.Bytes != 6 {
+		t.Fatalf("unexpected stream_end event %+v: %v", streamed, err)
+	}
+
+	_ = client.Close()
+	var disconnected AppSocket.DisconnectEvent
+	if err = json.Unmarshal(next(AppSocket.SinkEventDisconnect).Payload, &disconnected); err != nil || disconnected.BytesSent < 6 {
+		t.Fatalf("unexpected disconnect event %+v: %v", disconnected, err)
+	}
+	select {
+	case record := <-topics[AppSocket.SinkEventAction]:
+		t.Fatalf("action outside the allowlist forwarded: %s", record.Payload)
+	default:
+	}
+
+	t.Run("slow sink drops events", func(t *testing.T) {
+		sink := blockingSink{release: make(chan struct{})}
+		defer close(sink.release)
+		socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}), AppSocket.WithEventSink(AppSocket.EventSinkConfig{
+			Sink:       sink,
+			Connect:    true,
+			BufferSize: 1,
+			BatchSize:  1,
+		}))
+		for i := 0; i < 5; i++ {
+			key := fmt.Sprint("slow", i)
+			dialSocket(t, url+key)
+			waitOnline(t, socket, key)
+		}
+		if stats := socket.EventSinkStats(); stats.Dropped == 0 || stats.Published != 0 {
+			t.Fatalf("expected dropped events while the sink is blocked, got %+v", stats)
+		}
+	})
+}
+
+func TestSocketPendingStore(t *testing.T) {
+	if _, err := AppSocket.NewMemoryPendingStore(AppSocket.PendingLimits{MaxMessages: 10}); !errors.Is(err, AppSocket.ErrInvalidOption) {
+		t.Fatalf("limits without caps should be rejected, got %v", err)
+	}
+	store, err := AppSocket.NewMemoryPendingStore(AppSocket.PendingLimits{MaxMessages: 1000, MaxBytes: 1 << 20, MaxAge: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}), AppSocket.WithPendingStore(store))
+
+	const offline, total = 3, 300
+	for i := 0; i < offline; i++ {
+		if err = socket.SendTo("user", websocket.TextMessage, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("offline send should be stored, got %v", err)
+		}
+	}
+	// 连接建立期间持续发送，补发与实时消息交接时不能乱序或丢失
+	sent := make(chan error, 1)
+	go func() {
+		for i := offline; i < total; i++ {
+			if err := socket.SendTo("user", websocket.TextMessage, []byte(fmt.Sprint(i))); err != nil {
+				sent <- err
+				return
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+		sent <- nil
+	}()
+	time.Sleep(5 * time.Millisecond)
+	conn := dialSocket(t, url+"user")
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < total; i++ {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != fmt.Sprint(i) {
+			t.Fatalf("expected message %d, got %s", i, data)
+		}
+	}
+	if err = <-sent; err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := store.DrainSince("user", 0); len(pending) != 0 {
+		t.Fatalf("delivered messages should be trimmed, %d left", len(pending))
+	}
+
+	t.Run("limits", func(t *testing.T) {
+		store, err := AppSocket.NewMemoryPendingStore(AppSocket.PendingLimits{MaxMessages: 2, MaxBytes: 8, MaxAge: time.Minute})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, data := range []string{"a", "bb", "ccc"} {
+			if err = store.Append("user", AppSocket.PendingMessage{Data: []byte(data)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		pending, _ := store.DrainSince("user", 0)
+		if len(pending) != 2 || string(pending[0].Data) != "bb" || pending[1].Cursor != 3 {
+			t.Fatalf("expected the oldest message evicted, got %+v", pending)
+		}
+		if err = store.Append("user", AppSocket.PendingMessage{Data: []byte("dddddd")}); err != nil {
+			t.Fatal(err)
+		}
+		if pending, _ = store.DrainSince("user", 0); len(pending) != 1 || string(pending[0].Data) != "dddddd" {
+			t.Fatalf("expected byte cap to evict older messages, got %+v", pending)
+		}
+		if err = store.Append("user", AppSocket.PendingMessage{Data: []byte("too large!")}); !errors.Is(err, AppSocket.ErrMessageTooLarge) {
+			t.Fatalf("expected ErrMessageTooLarge, got %v", err)
+		}
+		if err = store.Append("user", AppSocket.PendingMessage{Data: []byte("o"), Time: time.Now().Add(-2 * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+		if pending, _ = store.DrainSince("user", 0); len(pending) != 1 {
+			t.Fatalf("expired messages should not be drained, got %+v", pending)
+		}
+	})
+}
+
+func TestSocketDuplicateSessionPolicy(t *testing.T) {
+	userLabel := AppSocket.WithLabelExtractor(func(ctx *gin.Context) map[string]string {
+		return map[string]string{AppSocket.SessionLabel: ctx.Query("user")}
+	})
+	closeCode := func(conn *websocket.Conn) int {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				var closeErr *websocket.CloseError
+				if errors.As(err, &closeErr) {
+					return closeErr.Code
+				}
+				return 0
+			}
+		}
+	}
+	cases := []struct {
+		name        string
+		policy      AppSocket.DuplicatePolicy
+		firstOnline bool
+		newOnline   bool
+	}{
+		{"allow multiple", AppSocket.AllowMultiple, true, true},
+		{"close oldest", AppSocket.CloseOldest, false, true},
+		{"close newest", AppSocket.CloseNewest, true, false},
+		{"error on duplicate", AppSocket.ErrorOnDuplicate, true, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}), userLabel,
+				AppSocket.WithDuplicateSessionPolicy(c.policy))
+			first := dialSocket(t, url+"first?user=u1")
+			waitOnline(t, socket, "first")
+			dialSocket(t, url+"other?user=u2")
+			waitOnline(t, socket, "other")
+
+			second, resp, err := websocket.DefaultDialer.Dial(url+"second?user=u1", nil)
+			if c.policy == AppSocket.ErrorOnDuplicate {
+				if err == nil || resp == nil || resp.StatusCode != http.StatusConflict {
+					t.Fatalf("expected 409, got %v", err)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { second.Close() })
+			}
+			if c.policy == AppSocket.CloseNewest {
+				if code := closeCode(second); code != AppSocket.CloseLoggedInElsewhere {
+					t.Fatalf("expected close code %d, got %d", AppSocket.CloseLoggedInElsewhere, code)
+				}
+			}
+			if c.policy == AppSocket.CloseOldest {
+				if code := closeCode(first); code != AppSocket.CloseLoggedInElsewhere {
+					t.Fatalf("expected close code %d, got %d", AppSocket.CloseLoggedInElsewhere, code)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			if c.newOnline {
+				waitOnline(t, socket, "second")
+			} else if socket.GetClientState("second") == AppSocket.OnlineState {
+				t.Fatal("duplicate connection should not be registered")
+			}
+			if online := socket.GetClientState("first") == AppSocket.OnlineState; online != c.firstOnline {
+				t.Fatalf("expected first connection online=%v", c.firstOnline)
+			}
+			if socket.GetClientState("other") != AppSocket.OnlineState {
+				t.Fatal("other users should not be affected")
+			}
+		})
+	}
+}
+
+func TestSocketRoomLimits(t *testing.T) {
+	events := make(chan AppSocket.RoomLimitEvent, 16)
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithRoomLimits(AppSocket.RoomLimits{InboundPerSecond: 2}),
+		AppSocket.WithRoomLimitHook(func(event AppSocket.RoomLimitEvent) { events <- event }))
+	sender := dialSocket(t, url+"sender")
+	listener := dialSocket(t, url+"listener")
+	waitOnline(t, socket, "sender")
+	waitOnline(t, socket, "listener")
+	rooms := socket.Rooms()
+	for _, key := range []string{"sender", "listener"} {
+		if err := rooms.Join("chat", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readText := func(conn *websocket.Conn) string {
+		t.Helper()
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	t.Run("inbound rejected", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			if err := rooms.SendFrom("chat", "sender", websocket.TextMessage, []byte("hi")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := rooms.SendFrom("chat", "sender", websocket.TextMessage, []byte("hi")); !errors.Is(err, AppSocket.ErrRateLimited) {
+			t.Fatalf("expected ErrRateLimited, got %v", err)
+		}
+		// 发送者先收到自己的两条广播，再收到拒绝通知
+		readText(sender)
+		readText(sender)
+		var notice map[string]any
+		if err := json.Unmarshal([]byte(readText(sender)), &notice); err != nil || notice["type"] != "rate_limited" || notice["rejected"] != true {
+			t.Fatalf("unexpected notice %v: %v", notice, err)
+		}
+		readText(listener)
+		readText(listener)
+		if event := <-events; event.Kind != AppSocket.RoomInboundRejected || event.Key != "sender" || event.Room != "chat" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+		room, _ := rooms.Room("chat")
+		if stats := room.Stats(); stats.InboundRejected != 1 || stats.Members != 2 {
+			t.Fatalf("unexpected room stats %+v", stats)
+		}
+	})
+
+	t.Run("broadcasts coalesced", func(t *testing.T) {
+		if err := rooms.SetRoomLimits("chat", AppSocket.RoomLimits{BroadcastsPerSecond: 5}); err != nil {
+			t.Fatal(err)
+		}
+		if rooms.RoomLimits("chat").InboundPerSecond != 0 {
+			t.Fatal("room override should replace the default limits")
+		}
+		// 上一个子测试的广播仍在当前窗口内，等窗口结束后第一条广播才会立即投递
+		time.Sleep(250 * time.Millisecond)
+		for i := 1; i <= 4; i++ {
+			if err := rooms.Broadcast("chat", websocket.TextMessage, []byte(fmt.Sprintf(`{"n":%d}`, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := readText(listener); got != `{"n":1}` {
+			t.Fatalf("first broadcast should be delivered immediately, got %s", got)
+		}
+		if got := readText(listener); got != `{"_coalesced":2,"n":4}` {
+			t.Fatalf("expected only the latest broadcast flagged as coalesced, got %s", got)
+		}
+		for i := 0; i < 2; i++ {
+			if event := <-events; event.Kind != AppSocket.RoomBroadcastCoalesced {
+				t.Fatalf("unexpected event %+v", event)
+			}
+		}
+		if stats := rooms.Stats(); stats.BroadcastsCoalesced != 2 || stats.InboundRejected != 1 {
+			t.Fatalf("unexpected manager stats %+v", stats)
+		}
+		if err := rooms.SetRoomLimits("chat", AppSocket.RoomLimits{InboundPerSecond: -1}); !errors.Is(err, AppSocket.ErrInvalidOption) {
+			t.Fatalf("expected ErrInvalidOption, got %v", err)
+		}
+	})
+}
+
+func TestSocketContentTypeNegotiation(t *testing.T) {
+	msgpack := &codec.MsgpackHandle{}
+	msgpack.RawToString = true
+	msgpack.WriteExt = true
+	routed := make(chan string, 4)
+	router := AppSocket.NewMessageRouter(nil)
+	AppSocket.Handle(router, "prompt", func(key string, payload chatPrompt) error {
+		routed <- key + ":" + payload.Prompt
+		return nil
+	})
+	socket, url := newSocketServer(t, AppSocket.WithHandler(router),
+		AppSocket.WithContentTypeNegotiation([]string{AppSocket.ContentTypeJSON, AppSocket.ContentTypeMsgPack}))
+	expectRouted := func(want string) {
+		t.Helper()
+		select {
+		case got := <-routed:
+			if got != want {
+				t.Fatalf("expected %s, got %s", want, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("route was not invoked")
+		}
+	}
+
+	t.Run("declared msgpack", func(t *testing.T) {
+		conn := dialSocket(t, url+"packed?content_type=application/msgpack")
+		waitOnline(t, socket, "packed")
+		var frame []byte
+		if err := codec.NewEncoderBytes(&frame, msgpack).Encode(map[string]any{
+			"type": "prompt",
+			"data": map[string]any{"conversation_id": "c1", "prompt": "hi"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.WriteMessage(websocket.BinaryMessage, frame)
+		expectRouted("packed:hi")
+
+		if err := socket.SendJSON("packed", chatPrompt{ConversationID: "c1", Prompt: "reply"}); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		mt, data, err := conn.ReadMessage()
+		if err != nil || mt != websocket.BinaryMessage {
+			t.Fatalf("expected a binary frame, got %d: %v", mt, err)
+		}
+		var reply map[string]any
+		if err = codec.NewDecoderBytes(data, msgpack).Decode(&reply); err != nil || reply["prompt"] != "reply" {
+			t.Fatalf("unexpected reply %v: %v", reply, err)
+		}
+	})
+
+	t.Run("first message decides", func(t *testing.T) {
+		conn := dialSocket(t, url+"plain")
+		waitOnline(t, socket, "plain")
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"prompt","data":{"prompt":"hello"}}`))
+		expectRouted("plain:hello")
+		if err := socket.SendJSON("plain", chatPrompt{Prompt: "reply"}); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if mt, data, err := conn.ReadMessage(); err != nil || mt != websocket.TextMessage || !strings.Contains(string(data), `"prompt":"reply"`) {
+			t.Fatalf("unexpected reply %d %s: %v", mt, data, err)
+		}
+	})
+
+	t.Run("unsupported content type", func(t *testing.T) {
+		_, resp, err := websocket.DefaultDialer.Dial(url+"csv?content_type=text/csv", nil)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnsupportedMediaType {
+			t.Fatalf("expected 415, got %v", err)
+		}
+	})
+}
+
+type pingPubSub struct {
+	*AppSocket.LocalPubSub
+	err atomic.Value
+}
+
+func (p *pingPubSub) Ping() error {
+	if err, ok := p.err.Load().(error); ok {
+		return err
+	}
+	return nil
+}
+
+func TestSocketHealth(t *testing.T) {
+	bus := &pingPubSub{LocalPubSub: AppSocket.NewLocalPubSub()}
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}), AppSocket.WithPubSub(bus),
+		AppSocket.WithHealthThresholds(AppSocket.HealthThresholds{MaxConnections: 2, MaxQueuePressure: 0.9}))
+	engine := gin.New()
+	engine.GET("/ready", socket.ReadyHandler())
+	probe := func() (int, AppSocket.HealthReport) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		var report AppSocket.HealthReport
+		if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		return recorder.Code, report
+	}
+
+	dialSocket(t, url+"a")
+	waitOnline(t, socket, "a")
+	if code, report := probe(); code != http.StatusOK || !report.Ready || report.Connections != 1 ||
+		report.Backplane == nil || !report.Backplane.Connected {
+		t.Fatalf("expected ready, got %d %+v", code, report)
+	}
+
+	dialSocket(t, url+"b")
+	waitOnline(t, socket, "b")
+	if code, report := probe(); code != http.StatusServiceUnavailable || report.Ready || len(report.Reasons) != 1 {
+		t.Fatalf("expected the connection cap to fail readiness, got %d %+v", code, report)
+	}
+	_ = socket.Close("b")
+	deadline := time.Now().Add(2 * time.Second)
+	for socket.Health().Connections != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	bus.err.Store(errors.New("connection refused"))
+	report := socket.Health()
+	if report.Ready || report.Backplane.Connected || report.Backplane.Error != "connection refused" {
+		t.Fatalf("expected the backplane to fail readiness, got %+v", report)
+	}
+}
+
+func TestSocketPing(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}))
+	reading := dialSocket(t, url+"reading")
+	go func() {
+		for {
+			if _, _, err := reading.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	dialSocket(t, url+"idle")
+	waitOnline(t, socket, "reading")
+	waitOnline(t, socket, "idle")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		if rtt, err := socket.Ping(ctx, "reading"); err != nil || rtt <= 0 {
+			t.Fatalf("unexpected ping result %s: %v", rtt, err)
+		}
+	}
+
+	// 客户端不读取时不会回复pong
+	short, cancelShort := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelShort()
+	if _, err := socket.Ping(short, "idle"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if _, err := socket.Ping(ctx, "missing"); !errors.Is(err, AppSocket.ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	client, _ := socket.Client("idle")
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Ping(ctx)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_ = socket.Close("idle")
+	if err := <-done; !errors.Is(err, AppSocket.ErrConnectionClosed) {
+		t.Fatalf("expected ErrConnectionClosed, got %v", err)
+	}
+}
+
+func TestSocketRoomHistoryAction(t *testing.T) {
+	store, _ := AppSocket.NewMemoryHistoryStore(AppSocket.HistoryRetention{MaxMessages: 10, MaxAge: time.Minute})
+	errs := make(chan error, 4)
+	router := AppSocket.NewMessageRouter(&AppSocket.HandlerFuncs{ErrorFunc: func(key string, err error) { errs <- err }})
+	router.HandleRoomHistory()
+	socket, url := newSocketServer(t, AppSocket.WithHandler(router),
+		AppSocket.WithMessageHistory(AppSocket.HistoryConfig{Store: store, Enabled: true}))
+	member := dialSocket(t, url+"member")
+	waitOnline(t, socket, "member")
+	outsider := dialSocket(t, url+"outsider")
+	waitOnline(t, socket, "outsider")
+	if err := socket.Rooms().Join("chat", "member"); err != nil {
+		t.Fatal(err)
+	}
+	_ = socket.Rooms().Broadcast("chat", websocket.TextMessage, []byte("one"))
+	_ = socket.Rooms().Broadcast("chat", websocket.BinaryMessage, []byte("two"))
+	_ = member.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for i := 0; i < 2; i++ {
+		if _, _, err := member.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	request := func(conn *websocket.Conn, room string) {
+		t.Helper()
+		data := fmt.Sprintf(`{"type":%q,"data":{"room":%q,"limit":10}}`, AppSocket.RoomHistoryAction, room)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectErr := func(want error) {
+		t.Helper()
+		select {
+		case err := <-errs:
+			if !errors.Is(err, want) {
+				t.Fatalf("expected %v, got %v", want, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected %v", want)
+		}
+	}
+
+	request(member, "chat")
+	_, data, err := member.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply AppSocket.RoomHistoryReply
+	if err = json.Unmarshal(data, &reply); err != nil {
+		t.Fatal(err)
+	}
+	messages := reply.Data.Messages
+	if reply.Type != AppSocket.RoomHistoryAction || reply.Data.Room != "chat" || len(messages) != 2 {
+		t.Fatalf("unexpected reply %s", data)
+	}
+	if messages[0].Text != "one" || string(messages[1].Binary) != "two" || messages[0].Seq >= messages[1].Seq {
+		t.Fatalf("unexpected history %+v", messages)
+	}
+
+	request(outsider, "chat")
+	expectErr(AppSocket.ErrNotRoomMember)
+	_ = outsider.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, data, err := outsider.ReadMessage(); err == nil {
+		t.Fatalf("non-member received history %s", data)
+	}
+
+	request(member, "missing")
+	expectErr(AppSocket.ErrRoomNotFound)
+}
+
+func TestSocketUpgradeTimeout(t *testing.T) {
+	handler := newRecordHandler()
+	socket, err := AppSocket.NewSocket(AppSocket.WithHandler(handler), AppSocket.WithUpgradeTimeout(time.Nanosecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	connectErr := make(chan error, 1)
+	engine := gin.New()
+	engine.GET("/socket/:key", func(ctx *gin.Context) {
+		connectErr <- socket.Connect(ctx, ctx.Param("key"))
+	})
+	srv := httptest.NewServer(engine)
+	t.Cleanup(srv.Close)
+
+	// 截止时间在写出101响应之前已经过去，相当于客户端迟迟不读取握手响应
+	if conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/socket/stalled", nil); err == nil {
+		_ = conn.Close()
+		t.Fatal("handshake should not complete after the upgrade timeout")
+	}
+	select {
+	case err = <-connectErr:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connect did not return")
+	}
+	if !errors.Is(err, AppSocket.ErrUpgradeFailed) || !errors.Is(err, AppSocket.ErrUpgradeTimeout) {
+		t.Fatalf("expected ErrUpgradeFailed and ErrUpgradeTimeout, got %v", err)
+	}
+	if _, err = socket.Client("stalled"); err == nil || socket.GetClientState("stalled") == AppSocket.OnlineState {
+		t.Fatal("timed out connection was registered")
+	}
+	select {
+	case key := <-handler.closed:
+		t.Fatalf("OnClose called for unregistered connection %s", key)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSocketMigrationToken(t *testing.T) {
+	signer, err := AppSocket.NewMigrationSigner(time.Minute, nil,
+		AppSocket.MigrationKey{ID: "k1", Secret: []byte(strings.Repeat("s", 32))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, _ := AppSocket.NewMemoryHistoryStore(AppSocket.HistoryRetention{MaxMessages: 10, MaxAge: time.Minute})
+	history := AppSocket.WithMessageHistory(AppSocket.HistoryConfig{Store: store, Enabled: true})
+	draining, oldURL := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}), history,
+		AppSocket.WithMigrationIssuer(signer),
+		AppSocket.WithLabelExtractor(func(ctx *gin.Context) map[string]string {
+			return map[string]string{AppSocket.SessionLabel: ctx.Query("user")}
+		}))
+	fresh, newURL := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}), history,
+		AppSocket.WithMigrationAcceptor(signer))
+
+	conn := dialSocket(t, oldURL+"session-1?user=u1")
+	waitOnline(t, draining, "session-1")
+	if err = draining.Rooms().Join("chat", "session-1"); err != nil {
+		t.Fatal(err)
+	}
+	_ = draining.Rooms().Broadcast("chat", websocket.TextMessage, []byte("delivered"))
+	if err = draining.RequestReconnect("session-1"); err != nil {
+		t.Fatal(err)
+	}
+	var notice struct {
+		Code   int               `json:"code"`
+		Detail map[string]string `json:"detail"`
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for notice.Code == 0 {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = json.Unmarshal(data, &notice)
+	}
+	token := notice.Detail[AppSocket.MigrationTokenParam]
+	if notice.Code != AppSocket.CloseServerDraining || token == "" {
+		t.Fatalf("unexpected reconnect notice %+v", notice)
+	}
+	// 重连之前房间里又产生了一条广播
+	_, _ = store.Append("chat", AppSocket.StoredMessage{MessageType: websocket.TextMessage, Data: []byte("missed")})
+
+	migrated := dialSocket(t, newURL+"session-2?migration_token="+token)
+	waitOnline(t, fresh, "session-1")
+	room, ok := fresh.Rooms().Room("chat")
+	if !ok || len(room.Members()) != 1 {
+		t.Fatal("room membership was not restored")
+	}
+	if info, _ := fresh.Info("session-1"); info.Labels[AppSocket.SessionLabel] != "u1" {
+		t.Fatalf("user binding was not restored: %v", info.Labels)
+	}
+	_ = migrated.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, data, err := migrated.ReadMessage(); err != nil || string(data) != "missed" {
+		t.Fatalf("expected only the missed broadcast to be replayed, got %q: %v", data, err)
+	}
+
+	dialSocket(t, newURL+"session-3?migration_token="+token)
+	waitOnline(t, fresh, "session-3")
+	if _, err = signer.Verify(token[:len(token)-2] + "xx"); !errors.Is(err, AppSocket.ErrInvalidMigrationToken) {
+		t.Fatalf("expected a tampered token to be rejected, got %v", err)
+	}
+}
+
+func TestSocketStrictOrdering(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}), AppSocket.WithStrictOrdering(true))
+	conn := dialSocket(t, url+"ordered")
+	waitOnline(t, socket, "ordered")
+
+	const senders, each = 4, 10
+	var wg sync.WaitGroup
+	for g := 0; g < senders; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				_ = socket.SendTo("ordered", websocket.TextMessage, []byte(fmt.Sprintf(`{"g":%d,"i":%d}`, g, i)))
+			}
+		}(g)
+	}
+	wg.Wait()
+	_ = socket.SendTo("ordered", websocket.BinaryMessage, []byte{1, 2, 3})
+	_ = socket.SendTo("ordered", websocket.TextMessage, []byte(`{"last":true}`))
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var expected int64 = 1
+	for expected <= senders*each+1 {
+		mt, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mt == websocket.BinaryMessage {
+			if !bytes.Equal(data, []byte{1, 2, 3}) {
+				t.Fatalf("binary message should not be stamped, got %v", data)
+			}
+			continue
+		}
+		var msg struct {
+			Seq int64 `json:"_seq"`
+		}
+		if err = json.Unmarshal(data, &msg); err != nil || msg.Seq != expected {
+			t.Fatalf("expected _seq %d, got %s: %v", expected, data, err)
+		}
+		expected++
+	}
+	if stats, _ := socket.Stats("ordered"); stats.OutOfOrderMessagesSent != 0 {
+		t.Fatalf("unexpected out of order count %d", stats.OutOfOrderMessagesSent)
+	}
+}
+
+// frameRecorder 记录客户端从底层连接读到的原始字节，用于检查帧头
+type frameRecorder struct {
+	net.Conn
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (r *frameRecorder) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	r.mu.Lock()
+	r.buf.Write(p[:n])
+	r.mu.Unlock()
+	return n, err
+}
+
+// rsv1Bits 跳过握手响应，按顺序返回每个服务端数据帧的RSV1位(压缩标志)
+func (r *frameRecorder) rsv1Bits() []bool {
+	r.mu.Lock()
+	raw := append([]byte(nil), r.buf.Bytes()...)
+	r.mu.Unlock()
+	_, frames, _ := bytes.Cut(raw, []byte("\r\n\r\n"))
+	var bits []bool
+	for len(frames) >= 2 {
+		header, length := 2, int(frames[1]&0x7f)
+		switch length {
+		case 126:
+			length, header = int(binary.BigEndian.Uint16(frames[2:4])), 4
+		case 127:
+			length, header = int(binary.BigEndian.Uint64(frames[2:10])), 10
+		}
+		if len(frames) < header+length {
+			break
+		}
+		if opcode := frames[0] & 0x0f; opcode == websocket.TextMessage || opcode == websocket.BinaryMessage {
+			bits = append(bits, frames[0]&0x40 != 0)
+		}
+		frames = frames[header+length:]
+	}
+	return bits
+}
+
+func TestSocketPerMessageCompression(t *testing.T) {
+	for _, flush := range []time.Duration{0, 20 * time.Millisecond} {
+		t.Run(fmt.Sprint("flush ", flush), func(t *testing.T) {
+			opts := []AppSocket.SocketOptionFunc{AppSocket.WithHandler(AppSocket.BaseHandler{}), AppSocket.WithEnableCompression(true)}
+			if flush > 0 {
+				opts = append(opts, AppSocket.WithFlushInterval(flush))
+			}
+			socket, url := newSocketServer(t, opts...)
+			recorder := &frameRecorder{}
+			dialer := websocket.Dialer{
+				EnableCompression: true,
+				NetDial: func(network, addr string) (net.Conn, error) {
+					conn, err := net.Dial(network, addr)
+					recorder.Conn = conn
+					return recorder, err
+				},
+			}
+			conn, _, err := dialer.Dial(url+"compress", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			waitOnline(t, socket, "compress")
+
+			off, on := false, true
+			snapshot := []byte(`{"state":"` + strings.Repeat("a", 512) + `"}`)
+			sends := []*bool{nil, &off, &off, &on}
+			for _, compress := range sends {
+				if err = socket.SendToOpt("compress", websocket.TextMessage, snapshot, AppSocket.SendOpts{Compress: compress}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// 默认设置在单条消息之后恢复
+			if err = socket.SendTo("compress", websocket.TextMessage, snapshot); err != nil {
+				t.Fatal(err)
+			}
+			want := []bool{true, false, false, true, true}
+			if flush > 0 {
+				// 压缩选项相同的相邻消息合并：nil | off,off | on,nil
+				want = []bool{true, false, true}
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			for range want {
+				if _, _, err = conn.ReadMessage(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := recorder.rsv1Bits(); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("expected RSV1 bits %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestSocketDowngradeEncoder(t *testing.T) {
+	rename := func(from, to string) func([]byte) ([]byte, error) {
+		return func(msg []byte) ([]byte, error) {
+			return bytes.ReplaceAll(msg, []byte(from), []byte(to)), nil
+		}
+	}
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithSchemaVersion(3),
+		AppSocket.WithDowngradeEncoder(1, rename(`"name"`, `"title"`)),
+		AppSocket.WithDowngradeEncoder(2, rename(`"full_name"`, `"name"`)),
+	)
+	clients := map[string]string{
+		"v3":     `{"full_name":"x"}`,
+		"v2":     `{"name":"x"}`,
+		"v1":     `{"title":"x"}`,
+		"legacy": `{"title":"x"}`,
+	}
+	conns := map[string]*websocket.Conn{
+		"v3":     dialSocket(t, url+"v3"),
+		"v2":     dialSocket(t, url+"v2?schema_version=2"),
+		"v1":     dialSocket(t, url+"v1?schema_version=1"),
+		"legacy": dialSocket(t, url+"legacy?schema_version=0"),
+	}
+	for key, conn := range conns {
+		waitOnline(t, socket, key)
+		_ = socket.SendTo(key, websocket.TextMessage, []byte(`{"full_name":"x"}`))
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != clients[key] {
+			t.Fatalf("%s: expected %s, got %s", key, clients[key], data)
+		}
+	}
+	if client, _ := socket.Client("v1"); client.SchemaVersion() != 1 {
+		t.Fatalf("expected schema version 1, got %d", client.SchemaVersion())
+	}
+
+	if _, err := AppSocket.NewSocket(AppSocket.WithSchemaVersion(2), AppSocket.WithDowngradeEncoder(2, rename("a", "b"))); !errors.Is(err, AppSocket.ErrInvalidOption) {
+		t.Fatalf("expected ErrInvalidOption, got %v", err)
+	}
+}
+
+func TestSocketCodecSelection(t *testing.T) {
+	msgpack := &codec.MsgpackHandle{}
+	msgpack.RawToString = true
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithCodecs(map[string]AppSocket.Codec{"json": AppSocket.JSONCodec, "msgpack": AppSocket.MsgPackCodec}))
+	readWelcome := func(t *testing.T, conn *websocket.Conn, wantType int, wantCodec string) {
+		t.Helper()
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		mt, data, err := conn.ReadMessage()
+		if err != nil || mt != wantType {
+			t.Fatalf("expected frame type %d, got %d: %v", wantType, mt, err)
+		}
+		var welcome struct {
+			Type string `json:"type"`
+			Data struct {
+				Codec string `json:"codec"`
+			} `json:"data"`
+		}
+		if mt == websocket.BinaryMessage {
+			err = codec.NewDecoderBytes(data, msgpack).Decode(&welcome)
+		} else {
+			err = json.Unmarshal(data, &welcome)
+		}
+		if err != nil || welcome.Type != "welcome" || welcome.Data.Codec != wantCodec {
+			t.Fatalf("unexpected welcome %+v: %v", welcome, err)
+		}
+	}
+
+	cases := []struct {
+		name     string
+		path     string
+		header   http.Header
+		mt       int
+		codec    string
+		protocol string
+	}{
+		{name: "default", path: "plain", mt: websocket.TextMessage, codec: "json"},
+		{name: "query", path: "query?codec=msgpack", mt: websocket.BinaryMessage, codec: "msgpack"},
+		{name: "header", path: "header", header: http.Header{"X-WS-Codec": {"msgpack"}}, mt: websocket.BinaryMessage, codec: "msgpack"},
+		{name: "subprotocol", path: "proto", header: http.Header{"Sec-WebSocket-Protocol": {"v2.chat, msgpack"}}, mt: websocket.BinaryMessage, codec: "msgpack", protocol: "msgpack"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn, _, err := websocket.DefaultDialer.Dial(url+c.path, c.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if conn.Subprotocol() != c.protocol {
+				t.Fatalf("expected subprotocol %q, got %q", c.protocol, conn.Subprotocol())
+			}
+			readWelcome(t, conn, c.mt, c.codec)
+			key, _, _ := strings.Cut(c.path, "?")
+			client, err := socket.Client(key)
+			if err != nil || client.CodecName() != c.codec || client.Codec().MessageType() != c.mt {
+				t.Fatalf("unexpected codec on %s: %v", key, err)
+			}
+			if protocol, err := socket.Subprotocol(key); err != nil || protocol != c.protocol {
+				t.Fatalf("expected negotiated subprotocol %q, got %q: %v", c.protocol, protocol, err)
+			}
+		})
+	}
+
+	if _, err := socket.Subprotocol("missing"); !errors.Is(err, AppSocket.ErrConnectionClosed) {
+		t.Fatalf("expected ErrConnectionClosed, got %v", err)
+	}
+	_, resp, err := websocket.DefaultDialer.Dial(url+"unknown?codec=cbor", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown codec, got %v: %v", resp, err)
+	}
+	if _, err = AppSocket.NewSocket(AppSocket.WithCodecs(map[string]AppSocket.Codec{"msgpack": AppSocket.MsgPackCodec})); !errors.Is(err, AppSocket.ErrInvalidOption) {
+		t.Fatalf("expected ErrInvalidOption without a default codec, got %v", err)
+	}
+}
+
+func TestSocketHealthScore(t *testing.T) {
+	score := AppSocket.DefaultHealthScore(AppSocket.SocketStats{HeartbeatFailures: 2, HeartbeatFailMaxTimes: 4, PingRTT: 500 * time.Millisecond})
+	if math.Abs(score-0.5) > 1e-9 {
+		t.Fatalf("expected 0.5, got %v", score)
+	}
+
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}))
+	healthy := dialSocket(t, url+"healthy")
+	go func() {
+		for {
+			if _, _, err := healthy.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	waitOnline(t, socket, "healthy")
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := socket.Ping(ctx, "healthy"); err != nil {
+		t.Fatal(err)
+	}
+	if score, err := socket.HealthScore("healthy"); err != nil || score < 0.9 || score > 1 {
+		t.Fatalf("expected a healthy score, got %v: %v", score, err)
+	}
+	if _, err := socket.HealthScore("missing"); err == nil {
+		t.Fatal("expected an error for a missing connection")
+	}
+
+	custom, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithHealthScoreFormula(func(stats AppSocket.SocketStats) float64 {
+			if stats.Key == "vip" {
+				return 2
+			}
+			return -1
+		}))
+	dialSocket(t, url+"vip")
+	dialSocket(t, url+"guest")
+	waitOnline(t, custom, "vip")
+	waitOnline(t, custom, "guest")
+	if score, _ := custom.HealthScore("vip"); score != 1 {
+		t.Fatalf("expected the score clamped to 1, got %v", score)
+	}
+	if score, _ := custom.HealthScore("guest"); score != 0 {
+		t.Fatalf("expected the score clamped to 0, got %v", score)
+	}
+}
+
+func TestSocketSlowStart(t *testing.T) {
+	received := func(h *recordHandler) int {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return len(h.messages)
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		handler := newRecordHandler()
+		socket, url := newSocketServer(t, AppSocket.WithHandler(handler),
+			AppSocket.WithSlowStart(2, time.Minute), AppSocket.WithSlowStartPolicy(AppSocket.SlowStartReject))
+		conn := dialSocket(t, url+"burst")
+		waitOnline(t, socket, "burst")
+		for i := 0; i < 5; i++ {
+			_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"sync"}`))
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for i := 0; i < 3; i++ {
+			var notice struct {
+				Type         string `json:"type"`
+				Reason       string `json:"reason"`
+				RetryAfterMs int64  `json:"retry_after_ms"`
+			}
+			if err := conn.ReadJSON(&notice); err != nil || notice.Type != "rate_limited" || notice.Reason != "slow_start" || notice.RetryAfterMs <= 0 {
+				t.Fatalf("unexpected notice %+v: %v", notice, err)
+			}
+		}
+		if got := received(handler); got != 2 {
+			t.Fatalf("expected 2 messages within the budget, got %d", got)
+		}
+		if stats := socket.SlowStartStats(); stats.Rejected != 3 || stats.Deferred != 0 {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("defer", func(t *testing.T) {
+		handler := newRecordHandler()
+		socket, url := newSocketServer(t, AppSocket.WithHandler(handler),
+			AppSocket.WithSlowStart(2, time.Second), AppSocket.WithSlowStartGlobalBudget(100))
+		conn := dialSocket(t, url+"deferred")
+		waitOnline(t, socket, "deferred")
+		start := time.Now()
+		for i := 0; i < 4; i++ {
+			_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"sync"}`))
+		}
+		deadline := time.Now().Add(3 * time.Second)
+		for received(handler) < 4 {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected all 4 messages, got %d", received(handler))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+			t.Fatalf("deferred messages were released too early after %s", elapsed)
+		}
+		if stats := socket.SlowStartStats(); stats.Deferred != 2 || stats.Rejected != 0 {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+	})
+
+	if _, err := AppSocket.NewSocket(AppSocket.WithSlowStartGlobalBudget(10)); !errors.Is(err, AppSocket.ErrInvalidOption) {
+		t.Fatalf("expected ErrInvalidOption, got %v", err)
+	}
+}
+
+func TestSocketSerializer(t *testing.T) {
+	cbor := &codec.CborHandle{}
+	routed := make(chan string, 1)
+	router := AppSocket.NewMessageRouter(nil)
+	AppSocket.Handle(router, "prompt", func(key string, payload chatPrompt) error {
+		routed <- key + ":" + payload.Prompt
+		return nil
+	})
+	socket, url := newSocketServer(t, AppSocket.WithHandler(router), AppSocket.WithSerializer(AppSocket.CborSerializer{}))
+	conn := dialSocket(t, url+"cbor")
+	waitOnline(t, socket, "cbor")
+
+	var frame []byte
+	if err := codec.NewEncoderBytes(&frame, cbor).Encode(map[string]any{
+		"type": "prompt",
+		"data": map[string]any{"conversation_id": "c1", "prompt": "hi"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.WriteMessage(websocket.BinaryMessage, frame)
+	select {
+	case got := <-routed:
+		if got != "cbor:hi" {
+			t.Fatalf("unexpected route %s", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("route was not invoked")
+	}
+
+	if err := socket.SendJSON("cbor", chatPrompt{ConversationID: "c1", Prompt: "reply"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, field := range []string{"prompt", "reason"} {
+		if field == "reason" {
+			if err := socket.CloseWithReason("cbor", AppSocket.CloseServerDraining, "bye", nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mt, data, err := conn.ReadMessage()
+		if err != nil || mt != websocket.BinaryMessage {
+			t.Fatalf("expected a binary frame, got %d: %v", mt, err)
+		}
+		var decoded map[string]any
+		if err = codec.NewDecoderBytes(data, cbor).Decode(&decoded); err != nil || decoded[field] == nil {
+			t.Fatalf("expected %s in %v: %v", field, decoded, err)
+		}
+	}
+
+	if _, err := AppSocket.NewSocket(AppSocket.WithSerializer(AppSocket.MsgPackSerializer{}),
+		AppSocket.WithContentTypeNegotiation([]string{AppSocket.ContentTypeJSON})); !errors.Is(err, AppSocket.ErrInvalidOption) {
+		t.Fatalf("expected ErrInvalidOption, got %v", err)
+	}
+}
+
+func TestSocketStatsInterval(t *testing.T) {
+	connStats := make(chan AppSocket.SocketStats, 8)
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithStatsInterval(time.Second, func(stats AppSocket.SocketStats) { connStats <- stats }))
+	hubStats := make(chan AppSocket.HubStats, 8)
+	stop, err := socket.OnStats(time.Second, func(stats AppSocket.HubStats) { hubStats <- stats })
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := dialSocket(t, url+"periodic")
+	waitOnline(t, socket, "periodic")
+
+	select {
+	case stats := <-connStats:
+		if stats.Key != "periodic" {
+			t.Fatalf("unexpected connection stats %+v", stats)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection stats callback was not invoked")
+	}
+	select {
+	case stats := <-hubStats:
+		if stats.Connections != 1 {
+			t.Fatalf("expected 1 connection, got %+v", stats)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("hub stats callback was not invoked")
+	}
+
+	stop()
+	_ = conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for socket.GetClientState("periodic") == AppSocket.OnlineState && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for len(connStats) > 0 {
+		<-connStats
+	}
+	for len(hubStats) > 0 {
+		<-hubStats
+	}
+	select {
+	case stats := <-connStats:
+		t.Fatalf("callback fired after close: %+v", stats)
+	case stats := <-hubStats:
+		t.Fatalf("callback fired after stop: %+v", stats)
+	case <-time.After(1200 * time.Millisecond):
+	}
+
+	if _, err = socket.OnStats(100*time.Millisecond, func(AppSocket.HubStats) {}); !errors.Is(err, AppSocket.ErrInvalidOption) {
+		t.Fatalf("expected ErrInvalidOption, got %v", err)
+	}
+	if _, err = AppSocket.NewSocket(AppSocket.WithStatsInterval(time.Millisecond, func(AppSocket.SocketStats) {})); !errors.Is(err, AppSocket.ErrInvalidOption) {
+		t.Fatalf("expected ErrInvalidOption, got %v", err)
+	}
+}
+
+func TestCloseCodeDescription(t *testing.T) {
+	cases := map[int]string{
+		websocket.CloseAbnormalClosure: "abnormal closure: connection dropped without a close frame",
+		AppSocket.CloseSlowConsumer:    "slow consumer",
+		websocket.CloseTryAgainLater:   "try again later",
+		4500:                           "application close code 4500",
+		3001:                           "registered close code 3001",
+		2000:                           "unknown close code 2000",
+	}
+	for code, want := range cases {
+		if got := AppSocket.CloseCodeDescription(code); got != want {
+			t.Fatalf("code %d: expected %q, got %q", code, want, got)
+		}
+	}
+
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}))
+	dialSocket(t, url+"slow")
+	dropped := dialSocket(t, url+"dropped")
+	waitOnline(t, socket, "slow")
+	waitOnline(t, socket, "dropped")
+	slow, _ := socket.Client("slow")
+	gone, _ := socket.Client("dropped")
+	if stats := slow.Stats(); stats.LastCloseCode != 0 || stats.LastCloseReason != "" {
+		t.Fatalf("unexpected close on a live connection %+v", stats)
+	}
+
+	_ = socket.CloseWithReason("slow", AppSocket.CloseSlowConsumer, "queue full", nil)
+	_ = dropped.UnderlyingConn().Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for gone.State() == AppSocket.OnlineState && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := slow.Stats(); stats.LastCloseCode != AppSocket.CloseSlowConsumer || stats.LastCloseReason != "slow consumer" {
+		t.Fatalf("unexpected close stats %+v", stats)
+	}
+	if code, reason := slow.LastClose(); code != AppSocket.CloseSlowConsumer || reason != "queue full" {
+		t.Fatalf("unexpected last close %d %q", code, reason)
+	}
+	if stats := gone.Stats(); stats.LastCloseCode != websocket.CloseAbnormalClosure {
+		t.Fatalf("expected an abnormal closure, got %+v", stats)
+	}
+}
+
+func TestSocketBroadcastWhere(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithLabelExtractor(func(ctx *gin.Context) map[string]string {
+			return map[string]string{"country": ctx.Query("country"), "version": ctx.Query("version")}
+		}))
+	conns := map[string]*websocket.Conn{
+		"de2": dialSocket(t, url+"de2?country=DE&version=2"),
+		"de1": dialSocket(t, url+"de1?country=DE&version=1"),
+		"fr2": dialSocket(t, url+"fr2?country=FR&version=2"),
+	}
+	for key := range conns {
+		waitOnline(t, socket, key)
+	}
+	result := socket.BroadcastWhere(func(view AppSocket.ConnView) bool {
+		version, _ := strconv.Atoi(view.Label("version"))
+		return view.Label("country") == "DE" && version >= 2
+	}, websocket.TextMessage, []byte("hallo"))
+	if result.Matched != 1 || result.Sent != 1 || len(result.Failed) != 0 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	_ = conns["de2"].SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, data, err := conns["de2"].ReadMessage(); err != nil || string(data) != "hallo" {
+		t.Fatalf("expected hallo, got %s: %v", data, err)
+	}
+	_ = conns["de1"].SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, data, err := conns["de1"].ReadMessage(); err == nil {
+		t.Fatalf("unexpected message %s", data)
+	}
+
+	result = socket.BroadcastWhere(func(view AppSocket.ConnView) bool {
+		if view.ID() == "fr2" {
+			panic("bad predicate")
+		}
+		return false
+	}, websocket.TextMessage, []byte("x"))
+	if result.Matched != 0 {
+		t.Fatalf("a panicking predicate should not match, got %+v", result)
+	}
+}
+
+// BenchmarkSocketBroadcastWhere 谓词遍历的开销，连接数由WS_BENCH_CONNS设置(默认1000)，
+// 例如WS_BENCH_CONNS=50000 go test -bench BroadcastWhere ./test/websocket_test.go，需要足够的文件描述符
+func BenchmarkSocketBroadcastWhere(b *testing.B) {
+	n := 1000
+	if v, err := strconv.Atoi(os.Getenv("WS_BENCH_CONNS")); err == nil && v > 0 {
+		n = v
+	}
+	gin.SetMode(gin.TestMode)
+	socket, err := AppSocket.NewSocket(AppSocket.WithHandler(AppSocket.BaseHandler{}), AppSocket.WithPingPeriod(-1),
+		AppSocket.WithAllowNoLiveness(), AppSocket.WithNoReadDeadline())
+	if err != nil {
+		b.Fatal(err)
+	}
+	engine := gin.New()
+	engine.GET("/socket/:key", func(ctx *gin.Context) {
+		_ = socket.Connect(ctx, ctx.Param("key"))
+	})
+	srv := httptest.NewServer(engine)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/socket/"
+	for i := 0; i < n; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(url+strconv.Itoa(i), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	for len(socket.GetAllKeys()) < n {
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		socket.BroadcastWhere(func(view AppSocket.ConnView) bool {
+			return view.Label("country") == "DE"
+		}, websocket.TextMessage, []byte("x"))
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N)/float64(n), "ns/conn")
+}
+
+func TestSocketSendWithAck(t *testing.T) {
+	handler := newRecordHandler()
+	socket, url := newSocketServer(t, AppSocket.WithHandler(handler), AppSocket.WithMaxPendingAcks(1),
+		AppSocket.WithLabelExtractor(func(ctx *gin.Context) map[string]string {
+			return map[string]string{AppSocket.SessionLabel: ctx.Query("user")}
+		}))
+	phone := dialSocket(t, url+"phone?user=u1")
+	laptop := dialSocket(t, url+"laptop?user=u1")
+	waitOnline(t, socket, "phone")
+	waitOnline(t, socket, "laptop")
+
+	autoAck := func(conn *websocket.Conn) {
+		for {
+			if _, _, err := AppSocket.ReadMessageAck(conn); err != nil {
+				return
+			}
+		}
+	}
+	go autoAck(phone)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	client, _ := socket.Client("phone")
+	if err := client.SendWithAck(ctx, websocket.TextMessage, []byte(`{"type":"payment","status":"ok"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SendWithAck(ctx, websocket.BinaryMessage, []byte{1}); !errors.Is(err, AppSocket.ErrInvalidPayload) {
+		t.Fatalf("expected ErrInvalidPayload, got %v", err)
+	}
+
+	// laptop不回复确认
+	short, cancelShort := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancelShort()
+	results, err := socket.SendToUserWithAck(short, "u1", websocket.TextMessage, []byte(`{"type":"payment"}`))
+	if err != nil || len(results) != 2 || results["phone"] != nil || !errors.Is(results["laptop"], context.DeadlineExceeded) {
+		t.Fatalf("unexpected results %v: %v", results, err)
+	}
+	if _, err = socket.SendToUserWithAck(ctx, "nobody", websocket.TextMessage, []byte(`{}`)); !errors.Is(err, AppSocket.ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	waiting, _ := socket.Client("laptop")
+	done := make(chan error, 1)
+	go func() { done <- waiting.SendWithAck(context.Background(), websocket.TextMessage, []byte(`{"n":1}`)) }()
+	time.Sleep(100 * time.Millisecond)
+	if err = waiting.SendWithAck(ctx, websocket.TextMessage, []byte(`{"n":2}`)); !errors.Is(err, AppSocket.ErrTooManyPendingAcks) {
+		t.Fatalf("expected ErrTooManyPendingAcks, got %v", err)
+	}
+	_ = laptop.Close()
+	select {
+	case err = <-done:
+		if !errors.Is(err, AppSocket.ErrConnectionClosed) {
+			t.Fatalf("expected ErrConnectionClosed, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("pending ack was not released on close")
+	}
+
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if len(handler.messages) != 0 {
+		t.Fatalf("ack frames should not reach OnMessage, got %d messages", len(handler.messages))
+	}
+}
+
+func TestSocketDrain(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}), AppSocket.WithDrainGracePeriod(time.Minute))
+	first := dialSocket(t, url+"first")
+	second := dialSocket(t, url+"second")
+	waitOnline(t, socket, "first")
+	waitOnline(t, socket, "second")
+
+	socket.StartDrain("deploy")
+	socket.StartDrain("deploy")
+	for _, conn := range []*websocket.Conn{first, second} {
+		var notice struct {
+			Type       string    `json:"type"`
+			Reason     string    `json:"reason"`
+			ShutdownAt time.Time `json:"shutdown_at"`
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if err := conn.ReadJSON(&notice); err != nil || notice.Type != "draining" || notice.Reason != "deploy" || time.Until(notice.ShutdownAt) < 30*time.Second {
+			t.Fatalf("unexpected notice %+v: %v", notice, err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, data, err := conn.ReadMessage(); err == nil {
+			t.Fatalf("announcement should be delivered once, got %s", data)
+		}
+	}
+	if socket.GetClientState("first") != AppSocket.OnlineState {
+		t.Fatal("existing connections should keep working during drain")
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(url+"late", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After, got %v: %v", resp, err)
+	}
+	if report := socket.Health(); report.Ready || !report.Drain.Draining || report.Drain.Reason != "deploy" {
+		t.Fatalf("unexpected health report %+v", report)
+	}
+
+	socket.StopDrain()
+	dialSocket(t, url+"late")
+	waitOnline(t, socket, "late")
+	if report := socket.Health(); !report.Ready || report.Drain.Draining {
+		t.Fatalf("unexpected health report after StopDrain %+v", report)
+	}
+}
+
+func TestSocketOrderedBatch(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}))
+	viewer := dialSocket(t, url+"viewer")
+	speaker := dialSocket(t, url+"speaker")
+	waitOnline(t, socket, "viewer")
+	waitOnline(t, socket, "speaker")
+	viewerClient, _ := socket.Client("viewer")
+	speakerClient, _ := socket.Client("speaker")
+
+	batch := AppSocket.NewOrderedBatch()
+	batch.Add(viewerClient, websocket.TextMessage, []byte("text"))
+	batch.Add(speakerClient, websocket.BinaryMessage, []byte("audio"))
+	batch.Add(viewerClient, websocket.BinaryMessage, []byte("image"))
+	if err := batch.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if batch.Len() != 0 {
+		t.Fatalf("expected an empty batch after Flush, got %d", batch.Len())
+	}
+	expect := func(conn *websocket.Conn, wantType int, want string) {
+		t.Helper()
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		mt, data, err := conn.ReadMessage()
+		if err != nil || mt != wantType || string(data) != want {
+			t.Fatalf("expected %s, got %d %s: %v", want, mt, data, err)
+		}
+	}
+	expect(viewer, websocket.TextMessage, "text")
+	expect(viewer, websocket.BinaryMessage, "image")
+	expect(speaker, websocket.BinaryMessage, "audio")
+
+	_ = socket.Close("speaker")
+	batch.Add(viewerClient, websocket.TextMessage, []byte("late"))
+	batch.Add(speakerClient, websocket.TextMessage, []byte("late"))
+	if err := batch.Flush(); !errors.Is(err, AppSocket.ErrConnectionClosed) {
+		t.Fatalf("expected ErrConnectionClosed, got %v", err)
+	}
+}
+
+func TestSocketIDGenerator(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var next atomic.Value
+	next.Store("dc1-a")
+	socket, err := AppSocket.NewSocket(AppSocket.WithHandler(AppSocket.BaseHandler{}), AppSocket.WithIDGenerator(func(*gin.Context) string {
+		return next.Load().(string)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := gin.New()
+	engine.GET("/socket", func(ctx *gin.Context) {
+		_ = socket.Connect(ctx, "")
+	})
+	srv := httptest.NewServer(engine)
+	t.Cleanup(srv.Close)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/socket"
+
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	waitOnline(t, socket, "dc1-a")
+	client, _ := socket.Client("dc1-a")
+	if got := resp.Header.Get(AppSocket.ConnectionIDHeader); got != client.ID() {
+		t.Fatalf("header %q does not match client id %q", got, client.ID())
+	}
+	var welcome struct {
+		Type string `json:"type"`
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.ReadJSON(&welcome); err != nil || welcome.Type != "welcome" || welcome.Data.ID != "dc1-a" {
+		t.Fatalf("unexpected welcome %+v: %v", welcome, err)
+	}
+
+	if _, resp, err = websocket.DefaultDialer.Dial(url, nil); err == nil || resp == nil || resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 for a duplicate id, got %v: %v", resp, err)
+	}
+	next.Store("")
+	if _, resp, err = websocket.DefaultDialer.Dial(url, nil); err == nil || resp == nil || resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected 500 for an empty id, got %v: %v", resp, err)
+	}
+}
+
+func TestNewULID(t *testing.T) {
+	first := AppSocket.NewULID()
+	time.Sleep(2 * time.Millisecond)
+	second := AppSocket.NewULID()
+	if len(first) != 26 || len(second) != 26 || first == second || first[:10] > second[:10] {
+		t.Fatalf("unexpected ulids %s %s", first, second)
+	}
+}
+
+type countingPool struct {
+	submitted atomic.Int32
+}
+
+func (p *countingPool) Submit(task func()) error {
+	p.submitted.Add(1)
+	go task()
+	return nil
+}
+
+func TestSocketHeartbeatExecutor(t *testing.T) {
+	pool := &countingPool{}
+	socket, url := newSocketServer(t,
+		AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithPingPeriod(50*time.Millisecond),
+		AppSocket.WithHeartbeatExecutor(pool),
+		AppSocket.WithHeartbeatGoroutineLabel("hb-test"),
+	)
+	conn := dialSocket(t, url+"hb")
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	waitOnline(t, socket, "hb")
+	deadline := time.Now().Add(2 * time.Second)
+	for pool.submitted.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if pool.submitted.Load() < 3 {
+		t.Fatalf("expected pings to go through the pool, got %d", pool.submitted.Load())
+	}
+	if socket.GetClientState("hb") != AppSocket.OnlineState {
+		t.Fatal("connection should stay online")
+	}
+	var profile bytes.Buffer
+	_ = pprof.Lookup("goroutine").WriteTo(&profile, 1)
+	if !strings.Contains(profile.String(), `"ws_heartbeat":"hb-test"`) {
+		t.Fatal("expected the write loop to carry the heartbeat label")
+	}
+
+	if _, err := AppSocket.NewSocket(AppSocket.WithHandler(AppSocket.BaseHandler{}), AppSocket.WithPingPeriod(-1), AppSocket.WithHeartbeatExecutor(pool)); !errors.Is(err, AppSocket.ErrInvalidOption) {
+		t.Fatalf("expected ErrInvalidOption, got %v", err)
+	}
+}
+
+func TestSocketIsolatePanics(t *testing.T) {
+	received := make(chan string, 4)
+	errs := make(chan error, 8)
+	socket, url := newSocketServer(t,
+		AppSocket.WithIsolatePanics(true),
+		AppSocket.WithPanicEscalation(3, time.Minute),
+		AppSocket.WithPanicHandler(func(any, []byte, string) {}),
+		AppSocket.WithHandler(&AppSocket.HandlerFuncs{
+			MessageFunc: func(message AppSocket.Message) {
+				if string(message.Data) == "boom" {
+					panic("boom")
+				}
+				received <- string(message.Data)
+			},
+			ErrorFunc: func(key string, err error) { errs <- err },
+		}))
+	conn := dialSocket(t, url+"isolate")
+	waitOnline(t, socket, "isolate")
+
+	for _, data := range []string{"boom", "ok"} {
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(data))
+	}
+	var notice struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.ReadJSON(&notice); err != nil || notice.Type != "error" || notice.Reason != "internal_error" {
+		t.Fatalf("unexpected notice %+v: %v", notice, err)
+	}
+	select {
+	case data := <-received:
+		if data != "ok" {
+			t.Fatalf("unexpected message %q", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("read loop stopped after an isolated panic")
+	}
+	err := <-errs
+	var panicErr *AppSocket.PanicError
+	if !errors.Is(err, AppSocket.ErrPanic) || AppSocket.ErrorStage(err) != AppSocket.StageDispatch || !errors.As(err, &panicErr) || len(panicErr.Stack) == 0 {
+		t.Fatalf("expected a dispatch panic with stack, got %v", err)
+	}
+
+	// 第三次panic达到阈值，连接以1011关闭
+	_ = conn.WriteMessage(websocket.TextMessage, []byte("boom"))
+	_ = conn.WriteMessage(websocket.TextMessage, []byte("boom"))
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, websocket.CloseInternalServerErr) {
+		t.Fatalf("expected close 1011 after repeated panics, got %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for socket.GetClientState("isolate") == AppSocket.OnlineState && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if socket.GetClientState("isolate") == AppSocket.OnlineState {
+		t.Fatal("connection should be closed after repeated panics")
+	}
+}
+
+func TestSocketWriterFor(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}), AppSocket.WithWriteReadBufferSize(1024))
+	conn := dialSocket(t, url+"frames")
+	waitOnline(t, socket, "frames")
+
+	session, err := socket.WriterFor("frames", websocket.BinaryMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := make(chan error, 1)
+	go func() { queued <- socket.SendTo("frames", websocket.TextMessage, []byte("after")) }()
+
+	first := bytes.Repeat([]byte("a"), 4096)
+	if _, err = session.Write(first); err != nil {
+		t.Fatal(err)
+	}
+	if err = session.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	mt, r, err := conn.NextReader()
+	if err != nil || mt != websocket.BinaryMessage {
+		t.Fatalf("unexpected reader %d: %v", mt, err)
+	}
+	// Close之前第一段数据已作为非最终帧到达
+	got := make([]byte, len(first))
+	if _, err = io.ReadFull(r, got); err != nil || !bytes.Equal(got, first) {
+		t.Fatalf("flushed data not received: %v", err)
+	}
+	_, _ = session.Write([]byte("tail"))
+	if err = session.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rest, err := io.ReadAll(r); err != nil || string(rest) != "tail" {
+		t.Fatalf("unexpected tail %q: %v", rest, err)
+	}
+	if err = session.Close(); !errors.Is(err, AppSocket.ErrAlreadyClosed) {
+		t.Fatalf("expected ErrAlreadyClosed, got %v", err)
+	}
+	if err = <-queued; err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "after" {
+		t.Fatalf("queued message should follow the session, got %q: %v", data, err)
+	}
+}
+
+func TestSocketAllowedMessageTypes(t *testing.T) {
+	t.Run("drop", func(t *testing.T) {
+		handler := newRecordHandler()
+		socket, url := newSocketServer(t, AppSocket.WithHandler(handler),
+			AppSocket.WithAllowedMessageTypes(websocket.TextMessage),
+			AppSocket.WithMessageTypePolicy(AppSocket.MessageTypeDrop))
+		conn := dialSocket(t, url+"json")
+		waitOnline(t, socket, "json")
+		_ = conn.WriteMessage(websocket.BinaryMessage, []byte{0x01})
+		select {
+		case err := <-handler.errs:
+			if !errors.Is(err, AppSocket.ErrMessageTypeNotAllowed) {
+				t.Fatalf("unexpected error %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("dropped message should be reported to OnError")
+		}
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"ok":true}`))
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			handler.mu.Lock()
+			n := len(handler.messages)
+			handler.mu.Unlock()
+			if n > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		handler.mu.Lock()
+		defer handler.mu.Unlock()
+		if len(handler.messages) != 1 || handler.messages[0].MessageType != websocket.TextMessage {
+			t.Fatalf("only the text message should reach OnMessage, got %+v", handler.messages)
+		}
+		if stats, _ := socket.Stats("json"); stats.DisallowedMessages != 1 {
+			t.Fatalf("expected 1 disallowed message, got %d", stats.DisallowedMessages)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+			AppSocket.WithAllowedMessageTypes(websocket.BinaryMessage))
+		conn := dialSocket(t, url+"audio")
+		waitOnline(t, socket, "audio")
+		_ = conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var err error
+		for err == nil {
+			_, _, err = conn.ReadMessage()
+		}
+		if !websocket.IsCloseError(err, websocket.CloseUnsupportedData) {
+			t.Fatalf("expected close 1003, got %v", err)
+		}
+	})
+
+	if _, err := AppSocket.NewSocket(AppSocket.WithHandler(AppSocket.BaseHandler{}), AppSocket.WithAllowedMessageTypes(websocket.PingMessage)); !errors.Is(err, AppSocket.ErrInvalidOption) {
+		t.Fatalf("expected ErrInvalidOption, got %v", err)
+	}
+}
+
+func TestBinaryDispatcher(t *testing.T) {
+	control := make(chan []byte, 1)
+	data := make(chan []byte, 1)
+	other := make(chan AppSocket.Message, 2)
+	dataClosed := make(chan string, 1)
+	dispatcher := AppSocket.NewBinaryDispatcher(&AppSocket.HandlerFuncs{MessageFunc: func(message AppSocket.Message) { other <- message }})
+	dispatcher.Register(0x01, &AppSocket.HandlerFuncs{MessageFunc: func(message AppSocket.Message) { control <- message.Data }})
+	dispatcher.Register(0x02, &AppSocket.HandlerFuncs{
+		MessageFunc: func(message AppSocket.Message) { data <- message.Data },
+		CloseFunc:   func(key string) { dataClosed <- key },
+	})
+	socket, url := newSocketServer(t, AppSocket.WithHandler(dispatcher))
+	conn := dialSocket(t, url+"magic")
+	waitOnline(t, socket, "magic")
+
+	_ = conn.WriteMessage(websocket.BinaryMessage, []byte{0x01, 'c'})
+	_ = conn.WriteMessage(websocket.BinaryMessage, []byte{0x02, 'd'})
+	_ = conn.WriteMessage(websocket.BinaryMessage, []byte{0x09})
+	_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat"}`))
+	expect := func(ch chan []byte, want []byte) {
+		t.Helper()
+		select {
+		case got := <-ch:
+			if !bytes.Equal(got, want) {
+				t.Fatalf("expected %v, got %v", want, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("message %v was not dispatched", want)
+		}
+	}
+	expect(control, []byte{0x01, 'c'})
+	expect(data, []byte{0x02, 'd'})
+	for _, want := range []int{websocket.BinaryMessage, websocket.TextMessage} {
+		select {
+		case message := <-other:
+			if message.MessageType != want {
+				t.Fatalf("unexpected fallback message %+v", message)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("unrecognized message should fall through")
+		}
+	}
+
+	_ = socket.Close("magic")
+	select {
+	case key := <-dataClosed:
+		if key != "magic" {
+			t.Fatalf("unexpected key %q", key)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("registered handlers should receive OnClose")
+	}
+}
+
+func TestSocketAdmissionThresholds(t *testing.T) {
+	var load atomic.Value
+	load.Store(0.1)
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithAdmissionThresholds(AppSocket.AdmissionThresholds{
+			MaxConnections:     3,
+			DegradeConnections: 1,
+			Load:               func() float64 { return load.Load().(float64) },
+			MaxLoad:            0.9,
+			RetryAfter:         7 * time.Second,
+			DegradedOptions:    []AppSocket.SocketOptionFunc{AppSocket.WithPingPeriod(20 * time.Second)},
+		}))
+	dialSocket(t, url+"normal")
+	waitOnline(t, socket, "normal")
+	dialSocket(t, url+"degraded")
+	waitOnline(t, socket, "degraded")
+	if client, _ := socket.Client("normal"); client.Degraded() {
+		t.Fatal("first connection should be accepted normally")
+	}
+	if client, _ := socket.Client("degraded"); !client.Degraded() {
+		t.Fatal("second connection should be degraded")
+	}
+
+	load.Store(0.95)
+	_, resp, err := websocket.DefaultDialer.Dial(url+"rejected", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "7" {
+		t.Fatalf("expected 503 with Retry-After 7, got %v: %v", resp, err)
+	}
+	stats := socket.AdmissionStats()
+	if stats.Accepted != 1 || stats.Degraded != 1 || stats.Rejected != 1 {
+		t.Fatalf("unexpected admission stats %+v", stats)
+	}
+	if hub := socket.HubStats(); hub.Admission != stats {
+		t.Fatalf("hub stats should include admission decisions, got %+v", hub.Admission)
+	}
+
+	_, err = AppSocket.NewSocket(AppSocket.WithHandler(AppSocket.BaseHandler{}), AppSocket.WithAdmissionThresholds(AppSocket.AdmissionThresholds{
+		DegradedOptions: []AppSocket.SocketOptionFunc{AppSocket.WithSendQueueLength(8)},
+	}))
+	if !errors.Is(err, AppSocket.ErrInvalidOption) {
+		t.Fatalf("expected ErrInvalidOption for a non-adjustable degraded option, got %v", err)
+	}
+}
+
+func TestSocketAdmissionController(t *testing.T) {
+	reject := atomic.Bool{}
+	reject.Store(true)
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithAdmissionController(func() AppSocket.AdmissionDecision {
+			if reject.Load() {
+				return AppSocket.AdmissionDecision{Action: AppSocket.AdmissionReject, Reason: "memory"}
+			}
+			return AppSocket.AdmissionDecision{}
+		}))
+	if _, resp, err := websocket.DefaultDialer.Dial(url+"shed", nil); err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "5" {
+		t.Fatalf("expected 503 with the default Retry-After, got %v: %v", resp, err)
+	}
+	reject.Store(false)
+	dialSocket(t, url+"shed")
+	waitOnline(t, socket, "shed")
+}
+
+type memorySessionStore struct {
+	mu     sync.Mutex
+	states map[string]AppSocket.SessionState
+	saves  int
+}
+
+func (m *memorySessionStore) Save(token string, state AppSocket.SessionState, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.states == nil {
+		m.states = make(map[string]AppSocket.SessionState)
+	}
+	m.states[token] = state
+	m.saves++
+	return nil
+}
+
+func (m *memorySessionStore) Load(token string) (AppSocket.SessionState, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ok := m.states[token]
+	return state, ok, nil
+}
+
+func (m *memorySessionStore) get(token string) (AppSocket.SessionState, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ok := m.states[token]
+	return state, ok
+}
+
+func TestSocketSessionPersistence(t *testing.T) {
+	store := &memorySessionStore{}
+	opts := []AppSocket.SocketOptionFunc{
+		AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithStrictOrdering(true),
+		AppSocket.WithSessionPersistence(store, time.Hour),
+	}
+	socket, url := newSocketServer(t, opts...)
+	conn, resp, err := websocket.DefaultDialer.Dial(url+"crashy", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := resp.Header.Get(AppSocket.SessionResumeHeader)
+	if token == "" {
+		t.Fatal("expected a resume token in the upgrade response")
+	}
+	waitOnline(t, socket, "crashy")
+	var welcome struct {
+		Data struct {
+			ResumeToken string `json:"resume_token"`
+		} `json:"data"`
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err = conn.ReadJSON(&welcome); err != nil || welcome.Data.ResumeToken != token {
+		t.Fatalf("unexpected welcome %+v: %v", welcome, err)
+	}
+	client, _ := socket.Client("crashy")
+	client.Store().Set("locale", "zh-CN")
+	_ = socket.SendJSON("crashy", map[string]string{"type": "a"})
+	_ = socket.SendJSON("crashy", map[string]string{"type": "b"})
+	for i := 0; i < 2; i++ {
+		_, _, _ = conn.ReadMessage()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	// welcome消息占用序号1
+	for time.Now().Before(deadline) {
+		if state, ok := store.get(token); ok && state.Seq == 3 && state.Metadata["locale"] != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state, _ := store.get(token); state.Key != "crashy" || state.Seq != 3 || string(state.Metadata["locale"]) != `"zh-CN"` {
+		t.Fatalf("unexpected persisted state %+v", state)
+	}
+	conn.Close()
+
+	// 模拟崩溃后由新的节点接管，带上恢复令牌重连时使用任意连接标识都会恢复原来的会话
+	restarted, url := newSocketServer(t, opts...)
+	header := http.Header{AppSocket.SessionResumeHeader: {token}}
+	resumed, _, err := websocket.DefaultDialer.Dial(url+"other", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resumed.Close() })
+	waitOnline(t, restarted, "crashy")
+	client, _ = restarted.Client("crashy")
+	if locale, _ := AppSocket.StoreValue[string](client.Store(), "locale"); locale != "zh-CN" || client.ResumeToken() != token {
+		t.Fatalf("session state not restored: locale %q token %q", locale, client.ResumeToken())
+	}
+	_ = restarted.SendJSON("crashy", map[string]string{"type": "c"})
+	var next struct {
+		Seq int `json:"_seq"`
+	}
+	_ = resumed.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_ = resumed.ReadJSON(&next) // welcome
+	if err = resumed.ReadJSON(&next); err != nil || next.Seq != 5 {
+		t.Fatalf("sequence should continue after resume, got %d: %v", next.Seq, err)
+	}
+}
+
+func TestSocketQueueWaitTimeout(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithQueueWaitTimeout(50*time.Millisecond),
+		AppSocket.WithSendQueueLength(2))
+	conn := dialSocket(t, url+"late")
+	waitOnline(t, socket, "late")
+	client, _ := socket.Client("late")
+
+	// 占住写锁，让写循环停在第一条消息上
+	session, err := client.WriterFor(websocket.BinaryMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = socket.SendTo("late", websocket.TextMessage, []byte("first"))
+	time.Sleep(20 * time.Millisecond) // 写循环取出first后等待写锁
+	if err = socket.SendTo("late", websocket.TextMessage, []byte("stale")); err != nil {
+		t.Fatal(err)
+	}
+	if err = socket.SendToOpt("late", websocket.TextMessage, []byte("fresh"), AppSocket.SendOpts{QueueWait: -1}); err != nil {
+		t.Fatal(err)
+	}
+	err = client.SendWait(context.Background(), websocket.TextMessage, []byte("blocked"), AppSocket.SendOpts{QueueWait: 30 * time.Millisecond})
+	if !errors.Is(err, AppSocket.ErrQueueTimeout) {
+		t.Fatalf("expected ErrQueueTimeout, got %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err = session.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.SendWait(context.Background(), websocket.TextMessage, []byte("end"), AppSocket.SendOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(got) == 0 || got[len(got)-1] != "end" {
+		mt, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read failed after %v: %v", got, err)
+		}
+		if mt == websocket.TextMessage {
+			got = append(got, string(data))
+		}
+	}
+	if strings.Join(got, ",") != "first,fresh,end" {
+		t.Fatalf("stale message should be dropped, got %v", got)
+	}
+	if drops := client.Stats().QueueWaitDrops; drops != 2 {
+		t.Fatalf("expected 2 queue wait drops, got %d", drops)
+	}
+}
+
+func TestSocketCPULoadMonitor(t *testing.T) {
+	var load atomic.Value
+	load.Store(0.1)
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithCPULoadMonitor(0.5, 20*time.Millisecond),
+		AppSocket.WithCPUSampler(func() (float64, error) { return load.Load().(float64), nil }))
+	conn := dialSocket(t, url+"cpu")
+	waitOnline(t, socket, "cpu")
+
+	type notice struct {
+		Type   string `json:"type"`
+		Paused bool   `json:"paused"`
+		Reason string `json:"reason"`
+	}
+	expect := func(conn *websocket.Conn, paused bool) {
+		t.Helper()
+		var n notice
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if err := conn.ReadJSON(&n); err != nil || n.Type != "flow_control" || n.Paused != paused || n.Reason != "cpu" {
+			t.Fatalf("expected flow_control paused=%v, got %+v: %v", paused, n, err)
+		}
+	}
+	load.Store(0.9)
+	expect(conn, true)
+	if _, paused := socket.CPULoad(); !paused {
+		t.Fatal("expected paused state")
+	}
+	late := dialSocket(t, url+"late")
+	expect(late, true)
+
+	// 0.45仍高于恢复线0.4，不会恢复
+	load.Store(0.45)
+	time.Sleep(100 * time.Millisecond)
+	load.Store(0.3)
+	expect(conn, false)
+	expect(late, false)
+}
+
+func TestSocketServerConfigFrame(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithMaxMessageSize(4096), AppSocket.WithPingPeriod(time.Second),
+		AppSocket.WithServerConfigFrame("edge-1/v2", map[string]any{"region": "cn"}))
+	conn := dialSocket(t, url+"cfg")
+	waitOnline(t, socket, "cfg")
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, ok := AppSocket.ParseServerConfig(data)
+	if !ok {
+		t.Fatalf("expected server.config frame, got %s", data)
+	}
+	if cfg.Server != "edge-1/v2" || cfg.MaxMessageSize != 4096 || cfg.Extra["region"] != "cn" {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	// 读取截止时间取校验后的默认值30秒
+	if ping, read := cfg.Durations(); ping != time.Second || read != 30*time.Second || !cfg.PongRequired || cfg.MaxMissedPongs != 4 {
+		t.Fatalf("unexpected heartbeat config %+v", cfg)
+	}
+	if _, ok := AppSocket.ParseServerConfig([]byte(`{"type":"welcome"}`)); ok {
+		t.Fatal("welcome should not parse as server.config")
+	}
+}
+
+func TestSocketPProfHandlers(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithHeartbeatGoroutineLabel("hb"))
+	engine := gin.New()
+	socket.RegisterPProfHandlers(engine, "")
+	get := func(path string, v any) string {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", path, recorder.Code)
+		}
+		if v != nil {
+			if err := json.Unmarshal(recorder.Body.Bytes(), v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return recorder.Body.String()
+	}
+
+	dialSocket(t, url+"a")
+	dialSocket(t, url+"b")
+	waitOnline(t, socket, "a")
+	waitOnline(t, socket, "b")
+
+	// 连接上线时读写循环的goroutine可能还没有启动
+	var goroutines AppSocket.GoroutineProfile
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		get("/debug/ws/goroutines", &goroutines)
+		if goroutines.Connections >= 4 && goroutines.Heartbeat["hb"] >= 2 && len(goroutines.PerConnection) >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected goroutine profile %+v", goroutines)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if raw := get("/debug/ws/goroutines?debug=1", nil); !strings.Contains(raw, "ws_conn") {
+		t.Fatal("expected raw goroutine profile with ws_conn labels")
+	}
+
+	var conns []AppSocket.ConnectionProfile
+	get("/debug/ws/connections?limit=1", &conns)
+	if len(conns) != 1 || conns[0].QueueCap == 0 {
+		t.Fatalf("unexpected connections %+v", conns)
+	}
+	var stats AppSocket.DebugStats
+	get("/debug/ws/stats", &stats)
+	if stats.Hub.Connections != 2 || stats.Goroutines == 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestSocketBroadcastCoalesced(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}))
+	conn := dialSocket(t, url+"viewer")
+	waitOnline(t, socket, "viewer")
+	rooms := socket.Rooms()
+	if err := rooms.Join("doc", "viewer"); err != nil {
+		t.Fatal(err)
+	}
+	readText := func() string {
+		t.Helper()
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	send := func(key, data string) {
+		t.Helper()
+		if err := rooms.BroadcastCoalesced("doc", key, websocket.TextMessage, []byte(data), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 普通广播之前先投递暂存的合并广播，按key首次出现的顺序
+	send("cursor", "c1")
+	send("presence", "p1")
+	send("cursor", "c2")
+	send("cursor", "c3")
+	if err := rooms.Broadcast("doc", websocket.TextMessage, []byte("edit")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"c3", "p1", "edit"} {
+		if got := readText(); got != want {
+			t.Fatalf("expected %s, got %s", want, got)
+		}
+	}
+	if stats := rooms.Stats(); stats.BroadcastsSuppressed != 2 {
+		t.Fatalf("expected 2 suppressed broadcasts, got %+v", stats)
+	}
+
+	// 窗口结束时投递最新的一条
+	if err := rooms.BroadcastCoalesced("doc", "cursor", websocket.TextMessage, []byte("c4"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	send("cursor", "c5")
+	if got := readText(); got != "c5" {
+		t.Fatalf("expected c5 after the window, got %s", got)
+	}
+
+	send("cursor", "c6")
+	socket.StartDrain("deploy")
+	if got := readText(); got != "c6" {
+		t.Fatalf("drain should flush pending broadcasts first, got %s", got)
+	}
+	if err := rooms.BroadcastCoalesced("missing", "k", websocket.TextMessage, nil, time.Second); !errors.Is(err, AppSocket.ErrRoomNotFound) {
+		t.Fatalf("expected ErrRoomNotFound, got %v", err)
+	}
+}
+
+func TestSocketSampler(t *testing.T) {
+	type sample struct {
+		direction AppSocket.Direction
+		data      string
+	}
+	samples := make(chan sample, 64)
+	record := func(direction AppSocket.Direction, mt int, data []byte) {
+		samples <- sample{direction, string(data)}
+	}
+
+	t.Run("per message", func(t *testing.T) {
+		socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}), AppSocket.WithSampler(1, record))
+		conn := dialSocket(t, url+"all")
+		waitOnline(t, socket, "all")
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("question")); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-samples; got.direction != AppSocket.DirectionInbound || got.data != "question" {
+			t.Fatalf("unexpected inbound sample %+v", got)
+		}
+		if err := socket.SendTo("all", websocket.TextMessage, []byte("answer")); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-samples; got.direction != AppSocket.DirectionOutbound || got.data != "answer" {
+			t.Fatalf("unexpected outbound sample %+v", got)
+		}
+	})
+
+	t.Run("per session", func(t *testing.T) {
+		socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+			AppSocket.WithSampler(0.5, record), AppSocket.WithSessionSampling(true))
+		counts := make(map[string]int)
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("s%d", i)
+			conn := dialSocket(t, url+key)
+			waitOnline(t, socket, key)
+			for j := 0; j < 3; j++ {
+				if err := conn.WriteMessage(websocket.TextMessage, []byte(key)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			counts[key] = 0
+		}
+		time.Sleep(200 * time.Millisecond)
+		for len(samples) > 0 {
+			counts[(<-samples).data]++
+		}
+		sampled := 0
+		for key, n := range counts {
+			if n != 0 && n != 3 {
+				t.Fatalf("session %s should be sampled all or nothing, got %d", key, n)
+			}
+			if n == 3 {
+				sampled++
+			}
+		}
+		if sampled == 0 || sampled == len(counts) {
+			t.Fatalf("expected a subset of sessions to be sampled, got %v", counts)
+		}
+	})
+
+	if _, err := AppSocket.NewSocket(AppSocket.WithSampler(1.5, record)); !errors.Is(err, AppSocket.ErrInvalidOption) {
+		t.Fatalf("expected ErrInvalidOption, got %v", err)
+	}
+}
+
+func TestSocketNamespaces(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithDuplicateSessionPolicy(AppSocket.ErrorOnDuplicate),
+		AppSocket.WithLabelExtractor(func(ctx *gin.Context) map[string]string {
+			return map[string]string{AppSocket.NamespaceLabel: ctx.Query("ns"), AppSocket.SessionLabel: ctx.Query("user")}
+		}),
+		AppSocket.WithNamespaces(map[string]AppSocket.NamespaceLimits{"acme": {MaxConnections: 2}, "globex": {}}))
+	dialStatus := func(key, query string) int {
+		t.Helper()
+		conn, resp, err := websocket.DefaultDialer.Dial(url+key+"?"+query, nil)
+		if err == nil {
+			conn.Close()
+			return http.StatusSwitchingProtocols
+		}
+		return resp.StatusCode
+	}
+	readText := func(conn *websocket.Conn) string {
+		t.Helper()
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// 不同租户的同名用户互不影响
+	a1 := dialSocket(t, url+"a1?ns=acme&user=alice")
+	b1 := dialSocket(t, url+"b1?ns=globex&user=alice")
+	waitOnline(t, socket, "a1")
+	waitOnline(t, socket, "b1")
+	if code := dialStatus("x", "ns=initech"); code != http.StatusForbidden {
+		t.Fatalf("unknown namespace should be rejected with 403, got %d", code)
+	}
+	dialSocket(t, url+"a2?ns=acme&user=bob")
+	waitOnline(t, socket, "a2")
+	if code := dialStatus("a3", "ns=acme&user=carol"); code != http.StatusServiceUnavailable {
+		t.Fatalf("namespace connection cap should reject with 503, got %d", code)
+	}
+
+	acme, err := socket.Namespace("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	globex, _ := socket.Namespace("globex")
+	if err := acme.Rooms().Join("lobby", "a1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := acme.Rooms().Join("lobby", "b1"); !errors.Is(err, AppSocket.ErrSessionNotFound) {
+		t.Fatalf("joining another namespace's room should fail, got %v", err)
+	}
+	if err := socket.Rooms().Join("lobby", "a1"); !errors.Is(err, AppSocket.ErrSessionNotFound) {
+		t.Fatalf("namespaced connection should not join global rooms, got %v", err)
+	}
+	if err := globex.SendTo("a1", websocket.TextMessage, []byte("leak")); !errors.Is(err, AppSocket.ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+	if err := acme.Rooms().Broadcast("lobby", websocket.TextMessage, []byte("acme-room")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readText(a1); got != "acme-room" {
+		t.Fatalf("unexpected message %s", got)
+	}
+	if n := globex.SendToUser("alice", websocket.TextMessage, []byte("globex-alice")); n != 1 {
+		t.Fatalf("expected one globex connection for alice, got %d", n)
+	}
+	if got := readText(b1); got != "globex-alice" {
+		t.Fatalf("unexpected message %s", got)
+	}
+	if err := socket.AdminBroadcast(websocket.TextMessage, []byte("maintenance")); err != nil {
+		t.Fatal(err)
+	}
+	if readText(a1) != "maintenance" || readText(b1) != "maintenance" {
+		t.Fatal("admin broadcast should reach every namespace")
+	}
+
+	globex.StartDrain("migrate")
+	if got := readText(b1); !strings.Contains(got, `"draining"`) {
+		t.Fatalf("expected draining notice, got %s", got)
+	}
+	if code := dialStatus("b2", "ns=globex"); code != http.StatusServiceUnavailable {
+		t.Fatalf("draining namespace should reject with 503, got %d", code)
+	}
+	stats := socket.HubStats().Namespaces
+	if stats["acme"].Connections != 2 || stats["acme"].Rejected != 1 || !stats["globex"].Draining {
+		t.Fatalf("unexpected namespace stats %+v", stats)
+	}
+	if labels, _ := socket.Stats("a1"); labels.Labels[AppSocket.NamespaceLabel] != "acme" {
+		t.Fatalf("expected namespace metric label, got %+v", labels.Labels)
+	}
+	globex.Shutdown("tenant moved")
+	_ = b1.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := b1.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected going away close, got %v", err)
+	}
+}
+
+// chanHandler 把收到的消息转成字符串发到channel，mutate为true时在返回前就地修改消息，panicOn命中时panic
+type chanHandler struct {
+	AppSocket.BaseHandler
+	messages chan string
+	mutate   bool
+	panicOn  string
+}
+
+func (h *chanHandler) OnMessage(message AppSocket.Message) {
+	if string(message.Data) == h.panicOn {
+		panic("shadow failed")
+	}
+	h.messages <- string(message.Data)
+	if h.mutate {
+		copy(message.Data, bytes.Repeat([]byte("x"), len(message.Data)))
+	}
+}
+
+func TestSocketShadowHandler(t *testing.T) {
+	primary := &chanHandler{messages: make(chan string, 4), mutate: true}
+	shadow := &chanHandler{messages: make(chan string, 4), panicOn: "boom"}
+	panics := make(chan any, 4)
+	socket, url := newSocketServer(t, AppSocket.WithHandler(primary), AppSocket.WithShadowHandler(shadow),
+		AppSocket.WithPanicHandler(func(recovered any, stack []byte, connID string) { panics <- recovered }))
+	conn := dialSocket(t, url+"ab")
+	waitOnline(t, socket, "ab")
+
+	for _, text := range []string{"boom", "hello"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-primary.messages; got != text {
+			t.Fatalf("primary expected %s, got %s", text, got)
+		}
+	}
+	select {
+	case got := <-shadow.messages:
+		if got != "hello" {
+			t.Fatalf("shadow should get an unmodified copy, got %s", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("shadow handler was not called")
+	}
+	if r := <-panics; r != "shadow failed" {
+		t.Fatalf("unexpected panic %v", r)
+	}
+	if socket.GetClientState("ab") != AppSocket.OnlineState {
+		t.Fatal("shadow panic should not affect the connection")
+	}
+}
+
+func TestSocketTopicSubscriptions(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}), AppSocket.WithTopicSubscriptions(2))
+	conn := dialSocket(t, url+"sub")
+	waitOnline(t, socket, "sub")
+	type frame struct {
+		Type   string          `json:"type"`
+		Topic  string          `json:"topic"`
+		Reason string          `json:"reason"`
+		Data   json.RawMessage `json:"data"`
+	}
+	read := func() frame {
+		t.Helper()
+		var f frame
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if err := conn.ReadJSON(&f); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	subscribe := func(kind, topic string) frame {
+		t.Helper()
+		if err := conn.WriteJSON(map[string]string{"type": kind, "topic": topic}); err != nil {
+			t.Fatal(err)
+		}
+		return read()
+	}
+
+	if f := subscribe("subscribe", "jobs.*.done"); f.Type != "subscribed" {
+		t.Fatalf("unexpected reply %+v", f)
+	}
+	if f := subscribe("subscribe", "billing.>"); f.Type != "subscribed" {
+		t.Fatalf("unexpected reply %+v", f)
+	}
+	if f := subscribe("subscribe", "extra.topic"); f.Type != "subscribe_error" || f.Reason != "limit" {
+		t.Fatalf("expected limit error, got %+v", f)
+	}
+	if f := subscribe("unsubscribe", "billing.>"); f.Type != "unsubscribed" {
+		t.Fatalf("unexpected reply %+v", f)
+	}
+	if f := subscribe("subscribe", "bad.>.topic"); f.Type != "subscribe_error" || f.Reason != "invalid_topic" {
+		t.Fatalf("expected invalid topic error, got %+v", f)
+	}
+
+	for topic, want := range map[string]int{"jobs.42.done": 1, "jobs.42.started": 0, "billing.invoice.created": 0, "jobs.done": 0} {
+		if n, err := socket.Publish(topic, map[string]int{"id": 42}); err != nil || n != want {
+			t.Fatalf("publish %s: expected %d deliveries, got %d: %v", topic, want, n, err)
+		}
+	}
+	if f := read(); f.Type != "event" || f.Topic != "jobs.42.done" || string(f.Data) != `{"id":42}` {
+		t.Fatalf("unexpected event %+v", f)
+	}
+	if _, err := socket.Publish("jobs.*.done", nil); !errors.Is(err, AppSocket.ErrInvalidTopic) {
+		t.Fatalf("publishing a wildcard should fail, got %v", err)
+	}
+
+	client, _ := socket.Client("sub")
+	_ = socket.Close("sub")
+	deadline := time.Now().Add(2 * time.Second)
+	for len(client.Topics()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("subscriptions should be removed on close, got %v", client.Topics())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTopicTreeMatch(t *testing.T) {
+	tree := AppSocket.NewTopicTree()
+	for pattern, id := range map[string]string{"a.b.c": "exact", "a.*.c": "star", "a.>": "tail", ">": "all", "a.b": "short"} {
+		if _, err := tree.Subscribe(pattern, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	match := func(topic string) string {
+		ids := tree.Match(topic)
+		sort.Strings(ids)
+		return strings.Join(ids, ",")
+	}
+	if got := match("a.b.c"); got != "all,exact,star,tail" {
+		t.Fatalf("unexpected match %s", got)
+	}
+	if got := match("a"); got != "all" {
+		t.Fatalf("> should need at least one level, got %s", got)
+	}
+	tree.RemoveAll("tail")
+	tree.Unsubscribe(">", "all")
+	if got := match("a.b"); got != "short" || tree.Len() != 3 {
+		t.Fatalf("unexpected match %s with %d subscriptions", got, tree.Len())
+	}
+}
+
+// BenchmarkTopicTreeMatch 10000个连接共100000个订阅，其中包含*和>通配符
+func BenchmarkTopicTreeMatch(b *testing.B) {
+	tree := AppSocket.NewTopicTree()
+	for i := 0; i < 10000; i++ {
+		id := strconv.Itoa(i)
+		patterns := []string{
+			"jobs." + id + ".*", "jobs." + id + ".status", "jobs." + id + ".logs.>",
+			"users." + id + ".presence", "users." + id + ".>", "rooms." + strconv.Itoa(i%500) + ".messages",
+			"billing.invoice." + id, "billing.*." + id, "metrics." + strconv.Itoa(i%100) + ".>", "alerts." + id,
+		}
+		for _, pattern := range patterns {
+			if _, err := tree.Subscribe(pattern, id); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	if tree.Len() != 100000 {
+		b.Fatalf("expected 100000 subscriptions, got %d", tree.Len())
+	}
+	topics := []string{"jobs.1234.status", "users.42.presence", "rooms.7.messages", "billing.invoice.9999", "nothing.here"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Match(topics[i%len(topics)])
+	}
+}
+
+func TestAckTracker(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()))
+	conn := dialSocket(t, url+"qos")
+	waitOnline(t, socket, "qos")
+
+	timeouts := make(chan AppSocket.AckTimeout, 1)
+	tracker, err := AppSocket.NewAckTracker(socket, "qos", AppSocket.AckTrackerOptions{
+		Timeout:    100 * time.Millisecond,
+		MaxRetries: 2,
+		OnTimeout:  func(event AppSocket.AckTimeout) { timeouts <- event },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Close()
+
+	ctx := context.Background()
+	acked, err := tracker.Send(ctx, websocket.TextMessage, []byte(`{"type":"order"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frame struct {
+		QoS int64 `json:"_qos"`
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err = conn.ReadJSON(&frame); err != nil || frame.QoS != acked {
+		t.Fatalf("expected _qos %d, got %+v: %v", acked, frame, err)
+	}
+	if !tracker.Ack(acked) || tracker.Ack(acked) {
+		t.Fatal("ack should succeed exactly once")
+	}
+	if _, err = tracker.Send(ctx, websocket.BinaryMessage, []byte{1}); !errors.Is(err, AppSocket.ErrInvalidPayload) {
+		t.Fatalf("expected ErrInvalidPayload, got %v", err)
+	}
+
+	// 不确认：第一次发送加两次重发后超时
+	lost, err := tracker.Send(ctx, websocket.TextMessage, []byte(`{"type":"invoice"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracker.PendingAcks() != 1 {
+		t.Fatalf("expected 1 pending ack, got %d", tracker.PendingAcks())
+	}
+	for i := 0; i < 3; i++ {
+		if err = conn.ReadJSON(&frame); err != nil || frame.QoS != lost {
+			t.Fatalf("delivery %d: expected _qos %d, got %+v: %v", i, lost, frame, err)
+		}
+	}
+	select {
+	case event := <-timeouts:
+		if event.Seq != lost || event.Attempts != 3 || event.Key != "qos" {
+			t.Fatalf("unexpected timeout %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout callback was not called")
+	}
+	if tracker.PendingAcks() != 0 {
+		t.Fatalf("expected no pending acks, got %d", tracker.PendingAcks())
+	}
+
+	if _, err = tracker.Send(ctx, websocket.TextMessage, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if dropped := tracker.Close(); dropped != 1 {
+		t.Fatalf("expected 1 dropped message, got %d", dropped)
+	}
+	if _, err = tracker.Send(ctx, websocket.TextMessage, []byte(`{}`)); !errors.Is(err, AppSocket.ErrAlreadyClosed) {
+		t.Fatalf("expected ErrAlreadyClosed, got %v", err)
+	}
+}
+
+func TestAckTrackerTimeoutPanic(t *testing.T) {
+	panics := make(chan string, 1)
+	socket, url := newSocketServer(t, AppSocket.WithHandler(newRecordHandler()),
+		AppSocket.WithPanicHandler(func(recovered any, stack []byte, connID string) {
+			panics <- fmt.Sprint(recovered, " ", connID)
+		}))
+	dialSocket(t, url+"qos")
+	waitOnline(t, socket, "qos")
+
+	timeouts := make(chan int64, 2)
+	tracker, err := AppSocket.NewAckTracker(socket, "qos", AppSocket.AckTrackerOptions{
+		Timeout:    20 * time.Millisecond,
+		MaxRetries: -1,
+		OnTimeout: func(event AppSocket.AckTimeout) {
+			timeouts <- event.Seq
+			panic("on timeout")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Close()
+
+	// OnTimeout的panic交给WithPanicHandler，重发goroutine继续工作
+	for i := 0; i < 2; i++ {
+		seq, err := tracker.Send(context.Background(), websocket.TextMessage, []byte(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-timeouts:
+			if got != seq {
+				t.Fatalf("expected timeout for %d, got %d", seq, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout callback %d was not called", i)
+		}
+		select {
+		case got := <-panics:
+			if got != "on timeout qos" {
+				t.Fatalf("unexpected panic report %q", got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("panic handler was not called")
+		}
+	}
+}
+
+func TestSocketClientMetrics(t *testing.T) {
+	handler := &chanHandler{messages: make(chan string, 4)}
+	reports := make(chan AppSocket.ClientMetrics, 4)
+	socket, url := newSocketServer(t, AppSocket.WithHandler(handler), AppSocket.WithClientMetricsInterval(time.Hour),
+		AppSocket.WithClientMetricsHandler(func(connID string, m AppSocket.ClientMetrics) {
+			if connID == "web" {
+				reports <- m
+			}
+		}))
+	conn := dialSocket(t, url+"web")
+	waitOnline(t, socket, "web")
+
+	frames := []string{
+		`{"type":"client.metrics","render_latency_ms":12.5,"processing_lag_ms":3,"extra":{"fps":58}}`,
+		// 间隔太短
+		`{"type":"client.metrics","render_latency_ms":1}`,
+		`{"type":"client.metrics","render_latency_ms":-1}`,
+		`{"type":"client.metrics","render_latency_ms":"slow"}`,
+		`{"type":"client.metrics","pad":"` + strings.Repeat("x", 4096) + `"}`,
+		`{"type":"chat","text":"see client.metrics"}`,
+	}
+	for _, frame := range frames {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case m := <-reports:
+		if m.RenderLatency != 12500*time.Microsecond || m.ProcessingLag != 3*time.Millisecond || m.Extra["fps"] != 58 {
+			t.Fatalf("unexpected metrics %+v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("metrics handler was not called")
+	}
+	select {
+	case message := <-handler.messages:
+		if !strings.Contains(message, `"chat"`) {
+			t.Fatalf("only the chat message should reach OnMessage, got %s", message)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("chat message was not delivered")
+	}
+	select {
+	case m := <-reports:
+		t.Fatalf("violating frames should not reach the handler, got %+v", m)
+	default:
+	}
+	stats, err := socket.Stats("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.MetricsViolations != 4 || stats.ClientMetrics == nil || stats.ClientMetrics.RenderLatency != 12500*time.Microsecond {
+		t.Fatalf("unexpected stats %d %+v", stats.MetricsViolations, stats.ClientMetrics)
+	}
+}
+
+// echoHandler 原样回显，socket在NewSocket之后设置
+type echoHandler struct {
+	AppSocket.BaseHandler
+	socket AppSocket.SocketClientInterface
+}
+
+func (h *echoHandler) OnMessage(message AppSocket.Message) {
+	_ = h.socket.SendTo(message.Subkeys[0], message.MessageType, message.Data)
+}
+
+func TestLoadEcho(t *testing.T) {
+	handler := &echoHandler{}
+	socket, url := newSocketServer(t, AppSocket.WithHandler(handler))
+	handler.socket = socket
+
+	stress := testutil.NewStressClient(url+"load-{i}", 50, testutil.WithRate(20),
+		testutil.WithPayload(func(conn int, seq int64) []byte { return []byte(`{"type":"tick"}`) }))
+	if err := stress.Run(context.Background(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	report := stress.Report()
+	t.Log(report)
+	if report.Connections != 50 || report.DialErrors != 0 || report.SendErrors != 0 || report.ReadErrors != 0 {
+		t.Fatalf("unexpected errors: %s", report)
+	}
+	// 50个连接每秒20条，允许计时误差
+	if report.Sent < 700 || report.Received != report.Sent {
+		t.Fatalf("expected every message to be echoed: %s", report)
+	}
+	if report.LatencyP50 <= 0 || report.LatencyP50 > report.LatencyP99 || report.LatencyP99 > report.LatencyMax {
+		t.Fatalf("unexpected latency percentiles: %s", report)
+	}
+
+	failing := testutil.NewStressClient("ws://127.0.0.1:1/socket/{i}", 2)
+	if err := failing.Run(context.Background(), time.Second); err == nil || failing.Report().DialErrors != 2 {
+		t.Fatalf("expected dial errors, got %v %s", err, failing.Report())
+	}
+}
+
+func TestSocketSessionResume(t *testing.T) {
+	sessions := AppSocket.NewMemorySessionStore()
+	history, _ := AppSocket.NewMemoryHistoryStore(AppSocket.HistoryRetention{MaxMessages: 10, MaxAge: time.Minute})
+	pending, _ := AppSocket.NewMemoryPendingStore(AppSocket.PendingLimits{MaxMessages: 10, MaxBytes: 1 << 20, MaxAge: time.Minute})
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithSessionPersistence(sessions, 500*time.Millisecond),
+		AppSocket.WithMessageHistory(AppSocket.HistoryConfig{Store: history, Enabled: true}),
+		AppSocket.WithPendingStore(pending),
+		AppSocket.WithTopicSubscriptions(10))
+
+	type welcome struct {
+		Type string `json:"type"`
+		Data struct {
+			ResumeToken string `json:"resume_token"`
+			Session     string `json:"session"`
+		} `json:"data"`
+	}
+	readWelcome := func(conn *websocket.Conn) welcome {
+		t.Helper()
+		var w welcome
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if err := conn.ReadJSON(&w); err != nil || w.Type != "welcome" {
+			t.Fatalf("expected welcome, got %+v: %v", w, err)
+		}
+		return w
+	}
+
+	conn := dialSocket(t, url+"mobile")
+	first := readWelcome(conn)
+	if first.Data.Session != AppSocket.SessionNew || first.Data.ResumeToken == "" {
+		t.Fatalf("unexpected welcome %+v", first)
+	}
+	waitOnline(t, socket, "mobile")
+	if err := socket.Rooms().Join("chat", "mobile"); err != nil {
+		t.Fatal(err)
+	}
+	_ = socket.Rooms().Broadcast("chat", websocket.TextMessage, []byte("delivered"))
+	_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"subscribe","topic":"jobs.*"}`))
+	for _, expected := range []string{"delivered", `"subscribed"`} {
+		if _, data, err := conn.ReadMessage(); err != nil || !strings.Contains(string(data), expected) {
+			t.Fatalf("expected %s, got %s: %v", expected, data, err)
+		}
+	}
+
+	// 断线期间房间和连接都收到了新消息
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for socket.GetClientState("mobile") == AppSocket.OnlineState && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	_, _ = history.Append("chat", AppSocket.StoredMessage{MessageType: websocket.TextMessage, Data: []byte("missed")})
+	_ = socket.SendTo("mobile", websocket.TextMessage, []byte("direct"))
+
+	header := http.Header{AppSocket.SessionResumeHeader: {first.Data.ResumeToken}}
+	resumed, _, err := websocket.DefaultDialer.Dial(url+"anything", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resumed.Close() })
+	received := map[string]bool{}
+	_ = resumed.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(received) < 3 {
+		_, data, err := resumed.ReadMessage()
+		if err != nil {
+			t.Fatalf("expected welcome and replayed messages, got %v: %v", received, err)
+		}
+		var w welcome
+		if json.Unmarshal(data, &w) == nil && w.Type == "welcome" {
+			if w.Data.Session != AppSocket.SessionResumed || w.Data.ResumeToken != first.Data.ResumeToken {
+				t.Fatalf("unexpected welcome %+v", w)
+			}
+			received["welcome"] = true
+			continue
+		}
+		received[string(data)] = true
+	}
+	if !received["missed"] || !received["direct"] {
+		t.Fatalf("missed messages were not replayed: %v", received)
+	}
+	client, _ := socket.Client("mobile")
+	if topics := client.Topics(); len(topics) != 1 || topics[0] != "jobs.*" {
+		t.Fatalf("topic subscriptions were not restored: %v", topics)
+	}
+	if n, err := socket.Publish("jobs.1", "done"); err != nil || n != 1 {
+		t.Fatalf("expected the restored subscription to receive the event, got %d: %v", n, err)
+	}
+
+	expired := dialSocket(t, url+"fresh?"+AppSocket.SessionResumeParam+"=unknown")
+	if w := readWelcome(expired); w.Data.Session != AppSocket.SessionExpired || w.Data.ResumeToken == "unknown" {
+		t.Fatalf("expected a fresh session, got %+v", w)
+	}
+	if client, _ := socket.Client("fresh"); len(client.Topics()) != 0 {
+		t.Fatal("a fresh session should start without subscriptions")
+	}
+
+	resumed.Close()
+	expired.Close()
+	deadline = time.Now().Add(3 * time.Second)
+	for sessions.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected sessions to expire after the resume window, %d left", sessions.Len())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestSocketIdleTimeout(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}),
+		AppSocket.WithIdleTimeout(200*time.Millisecond), AppSocket.WithIdleGracePeriod(200*time.Millisecond))
+	idle := dialSocket(t, url+"idle")
+	foreground := dialSocket(t, url+"foreground")
+	waitOnline(t, socket, "idle")
+	waitOnline(t, socket, "foreground")
+	client, _ := socket.Client("foreground")
+	if err := client.UpdateOption(AppSocket.WithIdleTimeout(-1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 控制帧不算活动，客户端照常响应ping也会超时
+	_ = idle.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var notice struct {
+		Type      string `json:"type"`
+		CloseInMs int64  `json:"close_in_ms"`
+	}
+	if err := idle.ReadJSON(&notice); err != nil || notice.Type != "idle" || notice.CloseInMs != 200 {
+		t.Fatalf("expected an idle warning, got %+v: %v", notice, err)
+	}
+	_, _, err := idle.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != AppSocket.CloseIdleTimeout {
+		t.Fatalf("expected close code %d, got %v", AppSocket.CloseIdleTimeout, err)
+	}
+
+	// 提醒之后恢复活动则不会关闭
+	_ = client.UpdateOption(AppSocket.WithIdleTimeout(200 * time.Millisecond))
+	_ = foreground.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if err = foreground.ReadJSON(&notice); err != nil || notice.Type != "idle" {
+		t.Fatalf("expected an idle warning after re-enabling, got %+v: %v", notice, err)
+	}
+	_ = foreground.WriteMessage(websocket.TextMessage, []byte("still here"))
+	time.Sleep(300 * time.Millisecond)
+	if socket.GetClientState("foreground") != AppSocket.OnlineState {
+		t.Fatal("activity after the warning should keep the connection open")
+	}
+	if description := AppSocket.CloseCodeDescription(AppSocket.CloseIdleTimeout); !strings.Contains(description, "idle") {
+		t.Fatalf("unexpected description %q", description)
+	}
+}
+
+type busRecord struct {
+	topic, key, value string
+}
+
+// recordingBus value为fail时返回错误
+type recordingBus struct {
+	records chan busRecord
+}
+
+func (b *recordingBus) Publish(topic string, key []byte, value []byte) error {
+	if string(value) == "fail" {
+		return errors.New("bus unavailable")
+	}
+	b.records <- busRecord{topic, string(key), string(value)}
+	return nil
+}
+
+func TestSocketMessageBusPublisher(t *testing.T) {
+	bus := &recordingBus{records: make(chan busRecord, 4)}
+	handler := &chanHandler{messages: make(chan string, 4), mutate: true}
+	socket, url := newSocketServer(t, AppSocket.WithHandler(handler), AppSocket.WithMessageBusPublisher(bus),
+		AppSocket.WithLabelExtractor(func(ctx *gin.Context) map[string]string {
+			return map[string]string{AppSocket.SessionLabel: ctx.Query("session")}
+		}))
+	conn := dialSocket(t, url+"lab?session=s-42")
+	anonymous := dialSocket(t, url+"anon")
+	waitOnline(t, socket, "lab")
+	waitOnline(t, socket, "anon")
+
+	_ = conn.WriteMessage(websocket.TextMessage, []byte("prompt"))
+	_ = conn.WriteMessage(websocket.TextMessage, []byte("fail"))
+	_ = conn.WriteMessage(websocket.BinaryMessage, []byte("tensor"))
+	_ = anonymous.WriteMessage(websocket.TextMessage, []byte("hello"))
+	expected := map[busRecord]bool{
+		{"s-42", "1", "prompt"}: true,
+		{"s-42", "2", "tensor"}: true,
+		{"anon", "1", "hello"}:  true,
+	}
+	for i := 0; i < len(expected); i++ {
+		select {
+		case record := <-bus.records:
+			if !expected[record] {
+				t.Fatalf("unexpected bus record %+v", record)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("message was not published")
+		}
+	}
+	stats, _ := socket.Stats("lab")
+	if stats.BusPublishErrors != 1 {
+		t.Fatalf("expected 1 publish error, got %d", stats.BusPublishErrors)
+	}
+}
+
+func TestSocketQueueWatermarks(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}))
+	conn := dialSocket(t, url+"deep")
+	waitOnline(t, socket, "deep")
+	client, _ := socket.Client("deep")
+
+	// 占住写锁，让消息堆积在发送队列中
+	session, err := client.WriterFor(websocket.BinaryMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err = socket.SendTo("deep", websocket.TextMessage, []byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond) // 写循环取出第一条后等待写锁
+	stats := client.Stats()
+	if stats.QueueDepth != 4 || stats.QueueBytes != 40 {
+		t.Fatalf("expected 4 queued messages of 40 bytes, got %d/%d", stats.QueueDepth, stats.QueueBytes)
+	}
+	if stats.QueueDepthPeak < 4 || stats.QueueBytesPeak < 40 {
+		t.Fatalf("unexpected watermarks %d/%d", stats.QueueDepthPeak, stats.QueueBytesPeak)
+	}
+	if hub := socket.HubStats().QueueDepth; hub.Max != 4 || hub.P50 != 4 {
+		t.Fatalf("unexpected hub queue depth %+v", hub)
+	}
+
+	if err = session.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for received := 0; received < 5; {
+		mt, _, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mt == websocket.TextMessage {
+			received++
+		}
+	}
+	stats = client.Stats()
+	if stats.QueueDepth != 0 || stats.QueueBytes != 0 {
+		t.Fatalf("queue should be drained, got %d/%d", stats.QueueDepth, stats.QueueBytes)
+	}
+	if stats.QueueDepthPeak < 4 {
+		t.Fatalf("watermark should survive draining, got %d", stats.QueueDepthPeak)
+	}
+	client.ResetWatermarks()
+	if stats = client.Stats(); stats.QueueDepthPeak != 0 || stats.QueueBytesPeak != 0 {
+		t.Fatalf("watermarks should reset to current depth, got %d/%d", stats.QueueDepthPeak, stats.QueueBytesPeak)
+	}
+}
+
+// bufferedConn 模拟带写缓冲的自定义传输层，握手响应直接写出
+type bufferedConn struct {
+	net.Conn
+	mu        sync.Mutex
+	w         *bufio.Writer
+	handshake bool
+	flushes   atomic.Int64
+}
+
+func (c *bufferedConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.handshake {
+		c.handshake = true
+		return c.Conn.Write(p)
+	}
+	return c.w.Write(p)
+}
+
+func (c *bufferedConn) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushes.Add(1)
+	_ = c.w.Flush()
+}
+
+type bufferedWriter struct {
+	gin.ResponseWriter
+	conns chan<- *bufferedConn
+}
+
+func (w bufferedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	buffered := &bufferedConn{Conn: conn, w: bufio.NewWriterSize(conn, 64<<10)}
+	w.conns <- buffered
+	return buffered, rw, nil
+}
+
+func TestSocketFlushAfterBytes(t *testing.T) {
+	flushes := func(t *testing.T, opts ...AppSocket.SocketOptionFunc) int64 {
+		gin.SetMode(gin.TestMode)
+		socket, err := AppSocket.NewSocket(append(opts, AppSocket.WithHandler(AppSocket.BaseHandler{}))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns := make(chan *bufferedConn, 1)
+		engine := gin.New()
+		engine.GET("/socket/:key", func(ctx *gin.Context) {
+			ctx.Writer = bufferedWriter{ResponseWriter: ctx.Writer, conns: conns}
+			_ = socket.Connect(ctx, ctx.Param("key"))
+		})
+		srv := httptest.NewServer(engine)
+		t.Cleanup(srv.Close)
+		conn := dialSocket(t, "ws"+strings.TrimPrefix(srv.URL, "http")+"/socket/buffered")
+		waitOnline(t, socket, "buffered")
+		buffered := <-conns
+		client, _ := socket.Client("buffered")
+
+		// 占住写锁让消息堆积，释放后写循环连续写出
+		session, err := client.WriterFor(websocket.BinaryMessage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 20; i++ {
+			if err = socket.SendTo("buffered", websocket.TextMessage, []byte(strings.Repeat("x", 30))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		before := buffered.flushes.Load()
+		if err = session.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// 全部消息都能收到，说明队列清空时剩余的数据已刷新
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for received := 0; received < 20; {
+			mt, _, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("read failed after %d messages: %v", received, err)
+			}
+			if mt == websocket.TextMessage {
+				received++
+			}
+		}
+		return buffered.flushes.Load() - before
+	}
+
+	if n := flushes(t); n < 19 {
+		t.Fatalf("expected a flush per write by default, got %d", n)
+	}
+	if n := flushes(t, AppSocket.WithFlushAfterBytes(64)); n > 10 {
+		t.Fatalf("expected flushes every 64 bytes, got %d", n)
+	}
+	if _, err := AppSocket.NewSocket(AppSocket.WithHandler(AppSocket.BaseHandler{}), AppSocket.WithFlushAfterBytes(-1)); err == nil {
+		t.Fatal("negative flush threshold should be rejected")
+	}
+}
+
+func TestSocketCancelQueued(t *testing.T) {
+	socket, url := newSocketServer(t, AppSocket.WithHandler(AppSocket.BaseHandler{}))
+	conn := dialSocket(t, url+"switch")
+	waitOnline(t, socket, "switch")
+	client, _ := socket.Client("switch")
+
+	// 占住写锁，让写循环停在第一条消息上
+	session, err := client.WriterFor(websocket.BinaryMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(data, key string) {
+		t.Helper()
+		if err := client.SendBytesOpt(websocket.TextMessage, []byte(data), AppSocket.SendOpts{Key: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send("a0", "room-a")
+	time.Sleep(20 * time.Millisecond) // 写循环取出a0后等待写锁，a0已不能取消
+	send("a1", "room-a")
+	send("b1", "room-b")
+	send("a2", "room-a")
+	send("plain", "")
+	send("b2", "room-b")
+
+	if n := client.CancelQueued("room-a"); n != 2 {
+		t.Fatalf("expected 2 queued room-a messages cancelled, got %d", n)
+	}
+	if n := client.CancelQueued("room-a"); n != 0 {
+		t.Fatalf("cancelled messages should not be cancelled twice, got %d", n)
+	}
+	n := client.CancelQueuedWhere(func(m AppSocket.QueuedMessage) bool {
+		return m.Key == "" && string(m.Data) == "plain"
+	})
+	if n != 1 {
+		t.Fatalf("expected 1 message cancelled by predicate, got %d", n)
+	}
+	if stats := client.Stats(); stats.QueueDepth != 2 || stats.QueueCancelled != 3 || stats.QueueWaitDrops != 0 {
+		t.Fatalf("unexpected stats depth=%d cancelled=%d drops=%d", stats.QueueDepth, stats.QueueCancelled, stats.QueueWaitDrops)
+	}
+	if err = session.Close(); err != nil {
+		t.Fatal(err)
+	}
+	send("end", "")
+
+	var got []string
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(got) == 0 || got[len(got)-1] != "end" {
+		mt, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read failed after %v: %v", got, err)
+		}
+		if mt == websocket.TextMessage {
+			got = append(got, string(data))
+		}
+	}
+	if strings.Join(got, ",") != "a0,b1,b2,end" {
+		t.Fatalf("cancelled messages should not be delivered, got %v", got)
+	}
+	if depth := client.Stats().QueueDepth; depth != 0 {
+		t.Fatalf("queue should be drained, got depth %d", depth)
+	}
+}
+
+// hijackCapture 把升级后的底层连接交给测试，不做任何包装
+type hijackCapture struct {
+	gin.ResponseWriter
+	conns chan<- net.Conn
+}
+
+func (w hijackCapture) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.Hijack()
+	if err == nil {
+		w.conns <- conn
+	}
+	return conn, rw, err
+}
+
+func TestSocketDeadConnectionDetector(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		if _, err := AppSocket.NewSocket(AppSocket.WithHandler(AppSocket.BaseHandler{}), AppSocket.WithDeadConnectionDetector(time.Second)); !errors.Is(err, AppSocket.ErrInvalidOption) {
+			t.Fatalf("expected ErrInvalidOption on %s, got %v", runtime.GOOS, err)
+		}
+		return
+	}
+	gin.SetMode(gin.TestMode)
+	handler := newRecordHandler()
+	socket, err := AppSocket.NewSocket(AppSocket.WithHandler(handler), AppSocket.WithDeadConnectionDetector(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan net.Conn, 2)
+	engine := gin.New()
+	engine.GET("/socket/:key", func(ctx *gin.Context) {
+		ctx.Writer = hijackCapture{ResponseWriter: ctx.Writer, conns: conns}
+		_ = socket.Connect(ctx, ctx.Param("key"))
+	})
+	srv := httptest.NewServer(engine)
+	t.Cleanup(srv.Close)
+	base := "ws" + strings.TrimPrefix(srv.URL, "http") + "/socket/"
+	dialSocket(t, base+"alive")
+	waitOnline(t, socket, "alive")
+	<-conns
+	dialSocket(t, base+"dead")
+	waitOnline(t, socket, "dead")
+	dead := <-conns
+
+	// 服务端单方面发出FIN进入FIN_WAIT，对端不关闭，读循环仍阻塞在读取上
+	if err = dead.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-handler.errs:
+		if !errors.Is(err, AppSocket.ErrDeadConnection) {
+			t.Fatalf("expected ErrDeadConnection, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("dead connection was not detected")
+	}
+	select {
+	case key := <-handler.closed:
+		if key != "dead" {
+			t.Fatalf("expected dead to be closed, got %s", key)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("dead connection was not closed")
+	}
+	if _, err = socket.Client("alive"); err != nil {
+		t.Fatalf("established connection should stay online: %v", err)
+	}
+}
+
+func TestSocketReceiveAcks(t *testing.T) {
+	handler := &chanHandler{messages: make(chan string, 16)}
+	socket, url := newSocketServer(t, AppSocket.WithHandler(handler), AppSocket.WithReceiveAcks(3, 50*time.Millisecond))
+	conn := dialSocket(t, url+"sdk")
+	waitOnline(t, socket, "sdk")
+	client, _ := socket.Client("sdk")
+
+	send := func(seq int) {
+		t.Helper()
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"_seq":%d,"n":%d}`, seq, seq))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := func() int64 {
+		t.Helper()
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var frame struct {
+				Type    string `json:"type"`
+				Through int64  `json:"through"`
+			}
+			if json.Unmarshal(data, &frame) == nil && frame.Type == "received" {
+				return frame.Through
+			}
+		}
+	}
+
+	// 起点为第一条带序号的消息，满3条立即确认
+	for seq := 11; seq <= 13; seq++ {
+		send(seq)
+	}
+	if through := received(); through != 13 {
+		t.Fatalf("expected ack through 13, got %d", through)
+	}
+	// 乱序：15先到，只能确认到13；14补齐后一次前进到15
+	send(15)
+	if through := received(); through != 13 {
+		t.Fatalf("gap should hold the ack at 13, got %d", through)
+	}
+	send(14)
+	if through := received(); through != 15 {
+		t.Fatalf("expected ack through 15 once the gap is filled, got %d", through)
+	}
+	// 重发的消息不再分发，但会立即确认
+	send(12)
+	send(15)
+	if through := received(); through != 15 {
+		t.Fatalf("expected duplicate to be acked through 15, got %d", through)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for len(got) == 0 || got[len(got)-1] != "plain" {
+		select {
+		case text := <-handler.messages:
+			got = append(got, text)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("messages not dispatched, got %v", got)
+		}
+	}
+	if len(got) != 6 {
+		t.Fatalf("duplicates should be suppressed, dispatched %v", got)
+	}
+	if stats := client.Stats(); stats.ReceivedThrough != 15 || stats.DuplicatesSuppressed != 2 {
+		t.Fatalf("unexpected stats through=%d duplicates=%d", stats.ReceivedThrough, stats.DuplicatesSuppressed)
+	}
+	if _, err := AppSocket.NewSocket(AppSocket.WithHandler(handler), AppSocket.WithReceiveAcks(0, 0)); !errors.Is(err, AppSocket.ErrInvalidOption) {
+		t.Fatalf("expected ErrInvalidOption, got %v", err)
+	}
+}
+
+func TestSocketOptionString(t *testing.T) {
+	handler := &chanHandler{messages: make(chan string, 1)}
+	sessions := AppSocket.NewMemorySessionStore()
+	var opt AppSocket.SocketOption
+	for _, apply := range []AppSocket.SocketOptionFunc{
+		AppSocket.WithHandler(handler),
+		AppSocket.WithWriteReadBufferSize(4096),
+		AppSocket.WithSendQueueLength(64),
+		AppSocket.WithHeartbeatFailMaxTimes(3),
+		AppSocket.WithWriteDeadline(5 * time.Second),
+		AppSocket.WithReadDeadline(time.Minute),
+		AppSocket.WithPingPeriod(15 * time.Second),
+		AppSocket.WithPingMsg("hb"),
+		AppSocket.WithRoomHistory(8),
+		AppSocket.WithRoomRateLimit(100),
+		AppSocket.WithRoomLimits(AppSocket.RoomLimits{InboundPerSecond: 10, BroadcastsPerSecond: 5}),
+		AppSocket.WithMaxMessageSize(1 << 20),
+		AppSocket.WithTCPKeepAlive(30 * time.Second),
+		AppSocket.WithUpgradeBodyLimit(512),
+		AppSocket.WithUpgradeTimeout(3 * time.Second),
+		AppSocket.WithEnableCompression(true),
+		AppSocket.WithContinueOnError(func(error) bool { return true }),
+		AppSocket.WithWriteTransformer(func(mt int, data []byte) ([]byte, error) { return data, nil }),
+		AppSocket.WithInjectTimestamp(true),
+		AppSocket.WithFlushInterval(50 * time.Millisecond),
+		AppSocket.WithFlushAfterBytes(4096),
+		AppSocket.WithMetricLabels("tenant", "region"),
+		AppSocket.WithDuplicateSessionPolicy(AppSocket.CloseOldest),
+		AppSocket.WithContentTypeNegotiation([]string{"json"}),
+		AppSocket.WithSchemaVersion(3),
+		AppSocket.WithDowngradeEncoder(2, func(data []byte) ([]byte, error) { return data, nil }),
+		AppSocket.WithSlowStart(20, 2*time.Second),
+		AppSocket.WithSlowStartPolicy(AppSocket.SlowStartReject),
+		AppSocket.WithMaxPendingAcks(16),
+		AppSocket.WithDrainGracePeriod(10 * time.Second),
+		AppSocket.WithHeartbeatGoroutineLabel("ws-heartbeat"),
+		AppSocket.WithIsolatePanics(true),
+		AppSocket.WithPanicEscalation(5, time.Minute),
+		AppSocket.WithAllowedMessageTypes(websocket.TextMessage),
+		AppSocket.WithMessageTypePolicy(AppSocket.MessageTypeDrop),
+		AppSocket.WithSessionPersistence(sessions, 2*time.Minute),
+		AppSocket.WithQueueWaitTimeout(time.Second),
+		AppSocket.WithServerConfigFrame("edge-1", map[string]any{"region": "eu"}),
+		AppSocket.WithNamespaces(map[string]AppSocket.NamespaceLimits{"b": {MaxConnections: 2}, "a": {MaxConnections: 1}}),
+		AppSocket.WithTopicSubscriptions(32),
+		AppSocket.WithClientMetricsInterval(time.Minute),
+		AppSocket.WithIdleTimeout(5 * time.Minute),
+		AppSocket.WithIdleGracePeriod(10 * time.Second),
+		AppSocket.WithMessageBusPublisher(&recordingBus{}),
+		AppSocket.WithDeadConnectionDetector(time.Second),
+		AppSocket.WithReceiveAcks(10, 200*time.Millisecond),
+	} {
+		apply(&opt)
+	}
+	got := strings.Split(opt.String(), "\n")
+	for _, want := range []string{
+		"writeReadBufferSize: 4096",
+		"sendQueueLength: 64",
+		"heartbeatFailMaxTimes: 3",
+		"writeDeadline: 5s",
+		"readDeadline: 1m0s",
+		"pingPeriod: 15s",
+		`pingMsg: "hb"`,
+		"roomHistorySize: 8",
+		"roomRateLimit: 100",
+		"roomLimits: {InboundPerSecond:10 BroadcastsPerSecond:5}",
+		"maxMessageSize: 1048576",
+		"tcpKeepAlive: 30s",
+		"upgradeBodyLimit: 512",
+		"upgradeTimeout: 3s",
+		"enableCompression: true",
+		"continueOnError: set",
+		"writeTransformers: 1",
+		"injectTimestamp: true",
+		"flushInterval: 50ms",
+		"flushAfterBytes: 4096",
+		"metricLabels: [tenant region]",
+		"duplicatePolicy: 1",
+		"contentTypes: [json]",
+		"schemaVersion: 3",
+		"downgradeEncoders: [2]",
+		"slowStartBudget: 20",
+		"slowStartWindow: 2s",
+		"slowStartPolicy: 1",
+		"maxPendingAcks: 16",
+		"drainGracePeriod: 10s",
+		`heartbeatLabel: "ws-heartbeat"`,
+		"isolatePanics: true",
+		"panicEscalationCount: 5",
+		"panicEscalationWindow: 1m0s",
+		"allowedMessageTypes: [TextMessage]",
+		"messageTypePolicy: 1",
+		"sessionStore: *server.MemorySessionStore",
+		"sessionTTL: 2m0s",
+		"queueWaitTimeout: 1s",
+		`serverConfig: server="edge-1" extra=[region]`,
+		"namespaces: [a{MaxConnections:1 Rooms:{InboundPerSecond:0 BroadcastsPerSecond:0}} b{MaxConnections:2 Rooms:{InboundPerSecond:0 BroadcastsPerSecond:0}}]",
+		"topicLimit: 32",
+		"clientMetrics: unset",
+		"clientMetricsInterval: 1m0s",
+		"idleTimeout: 5m0s",
+		"idleGracePeriod: 10s",
+		"busPublisher: *test.recordingBus",
+		"deadConnInterval: 1s",
+		"recvAcks: true",
+		"recvAckEvery: 10",
+		"recvAckInterval: 200ms",
+		"handler: *test.chanHandler",
+		"logger: unset",
+	} {
+		found := false
+		for _, line := range got {
+			if line == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("missing %q in:\n%s", want, opt.String())
+		}
+	}
+
+	// 通过Socket取得的配置包含默认值，连接的配置包含UpdateOption调整后的值
+	socket, url := newSocketServer(t, AppSocket.WithHandler(handler))
+	defaults := socket.Options().String()
+	for _, want := range []string{"pingPeriod: 20s", "writeDeadline: 35s", "readDeadline: 30s", "heartbeatFailMaxTimes: 4", "maxPendingAcks: 64", "idleGracePeriod: 30s"} {
+		if !strings.Contains(defaults, want+"\n") {
+			t.Errorf("missing default %q in:\n%s", want, defaults)
+		}
+	}
+	dialSocket(t, url+"opts")
+	waitOnline(t, socket, "opts")
+	client, _ := socket.Client("opts")
+	if err := client.UpdateOption(AppSocket.WithPingPeriod(10 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if s := client.Options().String(); !strings.Contains(s, "pingPeriod: 10s\n") {
+		t.Errorf("connection options should reflect UpdateOption:\n%s", s)
+	}
+}
+
+// blockingHandler OnMessage一直阻塞到release关闭，模拟卡住的业务回调
+type blockingHandler struct {
+	AppSocket.BaseHandler
+	release chan struct{}
+	closed  chan string
+}
+
+func (h *blockingHandler) OnMessage(AppSocket.Message) {
+	<-h.release
+}
+
+func (h *blockingHandler) OnClose(key string) {
+	h.closed <- key
+}
+
+func TestSocketStaleConnectionReaper(t *testing.T) {
+	handler := &blockingHandler{release: make(chan struct{}), closed: make(chan string, 2)}
+	t.Cleanup(func() { close(handler.release) })
+	socket, url := newSocketServer(t, AppSocket.WithHandler(handler),
+		AppSocket.WithPingPeriod(20*time.Millisecond),
+		AppSocket.WithReadDeadline(100*time.Millisecond),
+		AppSocket.WithStaleConnectionReaper(20*time.Millisecond, 50*time.Millisecond))
+
+	// 空闲但正常响应心跳的连接不能被回收
+	healthy := dialSocket(t, url+"healthy")
+	go func() {
+		for {
+			if _, _, err := healthy.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	zombie := dialSocket(t, url+"zombie")
+	// 不回复pong：服务端读循环卡住后未读取的pong会使断开时发出RST，客户端可能收不到关闭帧
+	zombie.SetPingHandler(func(string) error { return nil })
+	waitOnline(t, socket, "healthy")
+	waitOnline(t, socket, "zombie")
+	// 读循环卡在OnMessage中，不再处理pong，读取截止时间也不会触发
+	if err := zombie.WriteMessage(websocket.TextMessage, []byte("stuck")); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = zombie.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var closeErr *websocket.CloseError
+	for {
+		if _, _, err := zombie.ReadMessage(); err != nil {
+			if !errors.As(err, &closeErr) {
+				t.Fatalf("expected close frame, got %v", err)
+			}
+			break
+		}
+	}
+	if closeErr.Code != AppSocket.CloseStaleConnection {
+		t.Fatalf("expected close code %d, got %d", AppSocket.CloseStaleConnection, closeErr.Code)
+	}
+	select {
+	case key := <-handler.closed:
+		if key != "zombie" {
+			t.Fatalf("expected zombie to be closed, got %s", key)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnClose not called for reaped connection")
+	}
+	time.Sleep(300 * time.Millisecond) // 多轮扫描之后健康连接仍然在线
+	if _, err := socket.Client("healthy"); err != nil {
+		t.Fatalf("healthy idle connection was reaped: %v", err)
+	}
+	if _, err := socket.Client("zombie"); err == nil {
+		t.Fatal("reaped connection should be unregistered")
+	}
+	if reaped := socket.HubStats().ReapedConnections; reaped != 1 {
+		t.Fatalf("expected 1 reaped connection, got %d", reaped)
+	}
+	if _, err := AppSocket.NewSocket(AppSocket.WithHandler(handler), AppSocket.WithStaleConnectionReaper(time.Second, 0)); !errors.Is(err, AppSocket.ErrInvalidOption) {
+		t.Fatalf("expected ErrInvalidOption, got %v", err)
+	}
+}
+
+func TestSocketTags(t *testing.T) {
+	handler := newRecordHandler()
+	socket, url := newSocketServer(t, AppSocket.WithHandler(handler))
+	conns := make(map[string]*websocket.Conn)
+	for _, key := range []string{"g1", "g2", "cpu"} {
+		conns[key] = dialSocket(t, url+key)
+		waitOnline(t, socket, key)
+	}
+	tag := func(key string, tags ...string) *AppSocket.SocketClient {
+		client, _ := socket.Client(key)
+		for _, tag := range tags {
+			client.Tag(tag)
+		}
+		return client
+	}
+	g1 := tag("g1", "gpu:a100", "region:eu")
+	tag("g2", "gpu:a100")
+	cpu := tag("cpu", "region:eu")
+	cpu.Tag("")
+
+	keys := func(tag string) string {
+		var keys []string
+		for _, client := range socket.ByTag(tag) {
+			keys = append(keys, client.Key())
+		}
+		sort.Strings(keys)
+		return strings.Join(keys, ",")
+	}
+	if got := keys("gpu:a100"); got != "g1,g2" {
+		t.Fatalf("unexpected gpu:a100 members %s", got)
+	}
+	if !g1.HasTag("region:eu") || cpu.HasTag("gpu:a100") || len(cpu.Tags()) != 1 {
+		t.Fatalf("unexpected tags g1=%v cpu=%v", g1.Tags(), cpu.Tags())
+	}
+	g1.Untag("region:eu")
+	g1.Untag("missing")
+	if got := keys("region:eu"); got != "cpu" {
+		t.Fatalf("untagged connection should leave the index, got %s", got)
+	}
+
+	result := socket.BroadcastTag("region:eu", websocket.TextMessage, []byte("eu only"))
+	if result.Matched != 1 || result.Sent != 1 {
+		t.Fatalf("unexpected broadcast result %+v", result)
+	}
+	_ = conns["cpu"].SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, data, err := conns["cpu"].ReadMessage(); err != nil || string(data) != "eu only" {
+		t.Fatalf("tagged connection should receive the broadcast, got %q %v", data, err)
+	}
+
+	if closed := socket.CloseTag("gpu:a100", AppSocket.CloseServerDraining, "gpu pool drained"); closed != 2 {
+		t.Fatalf("expected 2 connections closed, got %d", closed)
+	}
+	for _, key := range []string{"g1", "g2"} {
+		_ = conns[key].SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _, err := conns[key].ReadMessage()
+		if !websocket.IsCloseError(err, AppSocket.CloseServerDraining) {
+			t.Fatalf("expected %s to be closed with %d, got %v", key, AppSocket.CloseServerDraining, err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for keys("gpu:a100") != "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := keys("gpu:a100"); got != "" {
+		t.Fatalf("closed connections should leave the index, got %s", got)
+	}
+	g1.Tag("late")
+	if got := keys("late"); got != "" {
+		t.Fatalf("closed connections cannot be tagged, got %s", got)
+	}
+}
+
+func TestSocketClientLifecycle(t *testing.T) {
+	var zero AppSocket.SocketClient
+	for name, err := range map[string]error{
+		"SendJSON":     zero.SendJSON(map[string]int{"n": 1}),
+		"SendBytesOpt": zero.SendBytesOpt(websocket.TextMessage, []byte("early"), AppSocket.SendOpts{}),
+		"SendClose":    zero.SendClose(websocket.CloseNormalClosure, ""),
+		"Close":        zero.Close(),
+		"Run":          zero.Run(),
+	} {
+		if !errors.Is(err, AppSocket.ErrNotOpen) {
+			t.Fatalf("%s before upgrade should return ErrNotOpen, got %v", name, err)
+		}
+	}
+	if _, err := zero.Ping(context.Background()); !errors.Is(err, AppSocket.ErrNotOpen) {
+		t.Fatalf("Ping before upgrade should return ErrNotOpen, got %v", err)
+	}
+	if zero.State() != AppSocket.OffLineState || zero.Done() != nil {
+		t.Fatalf("zero client should be offline without a done channel")
+	}
+	if msg := <-zero.ReadPumpChan(context.Background()); !msg.Done || !errors.Is(msg.Err, AppSocket.ErrNotOpen) {
+		t.Fatalf("ReadPumpChan before upgrade should finish with ErrNotOpen, got %+v", msg)
+	}
+
+	handler := newRecordHandler()
+	socket, url := newSocketServer(t, AppSocket.WithHandler(handler))
+	conn := dialSocket(t, url+"life")
+	waitOnline(t, socket, "life")
+	client, err := socket.Client("life")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Run(); !errors.Is(err, AppSocket.ErrAlreadyReading) {
+		t.Fatalf("second read loop should return ErrAlreadyReading, got %v", err)
+	}
+
+	if err = client.SendClose(AppSocket.CloseServerDraining, "bye"); err != nil {
+		t.Fatal(err)
+	}
+	if client.State() != AppSocket.OnlineState {
+		t.Fatalf("draining connection should still be online")
+	}
+	if err = client.SendJSON(map[string]int{"n": 1}); !errors.Is(err, AppSocket.ErrClosed) || !errors.Is(err, AppSocket.ErrConnectionClosed) {
+		t.Fatalf("send after close frame should return ErrClosed, got %v", err)
+	}
+	if err = client.SendClose(AppSocket.CloseServerDraining, "again"); !errors.Is(err, AppSocket.ErrClosed) || !errors.Is(err, AppSocket.ErrAlreadyClosed) {
+		t.Fatalf("second close frame should return ErrClosed, got %v", err)
+	}
+	if err = client.UpdateOption(AppSocket.WithPingPeriod(10 * time.Second)); err != nil {
+		t.Fatalf("draining connection should accept option updates, got %v", err)
+	}
+	select {
+	case <-client.Done():
+		t.Fatal("done should stay open until the close handshake finishes")
+	default:
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err = conn.ReadMessage(); !websocket.IsCloseError(err, AppSocket.CloseServerDraining) {
+		t.Fatalf("expected close frame, got %v", err)
+	}
+	select {
+	case <-client.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("done should be closed once the peer answers the close frame")
+	}
+	select {
+	case err = <-handler.errs:
+		t.Fatalf("close handshake should not report an error, got %v", err)
+	case <-handler.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected OnClose")
+	}
+
+	if err = client.Run(); !errors.Is(err, AppSocket.ErrClosed) {
+		t.Fatalf("read loop after close should return ErrClosed, got %v", err)
+	}
+	if err = client.Close(); !errors.Is(err, AppSocket.ErrClosed) || !errors.Is(err, AppSocket.ErrAlreadyClosed) {
+		t.Fatalf("close after close should return ErrClosed, got %v", err)
+	}
+	if err = client.SendBytesOpt(websocket.TextMessage, []byte("late"), AppSocket.SendOpts{}); !errors.Is(err, AppSocket.ErrClosed) {
+		t.Fatalf("send after close should return ErrClosed, got %v", err)
+	}
+	if msg := <-client.ReadPumpChan(context.Background()); !msg.Done {
+		t.Fatalf("ReadPumpChan after close should finish immediately, got %+v", msg)
+	}
+}